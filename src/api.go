@@ -0,0 +1,316 @@
+/* This file contains functionality around the
+ * HTTP admin and command API, letting other tools
+ * and cron jobs manage the bot and reuse its
+ * commands without going through chat.
+ *
+ * Nothing is served unless 'apiListen' is set (e.g.
+ * "127.0.0.1:8081").  All endpoints but /health
+ * require 'Authorization: Bearer <apiToken>'.  All
+ * requests and responses are JSON; errors look like
+ * {"error": "..."}.
+ *
+ * GET    /health                           -- backend connectivity
+ * GET    /channels                         -- all channels
+ * GET    /channels/<name>                  -- one channel, incl. the below
+ * GET    /channels/<name>/history          -- recent changes, oldest first
+ * GET    /channels/<name>/settings
+ * PUT    /channels/<name>/settings/<key>   -- {"value": "..."}
+ * DELETE /channels/<name>/settings/<key>
+ * GET    /channels/<name>/throttles
+ * GET    /channels/<name>/toggles
+ * PUT    /channels/<name>/toggles/<toggle> -- {"enabled": true}
+ * GET    /counters                         -- counter names
+ * GET    /counters/<name>
+ * POST   /command                          -- see ApiCommand
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const API_MAX_BODY = 1 << 20
+
+var API_LOG = newLogger("api")
+
+type ApiChannel struct {
+	Name      string               `json:"name"`
+	Id        string               `json:"id"`
+	Type      string               `json:"type"`
+	Inviter   string               `json:"inviter"`
+	Settings  map[string]string    `json:"settings,omitempty"`
+	Throttles map[string]time.Time `json:"throttles,omitempty"`
+	Toggles   map[string]bool      `json:"toggles,omitempty"`
+}
+
+/* Runs the command as 'user' (default "api"); if
+ * 'channel' is given, the command sees that
+ * channel's settings, e.g. for '!oncall'. */
+type ApiCommand struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+	Channel string   `json:"channel"`
+	User    string   `json:"user"`
+}
+
+type ApiHealth struct {
+	Connected bool   `json:"connected"`
+	Error     string `json:"error,omitempty"`
+}
+
+func apiAuth(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if len(getConfig("apiToken")) < 1 ||
+			subtle.ConstantTimeCompare([]byte(token), []byte(getConfig("apiToken"))) != 1 {
+			API_LOG.Warn("unauthorized request", "remote", req.RemoteAddr, "path", req.URL.Path)
+			apiError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		h(w, req)
+	}
+}
+
+/* /channels/<name>[/<what>[/<key>]] */
+func apiChannel(w http.ResponseWriter, req *http.Request) {
+	path := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/channels"), "/"), "/")
+	if len(path[0]) < 1 {
+		if req.Method != http.MethodGet {
+			apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		channels := []ApiChannel{}
+		for _, ch := range channelList() {
+			channels = append(channels, ApiChannel{Name: ch.Name, Id: ch.Id, Type: ch.Type, Inviter: ch.Inviter})
+		}
+		apiReply(w, channels)
+		return
+	}
+
+	ch, found := getChannelByName(path[0])
+	if !found {
+		apiError(w, http.StatusNotFound, "no such channel: %s", path[0])
+		return
+	}
+
+	what := ""
+	if len(path) > 1 {
+		what = path[1]
+	}
+
+	if len(path) == 3 && req.Method != http.MethodGet {
+		apiChannelWrite(w, req, ch, what, path[2])
+		return
+	}
+
+	if len(path) > 2 || req.Method != http.MethodGet {
+		apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	switch what {
+	case "":
+		apiReply(w, ApiChannel{ch.Name, ch.Id, ch.Type, ch.Inviter,
+			getSettings(ch), getThrottles(ch), getToggles(ch)})
+	case "history":
+		apiReply(w, getHistory(ch))
+	case "settings":
+		apiReply(w, getSettings(ch))
+	case "throttles":
+		apiReply(w, getThrottles(ch))
+	case "toggles":
+		apiReply(w, getToggles(ch))
+	default:
+		apiError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func apiChannelWrite(w http.ResponseWriter, req *http.Request, ch *Channel, what, key string) {
+	switch {
+	case what == "settings" && req.Method == http.MethodPut:
+		var body struct {
+			Value *string `json:"value"`
+		}
+		if !apiDecode(w, req, &body) {
+			return
+		}
+		if body.Value == nil {
+			apiError(w, http.StatusBadRequest, "missing 'value'")
+			return
+		}
+		if err := validateSetting(key, *body.Value); err != nil {
+			apiError(w, http.StatusBadRequest, "%s", err)
+			return
+		}
+		old, found := setSetting(ch, key, *body.Value, "api")
+		API_LOG.Info("set setting", "channel", ch.Name, "setting", key, "value", *body.Value, "old", old)
+		apiReply(w, map[string]interface{}{"value": *body.Value, "old": old, "existed": found})
+	case what == "settings" && req.Method == http.MethodDelete:
+		old, found := unsetSetting(ch, key, "api")
+		if !found {
+			apiError(w, http.StatusNotFound, "no such setting: %s", key)
+			return
+		}
+		API_LOG.Info("unset setting", "channel", ch.Name, "setting", key, "old", old)
+		apiReply(w, map[string]interface{}{"old": old})
+	case what == "toggles" && req.Method == http.MethodPut:
+		var body struct {
+			Enabled *bool `json:"enabled"`
+		}
+		if !apiDecode(w, req, &body) {
+			return
+		}
+		if body.Enabled == nil {
+			apiError(w, http.StatusBadRequest, "missing 'enabled'")
+			return
+		}
+		if !setToggle(ch, key, *body.Enabled, "api") {
+			apiError(w, http.StatusNotFound, "no such toggle: %s", key)
+			return
+		}
+		API_LOG.Info("set toggle", "channel", ch.Name, "toggle", key, "enabled", *body.Enabled)
+		apiReply(w, map[string]bool{"enabled": *body.Enabled})
+	default:
+		apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func apiCommand(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var c ApiCommand
+	if !apiDecode(w, req, &c) {
+		return
+	}
+
+	cmd := strings.ToLower(strings.TrimPrefix(c.Command, "!"))
+	if _, found := COMMANDS[cmd]; !found {
+		cmd = findCommandAlias(cmd)
+	}
+	if command, found := COMMANDS[cmd]; !found || command.Call == nil {
+		apiError(w, http.StatusNotFound, "no such command: %s", c.Command)
+		return
+	}
+
+	if len(c.User) < 1 {
+		c.User = "api"
+	}
+	if c.Args == nil {
+		c.Args = []string{}
+	}
+	if len(c.Channel) > 0 {
+		if _, found := getChannelByName(c.Channel); !found {
+			apiError(w, http.StatusNotFound, "no such channel: %s", c.Channel)
+			return
+		}
+	}
+
+	/* Replies sent outside of the command's return
+	 * value go nowhere, as there's no "api"
+	 * backend. */
+	r := Recipient{ChatType: "api", Id: c.User, MentionName: c.User, Name: c.User, ReplyTo: c.Channel}
+	ctx := withLogFields(context.Background(),
+		"request", newRequestID(),
+		"chat", r.ChatType,
+		"channel", c.Channel,
+		"user", c.User,
+		"command", cmd)
+
+	API_LOG.InfoContext(ctx, "running command", "args", c.Args, "remote", req.RemoteAddr)
+	incrementCounter("commands", cmd)
+	response := callCommand(ctx, cmd, r, c.Channel, c.Args)
+	apiReply(w, map[string]string{"command": cmd, "reply": response})
+}
+
+func apiCounters(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	name := strings.Trim(strings.TrimPrefix(req.URL.Path, "/counters"), "/")
+	if len(name) < 1 {
+		apiReply(w, counterNames())
+		return
+	}
+
+	counter, err := getCounter(name)
+	if len(err) > 0 {
+		apiError(w, http.StatusNotFound, "no such counter: %s", name)
+		return
+	}
+	apiReply(w, counter)
+}
+
+func apiDecode(w http.ResponseWriter, req *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, req.Body, API_MAX_BODY))
+	if err := dec.Decode(v); err != nil {
+		apiError(w, http.StatusBadRequest, "invalid request: %s", err)
+		return false
+	}
+	return true
+}
+
+func apiError(w http.ResponseWriter, status int, format string, v ...interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf(format, v...)})
+}
+
+/* Backends that don't implement HealthChecker are
+ * considered connected, as we'd have exited if they
+ * failed to connect. */
+func apiHealth(w http.ResponseWriter, req *http.Request) {
+	healthy := true
+	backends := map[string]ApiHealth{}
+	for name, b := range BACKENDS {
+		if !b.Enabled() {
+			continue
+		}
+		h := ApiHealth{Connected: true}
+		if c, ok := b.(HealthChecker); ok {
+			if err := c.Healthy(); err != nil {
+				h = ApiHealth{false, err.Error()}
+				healthy = false
+			}
+		}
+		backends[name] = h
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"healthy": healthy, "backends": backends})
+}
+
+func apiReply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		API_LOG.Warn("unable to write response", "err", err)
+	}
+}
+
+func serveApi() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", apiHealth)
+	mux.HandleFunc("/channels", apiAuth(apiChannel))
+	mux.HandleFunc("/channels/", apiAuth(apiChannel))
+	mux.HandleFunc("/command", apiAuth(apiCommand))
+	mux.HandleFunc("/counters", apiAuth(apiCounters))
+	mux.HandleFunc("/counters/", apiAuth(apiCounters))
+
+	API_LOG.Info("serving api", "listen", getConfig("apiListen"))
+	err := http.ListenAndServe(getConfig("apiListen"), mux)
+	API_LOG.Error("unable to serve api", "err", err)
+}
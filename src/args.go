@@ -0,0 +1,261 @@
+/* This file contains functionality around
+ * declarative command arguments.
+ *
+ * A command may declare its arguments via the Args
+ * of its Command, e.g. for '!doh':
+ *
+ *   []Arg{
+ *     {Name: "country", Flag: "c"},
+ *     {Name: "name", Required: true},
+ *     {Name: "type"},
+ *   }
+ *
+ * callCommand() then parses the input before the
+ * command is called: it rejects missing, surplus and
+ * malformed arguments with a consistent message and
+ * the usage, and hands the command exactly one
+ * argument per declared Arg, in declaration order,
+ * with defaults filled in; i.e. '!doh example.com'
+ * yields []string{"", "example.com", ""}.
+ *
+ * Flags ("-c <country>", or just "-x" for ARG_BOOL)
+ * may appear anywhere before an ARG_TEXT argument
+ * and are always optional.  If fewer positional
+ * arguments than declared are given, the optional
+ * ones are filled from the left.  An ARG_TEXT
+ * argument must be the last one; it takes the rest
+ * of the input.
+ *
+ * An argument with Choices only takes one of those,
+ * e.g. "list" or "flush".  A command taking no
+ * arguments declares an empty, non-nil []Arg{}.
+ *
+ * Commands that declare their arguments need not
+ * set a Usage; see commandUsage().  Commands calling
+ * each other directly get their arguments via
+ * commandArgs().
+ */
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const ARG_BOOL = "bool"
+const ARG_INT = "int"
+const ARG_STRING = "string"
+const ARG_TEXT = "text"
+
+/* Type defaults to ARG_STRING.  A boolean flag is
+ * "true" if given and empty otherwise. */
+type Arg struct {
+	Name     string
+	Type     string
+	Flag     string
+	Required bool
+	Default  string
+	Help     string
+	Choices  []string
+}
+
+func argChoice(a Arg, value string) bool {
+	for _, c := range a.Choices {
+		if c == value {
+			return true
+		}
+	}
+	return false
+}
+
+func argType(a Arg) string {
+	if len(a.Type) < 1 {
+		return ARG_STRING
+	}
+	return a.Type
+}
+
+func argUsage(a Arg) (usage string) {
+	usage = "<" + a.Name + ">"
+	if len(a.Choices) > 0 {
+		usage = strings.Join(a.Choices, "|")
+	}
+	if len(a.Flag) > 0 {
+		if argType(a) == ARG_BOOL {
+			usage = "-" + a.Flag
+		} else {
+			usage = "-" + a.Flag + " " + usage
+		}
+	}
+	if !a.Required {
+		usage = "[" + usage + "]"
+	}
+	return
+}
+
+/* Describes those arguments that have a help text
+ * or a default, one per line. */
+func argsHelp(args []Arg) (result string) {
+	for _, a := range args {
+		if len(a.Help) < 1 && len(a.Default) < 1 {
+			continue
+		}
+		result += "  " + strings.Trim(argUsage(a), "[]")
+		if len(a.Help) > 0 {
+			result += " -- " + a.Help
+		}
+		if len(a.Default) > 0 {
+			result += fmt.Sprintf(" (default: %s)", a.Default)
+		}
+		result += "\n"
+	}
+	return
+}
+
+/* The arguments the command would be called with
+ * for the given input, as parsed by parseArgs(). */
+func commandArgs(cmd string, input ...string) (values []string) {
+	values, _ = parseArgs(COMMANDS[cmd].Args, input)
+	return
+}
+
+/* The command's Usage, or one generated from its
+ * Args. */
+func commandUsage(cmd string) string {
+	c, found := COMMANDS[cmd]
+	if !found {
+		return ""
+	}
+	if len(c.Usage) > 0 || c.Args == nil {
+		return c.Usage
+	}
+
+	usage := []string{"!" + cmd}
+	for _, a := range c.Args {
+		if len(a.Flag) > 0 {
+			usage = append(usage, argUsage(a))
+		}
+	}
+	for _, a := range c.Args {
+		if len(a.Flag) < 1 {
+			usage = append(usage, argUsage(a))
+		}
+	}
+	return strings.Join(usage, " ")
+}
+
+/* Returns one value per declared argument, or a
+ * message explaining what's wrong with the input. */
+func parseArgs(decl []Arg, input []string) (values []string, problem string) {
+	values = make([]string, len(decl))
+	given := make([]bool, len(decl))
+
+	flags := map[string]int{}
+	var positional []int
+	required := 0
+	for i, a := range decl {
+		if len(a.Flag) > 0 {
+			flags["-"+a.Flag] = i
+			continue
+		}
+		positional = append(positional, i)
+		if a.Required {
+			required++
+		}
+	}
+
+	var words []string
+	for n := 0; n < len(input); n++ {
+		w := input[n]
+		i, isFlag := flags[w]
+		if !isFlag {
+			words = append(words, w)
+			/* Everything after the start of free
+			 * text is part of it. */
+			if len(words) == len(positional) &&
+				argType(decl[positional[len(positional)-1]]) == ARG_TEXT {
+				words = append(words, input[n+1:]...)
+				break
+			}
+			continue
+		}
+
+		if given[i] {
+			problem = fmt.Sprintf("'%s' given more than once.", w)
+			return
+		}
+		given[i] = true
+		if argType(decl[i]) == ARG_BOOL {
+			values[i] = "true"
+			continue
+		}
+		if n+1 >= len(input) {
+			problem = fmt.Sprintf("'%s' requires a <%s>.", w, decl[i].Name)
+			return
+		}
+		n++
+		values[i] = input[n]
+	}
+
+	if len(words) < required {
+		n := len(words)
+		for _, i := range positional {
+			if !decl[i].Required {
+				continue
+			}
+			if n < 1 {
+				problem = fmt.Sprintf("Missing <%s>.", decl[i].Name)
+				return
+			}
+			n--
+		}
+	}
+
+	optional := len(words) - required
+	for _, i := range positional {
+		if len(words) < 1 {
+			break
+		}
+		if !decl[i].Required {
+			if optional < 1 {
+				continue
+			}
+			optional--
+		}
+
+		given[i] = true
+		if argType(decl[i]) == ARG_TEXT {
+			values[i] = strings.Join(words, " ")
+			words = nil
+			break
+		}
+		values[i] = words[0]
+		words = words[1:]
+	}
+
+	if len(words) > 0 {
+		problem = fmt.Sprintf("Too many arguments: '%s'.", strings.Join(words, " "))
+		return
+	}
+
+	for i, a := range decl {
+		if !given[i] {
+			values[i] = a.Default
+			continue
+		}
+		if argType(a) == ARG_INT {
+			if _, err := strconv.Atoi(values[i]); err != nil {
+				problem = fmt.Sprintf("<%s> must be a number, not '%s'.", a.Name, values[i])
+				return
+			}
+		}
+		if len(a.Choices) > 0 && !argChoice(a, values[i]) {
+			problem = fmt.Sprintf("<%s> must be one of %s, not '%s'.", a.Name,
+				strings.Join(a.Choices, ", "), values[i])
+			return
+		}
+	}
+	return
+}
@@ -9,10 +9,11 @@ func init() {
 	"quench your thirst",
 	"https://www.beeradvocate.com/",
 	"!beer <beer>",
+	nil,
 	nil}*/
 }
 
-/*func cmdBeer(r Recipient, chName string, args []string) (result string) {
+/*func cmdBeer(ctx context.Context, r Recipient, chName string, args []string) (result string) {
 	bType := "search"
 	theUrl := fmt.Sprintf("%ssearch/?qt=beer&q=", COMMANDS["beer"].How)
 	if len(args) < 1 {
@@ -27,7 +28,7 @@ func init() {
 	wantedBeer := strings.Join(args, " ")
 
 	theUrl += url.QueryEscape(wantedBeer)
-	data := getURLContents(theUrl, nil)
+	data := getURLContents(ctx, theUrl, nil)
 
 	type Beer struct {
 		Abv      string
@@ -65,7 +66,7 @@ func init() {
 			if m := beer_re.FindStringSubmatch(line); len(m) > 0 {
 				beer = Beer{"", "", m[3], m[2], "", m[1]}
 				theUrl = fmt.Sprintf("%s%s", COMMANDS["beer"].How, m[1])
-				data2 = getURLContents(theUrl, nil)
+				data2 = getURLContents(ctx, theUrl, nil)
 			} else if strings.Contains(line, "<title>"+wantedBeer) {
 				beer = Beer{"", "", "", wantedBeer, "", ""}
 				data2 = data
@@ -0,0 +1,318 @@
+/* This file contains functionality around the
+ * in-memory cache of HTTP responses used by
+ * getURLContents(), and the '!cache' command to
+ * inspect and flush it.
+ *
+ * Only requests that name a cache source (via
+ * args["cache"], e.g. "airports") are cached, and
+ * only 2xx responses.  Each source has its own TTL
+ * (see FETCH_CACHE_TTLS), which 'httpCacheTTLs' can
+ * override, e.g. "airports=168h,opsgenie-users=0s";
+ * a TTL of 0 disables caching for that source.
+ *
+ * Once an entry has expired, we revalidate it using
+ * its ETag / Last-Modified, if the server gave us
+ * either; a 304 renews the entry.  The cache holds
+ * at most FETCH_CACHE_MAX_SIZE bytes; the least
+ * recently used entries are evicted first.
+ *
+ * Note: only bot admins can flush the cache.
+ *
+ * Usage:
+ * !cache [list [<source>] | flush [<source>]]
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const FETCH_CACHE_MAX_ENTRY = 4 * 1024 * 1024
+const FETCH_CACHE_MAX_SIZE = 64 * 1024 * 1024
+
+var FETCH_CACHE_TTLS = map[string]time.Duration{
+	"airports":           24 * time.Hour,
+	"crtsh":              24 * time.Hour,
+	"opsgenie-rotations": time.Hour,
+	"opsgenie-schedules": time.Hour,
+	"opsgenie-teams":     time.Hour,
+	"opsgenie-users":     time.Hour,
+}
+
+var FETCH_CACHE_LOCK sync.Mutex
+
+/* By fetchCacheKey(). */
+var FETCH_CACHE = map[string]*FetchCacheEntry{}
+var FETCH_CACHE_SIZE int
+var FETCH_CACHE_STATS = map[string]*FetchCacheStats{}
+
+type FetchCacheEntry struct {
+	Source       string
+	URL          string
+	Data         []byte
+	ETag         string
+	LastModified string
+	Fetched      time.Time
+	Expires      time.Time
+	Used         time.Time
+	Hits         int
+}
+
+type FetchCacheStats struct {
+	Hits        int
+	Misses      int
+	Revalidated int
+}
+
+func init() {
+	COMMANDS["cache"] = &Command{cmdCache,
+		"inspect or flush the HTTP response cache (flushing only available to bot admins)",
+		"builtin",
+		"",
+		nil,
+		[]Arg{
+			{Name: "action", Choices: []string{"list", "flush"}},
+			{Name: "source", Help: "e.g. \"airports\"; default: all sources"},
+		}}
+}
+
+func cmdCache(ctx context.Context, r Recipient, chName string, args []string) (result string) {
+	source := args[1]
+
+	switch args[0] {
+	case "":
+		result = fetchCacheSummary()
+	case "list":
+		result = fetchCacheList(source)
+	case "flush":
+		if !hasRole(r, chName, ROLE_ADMIN) {
+			result = roleDenial("cache flush", ROLE_ADMIN, chName)
+			return
+		}
+		n := flushFetchCache(source)
+		FETCH_LOG.InfoContext(ctx, "flushed cache", "source", source, "entries", n)
+		result = fmt.Sprintf("Flushed %d cache entries.", n)
+	}
+	return
+}
+
+/* Must be called with FETCH_CACHE_LOCK held. */
+func evictFetchCache() {
+	for FETCH_CACHE_SIZE > FETCH_CACHE_MAX_SIZE {
+		oldest := ""
+		for k, e := range FETCH_CACHE {
+			if len(oldest) < 1 || e.Used.Before(FETCH_CACHE[oldest].Used) {
+				oldest = k
+			}
+		}
+		if len(oldest) < 1 {
+			return
+		}
+		FETCH_LOG.Debug("evicting", "source", FETCH_CACHE[oldest].Source, "url", FETCH_CACHE[oldest].URL)
+		FETCH_CACHE_SIZE -= len(FETCH_CACHE[oldest].Data)
+		delete(FETCH_CACHE, oldest)
+	}
+}
+
+func fetchCacheKey(source, url string) string {
+	return source + "\x00" + url
+}
+
+func fetchCacheList(source string) (result string) {
+	FETCH_CACHE_LOCK.Lock()
+	defer FETCH_CACHE_LOCK.Unlock()
+
+	var entries []*FetchCacheEntry
+	for _, e := range FETCH_CACHE {
+		if len(source) < 1 || e.Source == source {
+			entries = append(entries, e)
+		}
+	}
+	if len(entries) < 1 {
+		result = "No cache entries."
+		return
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Source != entries[j].Source {
+			return entries[i].Source < entries[j].Source
+		}
+		return entries[i].URL < entries[j].URL
+	})
+
+	now := time.Now()
+	lines := []string{}
+	for _, e := range entries {
+		expires := "expired"
+		if e.Expires.After(now) {
+			expires = "expires in " + e.Expires.Sub(now).Round(time.Second).String()
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s (%s, %d hits, %s)", e.Source, e.URL,
+			formatCacheSize(len(e.Data)), e.Hits, expires))
+	}
+	result = "```" + strings.Join(lines, "\n") + "```"
+	return
+}
+
+/* Returns a copy of the cached entry, if any, and
+ * whether it's still fresh; fresh entries count as
+ * hits. */
+func fetchCacheLookup(source, url string) (entry FetchCacheEntry, found, fresh bool) {
+	FETCH_CACHE_LOCK.Lock()
+	defer FETCH_CACHE_LOCK.Unlock()
+
+	e, found := FETCH_CACHE[fetchCacheKey(source, url)]
+	if !found {
+		return
+	}
+
+	now := time.Now()
+	fresh = e.Expires.After(now)
+	if fresh {
+		e.Used = now
+		e.Hits++
+		fetchCacheStats(source).Hits++
+		incrementMetric("jbot_http_cache_requests_total", source, "hit")
+	}
+	entry = *e
+	return
+}
+
+/* The server told us our stale copy is still
+ * good. */
+func fetchCacheRevalidated(source, url string, resp *http.Response) {
+	FETCH_CACHE_LOCK.Lock()
+	defer FETCH_CACHE_LOCK.Unlock()
+
+	fetchCacheStats(source).Revalidated++
+	incrementMetric("jbot_http_cache_requests_total", source, "revalidated")
+
+	e, found := FETCH_CACHE[fetchCacheKey(source, url)]
+	if !found {
+		return
+	}
+
+	now := time.Now()
+	e.Expires = now.Add(fetchCacheTTL(source))
+	e.Used = now
+	if resp != nil {
+		if etag := resp.Header.Get("ETag"); len(etag) > 0 {
+			e.ETag = etag
+		}
+		if lm := resp.Header.Get("Last-Modified"); len(lm) > 0 {
+			e.LastModified = lm
+		}
+	}
+}
+
+/* Must be called with FETCH_CACHE_LOCK held. */
+func fetchCacheStats(source string) *FetchCacheStats {
+	s, found := FETCH_CACHE_STATS[source]
+	if !found {
+		s = &FetchCacheStats{}
+		FETCH_CACHE_STATS[source] = s
+	}
+	return s
+}
+
+func fetchCacheStore(source, url, safeURL string, data []byte, resp *http.Response) {
+	FETCH_CACHE_LOCK.Lock()
+	defer FETCH_CACHE_LOCK.Unlock()
+
+	fetchCacheStats(source).Misses++
+	incrementMetric("jbot_http_cache_requests_total", source, "miss")
+
+	key := fetchCacheKey(source, url)
+	if old, found := FETCH_CACHE[key]; found {
+		FETCH_CACHE_SIZE -= len(old.Data)
+		delete(FETCH_CACHE, key)
+	}
+
+	if len(data) > FETCH_CACHE_MAX_ENTRY ||
+		strings.Contains(resp.Header.Get("Cache-Control"), "no-store") {
+		return
+	}
+
+	now := time.Now()
+	FETCH_CACHE[key] = &FetchCacheEntry{
+		Source:       source,
+		URL:          safeURL,
+		Data:         data,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Fetched:      now,
+		Expires:      now.Add(fetchCacheTTL(source)),
+		Used:         now,
+	}
+	FETCH_CACHE_SIZE += len(data)
+	evictFetchCache()
+}
+
+func fetchCacheSummary() (result string) {
+	FETCH_CACHE_LOCK.Lock()
+	defer FETCH_CACHE_LOCK.Unlock()
+
+	result = fmt.Sprintf("%d cache entries, %s (max %s).\n", len(FETCH_CACHE),
+		formatCacheSize(FETCH_CACHE_SIZE), formatCacheSize(FETCH_CACHE_MAX_SIZE))
+
+	sources := map[string]bool{}
+	for s := range FETCH_CACHE_TTLS {
+		sources[s] = true
+	}
+	for s := range FETCH_CACHE_STATS {
+		sources[s] = true
+	}
+
+	var names []string
+	for s := range sources {
+		names = append(names, s)
+	}
+	sort.Strings(names)
+
+	for _, s := range names {
+		stats := fetchCacheStats(s)
+		result += fmt.Sprintf("%s (TTL %s): %d hits, %d misses, %d revalidated\n", s,
+			fetchCacheTTL(s), stats.Hits, stats.Misses, stats.Revalidated)
+	}
+	return
+}
+
+func fetchCacheTTL(source string) time.Duration {
+	if d, found := configDurations("httpCacheTTLs")[source]; found {
+		return d
+	}
+	return FETCH_CACHE_TTLS[source]
+}
+
+/* Flushes all entries of the given source, or all
+ * entries if no source is given. */
+func flushFetchCache(source string) (n int) {
+	FETCH_CACHE_LOCK.Lock()
+	defer FETCH_CACHE_LOCK.Unlock()
+
+	for k, e := range FETCH_CACHE {
+		if len(source) < 1 || e.Source == source {
+			FETCH_CACHE_SIZE -= len(e.Data)
+			delete(FETCH_CACHE, k)
+			n++
+		}
+	}
+	return
+}
+
+func formatCacheSize(n int) string {
+	switch {
+	case n >= 1024*1024:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1024*1024))
+	case n >= 1024:
+		return fmt.Sprintf("%.1f KB", float64(n)/1024)
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
@@ -4,6 +4,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"regexp"
@@ -11,6 +12,8 @@ import (
 	"time"
 )
 
+var CHATTER_LOG = newLogger("chatter")
+
 var DONTKNOW = []string{
 	"How the hell am I supposed to know that?",
 	"Why waste time learning, when ignorance is instantaneous?",
@@ -135,7 +138,7 @@ func init() {
 	URLS["swquotes"] = "http://localhost/swquotes"
 }
 
-func chatterEliza(msg string, r Recipient) (result string) {
+func chatterEliza(ctx context.Context, msg string, r Recipient) (result string) {
 	rand.Seed(time.Now().UnixNano())
 
 	eliza := []*ElizaResponse{
@@ -261,7 +264,7 @@ func chatterEliza(msg string, r Recipient) (result string) {
 			"Can you think of anybody in particular?",
 		}},
 		&ElizaResponse{regexp.MustCompile(`(?i)(how ((will|can|[cw]ould) (yo)?u) help)|(what (can|do) you do)|(how do (I|we) use you)`), []string{
-			cmdHelp(r, "", []string{}),
+			cmdHelp(ctx, r, "", []string{}),
 		}},
 		&ElizaResponse{regexp.MustCompile(`(?i)((please )? help)|((will|can|[cw]ould) (yo)?u)`), []string{
 			"Sure, why not?",
@@ -359,22 +362,23 @@ func chatterEliza(msg string, r Recipient) (result string) {
 
 	n := rand.Intn(10)
 	if n == 1 {
-		result = randomLineFromUrl(URLS["insults"], false)
+		result = randomLineFromUrl(ctx, URLS["insults"])
 	} else if n < 4 {
-		result = randomLineFromUrl(URLS["praise"], false)
+		result = randomLineFromUrl(ctx, URLS["praise"])
 	} else {
-		result = randomLineFromUrl(URLS["eliza"], false)
+		result = randomLineFromUrl(ctx, URLS["eliza"])
 		result = strings.Replace(result, "<@>", fmt.Sprintf("<@%s>", r.Id), -1)
 	}
 	return
 }
 
-func chatterAtnoyance(msg string, ch *Channel, r Recipient) (result string) {
+func chatterAtnoyance(ctx context.Context, msg string, ch *Channel, r Recipient) (result string) {
 	if strings.Contains(msg, "<!channel>") {
-		if slackChannel, err := SLACK_CLIENT.GetChannelInfo(ch.Id); err == nil {
-			num := len(getAllMembersInChannel(slackChannel.ID))
-			result = fmt.Sprintf("To all the %d users who were just notified courtesy of <@%s>:\n",
-				num, r.Id)
+		if ch.Type == "slack" {
+			if members := getAllMembersInChannel(ch.Id); len(members) > 0 {
+				result = fmt.Sprintf("To all the %d users who were just notified courtesy of <@%s>:\n",
+					len(members), r.Id)
+			}
 		}
 		result += "You can adjust your notification settings on a per-channel basis. :idea2:\n"
 		result += "Click channel name -> Notifications Preferences -> 'Ignore notifications for...'\n"
@@ -419,7 +423,7 @@ func chatterDrWho(msg string) (result string) {
 	return
 }
 
-func chatterFlight(msg string, ch *Channel, r Recipient) (result string) {
+func chatterFlight(ctx context.Context, msg string, ch *Channel, r Recipient) (result string) {
 	flight_re := regexp.MustCompile(`([A-Z]+)\s*(:[^:]*plane[^:]*:|✈️)\s*([A-Z]+)`)
 	m := flight_re.FindStringSubmatch(msg)
 	from := ""
@@ -427,8 +431,7 @@ func chatterFlight(msg string, ch *Channel, r Recipient) (result string) {
 	if len(m) > 0 {
 		from = m[1]
 		to = m[3]
-		cmd := from + " " + to
-		result = cmdFlight(r, ch.Name, []string{cmd})
+		result = cmdFlight(ctx, r, ch.Name, commandArgs("flight", from, to))
 	}
 
 	if len(result) > 0 && strings.HasPrefix(result, "Sorry") {
@@ -488,13 +491,13 @@ func chatterH2G2(msg string) (result string) {
 	return
 }
 
-func chatterMisc(msg string, ch *Channel, r Recipient) (result string) {
+func chatterMisc(ctx context.Context, msg string, ch *Channel, r Recipient) (result string) {
 	rand.Seed(time.Now().UnixNano())
 
 	holdon := regexp.MustCompile(`(?i)^((hold|hang) on([^[:punct:],.]*))`)
 	m := holdon.FindStringSubmatch(msg)
 	if len(m) > 0 {
-		m[1] = strings.Replace(m[1], fmt.Sprintf(" @%s", CONFIG["mentionName"]), "", -1)
+		m[1] = strings.Replace(m[1], fmt.Sprintf(" @%s", getConfig("mentionName")), "", -1)
 		if !isThrottled("holdon", ch) {
 			result = fmt.Sprintf("No *YOU* %s, <@%s>!", m[1], r.Id)
 			return
@@ -502,14 +505,14 @@ func chatterMisc(msg string, ch *Channel, r Recipient) (result string) {
 	}
 
 	trivia_re := regexp.MustCompile(`(trivia|factlet|anything interesting.*\?)`)
-	if trivia_re.MatchString(msg) && ch.Toggles["trivia"] && !isThrottled("trivia", ch) {
-		reply(r, cmdTrivia(r, r.ReplyTo, []string{}))
+	if trivia_re.MatchString(msg) && getToggle(ch, "trivia") && !isThrottled("trivia", ch) {
+		reply(r, cmdTrivia(ctx, r, r.ReplyTo, []string{}))
 		return
 	}
 
 	oncall := regexp.MustCompile(`(?i)^who('?s| is) on ?call\??$`)
 	if oncall.MatchString(msg) {
-		result = cmdOncall(r, ch.Name, []string{})
+		result = cmdOncall(ctx, r, ch.Name, commandArgs("oncall"))
 		return
 	}
 
@@ -581,7 +584,7 @@ func chatterMisc(msg string, ch *Channel, r Recipient) (result string) {
 			"Please try again later.",
 			"IF YOU DON'T SEE THE FNORD IT CAN'T EAT YOU",
 			fmt.Sprintf("Nice. This brings your total #yubifail count to %s.",
-				strings.TrimSpace(cmdYubifail(r, ch.Name, []string{r.MentionName}))),
+				strings.TrimSpace(cmdYubifail(ctx, r, ch.Name, []string{r.MentionName}))),
 		}
 		result = replies[rand.Intn(len(replies))]
 	}
@@ -605,14 +608,14 @@ func chatterMisc(msg string, ch *Channel, r Recipient) (result string) {
 	}
 
 	shakespeare := regexp.MustCompile(`(?i)(shakespear|hamlet|macbeth|romeo and juliet|merchant of venice|midsummer night's dream|henry V|as you like it|All's Well That Ends Well|Comedy of Errors|Cymbeline|Love's Labours Lost|Measure for Measure|Merry Wives of Windsor|Much Ado About Nothing|Pericles|Prince of Tyre|Taming of the Shrew|Tempest|Troilus|Cressida|(Twelf|)th Night|gentlemen of verona|Winter's tale|henry IV|king john|richard II|anth?ony and cleopatra|coriolanus|julius caesar|king lear|othello|timon of athens|titus|andronicus)`)
-	if shakespeare.MatchString(msg) && ch.Toggles["shakespeare"] && !isThrottled("shakespeare", ch) {
-		result = gothicText(randomLineFromUrl(URLS["shakespeare"], false))
+	if shakespeare.MatchString(msg) && getToggle(ch, "shakespeare") && !isThrottled("shakespeare", ch) {
+		result = gothicText(randomLineFromUrl(ctx, URLS["shakespeare"]))
 		return
 	}
 
 	schneier := regexp.MustCompile(`(?i)(schneier|blowfish|skein)`)
-	if schneier.MatchString(msg) && ch.Toggles["schneier"] && !isThrottled("schneier", ch) {
-		result = randomLineFromUrl(URLS["schneier"], false)
+	if schneier.MatchString(msg) && getToggle(ch, "schneier") && !isThrottled("schneier", ch) {
+		result = randomLineFromUrl(ctx, URLS["schneier"])
 		return
 	}
 
@@ -656,13 +659,13 @@ func chatterMisc(msg string, ch *Channel, r Recipient) (result string) {
 
 	speb := regexp.MustCompile(`(?i)security ((problem )?excuse )?bingo`)
 	if speb.MatchString(msg) && !isThrottled("speb", ch) {
-		result = cmdSpeb(r, ch.Name, []string{})
+		result = cmdSpeb(ctx, r, ch.Name, []string{})
 		return
 	}
 
 	/*beer := regexp.MustCompile(`(?i)^b[ie]er( me)?$`)
 	if beer.MatchString(msg) {
-		result = cmdBeer(r, ch.Name, []string{})
+		result = cmdBeer(ctx, r, ch.Name, []string{})
 	}*/
 
 	ed := regexp.MustCompile(`(?i)(editor war)|(emacs.*vi)|(vi.*emacs)|((best|text) (text[ -]?)?editor)`)
@@ -704,8 +707,8 @@ func chatterMisc(msg string, ch *Channel, r Recipient) (result string) {
 	}
 
 	corpbs_re := regexp.MustCompile(`((c-level|corporate|business|manage(r|ment)|marketing) (bullshit|bs|jargon|speak|lingo))|synergize`)
-	if corpbs_re.MatchString(msg) && ch.Toggles["corpbs"] && !isThrottled("corpbs", ch) {
-		reply(r, cmdBs(r, r.ReplyTo, []string{"chatter"}))
+	if corpbs_re.MatchString(msg) && getToggle(ch, "corpbs") && !isThrottled("corpbs", ch) {
+		reply(r, cmdBs(ctx, r, r.ReplyTo, []string{"chatter"}))
 		return
 	}
 
@@ -759,17 +762,17 @@ func chatterMisc(msg string, ch *Channel, r Recipient) (result string) {
 
 	swquote_re := regexp.MustCompile(`(?i)(program.*wisdom|murphy.*law|fred.*brooks|((dijkstra|kernighan|knuth|pike|thompson|ritchie).*quote))`)
 	if swquote_re.MatchString(msg) && !isThrottled("swquotes", ch) {
-		result = randomLineFromUrl(URLS["swquotes"], false)
+		result = randomLineFromUrl(ctx, URLS["swquotes"])
 	}
 
 	insects_re := regexp.MustCompile(`(?i)(insect|cockroach|drosophila|weevil|butterfly|honeybee|aphid)`)
 	if insects_re.MatchString(msg) && !isThrottled("insects", ch) {
-		result = randomLineFromUrl(URLS["insects"], false)
+		result = randomLineFromUrl(ctx, URLS["insects"])
 	}
 
 	animals_re := regexp.MustCompile(`(?i)(mammal|lobster|chicken|koala|opossum|flamingo|giraffe|armadillo)`)
 	if animals_re.MatchString(msg) && !isThrottled("animals", ch) {
-		result = randomLineFromUrl(URLS["animals"], false)
+		result = randomLineFromUrl(ctx, URLS["animals"])
 	}
 
 	return
@@ -820,9 +823,9 @@ func chatterMontyPython(msg string) (result string) {
 	return
 }
 
-func chatterParrotParty(msg string) (result string) {
+func chatterParrotParty(ctx context.Context, msg string) (result string) {
 	if m, _ := regexp.MatchString("(?i)parrot *party", msg); m {
-		result = randomLineFromUrl(URLS["parrots"], false)
+		result = randomLineFromUrl(ctx, URLS["parrots"])
 	}
 	return
 }
@@ -888,15 +891,18 @@ func chatterSeinfeld(msg string) (result string) {
 	return
 }
 
-func processChatter(r Recipient, msg string, forUs bool) {
+func processChatter(ctx context.Context, r Recipient, msg string, forUs bool) {
 	var chitchat string
 
-	yo := "(@?" + CONFIG["mentionName"] + ")"
+	ctx, cancel := commandContext(ctx, "chatter")
+	defer cancel()
+
+	yo := "(@?" + getConfig("mentionName") + ")"
 	/* We can't use "\b", because that doesn't
 	 * match e.g., "<@1234>" because "<" or "@"
 	 * are not non-word boundary chars. */
 	mentioned_re := regexp.MustCompile(`(?i)[^a-z0-9_/-]` + yo + `[^a-z0-9_/-]`)
-	forUs_re := regexp.MustCompile(`(?i)([^a-z0-9_/-]<@` + CONFIG["slackID"] + `[^a-z0-9_/-])|(^` + CONFIG["mentionName"] + `|` + CONFIG["mentionName"] + `$)`)
+	forUs_re := regexp.MustCompile(`(?i)([^a-z0-9_/-]<@` + getConfig("slackID") + `[^a-z0-9_/-])|(^` + getConfig("mentionName") + `|` + getConfig("mentionName") + `$)`)
 
 	/* If we received a message but can't find the
 	 * channel, then it must have been a priv
@@ -907,14 +913,14 @@ func processChatter(r Recipient, msg string, forUs bool) {
 		/* Per https://is.gd/HXUix5, a privmsg
 		 * begins with a 'D'. */
 		if r.ReplyTo[0] == 'D' {
-			processCommands(r, "!", msg)
+			processCommands(ctx, r, "!", msg)
 		}
 		return
 	} else if !forUs {
 		forUs = forUs_re.MatchString(msg)
 	}
 
-	jbotDebug(fmt.Sprintf("%v in %s: %s - %v", r, ch.Name, msg, forUs))
+	CHATTER_LOG.DebugContext(ctx, "processing chatter", "msg", msg, "forUs", forUs)
 	leave_re := regexp.MustCompile(fmt.Sprintf("(?i)^((%s[,:]? *)(please )?leave)|(please )?leave[,:]? %s", yo, yo))
 	if leave_re.MatchString(msg) {
 		leave(r, found, msg, false)
@@ -924,7 +930,7 @@ func processChatter(r Recipient, msg string, forUs bool) {
 	insult_re := regexp.MustCompile(fmt.Sprintf("(?i)^(%s[,:]? *)(please )?insult ", yo))
 	if insult_re.MatchString(msg) {
 		target := strings.SplitN(msg, "insult ", 2)
-		reply(r, cmdInsult(r, r.ReplyTo, []string{target[1]}))
+		reply(r, cmdInsult(ctx, r, r.ReplyTo, []string{target[1]}))
 		return
 	}
 
@@ -939,34 +945,35 @@ func processChatter(r Recipient, msg string, forUs bool) {
 		mentioned = false
 	}
 
-	jbotDebug(fmt.Sprintf("forUs: %v; chatter: %v; mentioned: %v\n", forUs, ch.Toggles["chatter"], mentioned))
+	CHATTER_LOG.DebugContext(ctx, "chatter state", "forUs", forUs,
+		"chatter", getToggle(ch, "chatter"), "mentioned", mentioned)
 
-	help_re := regexp.MustCompile(fmt.Sprintf("(?i)@?%s,? (!?help( all)?)$", CONFIG["mentionName"]))
+	help_re := regexp.MustCompile(fmt.Sprintf("(?i)@?%s,? (!?help( all)?)$", getConfig("mentionName")))
 	m := help_re.FindStringSubmatch(msg)
 	if len(m) > 0 {
 		arg := ""
 		if len(m[2]) > 0 {
 			arg = "all"
 		}
-		reply(r, cmdHelp(r, r.ReplyTo, []string{arg}))
+		reply(r, cmdHelp(ctx, r, r.ReplyTo, []string{arg}))
 		return
 	}
 
 	if wasInsult(msg) && (forUs ||
-		(ch.Toggles["chatter"] && mentioned)) {
-		reply(r, cmdInsult(r, r.ReplyTo, []string{"me"}))
+		(getToggle(ch, "chatter") && mentioned)) {
+		reply(r, cmdInsult(ctx, r, r.ReplyTo, []string{"me"}))
 		return
 	}
 
-	if ch.Toggles["chatter"] {
-		chitchat = chatterParrotParty(msg)
+	if getToggle(ch, "chatter") {
+		chitchat = chatterParrotParty(ctx, msg)
 		if len(chitchat) > 0 {
 			reply(r, chitchat)
 			return
 		}
 
 		chitchat = chatterMontyPython(msg)
-		if (len(chitchat) > 0) && ch.Toggles["python"] &&
+		if (len(chitchat) > 0) && getToggle(ch, "python") &&
 			!isThrottled("python", ch) {
 			reply(r, chitchat)
 			return
@@ -990,7 +997,7 @@ func processChatter(r Recipient, msg string, forUs bool) {
 			return
 		}
 
-		chitchat = chatterMisc(msg, ch, r)
+		chitchat = chatterMisc(ctx, msg, ch, r)
 		if len(chitchat) > 0 {
 			reply(r, chitchat)
 			return
@@ -1002,21 +1009,21 @@ func processChatter(r Recipient, msg string, forUs bool) {
 			return
 		}*/
 
-		chitchat = chatterAtnoyance(msg, ch, r)
-		if (len(chitchat) > 0) && ch.Toggles["atnoyance"] && !isThrottled("atnoyance", ch) {
+		chitchat = chatterAtnoyance(ctx, msg, ch, r)
+		if (len(chitchat) > 0) && getToggle(ch, "atnoyance") && !isThrottled("atnoyance", ch) {
 			reply(r, chitchat)
 			return
 		}
 
-		chitchat = chatterFlight(msg, ch, r)
+		chitchat = chatterFlight(ctx, msg, ch, r)
 		if len(chitchat) > 0 {
 			reply(r, chitchat)
 			return
 		}
 	}
 
-	if forUs || (ch.Toggles["chatter"] && mentioned) {
-		chitchat = chatterEliza(msg, r)
+	if forUs || (getToggle(ch, "chatter") && mentioned) {
+		chitchat = chatterEliza(ctx, msg, r)
 		if len(chitchat) > 0 {
 			reply(r, chitchat)
 		}
@@ -1028,12 +1035,12 @@ func wasInsult(msg string) (result bool) {
 	result = false
 
 	var insultPatterns = []*regexp.Regexp{
-		regexp.MustCompile(fmt.Sprintf("(?i)you('re|r| are) a tool[, ]*@?%s", CONFIG["mentionName"])),
-		regexp.MustCompile(fmt.Sprintf("(?i)fu[, ]@?%s", CONFIG["mentionName"])),
-		regexp.MustCompile(fmt.Sprintf("(?i)@?%s su(cks|x)", CONFIG["mentionName"])),
+		regexp.MustCompile(fmt.Sprintf("(?i)you('re|r| are) a tool[, ]*@?%s", getConfig("mentionName"))),
+		regexp.MustCompile(fmt.Sprintf("(?i)fu[, ]@?%s", getConfig("mentionName"))),
+		regexp.MustCompile(fmt.Sprintf("(?i)@?%s su(cks|x)", getConfig("mentionName"))),
 		regexp.MustCompile("(?i)asshole|bitch|dickhead"),
 		regexp.MustCompile("(?i)dam+n? (yo)?u"),
-		regexp.MustCompile(fmt.Sprintf("(?i)(be )?quiet @?%s", CONFIG["mentionName"])),
+		regexp.MustCompile(fmt.Sprintf("(?i)(be )?quiet @?%s", getConfig("mentionName"))),
 		regexp.MustCompile("(?i)shut ?(the fuck )?up"),
 		regexp.MustCompile("(?i)(screw|fuck) (yo)u"),
 		regexp.MustCompile("(?i)(piss|bugger) ?off"),
@@ -1041,8 +1048,8 @@ func wasInsult(msg string) (result bool) {
 		regexp.MustCompile("(?i)(yo)?u (suck|blow|are ((very|so+) )?(useless|lame|dumb|stupid|stink))"),
 		regexp.MustCompile("(?i)(stfu|go to hell|shut[ t]up)"),
 		regexp.MustCompile("(?i) is (stupid|dumb|annoying|lame|boring|useless|a jerk)"),
-		regexp.MustCompile(fmt.Sprintf("(?i)(stupid|annoying|lame|boring|useless) +(%s|bot)", CONFIG["mentionName"])),
-		regexp.MustCompile(fmt.Sprintf("(?i)(blame )?(%s|the bot)('?s fault)", CONFIG["mentionName"])),
+		regexp.MustCompile(fmt.Sprintf("(?i)(stupid|annoying|lame|boring|useless) +(%s|bot)", getConfig("mentionName"))),
+		regexp.MustCompile(fmt.Sprintf("(?i)(blame )?(%s|the bot)('?s fault)", getConfig("mentionName"))),
 	}
 
 	for _, p := range insultPatterns {
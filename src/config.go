@@ -0,0 +1,598 @@
+/* This file contains functionality around the
+ * configuration: the schema of all known keys, parsing
+ * the config file, environment overrides and
+ * validation.
+ *
+ * The config file consists of 'key = value' lines;
+ * values may contain '=', and '#' starts a comment at
+ * the beginning of a line or when surrounded by
+ * whitespace (so that e.g. '#channel' is a value).
+ *
+ * Every key can be overridden via the environment
+ * as JBOT_<KEY>, with the key in upper snake case,
+ * e.g. 'slackToken' becomes JBOT_SLACK_TOKEN.
+ *
+ * Secrets can be read from a file by appending
+ * 'File' to the key, e.g. 'slackTokenFile = /path'
+ * or JBOT_SLACK_TOKEN_FILE=/path.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	CONFIG_STRING = iota
+	CONFIG_BOOL
+	CONFIG_DURATION
+	CONFIG_DURATIONS
+	CONFIG_LOG_LEVEL
+	CONFIG_LOG_LEVELS
+	CONFIG_DIR
+	CONFIG_FILE
+	CONFIG_PATH
+)
+
+/* Backend:  the backend this key belongs to
+ * Enables:  setting this key enables that backend
+ * Required: whether it must be set if that backend
+ *           is enabled
+ * Secret:   never print the value; may be read from
+ *           a file via '<key>File' */
+type ConfigOption struct {
+	Default  string
+	Type     int
+	Backend  string
+	Enables  bool
+	Required bool
+	Secret   bool
+}
+
+var CONFIG_COMMENT_RE = regexp.MustCompile(`(^|\s)#(\s|$)`)
+var CONFIG_LOG = newLogger("config")
+
+var CONFIG_SCHEMA = map[string]ConfigOption{
+	"apiListen":            {},
+	"apiToken":             {Secret: true},
+	"botAdmins":            {},
+	"botOwner":             {},
+	"byUser":               {},
+	"byPassword":           {Secret: true},
+	"channelsFile":         {Default: "/var/tmp/jbot.channels", Type: CONFIG_PATH},
+	"commandRoles":         {},
+	"commandTimeout":       {Default: "30s", Type: CONFIG_DURATION},
+	"commandTimeouts":      {Type: CONFIG_DURATIONS},
+	"countersFile":         {Default: "/var/tmp/jbot.counters", Type: CONFIG_PATH},
+	"configFile":           {Default: "jbot.conf", Type: CONFIG_PATH},
+	"debug":                {Default: "no", Type: CONFIG_BOOL},
+	"emailDomain":          {},
+	"fullName":             {Default: "garybot"},
+	"giphyApiKey":          {Secret: true},
+	"hcControlChannel":     {Backend: "hipchat"},
+	"hcJabberID":           {Backend: "hipchat", Required: true},
+	"hcOauthToken":         {Backend: "hipchat", Secret: true},
+	"hcPassword":           {Backend: "hipchat", Secret: true},
+	"hcService":            {Backend: "hipchat", Enables: true},
+	"httpCacheTTLs":        {Type: CONFIG_DURATIONS},
+	"httpProxy":            {Secret: true},
+	"httpTimeout":          {Default: "20s", Type: CONFIG_DURATION},
+	"ircChannels":          {Backend: "irc"},
+	"ircNick":              {Backend: "irc"},
+	"ircNickServPassword":  {Backend: "irc", Secret: true},
+	"ircPassword":          {Backend: "irc", Secret: true},
+	"ircSASLPassword":      {Backend: "irc", Secret: true},
+	"ircSASLUser":          {Backend: "irc"},
+	"ircServer":            {Backend: "irc", Enables: true},
+	"ircTLS":               {Default: "yes", Type: CONFIG_BOOL, Backend: "irc"},
+	"jiraPassword":         {Secret: true},
+	"jiraUser":             {},
+	"logFormat":            {Default: "text"},
+	"logLevel":             {Default: "warn", Type: CONFIG_LOG_LEVEL},
+	"logLevels":            {Type: CONFIG_LOG_LEVELS},
+	"matrixAccessToken":    {Backend: "matrix", Required: true, Secret: true},
+	"matrixHomeserver":     {Backend: "matrix", Enables: true},
+	"memfile":              {Type: CONFIG_PATH},
+	"mentionName":          {Default: "garybot"},
+	"metricsListen":        {},
+	"openweathermapApiKey": {Secret: true},
+	"opsgenieApiKey":       {Secret: true},
+	"pluginDir":            {Type: CONFIG_DIR},
+	"pluginTimeout":        {Default: "30s", Type: CONFIG_DURATION},
+	"slackAppToken":        {Backend: "slack", Secret: true},
+	"slackEventsListen":    {Default: ":8080", Backend: "slack"},
+	"slackEventsPath":      {Default: "/slack/events", Backend: "slack"},
+	"slackID":              {Default: "garybot", Backend: "slack"},
+	"slackService":         {Default: "vetsec.slack.com", Backend: "slack", Enables: true},
+	"slackSigningSecret":   {Backend: "slack", Secret: true},
+	"slackToken":           {Backend: "slack", Required: true, Secret: true},
+	"SMTP":                 {},
+	"stateDB":              {Default: "/var/tmp/jbot.db", Type: CONFIG_PATH},
+	"timezonedbApiKey":     {Secret: true},
+	"x509Cert":             {Type: CONFIG_FILE},
+	"x509Key":              {Type: CONFIG_FILE},
+	"xmppCAFile":           {Type: CONFIG_FILE, Backend: "xmpp"},
+	"xmppChannels":         {Backend: "xmpp"},
+	"xmppJID":              {Backend: "xmpp", Enables: true},
+	"xmppMUCDomain":        {Backend: "xmpp"},
+	"xmppPassword":         {Backend: "xmpp", Required: true, Secret: true},
+	"xmppServer":           {Backend: "xmpp"},
+	"xmppTLS":              {Default: "yes", Type: CONFIG_BOOL, Backend: "xmpp"},
+}
+
+/* Replaced as a whole on reload and never modified
+ * in place; read it via getConfig(). */
+var CONFIG = map[string]string{}
+var CONFIG_LOCK sync.RWMutex
+
+/* Set via command-line flags; these take precedence
+ * over everything else. */
+var CONFIG_FLAGS = map[string]string{}
+
+func init() {
+	for key, o := range CONFIG_SCHEMA {
+		CONFIG[key] = o.Default
+	}
+}
+
+/* Backends are only checked if they're going to
+ * connect with the given configuration, which the
+ * console and export / import never do; those are
+ * chosen via flags, not the configuration. */
+func configBackendEnabled(cfg map[string]string, name string) bool {
+	if BACKENDS["console"].Enabled() || len(EXPORT_FILE) > 0 || len(IMPORT_FILE) > 0 {
+		return false
+	}
+	return configEnablesBackend(cfg, name)
+}
+
+func configBool(key string) bool {
+	b, _ := parseConfigBool(getConfig(key))
+	return b
+}
+
+func configDuration(key string) time.Duration {
+	d, err := time.ParseDuration(getConfig(key))
+	if err != nil {
+		d, _ = time.ParseDuration(CONFIG_SCHEMA[key].Default)
+	}
+	return d
+}
+
+/* Parses a 'name=duration,...' list, e.g.
+ * "whois=1m,oncall=2m"; invalid entries are skipped. */
+func configDurations(key string) (durations map[string]time.Duration) {
+	durations, _ = parseConfigDurations(getConfig(key))
+	return
+}
+
+/* Returns the environment variable for the given
+ * key, e.g. "ircSASLPassword" => "JBOT_IRC_SASL_PASSWORD". */
+func configEnvName(key string) string {
+	var name []rune
+	runes := []rune(key)
+	for i, c := range runes {
+		if i > 0 && unicode.IsUpper(c) {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				name = append(name, '_')
+			}
+		}
+		name = append(name, unicode.ToUpper(c))
+	}
+	return "JBOT_" + string(name)
+}
+
+/* Whether the given configuration sets any of the
+ * keys that enable the backend. */
+func configEnablesBackend(cfg map[string]string, name string) bool {
+	for key, o := range CONFIG_SCHEMA {
+		if o.Backend == name && o.Enables && len(cfg[key]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func configKeys() (keys []string) {
+	for key := range CONFIG_SCHEMA {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return
+}
+
+func isSecret(key string) bool {
+	return CONFIG_SCHEMA[key].Secret
+}
+
+func maskSecret(val string) string {
+	if len(val) < 12 {
+		return "..."
+	}
+	return val[:4] + "..."
+}
+
+/* Builds a new configuration from the defaults, the
+ * config file, the environment and the command-line
+ * flags, in that order of precedence. */
+func loadConfig() (cfg map[string]string, problems []string) {
+	cfg = map[string]string{}
+	for key, o := range CONFIG_SCHEMA {
+		cfg[key] = o.Default
+	}
+	if f, found := CONFIG_FLAGS["configFile"]; found {
+		cfg["configFile"] = f
+	}
+
+	fname := cfg["configFile"]
+	CONFIG_LOG.Info("parsing config file", "file", fname)
+	if fd, err := os.Open(fname); err == nil {
+		problems = append(problems, readConfigFile(cfg, fname, fd)...)
+		fd.Close()
+	} else if BACKENDS["console"].Enabled() && os.IsNotExist(err) {
+		/* The console doesn't need any
+		 * configuration. */
+		CONFIG_LOG.Info("no config file, using defaults", "file", fname)
+	} else {
+		problems = append(problems, fmt.Sprintf("Unable to open '%s': %v", fname, err))
+	}
+
+	problems = append(problems, readConfigEnv(cfg)...)
+
+	for key, val := range CONFIG_FLAGS {
+		cfg[key] = val
+	}
+
+	if jid := strings.SplitN(cfg["xmppJID"], "@", 2); len(jid) == 2 && len(cfg["xmppMUCDomain"]) < 1 {
+		cfg["xmppMUCDomain"] = "conference." + jid[1]
+	}
+	return
+}
+
+/* Whether the current configuration enables the
+ * backend; see ConfigOption.Enables. */
+func backendEnabled(name string) bool {
+	CONFIG_LOCK.RLock()
+	defer CONFIG_LOCK.RUnlock()
+	return configEnablesBackend(CONFIG, name)
+}
+
+func getConfig(key string) string {
+	CONFIG_LOCK.RLock()
+	defer CONFIG_LOCK.RUnlock()
+	return CONFIG[key]
+}
+
+func parseConfig() {
+	cfg, problems := loadConfig()
+	problems = append(problems, validateConfig(cfg)...)
+	setConfig(cfg)
+
+	if len(problems) > 0 {
+		fail("Invalid configuration:\n  %s\n", strings.Join(problems, "\n  "))
+	}
+
+	if len(cfg["hcControlChannel"]) > 0 && configBackendEnabled(cfg, "hipchat") {
+		CONFIG_LOG.Debug("setting up control channel", "channel", getConfig("hcControlChannel"))
+		r := getRecipientFromMessage(getConfig("hcControlChannel"), "hipchat")
+		ch := newHipChatChannel(r.ReplyTo, r.Id, "")
+		CONFIG_LOG.Debug("control channel", "info", ch)
+		addChannel(&ch)
+	}
+}
+
+func parseConfigBool(val string) (b bool, ok bool) {
+	switch strings.ToLower(val) {
+	case "yes", "true", "on", "1":
+		return true, true
+	case "no", "false", "off", "0", "":
+		return false, true
+	}
+	return false, false
+}
+
+func parseConfigDurations(val string) (durations map[string]time.Duration, problems []string) {
+	durations = map[string]time.Duration{}
+	for _, f := range strings.Split(val, ",") {
+		f = strings.TrimSpace(f)
+		if len(f) < 1 {
+			continue
+		}
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			problems = append(problems, fmt.Sprintf("'%s' is not of the form name=duration", f))
+			continue
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(kv[1]))
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("'%s' is not a duration (e.g. 30s)", kv[1]))
+			continue
+		}
+		durations[strings.TrimSpace(kv[0])] = d
+	}
+	return
+}
+
+func readConfigEnv(cfg map[string]string) (problems []string) {
+	for _, key := range configKeys() {
+		/* Set via '-c'. */
+		if key == "configFile" {
+			continue
+		}
+
+		env := configEnvName(key)
+		if val, found := os.LookupEnv(env); found {
+			CONFIG_LOG.Debug("setting key from environment", "key", key, "env", env)
+			cfg[key] = val
+		}
+
+		if !isSecret(key) {
+			continue
+		}
+		if fname, found := os.LookupEnv(env + "_FILE"); found {
+			if p := readConfigSecretFile(cfg, key, fname); len(p) > 0 {
+				problems = append(problems, env+"_FILE: "+p)
+			}
+		}
+	}
+	return
+}
+
+func readConfigFile(cfg map[string]string, fname string, fd io.Reader) (problems []string) {
+	n := 0
+	input := bufio.NewReader(fd)
+	for {
+		data, err := input.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			CONFIG_LOG.Error("unable to read config file", "file", fname, "err", err)
+			break
+		}
+
+		n++
+
+		line := string(data)
+		if loc := CONFIG_COMMENT_RE.FindStringIndex(line); loc != nil {
+			line = line[:loc[0]]
+		}
+		line = strings.TrimSpace(line)
+
+		if len(line) > 0 {
+			if p := setConfigLine(cfg, line); len(p) > 0 {
+				problems = append(problems, fmt.Sprintf("%s, line %d: %s", fname, n, p))
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+	return
+}
+
+/* Reads the value of a secret from the given file. */
+func readConfigSecretFile(cfg map[string]string, key, fname string) (problem string) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return fmt.Sprintf("unable to read '%s': %s", fname, err)
+	}
+	cfg[key] = strings.TrimSpace(string(data))
+	CONFIG_LOG.Debug("setting key from file", "key", key, "file", fname)
+	return
+}
+
+/* Re-reads the configuration (e.g. on SIGHUP) and, if
+ * it is valid, replaces the current one in one go.
+ * Backend settings are only used when connecting, so
+ * changes to those require a restart.
+ *
+ * Secret files are re-read as part of loading the
+ * configuration, and the x509 client cert and key are
+ * re-read on the next fetch that needs them.  The
+ * 'xmppCAFile' is read whenever we connect.  Plugins
+ * are not rescanned: they are registered as commands,
+ * and COMMANDS is not meant to change at runtime. */
+func reloadConfig() {
+	CONFIG_LOG.Info("reloading configuration")
+
+	cfg, problems := loadConfig()
+	problems = append(problems, validateConfig(cfg)...)
+	if len(problems) > 0 {
+		CONFIG_LOG.Error("not reloading invalid configuration",
+			"problems", strings.Join(problems, "; "))
+		return
+	}
+
+	changed := 0
+	for _, key := range configKeys() {
+		old := getConfig(key)
+		val := cfg[key]
+		if old == val {
+			continue
+		}
+		changed++
+
+		restart := len(CONFIG_SCHEMA[key].Backend) > 0
+		if isSecret(key) {
+			CONFIG_LOG.Info("config changed", "key", key, "restart", restart)
+		} else {
+			CONFIG_LOG.Info("config changed", "key", key, "old", old, "new", val, "restart", restart)
+		}
+	}
+
+	setConfig(cfg)
+	resetFetchClients()
+	setupLogging()
+	CONFIG_LOG.Info("reloaded configuration", "changed", changed)
+}
+
+func setConfig(cfg map[string]string) {
+	CONFIG_LOCK.Lock()
+	CONFIG = cfg
+	CONFIG_LOCK.Unlock()
+}
+
+func setConfigLine(cfg map[string]string, line string) (problem string) {
+	keyval := strings.SplitN(line, "=", 2)
+	if len(keyval) != 2 {
+		return "expected 'key = value'"
+	}
+
+	key := strings.TrimSpace(keyval[0])
+	val := strings.TrimSpace(keyval[1])
+
+	if strings.HasSuffix(key, "File") {
+		if k := strings.TrimSuffix(key, "File"); isSecret(k) {
+			if p := readConfigSecretFile(cfg, k, val); len(p) > 0 {
+				return key + ": " + p
+			}
+			return
+		}
+	}
+
+	if _, found := CONFIG_SCHEMA[key]; !found {
+		return fmt.Sprintf("unknown key '%s'", key)
+	}
+
+	printval := val
+	if isSecret(key) {
+		printval = maskSecret(val)
+	}
+	CONFIG_LOG.Debug("setting key", "key", key, "value", printval)
+	cfg[key] = val
+	return
+}
+
+/* Checks every key against its type and the
+ * requirements of the backends the configuration
+ * enables.  Bools are normalized to "yes" / "no". */
+func validateConfig(cfg map[string]string) (problems []string) {
+	for _, key := range configKeys() {
+		o := CONFIG_SCHEMA[key]
+		val := cfg[key]
+
+		if len(o.Backend) > 0 && o.Required && len(val) < 1 && configBackendEnabled(cfg, o.Backend) {
+			problems = append(problems, fmt.Sprintf("%s: required for %s", key, o.Backend))
+			continue
+		}
+
+		if len(val) < 1 {
+			continue
+		}
+
+		switch o.Type {
+		case CONFIG_BOOL:
+			b, ok := parseConfigBool(val)
+			if !ok {
+				problems = append(problems, fmt.Sprintf("%s: '%s' is not a boolean (yes|no)", key, val))
+			} else if b {
+				cfg[key] = "yes"
+			} else {
+				cfg[key] = "no"
+			}
+		case CONFIG_DURATION:
+			if _, err := time.ParseDuration(val); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: '%s' is not a duration (e.g. 30s)", key, val))
+			}
+		case CONFIG_DURATIONS:
+			_, dProblems := parseConfigDurations(val)
+			for _, p := range dProblems {
+				problems = append(problems, fmt.Sprintf("%s: %s", key, p))
+			}
+		case CONFIG_LOG_LEVEL:
+			if _, found := LOG_LEVEL_NAMES[strings.ToLower(val)]; !found {
+				problems = append(problems, fmt.Sprintf("%s: '%s' is not a log level (debug|info|warn|error)", key, val))
+			}
+		case CONFIG_LOG_LEVELS:
+			_, lProblems := parseLogLevels(val)
+			for _, p := range lProblems {
+				problems = append(problems, fmt.Sprintf("%s: %s", key, p))
+			}
+		case CONFIG_DIR:
+			if fi, err := os.Stat(val); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %s", key, err))
+			} else if !fi.IsDir() {
+				problems = append(problems, fmt.Sprintf("%s: '%s' is not a directory", key, val))
+			}
+		case CONFIG_FILE:
+			if fh, err := os.Open(val); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %s", key, err))
+			} else {
+				fh.Close()
+			}
+		case CONFIG_PATH:
+			if _, err := os.Stat(filepath.Dir(val)); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %s", key, err))
+			}
+		}
+	}
+
+	if len(cfg["apiListen"]) > 0 && len(cfg["apiToken"]) < 1 {
+		problems = append(problems, "apiToken: required when using 'apiListen'")
+	}
+
+	_, rProblems := parseCommandRoles(cfg["commandRoles"])
+	for _, p := range rProblems {
+		problems = append(problems, fmt.Sprintf("commandRoles: %s", p))
+	}
+
+	_, aProblems := parseBotAdmins(cfg["botAdmins"])
+	for _, p := range aProblems {
+		problems = append(problems, fmt.Sprintf("botAdmins: %s", p))
+	}
+
+	if p := cfg["httpProxy"]; len(p) > 0 {
+		if u, err := url.Parse(p); err != nil || len(u.Scheme) < 1 || len(u.Host) < 1 {
+			problems = append(problems, "httpProxy: not a URL (e.g. http://proxy:3128)")
+		}
+	}
+
+	if f := cfg["logFormat"]; f != "text" && f != "json" {
+		problems = append(problems, fmt.Sprintf("logFormat: '%s' is neither 'text' nor 'json'", f))
+	}
+
+	if configBackendEnabled(cfg, "hipchat") {
+		if len(cfg["hcPassword"]) > 0 && len(cfg["hcOauthToken"]) > 0 {
+			problems = append(problems, "hcPassword, hcOauthToken: set *either* one, not both")
+		} else if len(cfg["hcPassword"]) < 1 && len(cfg["hcOauthToken"]) < 1 {
+			problems = append(problems, "hcPassword, hcOauthToken: one of them is required for hipchat")
+		}
+	}
+
+	if configBackendEnabled(cfg, "irc") {
+		if len(cfg["ircSASLUser"]) > 0 && len(cfg["ircSASLPassword"]) < 1 {
+			problems = append(problems, "ircSASLPassword: required when using 'ircSASLUser'")
+		}
+	}
+
+	if configBackendEnabled(cfg, "slack") {
+		if len(cfg["mentionName"]) < 1 {
+			problems = append(problems, "mentionName: required for slack")
+		}
+		if len(cfg["slackAppToken"]) < 1 && len(cfg["slackSigningSecret"]) < 1 {
+			problems = append(problems, "slackAppToken, slackSigningSecret: one of them is required for slack (Socket Mode or Events API)")
+		}
+	}
+
+	if configBackendEnabled(cfg, "xmpp") {
+		if _, _, ok := xmppSplitJID(cfg["xmppJID"]); !ok {
+			problems = append(problems, fmt.Sprintf("xmppJID: '%s' is not of the form user@domain", cfg["xmppJID"]))
+		}
+	}
+
+	return
+}
@@ -0,0 +1,153 @@
+/* This file contains functionality around the
+ * local console backend, letting you talk to the bot
+ * without connecting to any chat service.  All input
+ * is run through the regular processMessage pipeline
+ * in an in-memory channel called '#console'; replies
+ * are printed to stdout.
+ *
+ * Usage:
+ * jbot -i                      -- interactive prompt
+ * jbot -e '!cidr 10.0.0.0/8'   -- run one command and exit
+ *
+ * Note: console mode does not read or write the
+ * state database.
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const CONSOLE_CHANNEL = "console"
+const CONSOLE_PROMPT = "jbot> "
+
+/* Set via '-i' or '-e'. */
+var CONSOLE_INTERACTIVE bool
+var CONSOLE_EVAL string
+
+var CONSOLE_USERS = map[string]UserInfo{}
+
+type ConsoleBackend struct{}
+
+func init() {
+	BACKENDS["console"] = &ConsoleBackend{}
+}
+
+func (b *ConsoleBackend) Enabled() bool {
+	return CONSOLE_INTERACTIVE || len(CONSOLE_EVAL) > 0
+}
+
+func (b *ConsoleBackend) Connect() error {
+	var ch Channel
+
+	ch.Toggles = map[string]bool{}
+	ch.Throttles = map[string]time.Time{}
+	ch.Settings = map[string]string{}
+	ch.Type = "console"
+	ch.Id = CONSOLE_CHANNEL
+	ch.Inviter = consoleUser()
+	ch.Name = CONSOLE_CHANNEL
+	ch.Phishy = &PhishCount{0, 0, time.Now(), time.Unix(0, 0)}
+	ch.CVEs = map[string]CVEItem{}
+
+	for t, v := range TOGGLES {
+		ch.Toggles[t] = v
+	}
+
+	addChannel(&ch)
+	return nil
+}
+
+/* Unlike the other backends, this returns once
+ * we're done, so that the caller can exit. */
+func (b *ConsoleBackend) Receive() {
+	r := getRecipientFromMessage(fmt.Sprintf("%s@%s", consoleUser(), CONSOLE_CHANNEL), "console")
+
+	if len(CONSOLE_EVAL) > 0 {
+		processConsoleInput(r, CONSOLE_EVAL)
+		return
+	}
+
+	input := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Print(CONSOLE_PROMPT)
+		if !input.Scan() {
+			fmt.Println()
+			break
+		}
+		processConsoleInput(r, input.Text())
+	}
+	if err := input.Err(); err != nil {
+		LOG.Error("unable to read input", "err", err)
+	}
+}
+
+func (b *ConsoleBackend) Send(r Recipient, msg string) {
+	fmt.Println(msg)
+}
+
+/* Format is "user@channel". */
+func (b *ConsoleBackend) ResolveUser(from string) (r Recipient) {
+	r.ChatType = "console"
+	f := strings.SplitN(from, "@", 2)
+	r.Id = f[0]
+	r.Name = f[0]
+	r.MentionName = f[0]
+	r.ReplyTo = CONSOLE_CHANNEL
+	if len(f) > 1 {
+		r.ReplyTo = f[1]
+	}
+
+	return
+}
+
+func (b *ConsoleBackend) ResolveChannel(id string) string {
+	return id
+}
+
+func (b *ConsoleBackend) Leave(r Recipient, ch *Channel) {
+	reply(r, "_pretends to have left #console._ (Hit ^D to quit.)")
+}
+
+func (b *ConsoleBackend) ChannelRecipient(ch *Channel) Recipient {
+	return b.ResolveUser(fmt.Sprintf("%s@%s", getConfig("mentionName"), ch.Id))
+}
+
+func (b *ConsoleBackend) SeenUsers(ch *Channel) map[string]UserInfo {
+	return CONSOLE_USERS
+}
+
+func (b *ConsoleBackend) UpdateSeenUser(ch *Channel, r Recipient, uInfo UserInfo) {
+	CONSOLE_USERS[r.MentionName] = uInfo
+}
+
+func consoleUser() (user string) {
+	user = os.Getenv("USER")
+	if len(user) < 1 {
+		user = "console"
+	}
+	return
+}
+
+func processConsoleInput(r Recipient, msg string) {
+	msg = strings.TrimSpace(msg)
+	if len(msg) < 1 {
+		return
+	}
+
+	updateSeen(r, msg)
+	processMessage(context.Background(), r, msg)
+}
+
+func runConsole() {
+	b := BACKENDS["console"]
+	b.Connect()
+	b.Receive()
+	os.Exit(EXIT_SUCCESS)
+}
@@ -10,6 +10,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 	"strings"
@@ -19,16 +20,14 @@ func init() {
 	COMMANDS["ct"] = &Command{cmdCt,
 		"display certificate transparency information",
 		"https://crt.sh/?",
-		"!ct [name|serial=<serial>]",
-		nil}
+		"",
+		nil,
+		[]Arg{
+			{Name: "name|serial=serial", Required: true},
+		}}
 }
 
-func cmdCt(r Recipient, chName string, args []string) (result string) {
-	if len(args) < 1 {
-		result = "Usage: " + COMMANDS["ct"].Usage
-		return
-	}
-
+func cmdCt(ctx context.Context, r Recipient, chName string, args []string) (result string) {
 	input := args[0]
 	input = strings.TrimPrefix(input, "https://")
 	input = strings.TrimSuffix(input, "/")
@@ -54,14 +53,19 @@ func cmdCt(r Recipient, chName string, args []string) (result string) {
 
 	var ctr ctresult
 
-	data := string(getURLContents(theURL, nil))
+	data, err := getURLContents(ctx, theURL, nil)
+	if err != nil && !isFetchNotFound(err) {
+		result = fmt.Sprintf("Unable to query crt.sh: %s\n", err)
+		return
+	}
+
 	for _, line := range strings.Split(string(data), "\n") {
 		if strings.Contains(line, "<TD style=\"text-align:center\">") {
 			column_count++
 			switch column_count {
 			case 1:
 				ctr.ID = dehtmlify(line)
-				in, cn, sans := getCNsFromCTID(ctr.ID)
+				in, cn, sans := getCNsFromCTID(ctx, ctr.ID)
 				ctr.IssuerName = in
 				ctr.CommonName = cn
 				ctr.SANs = sans
@@ -88,9 +92,13 @@ func cmdCt(r Recipient, chName string, args []string) (result string) {
 	return
 }
 
-func getCNsFromCTID(id string) (in, cn, sans string) {
+func getCNsFromCTID(ctx context.Context, id string) (in, cn, sans string) {
 	theURL := COMMANDS["ct"].How + "id=" + id
-	data := string(getURLContents(theURL, nil))
+	data, err := getURLContents(ctx, theURL, map[string]string{"cache": "crtsh"})
+	if err != nil {
+		return
+	}
+
 	cns := []string{}
 	for _, line := range strings.Split(string(data), "\n") {
 		for _, l := range strings.Split(line, "<BR>") {
@@ -9,15 +9,18 @@ package main
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
-	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var ALL_CVES = map[string]CVEItem{}
+var CVE_LOG = newLogger("cve")
 
+const CVE_FEED_TIMEOUT = 300
 const MAX_NEW_CVES = 30
 
 type NvdCVSSV2 struct {
@@ -101,34 +104,39 @@ func init() {
 	COMMANDS["cve"] = &Command{cmdCve,
 		"display vulnerability description",
 		"https://v1.cveapi.com/",
-		"!cve <cve-id>",
-		nil}
+		"",
+		nil,
+		[]Arg{
+			{Name: "cve-id", Required: true},
+		}}
+	SETTINGS["cve-alert"] = &Setting{"whether to post newly published CVEs in the channel",
+		"true|false",
+		"false",
+		validateSettingBool}
 }
 
-func cmdCve(r Recipient, chName string, args []string) (result string) {
-	input := strings.Join(args, " ")
-	cves := args
-	if len(cves) != 1 {
-		result = "Usage: " + COMMANDS["cve"].Usage
-		return
-	}
-
-	cve := strings.TrimSpace(cves[0])
+func cmdCve(ctx context.Context, r Recipient, chName string, args []string) (result string) {
+	input := args[0]
+	cve := strings.TrimSpace(input)
 
 	if !strings.HasPrefix(cve, "CVE-") {
 		cve = fmt.Sprintf("CVE-%s", cve)
 	}
 
-	if c, found := ALL_CVES[cve]; found {
+	if c, found := getCVE(cve); found {
 		result = formatCVEData(c)
 		return
 	}
 
 	theUrl := fmt.Sprintf("%s%s.json", COMMANDS["cve"].How, cve)
-	data := getURLContents(theUrl, nil)
+	data, err := getURLContents(ctx, theUrl, nil)
+	if err != nil && !isFetchNotFound(err) {
+		result = fmt.Sprintf("Unable to fetch cveapi data: %s\n", err)
+		return
+	}
 
 	var cveData CVEItem
-	err := json.Unmarshal(data, &cveData)
+	err = json.Unmarshal(data, &cveData)
 	if err != nil {
 		if strings.HasPrefix(err.Error(), "invalid character") {
 			result = fmt.Sprintf("No CVE data found for '%s'.\n", input)
@@ -144,8 +152,8 @@ func cmdCve(r Recipient, chName string, args []string) (result string) {
 	return
 }
 
-func cveAlert(chInfo Channel) {
-	cve_alert, found := chInfo.Settings["cve-alert"]
+func cveAlert(chInfo *Channel) {
+	cve_alert, found := getSetting(chInfo, "cve-alert")
 	if !found {
 		return
 	}
@@ -155,10 +163,10 @@ func cveAlert(chInfo Channel) {
 		return
 	}
 
-	r := getRecipientFromMessage(fmt.Sprintf("%s@%s", CONFIG["mentionName"], chInfo.Id), "slack")
+	r := getChannelRecipient(chInfo)
 	v, err := strconv.ParseBool(cve_alert)
 
-	verbose(3, "Running cve-alert in '%s' (%v)...", chInfo.Name, v)
+	CVE_LOG.Debug("running cve-alert", "channel", chInfo.Name, "enabled", v)
 	if err != nil {
 		msg := fmt.Sprintf("'cve-alert' setting '%s' invalid.\n", cve_alert)
 		msg += "Please change via '!set cve-alert=<0|1|true|false>'."
@@ -168,27 +176,14 @@ func cveAlert(chInfo Channel) {
 		return
 	}
 
-	silent := false
-	count := 0
-	for id, cve := range ALL_CVES {
-		if _, found := chInfo.CVEs[id]; found {
-			continue
-		} else {
-			chInfo.CVEs[id] = cve
-		}
-
-		count++
-		if count > MAX_NEW_CVES {
-			if !silent {
-				reply(r, "...\n")
-			}
-			silent = true
-		}
-
-		msg := formatCVEData(cve)
-		if !silent {
-			reply(r, msg)
+	incrementMetric("jbot_alert_runs_total", "cve-alert")
+	cves := newCVEs(chInfo)
+	for i, cve := range cves {
+		if i >= MAX_NEW_CVES {
+			reply(r, fmt.Sprintf("%d more CVEs suppressed.", len(cves)-i))
+			break
 		}
+		replyBulk(r, "CVEs", formatCVEData(cve))
 	}
 }
 
@@ -227,15 +222,21 @@ func formatCVEData(cve CVEItem) (msg string) {
 }
 
 func updateCVEData() {
-	verbose(2, "Updating CVE Data...")
+	CVE_LOG.Debug("updating CVE data")
 
-	data := getURLContents(URLS["cvefeed"], nil)
+	ctx, cancel := context.WithTimeout(context.Background(), CVE_FEED_TIMEOUT*time.Second)
+	defer cancel()
+
+	data, err := getURLContents(ctx, URLS["cvefeed"], nil)
+	if err != nil {
+		CVE_LOG.Error("unable to fetch NVD CVE feed", "err", err)
+		return
+	}
 
 	b := bytes.NewReader(data)
 	gz, err := gzip.NewReader(b)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to create a new gzip reader: %s\n",
-			err)
+		CVE_LOG.Error("unable to create a new gzip reader", "err", err)
 		return
 	}
 	defer gz.Close()
@@ -243,14 +244,12 @@ func updateCVEData() {
 	var nvdfeed NvdFeed
 	err = json.NewDecoder(gz).Decode(&nvdfeed)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to unmarshal NVD CVE Feed data: %s\n", err)
+		CVE_LOG.Error("unable to unmarshal NVD CVE feed data", "err", err)
 		return
 	}
 
 	for _, cve := range nvdfeed.CVEItems {
 		id := cve.CVE.CVE_data_meta.ID
-		if _, found := ALL_CVES[id]; !found {
-			ALL_CVES[id] = cve
-		}
+		addCVE(id, cve)
 	}
 }
@@ -2,7 +2,7 @@
  * '!delete' command, letting the user ask the bot to
  * delete one of its messages.
  *
- * Note: only the botowner can ask the bot to delete
+ * Note: only bot admins can ask the bot to delete
  * its own messages.
  *
  * Usage:
@@ -12,19 +12,23 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"regexp"
 )
 
 func init() {
 	COMMANDS["delete"] = &Command{cmdDelete,
-		"delete a slack message (only available to the bot owner)",
+		"delete a slack message (only available to bot admins)",
 		"Slack API",
-		"!delete URL",
-		nil}
+		"",
+		nil,
+		[]Arg{
+			{Name: "url", Required: true, Help: "the message's link, e.g. https://foo.slack.com/archives/<channelID>/p..."},
+		}}
 }
 
-func cmdDelete(r Recipient, chName string, args []string) (result string) {
+func cmdDelete(ctx context.Context, r Recipient, chName string, args []string) (result string) {
 
 	/* If this command fails, somehow we get the
 	 * same command delivered to us by the API as
@@ -34,15 +38,7 @@ func cmdDelete(r Recipient, chName string, args []string) (result string) {
 	if len(r.MentionName) < 1 {
 		return
 	}
-	if CONFIG["botOwner"] != r.MentionName {
-		result = fmt.Sprintf("Sorry, %s is not allowed to run this command.", r.MentionName)
-		return
-	}
 
-	if len(args) < 1 {
-		result = "Usage: " + COMMANDS["delete"].Usage
-		return
-	}
 	input := args[0]
 
 	/* The URL given should be of the format:
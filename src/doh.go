@@ -9,6 +9,7 @@
 package main
 
 import (
+	"context"
 	"strings"
 )
 
@@ -16,37 +17,17 @@ func init() {
 	COMMANDS["doh"] = &Command{cmdDoh,
 		"display DNS-over-HTTPS results from a few providers",
 		"puddy(1)",
-		"!doh [-c country] name [type]",
-		nil}
+		"",
+		nil,
+		[]Arg{
+			{Name: "country", Flag: "c"},
+			{Name: "name", Required: true},
+			{Name: "type"},
+		}}
 }
 
-func cmdDoh(r Recipient, chName string, args []string) (result string) {
-	if len(args) < 1 {
-		result = "Usage: " + COMMANDS["doh"].Usage
-		return
-	}
-
-	var country string
-	var name string
-	var rrtype string
-	if args[0] == "-c" {
-		if len(args) < 3 {
-			result = "'-c' requires an argument in addition to the name to look up."
-			return
-		}
-		country = args[1]
-		args = args[2:]
-	}
-
-	if len(args) > 2 {
-		result = "Usage: " + COMMANDS["doh"].Usage
-		return
-	}
-
-	name = args[0]
-	if len(args) > 1 {
-		rrtype = args[1]
-	}
+func cmdDoh(ctx context.Context, r Recipient, chName string, args []string) (result string) {
+	country, name, rrtype := args[0], args[1], args[2]
 
 	/* Just in case Slack turned the name into URL. */
 	name = strings.TrimPrefix(name, "https://")
@@ -61,7 +42,7 @@ func cmdDoh(r Recipient, chName string, args []string) (result string) {
 		cmd += " " + rrtype
 	}
 
-	out, _ := runCommand(cmd)
+	out, _ := runCommand(ctx, cmd)
 	result = string(out)
 
 	return
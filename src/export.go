@@ -0,0 +1,192 @@
+/* This file contains functionality around
+ * exporting and importing the bot's state as JSON, so
+ * that it can be inspected, hand-edited, backed up or
+ * moved to another host.
+ *
+ * Usage:
+ * jbot -export state.json [-channels foo,bar]
+ * jbot -import state.json [-channels foo,bar]
+ *
+ * Use '-' for stdout / stdin.  Counters and bot
+ * admins are global, so they are only exported /
+ * imported if no channels are selected.  Importing replaces the
+ * given channels and counters, but leaves all others
+ * alone.  jbot must not be running at the same time.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+const EXPORT_VERSION = 1
+
+/* Set via '-export', '-import' and '-channels'. */
+var EXPORT_FILE string
+var IMPORT_FILE string
+var EXPORT_CHANNELS []string
+
+type ExportedState struct {
+	Version  int
+	Channels map[string]*Channel
+	Counters map[string]map[string]int `json:",omitempty"`
+	Admins   map[string]RoleGrant      `json:",omitempty"`
+}
+
+func exportState() {
+	state := ExportedState{EXPORT_VERSION, map[string]*Channel{}, nil, nil}
+
+	names, err := selectExportChannels(CHANNELS)
+	if err != nil {
+		fail("%s\n", err)
+	}
+	for _, n := range names {
+		state.Channels[n] = CHANNELS[n]
+	}
+	if len(EXPORT_CHANNELS) < 1 {
+		state.Counters = COUNTERS
+		state.Admins = ADMINS
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		fail("Unable to encode state: %s\n", err)
+	}
+	data = append(data, '\n')
+
+	if EXPORT_FILE == "-" {
+		_, err = os.Stdout.Write(data)
+	} else {
+		err = ioutil.WriteFile(EXPORT_FILE, data, 0600)
+	}
+	if err != nil {
+		fail("Unable to write '%s': %s\n", EXPORT_FILE, err)
+	}
+
+	STORE_LOG.Info("exported state", "channels", len(state.Channels), "file", EXPORT_FILE)
+}
+
+func importState() {
+	var data []byte
+	var err error
+	if IMPORT_FILE == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(IMPORT_FILE)
+	}
+	if err != nil {
+		fail("Unable to read '%s': %s\n", IMPORT_FILE, err)
+	}
+
+	var state ExportedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		fail("Unable to parse '%s': %s\n", IMPORT_FILE, err)
+	}
+	if state.Version != EXPORT_VERSION {
+		fail("Unsupported version %d in '%s' (expected %d).\n",
+			state.Version, IMPORT_FILE, EXPORT_VERSION)
+	}
+
+	names, err := selectExportChannels(state.Channels)
+	if err != nil {
+		fail("%s\n", err)
+	}
+	for _, n := range names {
+		ch := state.Channels[n]
+		if ch == nil {
+			fail("Invalid (empty) channel '%s' in '%s'.\n", n, IMPORT_FILE)
+		}
+		if len(ch.Name) < 1 {
+			ch.Name = n
+		} else if ch.Name != n {
+			fail("Channel '%s' in '%s' has name '%s'.\n", n, IMPORT_FILE, ch.Name)
+		}
+
+		/* Hand-edited files may well omit these. */
+		if ch.Settings == nil {
+			ch.Settings = map[string]string{}
+		}
+		if ch.Throttles == nil {
+			ch.Throttles = map[string]time.Time{}
+		}
+		if ch.Toggles == nil {
+			ch.Toggles = map[string]bool{}
+		}
+		for t, v := range TOGGLES {
+			if _, found := ch.Toggles[t]; !found {
+				ch.Toggles[t] = v
+			}
+		}
+		if ch.CVEs == nil {
+			ch.CVEs = map[string]CVEItem{}
+		}
+		if ch.Phishy == nil {
+			ch.Phishy = &PhishCount{0, 0, time.Now(), time.Unix(0, 0)}
+		}
+
+		STORE_LOG.Debug("importing channel", "channel", n)
+		CHANNELS[n] = ch
+	}
+
+	if len(EXPORT_CHANNELS) < 1 {
+		for name, c := range state.Counters {
+			STORE_LOG.Debug("importing counter", "counter", name)
+			COUNTERS[name] = c
+		}
+		if state.Admins != nil {
+			ADMINS = state.Admins
+		}
+	}
+
+	if err := storeSave(); err != nil {
+		fail("Unable to write data to '%s': %s\n", getConfig("stateDB"), err)
+	}
+
+	STORE_LOG.Info("imported state", "channels", len(names), "file", IMPORT_FILE)
+}
+
+/* Export and import only touch the state database
+ * and then exit. */
+func runExportImport() {
+	readSavedData()
+
+	if len(EXPORT_FILE) > 0 {
+		exportState()
+	} else {
+		importState()
+	}
+
+	STORE_DB.Close()
+	os.Exit(EXIT_SUCCESS)
+}
+
+/* Returns the names of the selected channels, or all
+ * channels if none were selected. */
+func selectExportChannels(channels map[string]*Channel) (names []string, err error) {
+	if len(EXPORT_CHANNELS) < 1 {
+		for n := range channels {
+			names = append(names, n)
+		}
+		return
+	}
+
+	var missing []string
+	for _, n := range EXPORT_CHANNELS {
+		if _, found := channels[n]; !found {
+			missing = append(missing, n)
+			continue
+		}
+		names = append(names, n)
+	}
+
+	if len(missing) > 0 {
+		err = fmt.Errorf("No such channel(s): %s", strings.Join(missing, ", "))
+	}
+	return
+}
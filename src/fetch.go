@@ -0,0 +1,326 @@
+/* This file contains functionality around
+ * fetching URLs: all commands and alerts that need
+ * data from the web go through getURLContents().
+ *
+ * Every attempt is limited to 'httpTimeout' (and the
+ * command's own deadline); connection errors and
+ * 429, 502, 503 and 504 responses are retried up to
+ * FETCH_RETRIES times with exponential backoff,
+ * honoring 'Retry-After'.  Responses larger than
+ * FETCH_MAX_SIZE are rejected.
+ *
+ * Requests go through 'httpProxy' if set, otherwise
+ * through the proxy given in the environment
+ * (HTTPS_PROXY, HTTP_PROXY, NO_PROXY), if any.
+ *
+ * Errors never include the URL's query string, as
+ * that may contain API keys.
+ *
+ * Responses can be cached; see src/cache.go.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const FETCH_BROWSER_UA = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_13_2) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/63.0.3239.132 Safari/537.36"
+const FETCH_MAX_SIZE = 32 * 1024 * 1024
+const FETCH_RETRIES = 2
+const FETCH_USER_AGENT = "jbot/" + VERSION
+
+/* Backoff starts at FETCH_RETRY_DELAY and doubles;
+ * we don't wait longer than FETCH_RETRY_MAX, even if
+ * 'Retry-After' asks us to. */
+const FETCH_RETRY_DELAY = 500 * time.Millisecond
+const FETCH_RETRY_MAX = 30 * time.Second
+
+var FETCH_LOG = newLogger("fetch")
+
+var FETCH_CLIENT = &http.Client{Transport: newFetchTransport(nil)}
+
+/* Clients presenting our x509 cert, by cert/key
+ * file names, so that reloading the config with new
+ * files picks them up; emptied on reload so that
+ * renewed files under the same names are re-read. */
+var FETCH_X509_LOCK sync.Mutex
+var FETCH_X509_CLIENTS = map[string]*http.Client{}
+
+/* Returned (along with the body) for non-2xx
+ * responses. */
+type FetchStatusError struct {
+	URL    string
+	Status string
+	Code   int
+}
+
+func (e *FetchStatusError) Error() string {
+	return fmt.Sprintf("%s: %s", e.URL, e.Status)
+}
+
+/* Returns the client to use for the given request
+ * arguments. */
+func fetchClient(args map[string]string) (*http.Client, error) {
+	if args["auth"] != "x509" {
+		return FETCH_CLIENT, nil
+	}
+
+	certFile, keyFile := getConfig("x509Cert"), getConfig("x509Key")
+	if len(certFile) < 1 || len(keyFile) < 1 {
+		return nil, fmt.Errorf("x509 client cert required, but 'x509Cert' / 'x509Key' not set")
+	}
+
+	FETCH_X509_LOCK.Lock()
+	defer FETCH_X509_LOCK.Unlock()
+
+	key := certFile + "\x00" + keyFile
+	if client, found := FETCH_X509_CLIENTS[key]; found {
+		return client, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load x509 client cert: %s", err)
+	}
+
+	client := &http.Client{Transport: newFetchTransport(&cert)}
+	FETCH_X509_CLIENTS[key] = client
+	return client, nil
+}
+
+func fetchProxy(req *http.Request) (*url.URL, error) {
+	if len(getConfig("httpProxy")) > 0 {
+		return url.Parse(getConfig("httpProxy"))
+	}
+	return http.ProxyFromEnvironment(req)
+}
+
+/* How long to wait before the given (0-based)
+ * retry of a request that got 'resp'. */
+func fetchRetryDelay(attempt int, resp *http.Response) (delay time.Duration) {
+	delay = FETCH_RETRY_DELAY << uint(attempt)
+	if resp != nil {
+		if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s >= 0 {
+			delay = time.Duration(s) * time.Second
+		}
+	}
+	if delay > FETCH_RETRY_MAX {
+		delay = FETCH_RETRY_MAX
+	}
+	return
+}
+
+/* The URL without query string, fragment or
+ * password, for errors and logging. */
+func fetchSafeURL(u *url.URL) string {
+	safe := *u
+	safe.RawQuery = ""
+	safe.Fragment = ""
+	if safe.User != nil {
+		safe.User = url.User(safe.User.Username())
+	}
+	return safe.String()
+}
+
+/* Performs a single attempt; 'retry' is set if the
+ * request may be retried. */
+func fetchURL(ctx context.Context, client *http.Client, req *http.Request, safeURL string) (data []byte, resp *http.Response, retry bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, configDuration("httpTimeout"))
+	defer cancel()
+
+	resp, err = client.Do(req.WithContext(ctx))
+	if err != nil {
+		/* url.Error includes the full URL. */
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		retry = req.Context().Err() == nil
+		err = fmt.Errorf("%s: %s", safeURL, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	data, err = io.ReadAll(io.LimitReader(resp.Body, FETCH_MAX_SIZE+1))
+	if err != nil {
+		retry = req.Context().Err() == nil
+		err = fmt.Errorf("%s: unable to read body: %s", safeURL, err)
+		return
+	}
+	if len(data) > FETCH_MAX_SIZE {
+		data = nil
+		err = fmt.Errorf("%s: response larger than %d bytes", safeURL, FETCH_MAX_SIZE)
+		return
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		switch resp.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			retry = true
+		}
+		err = &FetchStatusError{safeURL, resp.Status, resp.StatusCode}
+	}
+	return
+}
+
+/* Fetches the given URL via GET and returns the
+ * body.  For non-2xx responses, the body is returned
+ * along with a *FetchStatusError, as some APIs
+ * explain themselves there.
+ *
+ * Additional arguments can influence how the request is made:
+ * - if args["auth"] is "x509", then the URL requires x509 client a cert / key
+ *   from 'x509Cert' and 'x509Key'
+ * - if args["ua"] is "true", then we fake a browser User-Agent
+ * - if args["basic-auth-user"] is set, use that username for basic HTTP auth
+ * - if args["basic-auth-password"] is set, use that password for basic HTTP auth
+ * - if args["cache"] is set, cache the response under that source, e.g. "airports"
+ * - any other args are set as headers, e.g. args["Authorization"]
+ */
+func getURLContents(ctx context.Context, givenURL string, args map[string]string) (data []byte, err error) {
+	u, err := url.Parse(givenURL)
+	if err != nil {
+		err = fmt.Errorf("invalid URL")
+		return
+	}
+	safeURL := fetchSafeURL(u)
+
+	client, err := fetchClient(args)
+	if err != nil {
+		FETCH_LOG.WarnContext(ctx, "unable to set up client", "url", safeURL, "err", err)
+		return
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", givenURL, nil)
+	if err != nil {
+		err = fmt.Errorf("%s: %s", safeURL, err)
+		return
+	}
+
+	req.Header.Set("User-Agent", FETCH_USER_AGENT)
+
+	var ba_user string
+	var ba_pass string
+
+	for key, val := range args {
+		switch key {
+		case "auth", "cache":
+		case "ua":
+			if val == "true" {
+				req.Header.Set("User-Agent", FETCH_BROWSER_UA)
+			}
+		case "basic-auth-user":
+			ba_user = val
+		case "basic-auth-password":
+			ba_pass = val
+		default:
+			req.Header.Set(key, val)
+		}
+	}
+
+	if len(ba_user) > 0 {
+		req.SetBasicAuth(ba_user, ba_pass)
+	}
+
+	source := args["cache"]
+	if fetchCacheTTL(source) <= 0 {
+		source = ""
+	}
+
+	var cached FetchCacheEntry
+	var isCached bool
+	if len(source) > 0 {
+		var fresh bool
+		cached, isCached, fresh = fetchCacheLookup(source, givenURL)
+		if fresh {
+			FETCH_LOG.DebugContext(ctx, "cache hit", "source", source, "url", safeURL)
+			data = cached.Data
+			return
+		}
+		if len(cached.ETag) > 0 {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if len(cached.LastModified) > 0 {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+
+	var resp *http.Response
+	for attempt := 0; ; attempt++ {
+		FETCH_LOG.DebugContext(ctx, "fetching url", "url", safeURL, "attempt", attempt+1)
+
+		var retry bool
+		data, resp, retry, err = fetchURL(ctx, client, req, safeURL)
+		if err == nil || !retry || attempt >= FETCH_RETRIES {
+			break
+		}
+
+		delay := fetchRetryDelay(attempt, resp)
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			break
+		}
+
+		FETCH_LOG.DebugContext(ctx, "retrying", "url", safeURL, "err", err, "delay", delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	if len(source) > 0 {
+		var serr *FetchStatusError
+		if isCached && errors.As(err, &serr) && serr.Code == http.StatusNotModified {
+			FETCH_LOG.DebugContext(ctx, "cache revalidated", "source", source, "url", safeURL)
+			fetchCacheRevalidated(source, givenURL, resp)
+			data, err = cached.Data, nil
+		} else if err == nil {
+			fetchCacheStore(source, givenURL, safeURL, data, resp)
+		}
+	}
+
+	if err != nil {
+		FETCH_LOG.WarnContext(ctx, "unable to fetch url", "err", err)
+	}
+	return
+}
+
+/* Lookups can treat a 404 like a page without the
+ * data they're looking for. */
+func isFetchNotFound(err error) bool {
+	var serr *FetchStatusError
+	return errors.As(err, &serr) && serr.Code == http.StatusNotFound
+}
+
+/* Whether err is (only) about the response status,
+ * i.e. we did get a body. */
+func isFetchStatusError(err error) bool {
+	var serr *FetchStatusError
+	return errors.As(err, &serr)
+}
+
+func newFetchTransport(cert *tls.Certificate) http.RoundTripper {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = fetchProxy
+	if cert != nil {
+		t.TLSClientConfig = &tls.Config{Certificates: []tls.Certificate{*cert}}
+	}
+	return &MetricsTransport{t}
+}
+
+func resetFetchClients() {
+	FETCH_X509_LOCK.Lock()
+	FETCH_X509_CLIENTS = map[string]*http.Client{}
+	FETCH_X509_LOCK.Unlock()
+}
@@ -7,6 +7,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"regexp"
 	"strings"
@@ -19,24 +20,26 @@ func init() {
 	COMMANDS["airport"] = &Command{cmdAirport,
 		"try to determine the airport location",
 		WIKI_AIRPORT_URL,
-		"!airport <code>",
+		"",
 		nil,
+		[]Arg{
+			{Name: "code", Required: true},
+		},
 	}
 	COMMANDS["flight"] = &Command{cmdFlight,
 		"display carbon emissions for the given flight",
 		TRAVELNAV_URL,
-		"!flight <from> <to>",
+		"",
 		[]string{":airplane:", "✈️"},
+		[]Arg{
+			{Name: "from", Required: true},
+			{Name: "to", Required: true},
+		},
 	}
 }
 
-func cmdAirport(r Recipient, chName string, args []string) (result string) {
-	if len(args) != 1 {
-		result = "Usage: " + COMMANDS["airport"].Usage
-		return
-	}
-
-	result = lookupAirportDetails(args[0])
+func cmdAirport(ctx context.Context, r Recipient, chName string, args []string) (result string) {
+	result = lookupAirportDetails(ctx, args[0])
 	if result == args[0] {
 		result = "Sorry, I'm unable to find the airport code " + args[0] + "."
 	}
@@ -44,18 +47,17 @@ func cmdAirport(r Recipient, chName string, args []string) (result string) {
 	return
 }
 
-func cmdFlight(r Recipient, chName string, args []string) (result string) {
-	if len(args) != 2 {
-		result = "Usage: " + COMMANDS["flight"].Usage
-		return
-	}
-
+func cmdFlight(ctx context.Context, r Recipient, chName string, args []string) (result string) {
 	from := strings.ToLower(strings.TrimSpace(args[0]))
 	to := strings.ToLower(strings.TrimSpace(args[1]))
 
 	theURL := strings.Replace(TRAVELNAV_URL, "<from>", from, -1)
 	theURL = strings.Replace(theURL, "<to>", to, -1)
-	data := getURLContents(theURL, nil)
+	data, err := getURLContents(ctx, theURL, nil)
+	if err != nil {
+		result = fmt.Sprintf("Unable to look up carbon emissions: %s", err)
+		return
+	}
 
 	lb_re := regexp.MustCompile(`&nbsp;<strong>([0-9,]+)</strong> lbs CO2</h2>`)
 	kg_re := regexp.MustCompile(`&nbsp;<strong>([0-9,]+)</strong> kg CO2e</h2>`)
@@ -76,8 +78,8 @@ func cmdFlight(r Recipient, chName string, args []string) (result string) {
 	if len(result) < 1 {
 		result = fmt.Sprintf("Sorry, I couldn't determine the carbon emissions for a flight from '%s' to '%s'.", from, to)
 	} else {
-		from = lookupAirportDetails(from)
-		to = lookupAirportDetails(to)
+		from = lookupAirportDetails(ctx, from)
+		to = lookupAirportDetails(ctx, to)
 		result = "Carbon emissions for a flight from " + from +
 			" to " + to + ": " + result
 	}
@@ -85,7 +87,7 @@ func cmdFlight(r Recipient, chName string, args []string) (result string) {
 	return
 }
 
-func lookupAirportDetails(code string) (result string) {
+func lookupAirportDetails(ctx context.Context, code string) (result string) {
 	if len(code) < 1 {
 		return
 	}
@@ -93,7 +95,11 @@ func lookupAirportDetails(code string) (result string) {
 	code = strings.ToUpper(code)
 	wikiURL := "https://en.wikipedia.org/wiki/List_of_airports_by_IATA_code:_"
 	wikiURL += string(code[0])
-	data := getURLContents(wikiURL, nil)
+	data, err := getURLContents(ctx, wikiURL, map[string]string{"cache": "airports"})
+	if err != nil {
+		return code
+	}
+
 	n := 0
 	table_entry := fmt.Sprintf("<td>%s</td>", code)
 	sup_re := regexp.MustCompile(`<sup .+?</sup>`)
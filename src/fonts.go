@@ -11,9 +11,9 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"sort"
-	"strings"
 )
 
 type FontFunc func(string) string
@@ -34,17 +34,39 @@ func init() {
 	COMMANDS["font"] = &Command{cmdFont,
 		"change the font used by jbot",
 		"builtin",
-		"!font <fontname>",
-		nil}
+		"",
+		nil,
+		[]Arg{
+			{Name: "fontname", Help: "omit to see the fonts I know"},
+		}}
 	COMMANDS["rot13"] = &Command{cmdRot13,
 		"encrypt input using a military grade cipher",
 		"builtin",
-		"!rot13 <text>",
-		nil}
+		"",
+		nil,
+		[]Arg{
+			{Name: "text", Type: ARG_TEXT, Required: true},
+		}}
+	SETTINGS["font"] = &Setting{"the font I use in the channel; see '!font'",
+		"<fontname>",
+		"normal",
+		func(value string) error {
+			if _, found := FONTS[value]; !found {
+				return fmt.Errorf("unknown font '%s'", value)
+			}
+			return nil
+		}}
 }
 
-func cmdFont(r Recipient, chName string, args []string) (result string) {
-	result = "Usage: " + COMMANDS["font"].Usage + "\n"
+func cmdFont(ctx context.Context, r Recipient, chName string, args []string) (result string) {
+	if _, found := FONTS[args[0]]; found {
+		result = cmdSet(ctx, r, chName, commandArgs("set", "font="+args[0]))
+		return
+	}
+
+	if len(args[0]) > 0 {
+		result = fmt.Sprintf("Unknown font '%s'.\n", args[0])
+	}
 	result += "I know the following fonts:\n"
 
 	fontKeys := []string{}
@@ -58,26 +80,11 @@ func cmdFont(r Recipient, chName string, args []string) (result string) {
 		fontFunc := FONTS[font]
 		result += fmt.Sprintf("%s: %s\n", font, fontFunc("The quick brown fox jumps over the lazy dog."))
 	}
-
-	if len(args) < 1 {
-		return
-	}
-
-	if _, found := FONTS[args[0]]; !found {
-		return
-	}
-
-	result = cmdSet(r, chName, []string{"font=" + args[0]})
 	return
 }
 
-func cmdRot13(r Recipient, chName string, args []string) (result string) {
-	if len(args) < 1 {
-		result = "Usage: " + COMMANDS["rot13"].Usage + "\n"
-		return
-	}
-
-	result = rot13Text(strings.Join(args, " "))
+func cmdRot13(ctx context.Context, r Recipient, chName string, args []string) (result string) {
+	result = rot13Text(args[0])
 	return
 }
 
@@ -96,12 +103,12 @@ func fill(in, space string, fontMap map[int]rune) (out string) {
 func fontFormat(channelName, msg string) (out string) {
 	out = msg
 
-	ch, found := CHANNELS[channelName]
+	ch, found := getChannelByName(channelName)
 	if !found {
 		return
 	}
 
-	fontSetting, found := ch.Settings["font"]
+	fontSetting, found := getSetting(ch, "font")
 	if !found {
 		return
 	}
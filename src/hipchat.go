@@ -0,0 +1,281 @@
+/* This file contains functionality around the
+ * HipChat chat backend: connecting to the HipChat
+ * XMPP service, processing incoming messages, and
+ * keeping track of rooms and the user roster. */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/daneharrigan/hipchat"
+)
+
+var HIPCHAT_CLIENT *hipchat.Client
+var HIPCHAT_LOG = newLogger("hipchat")
+var HIPCHAT_ROOMS = map[string]*hipchat.Room{}
+var HIPCHAT_ROSTER = map[string]*hipchat.User{}
+
+type HipChatBackend struct{}
+
+func init() {
+	BACKENDS["hipchat"] = &HipChatBackend{}
+}
+
+func (b *HipChatBackend) Enabled() bool {
+	return backendEnabled("hipchat")
+}
+
+func (b *HipChatBackend) Connect() (err error) {
+	user := strings.Split(getConfig("hcJabberID"), "@")[0]
+
+	authType := "plain"
+	pass := getConfig("hcPassword")
+	if len(pass) < 1 {
+		authType = "oauth"
+		pass = getConfig("hcOauthToken")
+	}
+
+	HIPCHAT_CLIENT, err = hipchat.NewClient(user, pass, "bot", authType)
+	if err != nil {
+		return
+	}
+
+	HIPCHAT_CLIENT.Status("chat")
+	HIPCHAT_CLIENT.RequestUsers()
+	HIPCHAT_CLIENT.RequestRooms()
+
+	for _, ch := range channelList() {
+		if ch.Type != "hipchat" {
+			continue
+		}
+
+		HIPCHAT_LOG.Info("joining channel", "channel", ch.Name)
+		HIPCHAT_CLIENT.Join(ch.Id, getConfig("fullName"))
+
+		/* Our state file might not contain
+		 * the changed structures, so explicitly
+		 * fix things here. */
+		STATE_LOCK.Lock()
+		if len(ch.HipChatUsers) < 1 {
+			ch.HipChatUsers = make(map[hipchat.User]UserInfo, 0)
+		}
+
+		for t, v := range TOGGLES {
+			if len(ch.Toggles) == 0 {
+				ch.Toggles = map[string]bool{}
+			}
+			if _, found := ch.Toggles[t]; !found {
+				ch.Toggles[t] = v
+			}
+		}
+		STATE_LOCK.Unlock()
+	}
+
+	go hcPeriodics()
+	go HIPCHAT_CLIENT.KeepAlive()
+
+	return
+}
+
+func (b *HipChatBackend) Receive() {
+	for {
+		select {
+		case message := <-HIPCHAT_CLIENT.Messages():
+			handleEvent("hipchat", func() error {
+				processHipChatMessage(message)
+				return nil
+			})
+		case users := <-HIPCHAT_CLIENT.Users():
+			handleEvent("hipchat", func() error {
+				updateRoster(users)
+				return nil
+			})
+		case rooms := <-HIPCHAT_CLIENT.Rooms():
+			handleEvent("hipchat", func() error {
+				updateHipChatRooms(rooms)
+				return nil
+			})
+		}
+	}
+}
+
+func (b *HipChatBackend) Healthy() error {
+	if HIPCHAT_CLIENT == nil {
+		return fmt.Errorf("not connected")
+	}
+	return nil
+}
+
+func (b *HipChatBackend) Send(r Recipient, msg string) {
+	if _, found := getChannelByName(r.ReplyTo); found {
+		HIPCHAT_CLIENT.Say(r.Id, getConfig("fullName"), msg)
+	} else {
+		HIPCHAT_CLIENT.PrivSay(r.Id, getConfig("fullName"), msg)
+	}
+}
+
+/* Format is "12345_98765@conf.hipchat.com/John Doe". */
+func (b *HipChatBackend) ResolveUser(mfrom string) (r Recipient) {
+	r.ChatType = "hipchat"
+	from := strings.Split(mfrom, "/")
+	r.Id = from[0]
+	r.ReplyTo = strings.SplitN(strings.Split(r.Id, "@")[0], "_", 2)[1]
+	r.Name = ""
+	r.MentionName = ""
+
+	if len(from) > 1 {
+		r.Name = from[1]
+	}
+
+	if len(r.Name) > 1 {
+		if u := findHipChatUser(r.Name); u != nil {
+			r.MentionName = u.MentionName
+		}
+	}
+
+	return
+}
+
+func (b *HipChatBackend) ResolveChannel(id string) string {
+	return id
+}
+
+func (b *HipChatBackend) Leave(r Recipient, ch *Channel) {
+	HIPCHAT_CLIENT.Part(r.Id, getConfig("fullName"))
+	deleteChannel(r.ReplyTo)
+}
+
+func (b *HipChatBackend) ChannelRecipient(ch *Channel) (r Recipient) {
+	r.ChatType = "hipchat"
+	r.Id = ch.Id
+	r.ReplyTo = ch.Name
+	return
+}
+
+func (b *HipChatBackend) SeenUsers(ch *Channel) (users map[string]UserInfo) {
+	users = map[string]UserInfo{}
+	for hc, u := range ch.HipChatUsers {
+		users[hc.MentionName] = u
+	}
+	return
+}
+
+func (b *HipChatBackend) UpdateSeenUser(ch *Channel, r Recipient, uInfo UserInfo) {
+	u := findHipChatUser(r.Name)
+	if u == nil {
+		return
+	}
+	if len(ch.HipChatUsers) < 1 {
+		ch.HipChatUsers = make(map[hipchat.User]UserInfo, 0)
+	}
+	ch.HipChatUsers[*u] = uInfo
+}
+
+func findHipChatUser(name string) *hipchat.User {
+	for _, u := range HIPCHAT_ROSTER {
+		if u.Name == name {
+			return u
+		}
+	}
+	return nil
+}
+
+func hcPeriodics() {
+	for _ = range time.Tick(PERIODICS * time.Second) {
+		HIPCHAT_CLIENT.Status("chat")
+		HIPCHAT_CLIENT.RequestUsers()
+		HIPCHAT_CLIENT.RequestRooms()
+
+		if len(getConfig("hcControlChannel")) > 0 {
+			r := getRecipientFromMessage(getConfig("hcControlChannel"), "hipchat")
+			HIPCHAT_CLIENT.Say(r.Id, getConfig("fullName"), "ping")
+		}
+	}
+}
+
+func newHipChatChannel(name, id, inviter string) (ch Channel) {
+	HIPCHAT_LOG.Debug("creating new channel", "channel", name)
+
+	ch.Toggles = map[string]bool{}
+	ch.Throttles = map[string]time.Time{}
+	ch.Settings = map[string]string{}
+	ch.Type = "hipchat"
+	ch.Id = id
+	ch.HipChatUsers = make(map[hipchat.User]UserInfo, 0)
+	ch.Inviter = inviter
+	ch.Name = name
+
+	for t, v := range TOGGLES {
+		ch.Toggles[t] = v
+	}
+
+	return
+}
+
+func processHipChatInvite(r Recipient, invite string) {
+	from := strings.Split(invite, "'")[1]
+	fr := getRecipientFromMessage(from, "hipchat")
+	inviter := strings.Split(fr.Id, "@")[0]
+	channelName := r.ReplyTo
+
+	inviterName := "Nobody"
+	if _, found := HIPCHAT_ROSTER[inviter]; found {
+		inviterName = HIPCHAT_ROSTER[inviter].MentionName
+	}
+	ch := newHipChatChannel(r.ReplyTo, r.Id, inviterName)
+
+	HIPCHAT_LOG.Info("invited into channel", "channel", channelName, "id", r.Id, "inviter", from)
+	addChannel(&ch)
+	HIPCHAT_LOG.Info("joining channel", "channel", ch.Name)
+	HIPCHAT_CLIENT.Join(r.Id, getConfig("fullName"))
+}
+
+func processHipChatMessage(message *hipchat.Message) {
+	if len(message.Body) < 1 {
+		/* If a user initiates a 1:1 dialog
+		 * with the bot, the hipchat client will send a ''
+		 * ping even if they try to close the
+		 * dialog.  If there is no data, we
+		 * have no business replying or doing
+		 * much of anything, so let's just
+		 * return. */
+		return
+	}
+
+	r := getRecipientFromMessage(message.From, "hipchat")
+	if r.Name == getConfig("fullName") {
+		//HIPCHAT_LOG.Debug("ignoring message from myself")
+		return
+	}
+
+	updateSeen(r, message.Body)
+
+	if strings.HasPrefix(message.Body, "<invite from") {
+		processHipChatInvite(r, message.Body)
+		return
+	}
+
+	if len(r.Name) < 1 && len(r.MentionName) < 1 {
+		HIPCHAT_LOG.Debug("ignoring channel topic message", "channel", r.ReplyTo, "topic", message.Body)
+		return
+	}
+
+	processMessage(context.Background(), r, message.Body)
+}
+
+func updateHipChatRooms(rooms []*hipchat.Room) {
+	for _, room := range rooms {
+		HIPCHAT_ROOMS[room.Id] = room
+	}
+}
+
+func updateRoster(users []*hipchat.User) {
+	for _, user := range users {
+		uid := strings.Split(user.Id, "@")[0]
+		HIPCHAT_ROSTER[uid] = user
+	}
+}
@@ -0,0 +1,184 @@
+/* This file contains functionality around a
+ * channel's History: who changed which setting,
+ * toggle or throttle when, from what to what.  The
+ * changes themselves are recorded by the functions
+ * in src/state.go.
+ *
+ * We keep the last CHANNEL_HISTORY_MAX changes per
+ * channel.  '!revert' restores the value a setting,
+ * toggle or throttle had before its last change;
+ * since the revert is itself recorded, reverting
+ * twice undoes the revert.
+ *
+ * Usage:
+ * !history [<name>]
+ * !revert <name>
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const CHANGE_SETTING = "setting"
+const CHANGE_THROTTLE = "throttle"
+const CHANGE_TOGGLE = "toggle"
+
+const CHANNEL_HISTORY_MAX = 100
+const HISTORY_SHOW = 10
+
+/* Old is only meaningful if Existed; New is empty if
+ * Deleted.  Throttles are formatted via
+ * formatThrottle(). */
+type ChannelChange struct {
+	Time    time.Time
+	Who     string
+	Kind    string
+	Name    string
+	Old     string
+	Existed bool
+	New     string
+	Deleted bool
+}
+
+func init() {
+	COMMANDS["history"] = &Command{cmdHistory,
+		"show recent changes to this channel's settings, toggles and throttles",
+		"builtin",
+		"",
+		nil,
+		[]Arg{
+			{Name: "name"},
+		}}
+	COMMANDS["revert"] = &Command{cmdRevert,
+		"revert the last change to a setting, toggle or throttle",
+		"builtin",
+		"",
+		nil,
+		[]Arg{
+			{Name: "name", Required: true},
+		}}
+}
+
+func cmdHistory(ctx context.Context, r Recipient, chName string, args []string) (result string) {
+	ch, found := getChannelByName(chName)
+	if !found {
+		result = "I only keep history for channels."
+		return
+	}
+
+	var changes []ChannelChange
+	for _, c := range getHistory(ch) {
+		if len(args[0]) < 1 || c.Name == args[0] {
+			changes = append(changes, c)
+		}
+	}
+
+	if len(changes) < 1 {
+		if len(args[0]) > 0 {
+			result = fmt.Sprintf("No recorded changes to '%s' in #%s.", args[0], ch.Name)
+		} else {
+			result = fmt.Sprintf("No recorded changes in #%s.", ch.Name)
+		}
+		return
+	}
+
+	if len(changes) > HISTORY_SHOW {
+		changes = changes[len(changes)-HISTORY_SHOW:]
+	}
+
+	var lines []string
+	for _, c := range changes {
+		lines = append(lines, formatChannelChange(c))
+	}
+	result = strings.Join(lines, "\n")
+	return
+}
+
+func cmdRevert(ctx context.Context, r Recipient, chName string, args []string) (result string) {
+	name := args[0]
+
+	ch, found := getChannelByName(chName)
+	if !found {
+		result = "I can only revert things in a channel."
+		return
+	}
+
+	var last *ChannelChange
+	history := getHistory(ch)
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Name == name {
+			last = &history[i]
+			break
+		}
+	}
+	if last == nil {
+		result = fmt.Sprintf("No recorded changes to '%s' in #%s.", name, ch.Name)
+		return
+	}
+
+	switch last.Kind {
+	case CHANGE_SETTING:
+		if last.Existed {
+			setSetting(ch, name, last.Old, r.MentionName)
+			result = fmt.Sprintf("Reverted %s to '%s'.", name, last.Old)
+		} else {
+			unsetSetting(ch, name, r.MentionName)
+			result = fmt.Sprintf("Reverted %s by unsetting it.", name)
+		}
+	case CHANGE_THROTTLE:
+		if t, err := time.Parse(time.RFC3339, last.Old); last.Existed && err == nil {
+			setThrottle(ch, name, t, r.MentionName)
+			result = fmt.Sprintf("Reverted throttle %s to %s.", name, t.Format(time.UnixDate))
+		} else {
+			unsetThrottle(ch, name, r.MentionName)
+			result = fmt.Sprintf("Reverted throttle %s by unthrottling it.", name)
+		}
+	case CHANGE_TOGGLE:
+		enabled := last.Old == "true"
+		setToggle(ch, name, enabled, r.MentionName)
+		result = fmt.Sprintf("Reverted toggle %s to %v.", name, enabled)
+	default:
+		result = fmt.Sprintf("I don't know how to revert '%s'.", name)
+		return
+	}
+
+	LOG.InfoContext(ctx, "reverted change", "kind", last.Kind, "name", name,
+		"by", last.Who, "at", last.Time)
+	return
+}
+
+func formatChannelChange(c ChannelChange) (line string) {
+	line = c.Time.Format("2006-01-02 15:04 MST") + " " + c.Who + " "
+
+	switch c.Kind {
+	case CHANGE_SETTING:
+		if c.Deleted {
+			line += fmt.Sprintf("unset %s (was: %s)", c.Name, c.Old)
+		} else if c.Existed {
+			line += fmt.Sprintf("set %s=%s (was: %s)", c.Name, c.New, c.Old)
+		} else {
+			line += fmt.Sprintf("set %s=%s", c.Name, c.New)
+		}
+	case CHANGE_THROTTLE:
+		if c.Deleted {
+			line += fmt.Sprintf("unthrottled %s", c.Name)
+		} else {
+			line += fmt.Sprintf("throttled %s until %s", c.Name, c.New)
+		}
+	case CHANGE_TOGGLE:
+		line += fmt.Sprintf("set toggle %s to %s", c.Name, c.New)
+	}
+	return
+}
+
+func formatThrottle(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
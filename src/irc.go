@@ -0,0 +1,615 @@
+/* This file contains functionality around the
+ * IRC chat backend.  jbot started out on IRC (see
+ * old/irc/jbot.pl), and this brings it back: we
+ * connect (optionally via TLS), authenticate via
+ * SASL and/or NickServ, join the channels we know
+ * about, follow invites, and rejoin after being
+ * kicked or disconnected.
+ *
+ * Configuration:
+ *   ircServer           = host[:port] of the IRC server
+ *   ircTLS              = yes|no (default: yes)
+ *   ircNick             = the bot's nick (default: mentionName)
+ *   ircPassword         = server password (PASS), if any
+ *   ircSASLUser         = SASL PLAIN username, if any
+ *   ircSASLPassword     = SASL PLAIN password
+ *   ircNickServPassword = password to IDENTIFY to NickServ with
+ *   ircChannels         = comma-separated list of channels to join
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"math/rand"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+/* Per RFC1459, a message may be at most 512 bytes
+ * including the trailing CRLF.  When relaying our
+ * PRIVMSG, the server prepends our full hostmask,
+ * which we don't necessarily know, so we assume
+ * the maximum user and host lengths. */
+const IRC_MAX_LINE = 512
+const IRC_MAX_USERLEN = 10
+const IRC_MAX_HOSTLEN = 63
+
+/* Send at most this many lines in a burst before
+ * slowing down so as to not get kicked for
+ * flooding. */
+const IRC_FLOOD_LINES = 4
+
+const IRC_KICK_REJOIN_DELAY = 10
+const IRC_RECONNECT_DELAY = 60
+
+var IRC_CONN net.Conn
+var IRC_LOG = newLogger("irc")
+var IRC_LOCK sync.Mutex
+var IRC_NICK string
+
+type IRCMessage struct {
+	Prefix  string
+	Command string
+	Params  []string
+}
+
+type IRCBackend struct{}
+
+func init() {
+	BACKENDS["irc"] = &IRCBackend{}
+}
+
+func (b *IRCBackend) Enabled() bool {
+	return backendEnabled("irc")
+}
+
+func (b *IRCBackend) Connect() (err error) {
+	if err = ircConnect(); err != nil {
+		return
+	}
+
+	go ircPeriodics()
+	return
+}
+
+func (b *IRCBackend) Receive() {
+	for {
+		IRC_LOCK.Lock()
+		conn := IRC_CONN
+		IRC_LOCK.Unlock()
+
+		input := bufio.NewReader(conn)
+		for {
+			/* We PING the server every PERIODICS
+			 * seconds, so if we don't hear anything
+			 * for a while, the connection is dead. */
+			conn.SetReadDeadline(time.Now().Add(3 * PERIODICS * time.Second))
+			line, err := input.ReadString('\n')
+			if err != nil {
+				IRC_LOG.Error("unable to read from server", "err", err)
+				break
+			}
+			handleEvent("irc", func() error {
+				processIRCEvent(parseIRCMessage(line))
+				return nil
+			})
+		}
+		conn.Close()
+
+		IRC_LOCK.Lock()
+		IRC_CONN = nil
+		IRC_LOCK.Unlock()
+
+		/* As jbot.pl's bot_reconnect notes, it's
+		 * important to wait between connection
+		 * attempts, lest the server consider it
+		 * abuse. */
+		for {
+			IRC_LOG.Info("reconnecting", "delay", IRC_RECONNECT_DELAY)
+			time.Sleep(IRC_RECONNECT_DELAY * time.Second)
+			if err := ircConnect(); err != nil {
+				IRC_LOG.Error("unable to reconnect", "err", err)
+				continue
+			}
+			break
+		}
+	}
+}
+
+func (b *IRCBackend) Healthy() error {
+	IRC_LOCK.Lock()
+	defer IRC_LOCK.Unlock()
+	if IRC_CONN == nil {
+		return fmt.Errorf("not connected")
+	}
+	return nil
+}
+
+func (b *IRCBackend) Send(r Recipient, msg string) {
+	target := r.ReplyTo
+	for n, line := range splitIRCMessage(msg, ircMaxPayload(target)) {
+		if n >= IRC_FLOOD_LINES {
+			time.Sleep(time.Second)
+		}
+		ircSend("PRIVMSG %s :%s", target, line)
+	}
+}
+
+/* Format is "nick@target", where target is either
+ * the channel or, for a privmsg, the nick. */
+func (b *IRCBackend) ResolveUser(from string) (r Recipient) {
+	r.ChatType = "irc"
+	f := strings.SplitN(from, "@", 2)
+	r.Id = f[0]
+	r.Name = f[0]
+	r.MentionName = f[0]
+	r.ReplyTo = f[0]
+	if len(f) > 1 && len(f[1]) > 0 {
+		r.ReplyTo = f[1]
+	}
+
+	return
+}
+
+func (b *IRCBackend) ResolveChannel(id string) string {
+	return strings.ToLower(id)
+}
+
+func (b *IRCBackend) Leave(r Recipient, ch *Channel) {
+	if ch == nil {
+		return
+	}
+	rand.Seed(time.Now().UnixNano())
+	ircSend("PART %s :%s", ch.Id, GOODBYE[rand.Intn(len(GOODBYE))])
+	deleteChannel(ch.Name)
+}
+
+func (b *IRCBackend) ChannelRecipient(ch *Channel) Recipient {
+	return b.ResolveUser(fmt.Sprintf("%s@%s", getConfig("mentionName"), ch.Id))
+}
+
+func (b *IRCBackend) SeenUsers(ch *Channel) map[string]UserInfo {
+	return ch.IRCUsers
+}
+
+func (b *IRCBackend) UpdateSeenUser(ch *Channel, r Recipient, uInfo UserInfo) {
+	if len(ch.IRCUsers) < 1 {
+		ch.IRCUsers = make(map[string]UserInfo, 0)
+	}
+	ch.IRCUsers[r.MentionName] = uInfo
+}
+
+func ircConnect() (err error) {
+	server := getConfig("ircServer")
+	useTLS := configBool("ircTLS")
+	if _, _, e := net.SplitHostPort(server); e != nil {
+		if useTLS {
+			server += ":6697"
+		} else {
+			server += ":6667"
+		}
+	}
+
+	IRC_LOG.Info("connecting", "server", server)
+
+	var conn net.Conn
+	dialer := &net.Dialer{Timeout: PERIODICS * time.Second}
+	if useTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", server, &tls.Config{})
+	} else {
+		conn, err = dialer.Dial("tcp", server)
+	}
+	if err != nil {
+		return
+	}
+
+	IRC_LOCK.Lock()
+	IRC_CONN = conn
+	IRC_NICK = getConfig("ircNick")
+	if len(IRC_NICK) < 1 {
+		IRC_NICK = getConfig("mentionName")
+	}
+	IRC_LOCK.Unlock()
+
+	if len(getConfig("ircSASLUser")) > 0 {
+		ircSend("CAP REQ :sasl")
+	}
+	if len(getConfig("ircPassword")) > 0 {
+		ircSend("PASS %s", getConfig("ircPassword"))
+	}
+	nick := ircNick()
+	ircSend("NICK %s", nick)
+	ircSend("USER %s 0 * :%s", nick, getConfig("fullName"))
+
+	return
+}
+
+func ircMaxPayload(target string) int {
+	overhead := len(fmt.Sprintf(":%s!@ PRIVMSG %s :\r\n", ircNick(), target))
+	return IRC_MAX_LINE - overhead - IRC_MAX_USERLEN - IRC_MAX_HOSTLEN
+}
+
+/* Our current nick, which the server may have
+ * changed. */
+func ircNick() string {
+	IRC_LOCK.Lock()
+	defer IRC_LOCK.Unlock()
+	return IRC_NICK
+}
+
+func ircNickFromPrefix(prefix string) string {
+	return strings.SplitN(prefix, "!", 2)[0]
+}
+
+func ircPeriodics() {
+	for _ = range time.Tick(PERIODICS * time.Second) {
+		IRC_LOG.Info("running irc periodics")
+		ircSend("PING :%s", ircNick())
+	}
+}
+
+func ircSend(format string, v ...interface{}) {
+	IRC_LOCK.Lock()
+	defer IRC_LOCK.Unlock()
+
+	if IRC_CONN == nil {
+		return
+	}
+
+	if _, err := fmt.Fprintf(IRC_CONN, format+"\r\n", v...); err != nil {
+		IRC_LOG.Error("unable to write to server", "err", err)
+	}
+}
+
+func joinIRCChannels() {
+	for _, name := range strings.Split(getConfig("ircChannels"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if len(name) < 1 {
+			continue
+		}
+		if _, found := getChannelByName(name); !found {
+			ch := newIRCChannel(name, "")
+			addChannel(&ch)
+		}
+	}
+
+	for _, ch := range channelList() {
+		if ch.Type != "irc" {
+			continue
+		}
+		IRC_LOG.Info("joining channel", "channel", ch.Name)
+		ircSend("JOIN %s", ch.Id)
+	}
+}
+
+func newIRCChannel(name, inviter string) (ch Channel) {
+	IRC_LOG.Debug("creating new channel", "channel", name)
+
+	ch.Toggles = map[string]bool{}
+	ch.Throttles = map[string]time.Time{}
+	ch.Settings = map[string]string{}
+	ch.Type = "irc"
+	ch.Id = name
+	ch.IRCUsers = make(map[string]UserInfo, 0)
+	ch.Inviter = "Nobody"
+	ch.Name = strings.ToLower(name)
+	ch.Phishy = &PhishCount{0, 0, time.Now(), time.Unix(0, 0)}
+	ch.CVEs = map[string]CVEItem{}
+
+	if len(inviter) > 0 {
+		ch.Inviter = inviter
+	}
+
+	for t, v := range TOGGLES {
+		ch.Toggles[t] = v
+	}
+
+	return
+}
+
+/* Format is "[@tags] [:prefix] COMMAND [params] [:trailing]" */
+func parseIRCMessage(line string) (m IRCMessage) {
+	line = strings.TrimRight(line, "\r\n")
+
+	if strings.HasPrefix(line, "@") {
+		if i := strings.Index(line, " "); i > 0 {
+			line = strings.TrimLeft(line[i:], " ")
+		}
+	}
+
+	if strings.HasPrefix(line, ":") {
+		f := strings.SplitN(line[1:], " ", 2)
+		m.Prefix = f[0]
+		line = ""
+		if len(f) > 1 {
+			line = f[1]
+		}
+	}
+
+	var trailing string
+	hasTrailing := false
+	if i := strings.Index(line, " :"); i >= 0 {
+		trailing = line[i+2:]
+		line = line[:i]
+		hasTrailing = true
+	} else if strings.HasPrefix(line, ":") {
+		trailing = line[1:]
+		line = ""
+		hasTrailing = true
+	}
+
+	f := strings.Fields(line)
+	if len(f) > 0 {
+		m.Command = strings.ToUpper(f[0])
+		m.Params = f[1:]
+	}
+	if hasTrailing {
+		m.Params = append(m.Params, trailing)
+	}
+
+	return
+}
+
+func processIRCEvent(m IRCMessage) {
+	IRC_LOG.Debug("message", "prefix", m.Prefix, "command", m.Command, "params", m.Params)
+
+	switch m.Command {
+	case "PING":
+		if len(m.Params) > 0 {
+			ircSend("PONG :%s", m.Params[0])
+		}
+
+	case "CAP":
+		if len(m.Params) < 3 {
+			return
+		}
+		if m.Params[1] == "ACK" && strings.Contains(m.Params[2], "sasl") {
+			ircSend("AUTHENTICATE PLAIN")
+		} else if m.Params[1] == "NAK" {
+			IRC_LOG.Warn("server does not support SASL")
+			ircSend("CAP END")
+		}
+
+	case "AUTHENTICATE":
+		if len(m.Params) > 0 && m.Params[0] == "+" {
+			user := getConfig("ircSASLUser")
+			auth := user + "\x00" + user + "\x00" + getConfig("ircSASLPassword")
+			ircSend("AUTHENTICATE %s", base64.StdEncoding.EncodeToString([]byte(auth)))
+		}
+
+	/* RPL_SASLSUCCESS */
+	case "903":
+		IRC_LOG.Debug("SASL authentication successful")
+		ircSend("CAP END")
+
+	/* ERR_NICKLOCKED, ERR_SASLFAIL, ERR_SASLTOOLONG, ERR_SASLABORTED */
+	case "902", "904", "905", "906":
+		IRC_LOG.Error("SASL authentication failed", "reply", strings.Join(m.Params, " "))
+		ircSend("CAP END")
+
+	/* RPL_WELCOME */
+	case "001":
+		if len(m.Params) > 0 {
+			setIRCNick(m.Params[0])
+		}
+		if len(getConfig("ircNickServPassword")) > 0 {
+			ircSend("PRIVMSG NickServ :IDENTIFY %s", getConfig("ircNickServPassword"))
+		}
+		joinIRCChannels()
+
+	/* ERR_NICKNAMEINUSE */
+	case "433":
+		nick := ircNick() + "_"
+		setIRCNick(nick)
+		IRC_LOG.Info("nick in use, trying another", "nick", nick)
+		ircSend("NICK %s", nick)
+
+	case "INVITE":
+		processIRCInvite(m)
+
+	case "KICK":
+		processIRCKick(m)
+
+	case "NICK":
+		processIRCNick(m)
+
+	case "PRIVMSG":
+		processIRCMessage(m)
+
+	case "ERROR":
+		IRC_LOG.Error("server error", "reply", strings.Join(m.Params, " "))
+	}
+}
+
+func processIRCInvite(m IRCMessage) {
+	if len(m.Params) < 2 {
+		return
+	}
+
+	inviter := ircNickFromPrefix(m.Prefix)
+	name := strings.ToLower(m.Params[1])
+
+	ch, found := getChannelByName(name)
+	if !found {
+		c := newIRCChannel(m.Params[1], inviter)
+		ch = &c
+		addChannel(ch)
+	}
+	IRC_LOG.Info("invited into channel", "channel", ch.Name, "inviter", inviter)
+	ircSend("JOIN %s", ch.Id)
+
+	if !found {
+		r := getRecipientFromMessage(fmt.Sprintf("%s@%s", inviter, ch.Id), "irc")
+		rand.Seed(time.Now().UnixNano())
+		reply(r, HELLO[rand.Intn(len(HELLO))])
+	}
+}
+
+func processIRCKick(m IRCMessage) {
+	if len(m.Params) < 2 {
+		return
+	}
+
+	channel := m.Params[0]
+	if !strings.EqualFold(m.Params[1], ircNick()) {
+		return
+	}
+
+	kicker := ircNickFromPrefix(m.Prefix)
+	IRC_LOG.Info("kicked out of channel, rejoining", "channel", channel,
+		"kicker", kicker, "delay", IRC_KICK_REJOIN_DELAY)
+
+	go func() {
+		time.Sleep(IRC_KICK_REJOIN_DELAY * time.Second)
+		ircSend("JOIN %s", channel)
+	}()
+}
+
+func processIRCMessage(m IRCMessage) {
+	if len(m.Params) < 2 {
+		return
+	}
+
+	nick := ircNickFromPrefix(m.Prefix)
+	target := m.Params[0]
+	txt := m.Params[1]
+
+	if strings.EqualFold(nick, ircNick()) {
+		/* Ignore our own messages. */
+		return
+	}
+
+	/* CTCP: treat '/me' actions as regular
+	 * messages, answer VERSION, and ignore
+	 * everything else. */
+	if strings.HasPrefix(txt, "\x01") {
+		ctcp := strings.Trim(txt, "\x01")
+		if strings.HasPrefix(ctcp, "ACTION ") {
+			txt = strings.TrimPrefix(ctcp, "ACTION ")
+		} else {
+			if ctcp == "VERSION" {
+				ircSend("NOTICE %s :\x01VERSION %s %s\x01", nick, PROGNAME, VERSION)
+			}
+			return
+		}
+	}
+
+	if len(txt) < 1 {
+		return
+	}
+
+	if !strings.ContainsAny(target[:1], "#&+!") {
+		/* A privmsg only gets commands, not
+		 * chatter. */
+		r := getRecipientFromMessage(fmt.Sprintf("%s@%s", nick, nick), "irc")
+		if strings.HasPrefix(txt, "!") {
+			processMessage(context.Background(), r, txt)
+		} else {
+			processCommands(messageContext(context.Background(), r), r, "!", txt)
+		}
+		return
+	}
+
+	r := getRecipientFromMessage(fmt.Sprintf("%s@%s", nick, target), "irc")
+
+	ch, found := getChannelByName(strings.ToLower(target))
+	if !found {
+		/* We're in a channel we didn't know
+		 * about, e.g. via a server-side
+		 * autojoin. */
+		c := newIRCChannel(target, "")
+		ch = &c
+		addChannel(ch)
+	}
+
+	/* On IRC, people address others via "nick: "
+	 * or "nick, ", so turn that into the "@nick"
+	 * form processMessage understands. */
+	addressed_re := regexp.MustCompile(`(?i)^` + regexp.QuoteMeta(ircNick()) + `[:,] *`)
+	mentioned := addressed_re.MatchString(txt)
+	if mentioned {
+		txt = addressed_re.ReplaceAllString(txt, "@"+getConfig("mentionName")+" ")
+	}
+
+	if ignored, _ := getSetting(ch, "ignored"); strings.EqualFold(ignored, "true") {
+		if mentioned {
+			setSetting(ch, "ignored", "false", r.MentionName)
+		} else {
+			return
+		}
+	}
+
+	updateSeen(r, txt)
+	processMessage(context.Background(), r, txt)
+}
+
+func processIRCNick(m IRCMessage) {
+	if len(m.Params) < 1 {
+		return
+	}
+
+	oldNick := ircNickFromPrefix(m.Prefix)
+	newNick := m.Params[0]
+
+	if strings.EqualFold(oldNick, ircNick()) {
+		IRC_LOG.Info("nick changed", "old", oldNick, "new", newNick)
+		setIRCNick(newNick)
+		return
+	}
+
+	STATE_LOCK.Lock()
+	defer STATE_LOCK.Unlock()
+
+	for _, ch := range CHANNELS {
+		if ch.Type != "irc" {
+			continue
+		}
+		if u, found := ch.IRCUsers[oldNick]; found {
+			delete(ch.IRCUsers, oldNick)
+			ch.IRCUsers[newNick] = u
+		}
+	}
+}
+
+func setIRCNick(nick string) {
+	IRC_LOCK.Lock()
+	IRC_NICK = nick
+	IRC_LOCK.Unlock()
+}
+
+/* Split a message into lines that fit into a single
+ * IRC message each, breaking long lines at a space
+ * if possible, but never within a UTF-8 sequence. */
+func splitIRCMessage(msg string, max int) (lines []string) {
+	for _, line := range strings.Split(msg, "\n") {
+		line = strings.TrimRight(line, "\r")
+		for len(line) > max {
+			cut := max
+			for cut > 0 && !utf8.RuneStart(line[cut]) {
+				cut--
+			}
+			if i := strings.LastIndex(line[:cut], " "); i > 0 {
+				cut = i
+			}
+			lines = append(lines, line[:cut])
+			line = strings.TrimLeft(line[cut:], " ")
+		}
+
+		/* IRC can't send empty lines. */
+		if len(line) < 1 {
+			line = " "
+		}
+		lines = append(lines, line)
+	}
+
+	return
+}
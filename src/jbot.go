@@ -24,15 +24,31 @@
  *
  * For Slack:
  *   slackService  = the Slack service name, e.g. <foo>.slack.com
- *   slackToken    = the authentication token for your bot
+ *   slackToken    = the bot token (xoxb-...) for your bot
+ *   slackAppToken = the app-level token (xapp-...) for Socket Mode
+ *     OR
+ *   slackSigningSecret = the signing secret for the Events API
+ *   (see slack.go for the optional settings)
+ *
+ * For IRC:
+ *   ircServer     = the IRC server, e.g. irc.example.com:6697
+ *   (see irc.go for the optional settings)
+ *
+ * For Matrix:
+ *   matrixHomeserver  = the homeserver URL, e.g. https://matrix.example.org
+ *   matrixAccessToken = the access token of the bot user
+ *
+ * For XMPP:
+ *   xmppJID       = the JID of the bot user, e.g. jbot@example.org
+ *   xmppPassword  = the password of the bot user
+ *   (see xmpp.go for the optional settings)
  *
  * This bot has a bunch of features that are company
  * internal; those features have been removed from
  * this public version.
  *
- * Some day this should be extended into a pluggable
- * bot, so that internal code can more easily be kept
- * apart, I suppose.  Pull requests welcome etc.
+ * Internal commands can be kept apart as external
+ * plugins; set 'pluginDir' and see plugin.go.
  */
 
 /*
@@ -45,11 +61,9 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/binary"
-	"encoding/gob"
 	"encoding/json"
 	"fmt"
 	"html"
@@ -77,7 +91,6 @@ import (
 
 	"github.com/daneharrigan/hipchat"
 	"github.com/google/shlex"
-	"github.com/nlopes/slack"
 )
 
 const EXIT_FAILURE = 1
@@ -92,64 +105,13 @@ const PERIODICS = 60
 /* Periodics are run PERIODICS * Seconds;
  * Intervals are run every I * PERIODICS * Seconds */
 const CVE_FEED_UPDATE_INTERVAL = 10
-const SLACK_LIVE_CHECK = 30
+const SLACK_HEARTBEAT_INTERVAL = 5
 const SLACK_CHANNEL_UPDATE_INTERVAL = 30
 
 /* API docs say 4000 chars, but experimentation
  * suggests we need some buffer room. */
 const SLACK_MAX_LENGTH = 3500
 
-var LAST_SLACK_MESSAGE_TIME time.Time
-
-var SLACK_UNLINK_RE1 = regexp.MustCompile("(<https?://([^|]+)\\|([^>]+)>)")
-var SLACK_UNLINK_RE2 = regexp.MustCompile("<(https?://[^>]+)>")
-
-var CONFIG = map[string]string{
-	"botOwner":             "",
-	"byUser":               "",
-	"byPassword":           "",
-	"channelsFile":         "/var/tmp/jbot.channels",
-	"countersFile":         "/var/tmp/jbot.counters",
-	"configFile":           "jbot.conf",
-	"debug":                "no",
-	"emailDomain":          "",
-	"fullName":             "garybot",
-	"giphyApiKey":          "",
-	"hcControlChannel":     "",
-	"hcJabberID":           "",
-	"hcOauthToken":         "",
-	"hcPassword":           "",
-	"hcService":            "",
-	"jiraPassword":         "",
-	"jiraUser":             "",
-	"mentionName":          "garybot",
-	"openweathermapApiKey": "",
-	"opsgenieApiKey":       "",
-	"slackID":              "garybot",
-	"slackService":         "vetsec.slack.com",
-	"slackToken":           "",
-	"SMTP":                 "",
-	"timezonedbApiKey":     "",
-	"x509Cert":             "",
-	"x509Key":              "",
-}
-
-var SECRETS = []string{
-	"byPassword",
-	"hcOauthToken",
-	"giphyApiKey",
-	"opsgenieApiKey",
-	"slackToken",
-}
-
-var HIPCHAT_CLIENT *hipchat.Client
-var HIPCHAT_ROOMS = map[string]*hipchat.Room{}
-var HIPCHAT_ROSTER = map[string]*hipchat.User{}
-
-var SLACK_CLIENT *slack.Client
-var SLACK_RTM *slack.RTM
-
-var SLACK_CHANNELS = map[string]slack.Channel{}
 var CHANNELS = map[string]*Channel{}
 var COMMANDS = map[string]*Command{}
 var COUNTERS = map[string]map[string]int{
@@ -184,8 +146,18 @@ var URLS = map[string]string{
 }
 
 var ALERTS = map[string]string{}
+var BACKENDS = map[string]ChatBackend{}
+
+/* How we refer to each chat type. */
+var CHAT_TYPE_NAMES = map[string]string{
+	"console": "console",
+	"hipchat": "HipChat",
+	"irc":     "IRC",
+	"matrix":  "Matrix",
+	"slack":   "Slack",
+	"xmpp":    "XMPP",
+}
 
-var COOKIES []*http.Cookie
 var VERBOSITY int
 
 type PhishCount struct {
@@ -199,21 +171,27 @@ const PHISH_MAX = 5
 const PHISH_TIME = 1200
 
 type Channel struct {
+	Admins       map[string]RoleGrant
 	CVEs         map[string]CVEItem
+	History      []ChannelChange
 	Inviter      string
+	InviterId    string
 	Id           string
 	Name         string
 	Toggles      map[string]bool
 	Throttles    map[string]time.Time
 	Type         string
 	HipChatUsers map[hipchat.User]UserInfo
+	IRCUsers     map[string]UserInfo
+	MatrixUsers  map[string]UserInfo
 	SlackUsers   map[string]UserInfo
+	XMPPUsers    map[string]UserInfo
 	Settings     map[string]string
 	Phishy       *PhishCount
 	Verified     bool
 }
 
-type CommandFunc func(Recipient, string, []string) string
+type CommandFunc func(context.Context, Recipient, string, []string) string
 
 type Command struct {
 	Call    CommandFunc
@@ -221,6 +199,7 @@ type Command struct {
 	How     string
 	Usage   string
 	Aliases []string
+	Args    []Arg
 }
 
 type UserInfo struct {
@@ -250,14 +229,63 @@ type Recipient struct {
 	ReplyTo     string
 }
 
+/*
+ * A ChatBackend connects the bot to a chat service.
+ * Each backend registers itself in BACKENDS under
+ * the name used as its Recipient's ChatType and
+ * Channel's Type.
+ */
+type ChatBackend interface {
+	/* Whether the backend is configured. */
+	Enabled() bool
+	/* Log in and join the known channels. */
+	Connect() error
+	/* Process incoming events; does not return. */
+	Receive()
+	/* Send a message to the given recipient. */
+	Send(r Recipient, msg string)
+	/* Turn a "from" string into a Recipient. */
+	ResolveUser(from string) Recipient
+	/* Turn a channel ID into a CHANNELS key. */
+	ResolveChannel(id string) string
+	/* Leave (or pretend to leave) a channel. */
+	Leave(r Recipient, ch *Channel)
+	/* Return a Recipient for the bot to post to a channel. */
+	ChannelRecipient(ch *Channel) Recipient
+	/* Return the users seen in a channel by mention name. */
+	SeenUsers(ch *Channel) map[string]UserInfo
+	/* Record the given user's info for the channel. */
+	UpdateSeenUser(ch *Channel, r Recipient, uInfo UserInfo)
+}
+
+/*
+ * A backend that paces its outgoing messages may
+ * implement BulkSender, so that it can drop bulk
+ * messages (e.g. alerts) instead of falling behind.
+ */
+type BulkSender interface {
+	/* Send a message of the given kind (e.g. "CVEs"). */
+	SendBulk(r Recipient, kind, msg string)
+}
+
+/*
+ * A backend that can tell whether it is still
+ * connected may implement HealthChecker; it is
+ * reported on the API's /health endpoint.
+ */
+type HealthChecker interface {
+	/* Return why the backend is unhealthy, if it is. */
+	Healthy() error
+}
+
 /*
  * Commands
  */
 
 func addressedToTheBot(in string) bool {
-	at_mention := "<@" + CONFIG["slackID"] + ">"
-	if strings.EqualFold(in, CONFIG["mentionName"]) ||
-		strings.EqualFold(in, "@"+CONFIG["mentionName"]) ||
+	at_mention := "<@" + getConfig("slackID") + ">"
+	if strings.EqualFold(in, getConfig("mentionName")) ||
+		strings.EqualFold(in, "@"+getConfig("mentionName")) ||
 		strings.EqualFold(in, at_mention) ||
 		in == "yourself" {
 		return true
@@ -266,8 +294,8 @@ func addressedToTheBot(in string) bool {
 	return false
 }
 
-func cmdAlerts(r Recipient, chName string, args []string) (result string) {
-	chInfo, found := CHANNELS[chName]
+func cmdAlerts(ctx context.Context, r Recipient, chName string, args []string) (result string) {
+	chInfo, found := getChannelByName(chName)
 	if !found {
 		result = "This command only works in a channel."
 		return
@@ -278,7 +306,7 @@ func cmdAlerts(r Recipient, chName string, args []string) (result string) {
 		result += "You currently have "
 		currentSettings := ""
 		for alert, _ := range ALERTS {
-			alertSetting, found := chInfo.Settings[alert]
+			alertSetting, found := getSetting(chInfo, alert)
 			if found {
 				currentSettings += fmt.Sprintf("%s=%s\n", alert, alertSetting)
 			}
@@ -355,27 +383,22 @@ func cmdAlerts(r Recipient, chName string, args []string) (result string) {
 				"!set jira-alert=5,1234;15,9876\n" +
 				"\nTo display the names and URLs of the currently set filters, run '!alerts jira-alert info'.\n"
 		} else if args[1] == "info" {
-			jiraAlert(*chInfo, true)
+			jiraAlert(ctx, chInfo, true)
 		}
 	}
 
 	return
 }
 
-func cmdAsn(r Recipient, chName string, args []string) (result string) {
-	if len(args) != 1 {
-		result = "Usage: " + COMMANDS["asn"].Usage
-		return
-	}
-
+func cmdAsn(ctx context.Context, r Recipient, chName string, args []string) (result string) {
 	arg := args[0]
 	number_re := regexp.MustCompile(`(?i)^(asn?)?([0-9]+)$`)
 	m := number_re.FindStringSubmatch(arg)
 	if len(m) > 0 {
 		arg = "AS" + m[2]
 	} else if net.ParseIP(arg) == nil {
-		arg = fqdn(arg)
-		addrs, err := net.LookupHost(arg)
+		arg = fqdn(ctx, arg)
+		addrs, err := net.DefaultResolver.LookupHost(ctx, arg)
 		if err != nil {
 			result = "Not a valid ASN, IP or hostname."
 			return
@@ -386,7 +409,7 @@ func cmdAsn(r Recipient, chName string, args []string) (result string) {
 	command := strings.Fields(COMMANDS["asn"].How)
 	command = append(command, arg)
 
-	data, _ := runCommand(command...)
+	data, _ := runCommand(ctx, command...)
 	lines := strings.Split(string(data), "\n")
 	if len(lines) < 2 {
 		result = "No ASN information found."
@@ -397,7 +420,7 @@ func cmdAsn(r Recipient, chName string, args []string) (result string) {
 	return
 }
 
-func cmdBacon(r Recipient, chName string, args []string) (result string) {
+func cmdBacon(ctx context.Context, r Recipient, chName string, args []string) (result string) {
 	pic := false
 	query := "bacon"
 	if len(args) > 0 {
@@ -407,9 +430,10 @@ func cmdBacon(r Recipient, chName string, args []string) (result string) {
 
 	rand.Seed(time.Now().UnixNano())
 	if pic || rand.Intn(4) == 0 {
-		result = cmdImage(r, chName, []string{query})
+		result = cmdImage(ctx, r, chName, []string{query})
 	} else {
-		data := getURLContents("https://baconipsum.com/?paras=1&type=all-meat", nil)
+		/* If this fails, we're out of bacon (below). */
+		data, _ := getURLContents(ctx, "https://baconipsum.com/?paras=1&type=all-meat", nil)
 		bacon_re := regexp.MustCompile(`anyipsum-output">(.*?\.)`)
 		for _, line := range strings.Split(string(data), "\n") {
 			if m := bacon_re.FindStringSubmatch(line); len(m) > 0 {
@@ -426,7 +450,7 @@ func cmdBacon(r Recipient, chName string, args []string) (result string) {
 	return
 }
 
-func cmdBs(r Recipient, chName string, args []string) (result string) {
+func cmdBs(ctx context.Context, r Recipient, chName string, args []string) (result string) {
 
 	answer := ""
 
@@ -856,13 +880,8 @@ func cmdBs(r Recipient, chName string, args []string) (result string) {
 	return
 }
 
-func cmdCert(r Recipient, chName string, args []string) (result string) {
+func cmdCert(ctx context.Context, r Recipient, chName string, args []string) (result string) {
 	names := args
-	if len(args) < 1 || len(args) > 3 {
-		result = "Usage: " + COMMANDS["cert"].Usage
-		return
-	}
-
 	names[0] = strings.TrimPrefix(names[0], "https://")
 	names[0] = strings.TrimSuffix(names[0], "/")
 
@@ -895,26 +914,23 @@ func cmdCert(r Recipient, chName string, args []string) (result string) {
 	 * errors for once. */
 	config := &tls.Config{InsecureSkipVerify: true}
 
-	chain := false
-	if len(names) > 1 {
-		if names[1] == "all" || names[1] == "chain" {
-			chain = true
-		} else {
-			config = &tls.Config{InsecureSkipVerify: true, ServerName: names[1]}
-		}
-
-		if len(names) == 3 {
-			chain = true
-		}
+	/* The <sni> may be left out, as in
+	 * '!cert <fqdn> chain'. */
+	chain := len(names[2]) > 0
+	if names[1] == "all" || names[1] == "chain" {
+		chain = true
+	} else if len(names[1]) > 0 {
+		config = &tls.Config{InsecureSkipVerify: true, ServerName: names[1]}
 	}
 
-	conn, err := tls.Dial("tcp", names[0], config)
+	conn, err := (&tls.Dialer{Config: config}).DialContext(ctx, "tcp", names[0])
 	if err != nil {
 		result = fmt.Sprintf("Unable to make a TLS connection to '%s'.\n", names[0])
 		return
 	}
+	defer conn.Close()
 
-	for n, c := range conn.ConnectionState().PeerCertificates {
+	for n, c := range conn.(*tls.Conn).ConnectionState().PeerCertificates {
 		if chain {
 			result += fmt.Sprintf("Certificate %d:\n", n)
 		}
@@ -963,42 +979,40 @@ func cmdCert(r Recipient, chName string, args []string) (result string) {
 	return
 }
 
-func cmdChannels(r Recipient, chName string, args []string) (result string) {
-	var hipChatChannels []string
-	var slackChannels []string
+func cmdChannels(ctx context.Context, r Recipient, chName string, args []string) (result string) {
+	byType := map[string][]string{}
 
-	if len(CHANNELS) == 0 {
+	channels := channelList()
+	if len(channels) == 0 {
 		result = "I'm not currently in any channels."
-	} else if len(CHANNELS) == 1 {
-		result = "I'm only here right now: "
+		return
 	}
 
-	for ch, chInfo := range CHANNELS {
-		if chInfo.Type == "hipchat" {
-			hipChatChannels = append(hipChatChannels, ch)
-		} else if chInfo.Type == "slack" {
-			slackChannels = append(slackChannels, chInfo.Name)
-		}
+	for _, chInfo := range channels {
+		byType[chInfo.Type] = append(byType[chInfo.Type], chInfo.Name)
 	}
-	sort.Strings(hipChatChannels)
-	sort.Strings(slackChannels)
-	if len(hipChatChannels) > 0 {
-		result = fmt.Sprintf("I'm in the following %d HipChat channels:\n", len(hipChatChannels))
-		result += strings.Join(hipChatChannels, ", ") + "\n"
+
+	var types []string
+	for t := range byType {
+		types = append(types, t)
 	}
-	if len(slackChannels) > 0 {
-		result += fmt.Sprintf("I'm in the following %d Slack channels:\n", len(slackChannels))
-		result += strings.Join(slackChannels, ", ")
+	sort.Strings(types)
+
+	var lines []string
+	for _, t := range types {
+		name, found := CHAT_TYPE_NAMES[t]
+		if !found {
+			name = t
+		}
+		sort.Strings(byType[t])
+		lines = append(lines, fmt.Sprintf("I'm in the following %d %s channels:\n%s",
+			len(byType[t]), name, strings.Join(byType[t], ", ")))
 	}
+	result = strings.Join(lines, "\n")
 	return
 }
 
-func cmdCidr(r Recipient, chName string, args []string) (result string) {
-	if len(args) != 1 {
-		result = "Usage: " + COMMANDS["cidr"].Usage
-		return
-	}
-
+func cmdCidr(ctx context.Context, r Recipient, chName string, args []string) (result string) {
 	input := args[0]
 
 	/* We're lazy here, but good enough. */
@@ -1068,17 +1082,17 @@ func cmdCidr(r Recipient, chName string, args []string) (result string) {
 	return
 }
 
-func cmdClear(r Recipient, chName string, args []string) (result string) {
+func cmdClear(ctx context.Context, r Recipient, chName string, args []string) (result string) {
 	count := 24
 
 	if len(args) > 0 {
 		if _, err := fmt.Sscanf(args[0], "%d", &count); err != nil {
-			result = cmdInsult(r, chName, []string{"me"})
+			result = cmdInsult(ctx, r, chName, []string{"me"})
 			return
 		}
 	}
 	if count < 1 {
-		result = cmdInsult(r, chName, []string{"me"})
+		result = cmdInsult(ctx, r, chName, []string{"me"})
 		return
 	}
 
@@ -1099,7 +1113,7 @@ func cmdClear(r Recipient, chName string, args []string) (result string) {
 
 		result += "\n"
 		if rcount == 9 {
-			cowsay := cmdCowsay(r, chName, []string{"clear"})
+			cowsay := cmdCowsay(ctx, r, chName, []string{"clear"})
 			// strip leading "/quote "
 			cowsay = cowsay[8:]
 			result += " " + cowsay
@@ -1112,24 +1126,19 @@ func cmdClear(r Recipient, chName string, args []string) (result string) {
 	return
 }
 
-func cmdCowsay(r Recipient, chName string, args []string) (result string) {
-	if len(args) < 1 {
-		result = "Usage: " + COMMANDS["cowsay"].Usage
-		return
-	}
-
-	out, _ := runCommand("cowsay " + strings.Join(args, " "))
+func cmdCowsay(ctx context.Context, r Recipient, chName string, args []string) (result string) {
+	out, _ := runCommand(ctx, "cowsay " + args[0])
 	result += "```\n" + string(out) + "```\n"
 
 	return
 }
 
-func cmdCurses(r Recipient, chName string, args []string) (result string) {
+func cmdCurses(ctx context.Context, r Recipient, chName string, args []string) (result string) {
 	result = getCountable("curses", chName, r, args)
 	return
 }
 
-func cmdEightBall(r Recipient, chName string, args []string) (result string) {
+func cmdEightBall(ctx context.Context, r Recipient, chName string, args []string) (result string) {
 	rand.Seed(time.Now().UnixNano())
 	answers := []string{
 		"It is certain.",
@@ -1157,14 +1166,13 @@ func cmdEightBall(r Recipient, chName string, args []string) (result string) {
 	return
 }
 
-func cmdFml(r Recipient, chName string, args []string) (result string) {
-	if len(args) > 0 {
-		result = "Usage: " + COMMANDS["fml"].Usage
+func cmdFml(ctx context.Context, r Recipient, chName string, args []string) (result string) {
+	data, err := getURLContents(ctx, COMMANDS["fml"].How, nil)
+	if err != nil {
+		result = fmt.Sprintf("Unable to fetch an FML: %s", err)
 		return
 	}
 
-	data := getURLContents(COMMANDS["fml"].How, nil)
-
 	fml_re := regexp.MustCompile(`(?i)^(Today, .*FML)$`)
 	for _, line := range strings.Split(string(data), "\n") {
 		m := fml_re.FindStringSubmatch(line)
@@ -1176,20 +1184,15 @@ func cmdFml(r Recipient, chName string, args []string) (result string) {
 	return
 }
 
-func cmdFortune(r Recipient, chName string, args []string) (result string) {
-	if len(args) > 0 {
-		result = "Usage: " + COMMANDS["fortune"].Usage
-		return
-	}
-
-	out, _ := runCommand("fortune -s")
+func cmdFortune(ctx context.Context, r Recipient, chName string, args []string) (result string) {
+	out, _ := runCommand(ctx, "fortune -s")
 	result = string(out)
 
 	return
 }
 
-func cmdGiphy(r Recipient, chName string, args []string) (result string) {
-	key := CONFIG["giphyApiKey"]
+func cmdGiphy(ctx context.Context, r Recipient, chName string, args []string) (result string) {
+	key := getConfig("giphyApiKey")
 	if len(key) < 1 {
 		result = "Sorry - no giphy API key in config file!\n"
 		result += "Try '!img' instead?\n"
@@ -1210,17 +1213,21 @@ func cmdGiphy(r Recipient, chName string, args []string) (result string) {
 
 	theUrl += "&api_key=" + url.QueryEscape(key)
 	theUrl += "&rating=g&limit=30"
-	data := getURLContents(theUrl, nil)
+	data, err := getURLContents(ctx, theUrl, nil)
+	if err != nil {
+		result = fmt.Sprintf("Unable to fetch giphy data: %s", err)
+		return
+	}
 
 	var giphyJson map[string]interface{}
-	err := json.Unmarshal(data, &giphyJson)
+	err = json.Unmarshal(data, &giphyJson)
 	if err != nil {
 		result = fmt.Sprintf("Unable to unmarshal giphy data: %s\n", err)
 		return
 	}
 
 	if _, found := giphyJson["meta"]; !found {
-		fmt.Fprintf(os.Stderr, "+++ giphy fail: %v\n", giphyJson)
+		LOG.WarnContext(ctx, "no meta in giphy data", "data", giphyJson)
 		result = fmt.Sprintf("No data received from giphy!")
 		return
 	}
@@ -1228,7 +1235,7 @@ func cmdGiphy(r Recipient, chName string, args []string) (result string) {
 	status := giphyJson["meta"].(map[string]interface{})["status"].(float64)
 
 	if status != 200 {
-		fmt.Fprintf(os.Stderr, "+++ giphy return status %f: %v\n", status, giphyJson)
+		LOG.WarnContext(ctx, "giphy returned non-200 status", "status", status, "data", giphyJson)
 		result = fmt.Sprintf("Giphy responded with a non-200 status code!")
 		return
 	}
@@ -1254,7 +1261,7 @@ func cmdGiphy(r Recipient, chName string, args []string) (result string) {
 	return
 }
 
-func cmdHelp(r Recipient, chName string, args []string) (result string) {
+func cmdHelp(ctx context.Context, r Recipient, chName string, args []string) (result string) {
 	if len(args) < 1 {
 		result = fmt.Sprintf("I know %d commands.\n"+
 			"Use '!help all' to show all commands.\n"+
@@ -1277,7 +1284,10 @@ func cmdHelp(r Recipient, chName string, args []string) (result string) {
 				result = fmt.Sprintf("%s: %s. Usage:\n%s",
 					cmd,
 					COMMANDS[cmd].Help,
-					COMMANDS[cmd].Usage)
+					commandUsage(cmd))
+				if details := argsHelp(COMMANDS[cmd].Args); len(details) > 0 {
+					result += "\n" + strings.TrimSuffix(details, "\n")
+				}
 				if len(COMMANDS[cmd].Aliases) > 0 {
 					result += "\nThis command can also be invoked as: '!"
 					result += strings.Join(COMMANDS[cmd].Aliases, "', '!")
@@ -1286,7 +1296,7 @@ func cmdHelp(r Recipient, chName string, args []string) (result string) {
 			} else {
 				/* 35 to account for 'No such command...' */
 				if len(cmd) >= (SLACK_MAX_LENGTH - 35) {
-					result = cmdInsult(r, chName, []string{"me"})
+					result = cmdInsult(ctx, r, chName, []string{"me"})
 				} else {
 					result = fmt.Sprintf("No such command: %s. Try '!help'.", cmd)
 				}
@@ -1296,27 +1306,17 @@ func cmdHelp(r Recipient, chName string, args []string) (result string) {
 	return
 }
 
-func cmdHost(r Recipient, chName string, args []string) (result string) {
-	if len(args) != 1 {
-		result = "Usage: " + COMMANDS["host"].Usage
-		return
-	}
-
-	out, _ := runCommand(fmt.Sprintf("host %s", args[0]))
+func cmdHost(ctx context.Context, r Recipient, chName string, args []string) (result string) {
+	out, _ := runCommand(ctx, fmt.Sprintf("host %s", args[0]))
 	result = string(out)
 
 	return
 }
 
-func cmdHow(r Recipient, chName string, args []string) (result string) {
-	if len(args) != 1 {
-		result = "Usage: " + COMMANDS["how"].Usage
-		return
-	}
-
+func cmdHow(ctx context.Context, r Recipient, chName string, args []string) (result string) {
 	if _, found := COMMANDS[args[0]]; found {
 		result = COMMANDS[args[0]].How
-	} else if strings.EqualFold(args[0], CONFIG["mentionName"]) {
+	} else if strings.EqualFold(args[0], getConfig("mentionName")) {
 		result = URLS["jbot"]
 	} else {
 		rand.Seed(time.Now().UnixNano())
@@ -1326,15 +1326,14 @@ func cmdHow(r Recipient, chName string, args []string) (result string) {
 	return
 }
 
-func cmdImage(r Recipient, chName string, args []string) (result string) {
-	if len(args) != 1 {
-		result = "Usage: " + COMMANDS["img"].Usage
+func cmdImage(ctx context.Context, r Recipient, chName string, args []string) (result string) {
+	theUrl := fmt.Sprintf("%s%s", COMMANDS["img"].How, url.QueryEscape(args[0]))
+	data, err := getURLContents(ctx, theUrl, nil)
+	if err != nil {
+		result = fmt.Sprintf("Unable to search for images: %s", err)
 		return
 	}
 
-	theUrl := fmt.Sprintf("%s%s", COMMANDS["img"].How, url.QueryEscape(args[0]))
-	data := getURLContents(theUrl, nil)
-
 	imgurl_re := regexp.MustCompile(`imgurl=(.*?)&`)
 	for _, line := range strings.Split(string(data), "\n") {
 		m := imgurl_re.FindAllStringSubmatch(line, -1)
@@ -1349,7 +1348,7 @@ func cmdImage(r Recipient, chName string, args []string) (result string) {
 	return
 }
 
-func cmdInfo(r Recipient, chName string, args []string) (result string) {
+func cmdInfo(ctx context.Context, r Recipient, chName string, args []string) (result string) {
 	var subject string
 	if len(args) != 1 {
 		subject = r.ReplyTo
@@ -1357,13 +1356,15 @@ func cmdInfo(r Recipient, chName string, args []string) (result string) {
 		subject = args[0]
 	}
 
-	slack_channel_re := regexp.MustCompile(`(?i)<(#[A-Z0-9]+)\|([^>]+)>`)
-	m := slack_channel_re.FindStringSubmatch(subject)
-	if len(m) > 0 {
-		result = getChannelInfo(m[1])
-		subject = m[2]
-	} else {
-		result = getChannelInfo(subject)
+	if r.ChatType == "slack" {
+		slack_channel_re := regexp.MustCompile(`(?i)<(#[A-Z0-9]+)\|([^>]+)>`)
+		m := slack_channel_re.FindStringSubmatch(subject)
+		if len(m) > 0 {
+			result = getChannelInfo(m[1])
+			subject = m[2]
+		} else {
+			result = getChannelInfo(subject)
+		}
 	}
 
 	subject = strings.ToLower(subject)
@@ -1373,35 +1374,29 @@ func cmdInfo(r Recipient, chName string, args []string) (result string) {
 
 		var names []string
 
-		if r.ChatType == "hipchat" {
-			for u := range ch.HipChatUsers {
-				names = append(names, u.MentionName)
-			}
-		} else if r.ChatType == "slack" {
-			for u := range ch.SlackUsers {
-				names = append(names, u)
-			}
+		for u := range getUsersFromChannel(ch.Name, r.ChatType) {
+			names = append(names, u)
 		}
 		sort.Strings(names)
 		result += strings.Join(names, ", ")
 
-		stfu := cmdStfu(r, ch.Name, []string{})
+		stfu := cmdStfu(ctx, r, ch.Name, []string{})
 		if len(stfu) > 0 {
 			result += fmt.Sprintf("\nTop 10 channel chatterers for #%s:\n", ch.Name)
 			result += fmt.Sprintf("%s", stfu)
 		}
 
-		toggles := cmdToggle(r, ch.Name, []string{})
+		toggles := cmdToggle(ctx, r, ch.Name, commandArgs("toggle"))
 		if len(toggles) > 0 {
 			result += fmt.Sprintf("\n%s", toggles)
 		}
 
-		throttles := cmdThrottle(r, ch.Name, []string{})
+		throttles := cmdThrottle(ctx, r, ch.Name, commandArgs("throttle"))
 		if len(throttles) > 0 {
 			result += fmt.Sprintf("\n%s", throttles)
 		}
 
-		settings := cmdSet(r, ch.Name, []string{})
+		settings := cmdSet(ctx, r, ch.Name, commandArgs("set"))
 		if !strings.HasPrefix(settings, "There currently are no settings") {
 			result += "\nThese are the channel settings:\n"
 			result += settings
@@ -1412,7 +1407,7 @@ func cmdInfo(r Recipient, chName string, args []string) (result string) {
 	return
 }
 
-func cmdInsult(r Recipient, chName string, args []string) (result string) {
+func cmdInsult(ctx context.Context, r Recipient, chName string, args []string) (result string) {
 	var insultee string
 	if len(args) > 0 {
 		insultee = strings.Join(args, " ")
@@ -1430,9 +1425,13 @@ func cmdInsult(r Recipient, chName string, args []string) (result string) {
 	rand.Seed(time.Now().UnixNano())
 	if rand.Intn(2) == 0 {
 		url := URLS["insults"]
-		result += randomLineFromUrl(url, false)
+		result += randomLineFromUrl(ctx, url)
 	} else {
-		data := getURLContents(COMMANDS["insult"].How, nil)
+		data, err := getURLContents(ctx, COMMANDS["insult"].How, nil)
+		if err != nil {
+			result = fmt.Sprintf("Unable to fetch an insult: %s", err)
+			return
+		}
 		found := false
 		insult_re := regexp.MustCompile(`^<p><font size="\+2">`)
 		for _, line := range strings.Split(string(data), "\n") {
@@ -1450,20 +1449,15 @@ func cmdInsult(r Recipient, chName string, args []string) (result string) {
 	return
 }
 
-func cmdLatLong(r Recipient, chName string, args []string) (result string) {
-	if len(args) != 1 {
-		result = "Usage: " + COMMANDS["latlong"].Usage
-		return
-	}
-
-	client := &http.Client{}
+func cmdLatLong(ctx context.Context, r Recipient, chName string, args []string) (result string) {
+	client := &http.Client{Transport: METRICS_TRANSPORT}
 
 	v := url.Values{}
 	v.Add("action", "gpcm")
 	v.Add("c1", args[0])
 
 	latlongURL := COMMANDS["latlong"].How + "_spm4.php"
-	req, err := http.NewRequest("POST", latlongURL, strings.NewReader(v.Encode()))
+	req, err := http.NewRequestWithContext(ctx, "POST", latlongURL, strings.NewReader(v.Encode()))
 	if err != nil {
 		result = fmt.Sprintf("Unable to create a new POST request: %s", err)
 		return
@@ -1487,7 +1481,7 @@ func cmdLatLong(r Recipient, chName string, args []string) (result string) {
 	return
 }
 
-func cmdLog(r Recipient, chName string, args []string) (result string) {
+func cmdLog(ctx context.Context, r Recipient, chName string, args []string) (result string) {
 	var room string
 	if r.ChatType == "hipchat" {
 		room = r.ReplyTo
@@ -1495,14 +1489,11 @@ func cmdLog(r Recipient, chName string, args []string) (result string) {
 		room = chName
 	}
 
-	if len(args) > 1 {
-		result = "Usage: " + COMMANDS["log"].Usage
-		return
-	} else if len(args) == 1 {
+	if len(args[0]) > 0 {
 		room = args[0]
 	}
 
-	roomInfo := cmdRoom(r, chName, []string{room})
+	roomInfo := cmdRoom(ctx, r, chName, []string{room})
 
 	if strings.Contains(roomInfo, "https://") {
 		result = roomInfo[strings.Index(roomInfo, "https://"):]
@@ -1512,13 +1503,8 @@ func cmdLog(r Recipient, chName string, args []string) (result string) {
 	return
 }
 
-func cmdMan(r Recipient, chName string, args []string) (result string) {
-	if len(args) < 1 {
-		result = "Usage: " + COMMANDS["man"].Usage
-		return
-	}
-
-	if args[0] == "woman" {
+func cmdMan(ctx context.Context, r Recipient, chName string, args []string) (result string) {
+	if args[1] == "woman" {
 		rand.Seed(time.Now().UnixNano())
 		replies := []string{
 			"That's not very original, now is it?",
@@ -1530,21 +1516,17 @@ func cmdMan(r Recipient, chName string, args []string) (result string) {
 		return
 	}
 
-	var section string
-	if len(args) == 2 {
-		section = url.QueryEscape(args[0])
-	}
-
-	cmd := url.QueryEscape(args[len(args)-1])
+	section := url.QueryEscape(args[0])
+	cmd := url.QueryEscape(args[1])
 
 	if len(section) > 0 {
-		result = getManResults(section, cmd)
+		result = getManResults(ctx, section, cmd)
 	} else {
 
 		sections := []string{"1", "1p", "2", "2p", "3", "3p", "4", "4p", "5", "5p", "6", "6p", "7", "7p", "8", "8p"}
 
 		for _, section := range sections {
-			result = getManResults(section, cmd)
+			result = getManResults(ctx, section, cmd)
 			if len(result) > 0 {
 				break
 			}
@@ -1558,7 +1540,7 @@ func cmdMan(r Recipient, chName string, args []string) (result string) {
 	return
 }
 
-func cmdMonkeyStab(r Recipient, chName string, args []string) (result string) {
+func cmdMonkeyStab(ctx context.Context, r Recipient, chName string, args []string) (result string) {
 	var stabbee string
 	if len(args) > 0 {
 		stabbee = strings.Join(args, " ")
@@ -1571,18 +1553,16 @@ func cmdMonkeyStab(r Recipient, chName string, args []string) (result string) {
 	return
 }
 
-func cmdOid(r Recipient, chName string, args []string) (result string) {
-	oids := args
-	if len(oids) != 1 {
-		result = "Usage: " + COMMANDS["oid"].Usage
-		return
-	}
-
-	oid := strings.TrimSpace(oids[0])
+func cmdOid(ctx context.Context, r Recipient, chName string, args []string) (result string) {
+	oid := strings.TrimSpace(args[0])
 
 	theUrl := fmt.Sprintf("%s%s", COMMANDS["oid"].How, oid)
 	urlArgs := map[string]string{"ua": "true"}
-	data := getURLContents(theUrl, urlArgs)
+	data, err := getURLContents(ctx, theUrl, urlArgs)
+	if err != nil && !isFetchNotFound(err) {
+		result = fmt.Sprintf("Unable to look up OID %s: %s", oid, err)
+		return
+	}
 
 	info_key := ""
 	found := false
@@ -1640,16 +1620,20 @@ func cmdOid(r Recipient, chName string, args []string) (result string) {
 	return
 }
 
-func cmdOnion(r Recipient, chName string, args []string) (result string) {
+func cmdOnion(ctx context.Context, r Recipient, chName string, args []string) (result string) {
 	search := false
 	theUrl := COMMANDS["onion"].How + "rss"
 
-	if len(args) > 0 {
-		theUrl = fmt.Sprintf("%ssearch?q=%s", COMMANDS["onion"].How, url.QueryEscape(strings.Join(args, " ")))
+	if len(args[0]) > 0 {
+		theUrl = fmt.Sprintf("%ssearch?q=%s", COMMANDS["onion"].How, url.QueryEscape(args[0]))
 		search = true
 	}
 
-	data := getURLContents(theUrl, nil)
+	data, err := getURLContents(ctx, theUrl, nil)
+	if err != nil {
+		result = fmt.Sprintf("Unable to fetch The Onion: %s", err)
+		return
+	}
 
 	if !search {
 		items := strings.Split(string(data), "<item>")
@@ -1688,19 +1672,16 @@ func cmdOnion(r Recipient, chName string, args []string) (result string) {
 	return
 }
 
-func cmdOncall(r Recipient, chName string, args []string) (result string) {
-	input := strings.Join(args, " ")
+func cmdOncall(ctx context.Context, r Recipient, chName string, args []string) (result string) {
+	input := strings.TrimSpace(strings.Join(args, " "))
 
-	var oncall string
 	var noncall string
-	if len(args) == 1 {
-		oncall = args[0]
-	}
+	oncall := args[0]
 	oncall_source := "user input"
 
 	atMention := false
 	uparrow_re := regexp.MustCompile(`(?i)^(-*\^+|https?://)`)
-	if uparrow_re.Match([]byte(input)) || len(args) > 1 {
+	if uparrow_re.Match([]byte(input)) || len(args[1]) > 0 {
 		atMention = true
 		oncall = ""
 	}
@@ -1713,20 +1694,20 @@ func cmdOncall(r Recipient, chName string, args []string) (result string) {
 				oncall = ch.Name
 			}
 			oncall_source = "channel name"
-			if v, found := ch.Settings["oncall"]; found {
+			if v, found := getSetting(ch, "oncall"); found {
 				oncall = v
 				oncall_source = "channel setting"
 			}
-			noncall, _ = ch.Settings["noncall"]
+			noncall, _ = getSetting(ch, "noncall")
 		} else if !atMention {
-			result = "Usage: " + COMMANDS["oncall"].Usage
+			result = "Outside of a channel, you need to tell me the <group>."
 			return
 		}
 	}
 
 	for _, rot := range strings.Split(oncall, ",") {
 
-		result = cmdOncallSnow(r, chName, []string{rot})
+		result = cmdOncallSnow(ctx, r, chName, []string{rot})
 		if strings.Contains(result, "Primary") ||
 			strings.Contains(result, "Secondary") {
 			continue
@@ -1739,7 +1720,7 @@ func cmdOncall(r Recipient, chName string, args []string) (result string) {
 		}
 
 		oncallFound := true
-		result += cmdOncallOpsGenie(r, chName, rot, true)
+		result += cmdOncallOpsGenie(ctx, r, chName, rot, true)
 		if len(result) < 1 {
 			result = fmt.Sprintf("No oncall information found for '%s'.\n", oncall)
 			oncallFound = false
@@ -1767,7 +1748,7 @@ func cmdOncall(r Recipient, chName string, args []string) (result string) {
 			if m := user_re.FindAllStringSubmatch(result, -1); len(m) > 0 {
 				users := map[string]bool{}
 				for _, u := range m {
-					user, err := SLACK_CLIENT.GetUserByEmail(u[1] + "@" + CONFIG["emailDomain"])
+					user, err := SLACK_CLIENT.GetUserByEmail(u[1] + "@" + getConfig("emailDomain"))
 					if err == nil {
 						users[fmt.Sprintf("<@%s>", user.ID)] = true
 					}
@@ -1792,23 +1773,18 @@ func cmdOncall(r Recipient, chName string, args []string) (result string) {
 	return
 }
 
-func cmdPing(r Recipient, chName string, args []string) (result string) {
+func cmdPing(ctx context.Context, r Recipient, chName string, args []string) (result string) {
 	ping := "ping"
 	hosts := args
-	if len(hosts) > 1 {
-		result = "Usage: " + COMMANDS["ping"].Usage
-		return
-	}
-
-	if len(hosts) == 0 {
+	if len(hosts[0]) == 0 {
 		result = "pong"
 		return
-	} else if strings.ToLower(hosts[0]) == strings.ToLower(CONFIG["mentionName"]) {
+	} else if strings.ToLower(hosts[0]) == strings.ToLower(getConfig("mentionName")) {
 		result = "I'm alive!"
 		return
 	}
 
-	host := fqdn(hosts[0])
+	host := fqdn(ctx, hosts[0])
 	if len(host) < 1 {
 		if strings.Contains(hosts[0], ".") {
 			result = fmt.Sprintf("Unable to resolve %s.", hosts[0])
@@ -1840,7 +1816,7 @@ func cmdPing(r Recipient, chName string, args []string) (result string) {
 		return
 	}
 
-	_, err := runCommand(fmt.Sprintf("%s -q -w 1 -W 0.5 -i 0.5 -c 1 %s", ping, host))
+	_, err := runCommand(ctx, fmt.Sprintf("%s -q -w 1 -W 0.5 -i 0.5 -c 1 %s", ping, host))
 	if err > 0 {
 		result = fmt.Sprintf("Unable to ping %s.", hosts[0])
 	} else {
@@ -1850,18 +1826,13 @@ func cmdPing(r Recipient, chName string, args []string) (result string) {
 	return
 }
 
-func cmdPraise(r Recipient, chName string, args []string) (result string) {
-	if _, found := CHANNELS[chName]; !found {
+func cmdPraise(ctx context.Context, r Recipient, chName string, args []string) (result string) {
+	if _, found := getChannelByName(chName); !found {
 		result = "This command only works in a channel."
 		return
 	}
 
-	if len(args) < 1 {
-		result = "Usage: " + COMMANDS["praise"].Usage
-		return
-	}
-
-	praisee := strings.Join(args, " ")
+	praisee := args[0]
 	expandedUser := expandSlackUser(praisee)
 	if expandedUser != nil && expandedUser.ID != "" {
 		praisee = expandedUser.Name
@@ -1869,7 +1840,7 @@ func cmdPraise(r Recipient, chName string, args []string) (result string) {
 	if strings.EqualFold(praisee, "me") ||
 		strings.EqualFold(praisee, "myself") ||
 		strings.EqualFold(praisee, r.MentionName) {
-		result = cmdInsult(r, chName, []string{"me"})
+		result = cmdInsult(ctx, r, chName, []string{"me"})
 		return
 	}
 
@@ -1879,26 +1850,20 @@ func cmdPraise(r Recipient, chName string, args []string) (result string) {
 		result = THANKYOU[rand.Intn(len(THANKYOU))]
 	} else {
 		result = fmt.Sprintf("%s: %s\n", praisee,
-			randomLineFromUrl(COMMANDS["praise"].How, false))
+			randomLineFromUrl(ctx, COMMANDS["praise"].How))
 	}
 	return
 }
 
-func cmdPwgen(r Recipient, chName string, args []string) (result string) {
-	if len(args) > 3 {
-		result = "Usage: " + COMMANDS["pwgen"].Usage
-		return
-	}
-
+func cmdPwgen(ctx context.Context, r Recipient, chName string, args []string) (result string) {
 	theUrl := COMMANDS["pwgen"].How + "?nohtml=1"
-	var i int
 	lines := 1
 
 	for n, a := range args {
-		if _, err := fmt.Sscanf(a, "%d", &i); err != nil {
-			result = "'" + a + "' does not look like a number to me."
-			return
+		if len(a) < 1 {
+			continue
 		}
+		i, _ := strconv.Atoi(a)
 		if i < 0 || i > 50 {
 			result = "Please try a number between 0 and 50."
 			return
@@ -1914,7 +1879,11 @@ func cmdPwgen(r Recipient, chName string, args []string) (result string) {
 		}
 	}
 
-	data := string(getURLContents(theUrl, nil))
+	data, err := getURLContents(ctx, theUrl, nil)
+	if err != nil {
+		result = fmt.Sprintf("Unable to generate passwords: %s", err)
+		return
+	}
 	for n, line := range strings.Split(string(data), "\n") {
 		if n < lines {
 			result += line + "\n"
@@ -1923,19 +1892,18 @@ func cmdPwgen(r Recipient, chName string, args []string) (result string) {
 	return
 }
 
-func cmdQuote(r Recipient, chName string, args []string) (result string) {
-	if len(args) < 1 {
-		result = "Usage: " + COMMANDS["quote"].Usage
-		return
-	}
-
-	subject := strings.Join(args, " ")
+func cmdQuote(ctx context.Context, r Recipient, chName string, args []string) (result string) {
+	subject := args[0]
 
 	result = fmt.Sprintf("\"%s\"", subject)
 
 	subject = strings.ToUpper(subject)
 	theURL := fmt.Sprintf("%s%s", COMMANDS["quote"].How, url.QueryEscape(subject))
-	data := getURLContents(theURL, nil)
+	data, err := getURLContents(ctx, theURL, nil)
+	if err != nil && !isFetchNotFound(err) {
+		result = fmt.Sprintf("Unable to look up %s: %s", subject, err)
+		return
+	}
 
 	type Quote struct {
 		FullExchangeName           string
@@ -1973,7 +1941,7 @@ func cmdQuote(r Recipient, chName string, args []string) (result string) {
 	}
 
 	var y YahooFinance
-	err := json.Unmarshal([]byte(jsonString), &y)
+	err = json.Unmarshal([]byte(jsonString), &y)
 	if err != nil {
 		result = fmt.Sprintf("Unable to unmarshal json data: %s\n", err)
 		return
@@ -1991,21 +1959,19 @@ func cmdQuote(r Recipient, chName string, args []string) (result string) {
 	return
 }
 
-func cmdRfc(r Recipient, chName string, args []string) (result string) {
-	rfcs := args
-	if len(rfcs) != 1 {
-		result = "Usage: " + COMMANDS["rfc"].Usage
-		return
-	}
-
-	rfc := strings.ToLower(strings.TrimSpace(rfcs[0]))
+func cmdRfc(ctx context.Context, r Recipient, chName string, args []string) (result string) {
+	rfc := strings.ToLower(strings.TrimSpace(args[0]))
 
 	if !strings.HasPrefix(rfc, "rfc") {
 		rfc = "rfc" + rfc
 	}
 
 	theUrl := fmt.Sprintf("%s%s", COMMANDS["rfc"].How, rfc)
-	data := getURLContents(theUrl, nil)
+	data, err := getURLContents(ctx, theUrl, nil)
+	if err != nil && !isFetchNotFound(err) {
+		result = fmt.Sprintf("Unable to look up %s: %s", rfc, err)
+		return
+	}
 
 	for _, line := range strings.Split(string(data), "\n") {
 		if strings.Contains(line, "<span class=\"h1\">") {
@@ -2023,12 +1989,7 @@ func cmdRfc(r Recipient, chName string, args []string) (result string) {
 	return
 }
 
-func cmdRoom(r Recipient, chName string, args []string) (result string) {
-	if len(args) < 1 {
-		result = "Usage: " + COMMANDS["room"].Usage
-		return
-	}
-
+func cmdRoom(ctx context.Context, r Recipient, chName string, args []string) (result string) {
 	room := strings.TrimSpace(args[0])
 	lroom := strings.ToLower(room)
 
@@ -2059,7 +2020,7 @@ func cmdRoom(r Recipient, chName string, args []string) (result string) {
 				if aRoom.NumParticipants != "0" {
 					result += fmt.Sprintf("Hip Chatters: %s\n", aRoom.NumParticipants)
 				}
-				result += fmt.Sprintf("https://%s.hipchat.com/history/room/%s\n", CONFIG["hcService"], aRoom.RoomId)
+				result += fmt.Sprintf("https://%s.hipchat.com/history/room/%s\n", getConfig("hcService"), aRoom.RoomId)
 				return
 			} else {
 				if strings.Contains(lc, lroom) {
@@ -2068,7 +2029,7 @@ func cmdRoom(r Recipient, chName string, args []string) (result string) {
 			}
 		}
 	} else if r.ChatType == "slack" {
-		for _, ch := range SLACK_CHANNELS {
+		for _, ch := range getSlackChannels() {
 			lc := strings.ToLower(ch.Name)
 			if lc == lroom {
 				result = fmt.Sprintf("'%s'\n", ch.Name)
@@ -2080,13 +2041,13 @@ func cmdRoom(r Recipient, chName string, args []string) (result string) {
 				}
 				creator, err := SLACK_CLIENT.GetUserInfo(ch.Creator)
 				if err != nil {
-					fmt.Fprintf(os.Stderr, "Unable to find user information for '%s'.\n", ch.Creator)
+					LOG.WarnContext(ctx, "unable to find user information", "creator", ch.Creator, "err", err)
 					result += fmt.Sprintf("Creator: Unknown\n")
 				} else {
 					result += fmt.Sprintf("Creator: %s\n", creator.Name)
 				}
 				result += fmt.Sprintf("# of members: %d\n", len(getAllMembersInChannel(ch.ID)))
-				result += fmt.Sprintf("https://%s/messages/%s/\n", CONFIG["slackService"], lroom)
+				result += fmt.Sprintf("https://%s/messages/%s/\n", getConfig("slackService"), lroom)
 				return
 			} else if strings.Contains(lc, lroom) {
 				candidates = append(candidates, &roomTopic{ch.Name, ch.Topic.Value})
@@ -2120,21 +2081,19 @@ func cmdRoom(r Recipient, chName string, args []string) (result string) {
 	return
 }
 
-func cmdSeen(r Recipient, chName string, args []string) (result string) {
-	wanted := args
-	user := wanted[0]
-	verbose(4, "Looking in %s", r.ReplyTo)
+func cmdSeen(ctx context.Context, r Recipient, chName string, args []string) (result string) {
+	user, where := args[0], args[1]
 
 	ch, found := getChannel(r.ChatType, r.ReplyTo)
 
-	if len(wanted) > 1 {
-		chName = wanted[1]
+	if len(where) > 0 {
+		chName = where
 		slack_channel_re := regexp.MustCompile(`(?i)<(#[A-Z0-9]+)\|([^>]+)>`)
-		m := slack_channel_re.FindStringSubmatch(wanted[1])
+		m := slack_channel_re.FindStringSubmatch(where)
 		if len(m) > 0 {
 			chName = m[2]
 		}
-		verbose(4, "Looking for %s in %s'...", user, chName)
+		LOG.DebugContext(ctx, "looking for user", "wanted", user, "in", chName)
 		ch, found = getChannel(r.ChatType, chName)
 	}
 
@@ -2151,29 +2110,16 @@ func cmdSeen(r Recipient, chName string, args []string) (result string) {
 	}
 
 	if !found {
-		if len(wanted) > 1 {
-			result = "I'm not currently in #" + wanted[1]
+		if len(where) > 0 {
+			result = "I'm not currently in #" + where
 		} else {
 			result = "Ask me about a user in a channel."
 		}
 		return
 	}
 
-	if len(user) < 1 {
-		result = fmt.Sprintf("Usage: %s", COMMANDS["seen"].Usage)
-		return
-	}
-
-	if r.ChatType == "hipchat" {
-		for u, info := range ch.HipChatUsers {
-			if u.MentionName == user {
-				result = info.Seen
-			}
-		}
-	} else if r.ChatType == "slack" {
-		if info, found := ch.SlackUsers[user]; found {
-			result = info.Seen
-		}
+	if info, found := getUsersFromChannel(ch.Name, r.ChatType)[user]; found {
+		result = info.Seen
 	}
 
 	if len(result) < 1 {
@@ -2182,45 +2128,54 @@ func cmdSeen(r Recipient, chName string, args []string) (result string) {
 	return
 }
 
-func cmdSet(r Recipient, chName string, args []string) (result string) {
-	var input []string
-	if len(args) == 1 {
-		input = strings.SplitN(args[0], "=", 2)
-	}
+func cmdSet(ctx context.Context, r Recipient, chName string, args []string) (result string) {
+	input := strings.SplitN(args[0], "=", 2)
 
-	if len(args) > 1 {
-		result = "Usage:\n" + COMMANDS["set"].Usage
+	if help := strings.Fields(args[0]); len(help) > 0 && help[0] == "help" && len(input) == 1 {
+		if len(help) == 1 {
+			result = settingsHelp()
+		} else {
+			result = settingHelp(strings.Join(help[1:], " "))
+		}
 		return
 	}
 
 	var ch *Channel
 	var found bool
-	if ch, found = CHANNELS[chName]; !found {
+	if ch, found = getChannelByName(chName); !found {
 		result = "I can only set things in a channel."
 		return
 	}
 
-	if len(args) < 1 {
-		if len(ch.Settings) < 1 {
+	if len(args[0]) < 1 {
+		settings := getSettings(ch)
+		if len(settings) < 1 {
 			result = fmt.Sprintf("There currently are no settings for #%s.", chName)
 			return
 		}
 
 		sorted := []string{}
-		for n, _ := range ch.Settings {
-			sorted = append(sorted, n)
+		for n, _ := range settings {
+			if !isInternalSetting(n) {
+				sorted = append(sorted, n)
+			}
 		}
 		sort.Strings(sorted)
 
+		if len(sorted) < 1 {
+			result = fmt.Sprintf("There currently are no settings for #%s.", chName)
+			return
+		}
+
 		for _, s := range sorted {
-			result += fmt.Sprintf("%s=%s\n", s, ch.Settings[s])
+			result += fmt.Sprintf("%s=%s\n", s, settings[s])
 		}
 		return
 	}
 
 	name := strings.TrimSpace(input[0])
 	if len(input) == 1 {
-		s, found := ch.Settings[name]
+		s, found := getSetting(ch, name)
 		if found {
 			result = fmt.Sprintf("%s=%s\n", name, s)
 		} else {
@@ -2241,12 +2196,13 @@ func cmdSet(r Recipient, chName string, args []string) (result string) {
 		value = strings.TrimSuffix(value, "&gt;")
 	}
 
-	if len(ch.Settings) < 1 {
-		ch.Settings = map[string]string{}
+	if err := validateSetting(name, value); err != nil {
+		result = err.Error()
+		return
 	}
 
 	old := ""
-	if old, found = ch.Settings[name]; found {
+	if old, found = setSetting(ch, name, value, r.MentionName); found {
 		if value == old {
 			result = fmt.Sprintf("'%s' unchanged.", name)
 			return
@@ -2254,25 +2210,13 @@ func cmdSet(r Recipient, chName string, args []string) (result string) {
 		old = fmt.Sprintf(" (was: %s)", old)
 	}
 
-	ch.Settings[name] = value
-
 	result = fmt.Sprintf("Set '%s' to '%s'%s.", name, value, old)
 	return
 }
 
-func cmdSms(r Recipient, chName string, args []string) (result string) {
+func cmdSms(ctx context.Context, r Recipient, chName string, args []string) (result string) {
 	lookupType := "number"
-	shortcode := ""
-	if len(args) < 1 {
-		shortcode = "773786" // Yahoo! Shortcode
-	} else if len(args) > 1 {
-		result = "Usage: " + COMMANDS["sms"].Usage
-		return
-	} else {
-		shortcode = args[0]
-	}
-
-	shortcode = strings.Replace(shortcode, "-", "", -1)
+	shortcode := strings.Replace(args[0], "-", "", -1)
 
 	var i int
 	if _, err := fmt.Sscanf(shortcode, "%d", &i); err != nil {
@@ -2285,7 +2229,11 @@ func cmdSms(r Recipient, chName string, args []string) (result string) {
 	} else if lookupType == "search" {
 		theUrl = fmt.Sprintf("%s?fwp_short_code_search=%s/", COMMANDS["sms"].How, url.QueryEscape(shortcode))
 	}
-	data := getURLContents(theUrl, nil)
+	data, err := getURLContents(ctx, theUrl, nil)
+	if err != nil && !isFetchNotFound(err) {
+		result = fmt.Sprintf("Unable to look up %s: %s", shortcode, err)
+		return
+	}
 
 	printNext := false
 	info := []string{
@@ -2326,41 +2274,27 @@ func cmdSms(r Recipient, chName string, args []string) (result string) {
 	return
 }
 
-func cmdSpeb(r Recipient, chName string, args []string) (result string) {
-	if len(args) > 0 {
-		result = "Usage: " + COMMANDS["speb"].Usage
-		return
-	}
-
-	result = randomLineFromUrl(COMMANDS["speb"].How, false)
+func cmdSpeb(ctx context.Context, r Recipient, chName string, args []string) (result string) {
+	result = randomLineFromUrl(ctx, COMMANDS["speb"].How)
 	return
 }
 
-func cmdStfu(r Recipient, chName string, args []string) (result string) {
+func cmdStfu(ctx context.Context, r Recipient, chName string, args []string) (result string) {
 	var ch *Channel
 	var found bool
 
-	if ch, found = CHANNELS[chName]; !found {
+	if ch, found = getChannelByName(chName); !found {
 		result = "This command only works in a channel."
 		return
 	}
 
 	chatter := make(map[int][]string)
 
-	if r.ChatType == "hipchat" {
-		for u := range ch.HipChatUsers {
-			if (len(args) > 0) && (u.MentionName != args[0]) {
-				continue
-			}
-			chatter[ch.HipChatUsers[u].Count] = append(chatter[ch.HipChatUsers[u].Count], u.MentionName)
-		}
-	} else if r.ChatType == "slack" {
-		for u := range ch.SlackUsers {
-			if (len(args) > 0) && (u != args[0]) {
-				continue
-			}
-			chatter[ch.SlackUsers[u].Count] = append(chatter[ch.SlackUsers[u].Count], u)
+	for u, info := range getUsersFromChannel(ch.Name, r.ChatType) {
+		if (len(args) > 0) && (u != args[0]) {
+			continue
 		}
+		chatter[info.Count] = append(chatter[info.Count], u)
 	}
 
 	if (len(args) > 0) && (len(chatter) < 1) {
@@ -2390,14 +2324,13 @@ func cmdStfu(r Recipient, chName string, args []string) (result string) {
 	return
 }
 
-func cmdTfln(r Recipient, chName string, args []string) (result string) {
-	if len(args) > 0 {
-		result = "Usage: " + COMMANDS["tfln"].Usage
+func cmdTfln(ctx context.Context, r Recipient, chName string, args []string) (result string) {
+	data, err := getURLContents(ctx, COMMANDS["tfln"].How, nil)
+	if err != nil {
+		result = fmt.Sprintf("Unable to fetch a text: %s", err)
 		return
 	}
 
-	data := getURLContents(COMMANDS["tfln"].How, nil)
-
 	tfln_re := regexp.MustCompile(`(?i)^<p><a href="/Text-Replies`)
 	for _, line := range strings.Split(string(data), "\n") {
 		if tfln_re.MatchString(line) {
@@ -2408,52 +2341,41 @@ func cmdTfln(r Recipient, chName string, args []string) (result string) {
 	return
 }
 
-func cmdThrottle(r Recipient, chName string, args []string) (result string) {
+func cmdThrottle(ctx context.Context, r Recipient, chName string, args []string) (result string) {
 	input := args
-	if len(input) > 2 {
-		result = "Usage: " + COMMANDS["throttle"].Usage
+	newThrottle, _ := strconv.Atoi(input[1])
+	if newThrottle < 0 {
+		result = cmdInsult(ctx, r, chName, []string{"me"})
 		return
 	}
 
-	newThrottle := DEFAULT_THROTTLE
-	if len(input) == 2 {
-		if _, err := fmt.Sscanf(input[1], "%d", &newThrottle); err != nil {
-			result = "Invalid number of seconds."
-			return
-		}
-
-		if newThrottle < 0 {
-			result = cmdInsult(r, chName, []string{"me"})
-			return
-		}
-	}
-
 	var ch *Channel
 	var found bool
-	if ch, found = CHANNELS[chName]; !found {
+	if ch, found = getChannelByName(chName); !found {
 		result = "I can only throttle things in a channel."
 		return
 	}
 
-	if len(args) > 0 {
+	if len(input[0]) > 0 {
 		d, err := time.ParseDuration(fmt.Sprintf("%ds", newThrottle-DEFAULT_THROTTLE))
 		if err != nil {
 			result = fmt.Sprintf("Unable to parse new duration: %s", err)
 			return
 		}
-		ch.Throttles[input[0]] = time.Now().Add(d)
+		setThrottle(ch, input[0], time.Now().Add(d), r.MentionName)
 		result = fmt.Sprintf("%s => %d", input[0], newThrottle)
 		return
 	}
 
 	var throttles []string
-	if len(ch.Throttles) == 0 {
+	chThrottles := getThrottles(ch)
+	if len(chThrottles) == 0 {
 		result = "This channel is currently unthrottled."
 		return
 	}
 
 	result = "These are the throttles for this channel:\n"
-	for t, v := range ch.Throttles {
+	for t, v := range chThrottles {
 		duration := math.Ceil(DEFAULT_THROTTLE - time.Since(v).Seconds())
 		if duration < 0 {
 			duration = 0
@@ -2465,7 +2387,7 @@ func cmdThrottle(r Recipient, chName string, args []string) (result string) {
 	return
 }
 
-/*func cmdTime(r Recipient, chName string, args []string) (result string) {
+/*func cmdTime(ctx context.Context, r Recipient, chName string, args []string) (result string) {
 	timezones := []string{"Asia/Taipei", "Asia/Calcutta", "UTC", "EST5EDT", "PST8PDT"}
 	if len(args) > 0 {
 		timezones = args
@@ -2482,12 +2404,12 @@ func cmdThrottle(r Recipient, chName string, args []string) (result string) {
 
 			address := getUserAddress(l)
 			if len(address) > 0 {
-				tz, found = locationToTZ(address)
+				tz, found = locationToTZ(ctx, address)
 			} else {
 				tz, found = getColoTZ(l)
 			}
 			if !found {
-				tz, _ = locationToTZ(l)
+				tz, _ = locationToTZ(ctx, l)
 			}
 
 			if loc, err := time.LoadLocation(tz); err == nil {
@@ -2502,14 +2424,8 @@ func cmdThrottle(r Recipient, chName string, args []string) (result string) {
 	return
 }*/
 
-func cmdTld(r Recipient, chName string, args []string) (result string) {
-	input := args
-	if len(input) != 1 {
-		result = "Usage: " + COMMANDS["tld"].Usage
-		return
-	}
-
-	domain := input[0]
+func cmdTld(ctx context.Context, r Recipient, chName string, args []string) (result string) {
+	domain := args[0]
 
 	if strings.HasPrefix(domain, ".") {
 		domain = domain[1:]
@@ -2518,7 +2434,7 @@ func cmdTld(r Recipient, chName string, args []string) (result string) {
 	command := strings.Fields(COMMANDS["tld"].How)
 	command = append(command, domain)
 
-	data, _ := runCommand(command...)
+	data, _ := runCommand(ctx, command...)
 
 	info := map[string]string{}
 
@@ -2558,64 +2474,46 @@ func cmdTld(r Recipient, chName string, args []string) (result string) {
 	return
 }
 
-func cmdToggle(r Recipient, chName string, args []string) (result string) {
-	wanted := "all"
-	if len(args) > 1 {
-		result = "Usage: " + COMMANDS["toggle"].Usage
-		return
-	} else if len(args) == 1 {
-		wanted = args[0]
+func cmdToggle(ctx context.Context, r Recipient, chName string, args []string) (result string) {
+	wanted := args[0]
+	if len(wanted) < 1 {
+		wanted = "all"
 	}
 
-	if ch, found := CHANNELS[chName]; found {
+	if ch, found := getChannelByName(chName); found {
 		if wanted == "all" {
 			var toggles []string
 			result = "These are the toggles for this channel:\n"
-			for t, v := range ch.Toggles {
+			for t, v := range getToggles(ch) {
 				toggles = append(toggles, fmt.Sprintf("%s => %v", t, v))
 			}
 			sort.Strings(toggles)
 			result += strings.Join(toggles, ", ")
 			return
 		}
-		if t, found := ch.Toggles[wanted]; found {
-			ch.Toggles[wanted] = !t
-			result = fmt.Sprintf("%s set to %v", wanted, ch.Toggles[wanted])
+		if enabled, found := flipToggle(ch, wanted, r.MentionName); found {
+			result = fmt.Sprintf("%s set to %v", wanted, enabled)
 		} else {
-			if _, found := TOGGLES[wanted]; found {
-				if len(ch.Toggles) == 0 {
-					ch.Toggles = map[string]bool{}
-				}
-				ch.Toggles[wanted] = true
-				result = fmt.Sprintf("%s set to true", wanted)
-			} else {
-				result = fmt.Sprintf("No such toggle: %s", wanted)
-			}
+			result = fmt.Sprintf("No such toggle: %s", wanted)
 		}
 	}
 	return
 }
 
-func cmdResetCounter(r Recipient, chName string, args []string) (result string) {
-
+func cmdResetCounter(ctx context.Context, r Recipient, chName string, args []string) (result string) {
 	input := strings.Join(args, " ")
-	if CONFIG["botOwner"] != r.MentionName {
-		result = fmt.Sprintf("Sorry, %s is not allowed to run this command.", r.MentionName)
-		return
-	}
-
 	_, err := getCounter(input)
 	if len(err) > 0 {
 		result = err
 		return
 	} else {
-		COUNTERS[input] = map[string]int{}
+		resetCounter(input)
 		result = input + " reset."
 	}
 	return
 }
 
-func cmdTop(r Recipient, chName string, args []string) (result string) {
+func cmdTop(ctx context.Context, r Recipient, chName string, args []string) (result string) {
 	input := strings.Join(args, " ")
 	counter, err := getCounter(input)
 	if len(err) > 0 {
@@ -2643,17 +2541,12 @@ func cmdTop(r Recipient, chName string, args []string) (result string) {
 	return
 }
 
-func cmdTrivia(r Recipient, chName string, args []string) (result string) {
-	if len(args) > 0 {
-		result = "Usage: " + COMMANDS["trivia"].Usage
-		return
-	}
-
-	result = randomLineFromUrl(COMMANDS["trivia"].How, false)
+func cmdTrivia(ctx context.Context, r Recipient, chName string, args []string) (result string) {
+	result = randomLineFromUrl(ctx, COMMANDS["trivia"].How)
 	return
 }
 
-func cmdTroutSlap(r Recipient, chName string, args []string) (result string) {
+func cmdTroutSlap(ctx context.Context, r Recipient, chName string, args []string) (result string) {
 	slappee := strings.Join(args, " ")
 	if addressedToTheBot(slappee) || slappee == "me" {
 		slappee = fmt.Sprintf("<@%s>", r.Id)
@@ -2663,18 +2556,22 @@ func cmdTroutSlap(r Recipient, chName string, args []string) (result string) {
 	return
 }
 
-func cmdUd(r Recipient, chName string, args []string) (result string) {
+func cmdUd(ctx context.Context, r Recipient, chName string, args []string) (result string) {
 
 	theUrl := COMMANDS["ud"].How
-	if len(args) > 0 {
-		theUrl += fmt.Sprintf("define.php?term=%s", url.QueryEscape(strings.Join(args, " ")))
+	if len(args[0]) > 0 {
+		theUrl += fmt.Sprintf("define.php?term=%s", url.QueryEscape(args[0]))
 	} else {
 		rand.Seed(time.Now().UnixNano())
 		n := rand.Intn(1000)
 		theUrl += fmt.Sprintf("random.php?page=%d", n)
 	}
 
-	data := getURLContents(theUrl, nil)
+	data, err := getURLContents(ctx, theUrl, nil)
+	if err != nil && !isFetchNotFound(err) {
+		result = fmt.Sprintf("Unable to fetch urban dictionary data: %s", err)
+		return
+	}
 	desc_re := regexp.MustCompile(`(?i)/><meta content="(.*?)" name="twitter:description" `)
 	example_re := regexp.MustCompile(`(?i)<div class="example">(.*?)</div>`)
 	tags_re := regexp.MustCompile(`(?i)<div class="tags">(.*?)</div>`)
@@ -2715,54 +2612,36 @@ func cmdUd(r Recipient, chName string, args []string) (result string) {
 	return
 }
 
-func cmdUnset(r Recipient, chName string, args []string) (result string) {
-	input := args
-	if len(input) != 1 {
-		result = "Usage: " + COMMANDS["unset"].Usage
-		return
-	}
-
+func cmdUnset(ctx context.Context, r Recipient, chName string, args []string) (result string) {
 	var ch *Channel
 	var found bool
-	if ch, found = CHANNELS[chName]; !found {
+	if ch, found = getChannelByName(chName); !found {
 		result = "I can only set things in a channel."
 		return
 	}
 
-	if len(ch.Settings) < 1 {
-		ch.Settings = map[string]string{}
-	}
-
 	old := ""
-	if old, found = ch.Settings[args[0]]; found {
-		delete(ch.Settings, args[0])
+	if old, found = unsetSetting(ch, args[0], r.MentionName); found {
 		result = fmt.Sprintf("Deleted %s=%s.", args[0], old)
 	} else {
-		result = fmt.Sprintf("No such setting: '%s'.", args[9])
+		result = fmt.Sprintf("No such setting: '%s'.", args[0])
 	}
 
 	return
 }
 
-func cmdUnthrottle(r Recipient, chName string, args []string) (result string) {
-	if len(args) != 1 {
-		result = "Usage: " + COMMANDS["unthrottle"].Usage
-		return
-	}
-
+func cmdUnthrottle(ctx context.Context, r Recipient, chName string, args []string) (result string) {
 	var ch *Channel
 	var found bool
-	if ch, found = CHANNELS[chName]; !found {
+	if ch, found = getChannelByName(chName); !found {
 		result = "I can only throttle things in a channel."
 		return
 	}
 
 	if args[0] == "*" || args[0] == "everything" {
-		for t, _ := range ch.Throttles {
-			delete(ch.Throttles, t)
-		}
+		unsetThrottle(ch, "*", r.MentionName)
 	} else {
-		delete(ch.Throttles, args[0])
+		unsetThrottle(ch, args[0], r.MentionName)
 	}
 
 	replies := []string{
@@ -2780,14 +2659,14 @@ func cmdUnthrottle(r Recipient, chName string, args []string) (result string) {
 	return
 }
 
-func cmdUser(r Recipient, chName string, args []string) (result string) {
-	if r.ChatType == "slack" {
-		result = "Sorry, this feature only works for HipChat right now."
+func cmdUser(ctx context.Context, r Recipient, chName string, args []string) (result string) {
+	if r.ChatType != "hipchat" && r.ChatType != "xmpp" {
+		result = "Sorry, this feature only works for HipChat and XMPP right now."
 		return
 	}
 
-	if len(args) < 1 {
-		result = "Usage: " + COMMANDS["user"].Usage
+	if r.ChatType == "xmpp" {
+		result = xmppUserInfo(strings.TrimSpace(args[0]))
 		return
 	}
 
@@ -2841,21 +2720,19 @@ func cmdUser(r Recipient, chName string, args []string) (result string) {
 	return
 }
 
-func cmdVu(r Recipient, chName string, args []string) (result string) {
-	nums := args
-	if len(nums) != 1 {
-		result = "Usage: " + COMMANDS["vu"].Usage
-		return
-	}
-
-	num := strings.TrimSpace(nums[0])
+func cmdVu(ctx context.Context, r Recipient, chName string, args []string) (result string) {
+	num := strings.TrimSpace(args[0])
 
 	if strings.HasPrefix(num, "#") {
 		num = num[1:]
 	}
 
 	theUrl := fmt.Sprintf("%s%s", COMMANDS["vu"].How, num)
-	data := getURLContents(theUrl, nil)
+	data, err := getURLContents(ctx, theUrl, nil)
+	if err != nil && !isFetchNotFound(err) {
+		result = fmt.Sprintf("Unable to look up VU#%s: %s", num, err)
+		return
+	}
 
 	info := []string{}
 
@@ -2888,9 +2765,9 @@ func cmdVu(r Recipient, chName string, args []string) (result string) {
 	return
 }
 
-/*func cmdWeather(r Recipient, chName string, args []string) (result string) {
+/*func cmdWeather(ctx context.Context, r Recipient, chName string, args []string) (result string) {
 	var where string
-	apikey := CONFIG["openweathermapApiKey"]
+	apikey := getConfig("openweathermapApiKey")
 	if len(apikey) < 1 {
 		result = "Missing OpenWeatherMap API Key."
 		return
@@ -2905,7 +2782,7 @@ func cmdVu(r Recipient, chName string, args []string) (result string) {
 		where = u.Name
 	}
 
-	if where == CONFIG["mentionName"] {
+	if where == getConfig("mentionName") {
 		where = "ne1"
 	}
 
@@ -2921,14 +2798,14 @@ func cmdVu(r Recipient, chName string, args []string) (result string) {
 		}
 	} else {
 		var unused Recipient
-		coloInfo := cmdColo(unused, "", []string{where})
+		coloInfo := cmdColo(ctx, unused, "", []string{where})
 		r := regexp.MustCompile(`(?m)Location\s+: (.+)`)
 		if m := r.FindStringSubmatch(coloInfo); len(m) > 0 {
 			where = m[1]
 		}
 	}
 
-	latlon := cmdLatLong(r, chName, []string{where})
+	latlon := cmdLatLong(ctx, r, chName, []string{where})
 
 	query := "weather?appid=" + apikey + "&"
 	if strings.Contains(latlon, ",") {
@@ -2945,7 +2822,11 @@ func cmdVu(r Recipient, chName string, args []string) (result string) {
 	}
 
 	theURL := fmt.Sprintf("https://api.openweathermap.org/data/2.5/%s", query)
-	data := getURLContents(theURL, nil)
+	data, err := getURLContents(ctx, theURL, nil)
+	if err != nil && !isFetchNotFound(err) {
+		result = fmt.Sprintf("Unable to fetch weather data: %s\n", err)
+		return
+	}
 
 	type OpenWeatherMapResult struct {
 		Coord struct {
@@ -2977,7 +2858,7 @@ func cmdVu(r Recipient, chName string, args []string) (result string) {
 	}
 
 	var w OpenWeatherMapResult
-	err := json.Unmarshal(data, &w)
+	err = json.Unmarshal(data, &w)
 	if err != nil {
 		result = fmt.Sprintf("Unable to unmarshal weather data: %s\n", err)
 		return
@@ -3012,14 +2893,13 @@ func tempStringFromKelvin(t float64) (s string) {
 	return
 }
 
-func cmdWhocyberedme(r Recipient, chName string, args []string) (result string) {
-	if len(args) > 0 {
-		result = "Usage: " + COMMANDS["whocyberedme"].Usage
+func cmdWhocyberedme(ctx context.Context, r Recipient, chName string, args []string) (result string) {
+	data, err := getURLContents(ctx, COMMANDS["whocyberedme"].How, nil)
+	if err != nil {
+		result = fmt.Sprintf("Unable to find out who cybered you: %s", err)
 		return
 	}
 
-	data := getURLContents(COMMANDS["whocyberedme"].How, nil)
-
 	for _, l := range strings.Split(string(data), "\n") {
 		if strings.Contains(l, "confirms") {
 			result = dehtmlify(l)
@@ -3029,19 +2909,14 @@ func cmdWhocyberedme(r Recipient, chName string, args []string) (result string)
 	return
 }
 
-func cmdWhois(r Recipient, chName string, args []string) (result string) {
-	if len(args) != 1 {
-		result = "Usage: " + COMMANDS["whois"].Usage
-		return
-	}
-
-	hostinfo := cmdHost(r, chName, args)
+func cmdWhois(ctx context.Context, r Recipient, chName string, args []string) (result string) {
+	hostinfo := cmdHost(ctx, r, chName, args)
 	if strings.Contains(hostinfo, "not found:") {
 		result = hostinfo
 		return
 	}
 
-	out, _ := runCommand(fmt.Sprintf("whois %s", args[0]))
+	out, _ := runCommand(ctx, fmt.Sprintf("whois %s", args[0]))
 	data := string(out)
 
 	/* whois formatting is a mess; different whois servers return
@@ -3234,16 +3109,16 @@ func cmdWhois(r Recipient, chName string, args []string) (result string) {
 	return
 }
 
-func cmdWiki(r Recipient, chName string, args []string) (result string) {
-	if len(args) < 1 {
-		result = "Usage: " + COMMANDS["wiki"].Usage
-		return
-	}
-	wiki := strings.Join(args, " ")
+func cmdWiki(ctx context.Context, r Recipient, chName string, args []string) (result string) {
+	wiki := args[0]
 
 	query := url.QueryEscape(wiki)
 	theUrl := fmt.Sprintf("%s%s", COMMANDS["wiki"].How, query)
-	data := getURLContents(theUrl, nil)
+	data, err := getURLContents(ctx, theUrl, nil)
+	if err != nil {
+		result = fmt.Sprintf("Unable to fetch wiki data: %s", err)
+		return
+	}
 
 	/* json results are:
 	 * [ "query",
@@ -3253,7 +3128,7 @@ func cmdWiki(r Recipient, chName string, args []string) (result string) {
 	 * ]
 	 */
 	var jsonData []interface{}
-	err := json.Unmarshal(data, &jsonData)
+	err = json.Unmarshal(data, &jsonData)
 	if err != nil {
 		result = fmt.Sprintf("Unable to unmarshal wiki data: %s\n", err)
 		return
@@ -3287,21 +3162,8 @@ func cmdWiki(r Recipient, chName string, args []string) (result string) {
 	return
 }
 
-/*func cmdWtf(r Recipient, chName string, args []string) (result string) {
-	if len(args) < 1 {
-		result = "Usage: " + COMMANDS["wtf"].Usage
-		return
-	}
-	terms := args
-	if (len(terms) > 2) || ((len(terms) == 2) && (terms[0] != "is")) {
-		result = "Usage: " + COMMANDS["wtf"].Usage
-		return
-	}
-
-	term := terms[0]
-	if len(terms) == 2 {
-		term = terms[1]
-	}
+/*func cmdWtf(ctx context.Context, r Recipient, chName string, args []string) (result string) {
+	term := args[1]
 
 	// Slack expands '#channel' to e.g. '<#CBEAWGAPJ|channel>'
 	slack_channel_re := regexp.MustCompile(`(?i)<(#[A-Z0-9]+)\|([^>]+)>`)
@@ -3321,7 +3183,7 @@ func cmdWiki(r Recipient, chName string, args []string) (result string) {
 		slack_user = u.Name
 	}
 	if slack_user != term {
-		result = cmdBy(r, "", []string{slack_user})
+		result = cmdBy(ctx, r, "", []string{slack_user})
 		if len(result) > 0 {
 			if strings.HasPrefix(result, "No such user") {
 				term = slack_user
@@ -3331,8 +3193,8 @@ func cmdWiki(r Recipient, chName string, args []string) (result string) {
 		}
 	}
 
-	if term == CONFIG["mentionName"] {
-		result = fmt.Sprintf("Unfortunately, no one can be told what %s is...\n", CONFIG["mentionName"])
+	if term == getConfig("mentionName") {
+		result = fmt.Sprintf("Unfortunately, no one can be told what %s is...\n", getConfig("mentionName"))
 		result += "You have to see it for yourself."
 		return
 	}
@@ -3342,7 +3204,7 @@ func cmdWiki(r Recipient, chName string, args []string) (result string) {
 		return
 	}
 
-	out, _ := runCommand(fmt.Sprintf("ywtf %s", term))
+	out, _ := runCommand(ctx, fmt.Sprintf("ywtf %s", term))
 	result = string(out)
 
 	if strings.HasPrefix(result, "ywtf: ") {
@@ -3352,10 +3214,10 @@ func cmdWiki(r Recipient, chName string, args []string) (result string) {
 	return
 }*/
 
-func cmdXkcd(r Recipient, chName string, args []string) (result string) {
+func cmdXkcd(ctx context.Context, r Recipient, chName string, args []string) (result string) {
 	latest := false
 	theUrl := COMMANDS["xkcd"].How
-	if len(args) < 1 {
+	if len(args[0]) < 1 {
 		theUrl = "https://xkcd.com/"
 		latest = true
 	} else if _, err := strconv.Atoi(args[0]); err == nil {
@@ -3365,7 +3227,11 @@ func cmdXkcd(r Recipient, chName string, args []string) (result string) {
 		theUrl += "process?action=xkcd&query=" + url.QueryEscape(args[0])
 	}
 
-	data := getURLContents(theUrl, nil)
+	data, err := getURLContents(ctx, theUrl, nil)
+	if err != nil {
+		result = fmt.Sprintf("Unable to fetch xkcd data: %s", err)
+		return
+	}
 	xkcd_re := regexp.MustCompile(`^Permanent link to this comic: (https://xkcd.com/[0-9]+/)`)
 	for n, line := range strings.Split(string(data), "\n") {
 		m := xkcd_re.FindStringSubmatch(line)
@@ -3383,7 +3249,7 @@ func cmdXkcd(r Recipient, chName string, args []string) (result string) {
 	return
 }
 
-func cmdYubifail(r Recipient, chName string, args []string) (result string) {
+func cmdYubifail(ctx context.Context, r Recipient, chName string, args []string) (result string) {
 	result = getCountable("yubifail", chName, r, args)
 	return
 }
@@ -3398,18 +3264,107 @@ func argcheck(flag string, args []string, i int) {
 	}
 }
 
+/* Runs the command, recording its latency and
+ * outcome: "ok", "denied" (see checkCommandRole()),
+ * "usage" (see parseArgs()), "timeout" or "panic". */
+func callCommand(ctx context.Context, cmd string, r Recipient, chName string, args []string) (response string) {
+	ctx, cancel := commandContext(ctx, cmd)
+	defer cancel()
+
+	start := time.Now()
+	outcome := "panic"
+	defer func() {
+		incrementMetric("jbot_commands_total", cmd, outcome)
+		observeMetric("jbot_command_duration_seconds", time.Since(start), cmd, outcome)
+	}()
+
+	if denial := checkCommandRole(ctx, cmd, r, chName, args); len(denial) > 0 {
+		outcome = "denied"
+		response = denial
+		return
+	}
+
+	if decl := COMMANDS[cmd].Args; decl != nil {
+		var problem string
+		if args, problem = parseArgs(decl, args); len(problem) > 0 {
+			outcome = "usage"
+			response = problem + "\nUsage: " + commandUsage(cmd)
+			return
+		}
+	}
+
+	if inWorkerPool(ctx) {
+		stop := workingIndicator(r)
+		defer stop()
+	}
+
+	response = COMMANDS[cmd].Call(ctx, r, chName, args)
+	outcome = "ok"
+	if ctx.Err() == context.DeadlineExceeded {
+		LOG.WarnContext(ctx, "command timed out", "timeout", commandTimeout(cmd))
+		response = fmt.Sprintf("Sorry, '!%s' timed out. Please try again later.", cmd)
+		outcome = "timeout"
+	}
+	return
+}
+
 func catchPanic() {
 	if r := recover(); r != nil {
-		fmt.Fprintf(os.Stderr, "Panic!\n%s\n", r)
-		debug.PrintStack()
-		fmt.Fprintf(os.Stderr, "Let's try this again.\n")
-		if len(CONFIG["hcService"]) > 0 {
-			doTheHipChat()
+		LOG.Error("panic", "panic", r, "stack", string(debug.Stack()))
+	}
+}
+
+/* Backends handle each incoming event via this, so
+ * that a panic while handling one event is logged
+ * and the receive loop carries on with the next one,
+ * rather than taking down the bot (or, for backends
+ * that recover, silently stopping the loop). */
+func handleEvent(backend string, f func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			LOG.Error("panic while handling event", "backend", backend, "panic", r,
+				"stack", string(debug.Stack()))
 		}
-		if len(CONFIG["slackName"]) > 0 {
-			doTheSlackChat()
+	}()
+	return f()
+}
+
+func channelPeriodics() {
+	LOG.Debug("running channel periodics")
+	for _, chInfo := range channelList() {
+		/* We may have state for channels on
+		 * chat services we're not currently
+		 * connected to. */
+		if b, found := BACKENDS[chInfo.Type]; !found || !b.Enabled() {
+			continue
 		}
+		cveAlert(chInfo)
+
+		chCtx := withLogFields(context.Background(), "channel", chInfo.Name)
+
+		ctx, cancel := commandContext(chCtx, "snow")
+		snowAlerts(ctx, chInfo)
+		cancel()
+
+		ctx, cancel = commandContext(chCtx, "jira")
+		jiraAlert(ctx, chInfo, false)
+		cancel()
+	}
+}
+
+/* Commands get a context that is cancelled once
+ * their timeout (see commandTimeout) expires. */
+func commandContext(parent context.Context, cmd string) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, commandTimeout(cmd))
+}
+
+/* 'commandTimeouts' overrides 'commandTimeout' for
+ * individual commands. */
+func commandTimeout(cmd string) time.Duration {
+	if d, found := configDurations("commandTimeouts")[cmd]; found {
+		return d
 	}
+	return configDuration("commandTimeout")
 }
 
 func createCommands() {
@@ -3417,209 +3372,303 @@ func createCommands() {
 		"ask the magic 8-ball",
 		"builtin",
 		"!8ball <question>",
+		nil,
 		nil}
 	COMMANDS["alerts"] = &Command{cmdAlerts,
 		"display alert settings and help",
 		"builtin",
 		"!alerts [cmr-alert|jira-alert|snow-alert]",
+		nil,
 		nil}
 	COMMANDS["asn"] = &Command{cmdAsn,
 		"display information about ASN",
 		"whois -h whois.cymru.com",
-		"!asn [<host>|<ip>|<asn>)",
-		nil}
+		"",
+		nil,
+		[]Arg{
+			{Name: "host|ip|asn", Required: true},
+		}}
 	COMMANDS["bacon"] = &Command{cmdBacon,
 		"everybody needs more bacon",
 		"mostly pork",
 		"!bacon",
+		nil,
 		nil}
 	COMMANDS["bs"] = &Command{cmdBs,
 		"Corporate B.S. Generator",
 		"builtin, but inspired from http://www.atrixnet.com/bs-generator.html",
 		"!bs",
+		nil,
 		nil}
 	COMMANDS["cert"] = &Command{cmdCert,
 		"display information about the x509 cert found at the given hostname",
 		"crypto/tls",
-		"!cert fqdn [<sni>] [chain]",
-		[]string{"certs"}}
+		"",
+		[]string{"certs"},
+		[]Arg{
+			{Name: "fqdn", Required: true, Help: "optionally followed by :<port> (default: 443)"},
+			{Name: "sni"},
+			{Name: "chain", Choices: []string{"chain", "all"}, Help: "show the whole chain"},
+		}}
 	COMMANDS["channels"] = &Command{cmdChannels,
 		"display channels I'm in",
 		"builtin",
 		"!channels",
+		nil,
 		nil}
 	COMMANDS["cidr"] = &Command{cmdCidr,
 		"display CIDR information",
 		"builtin (net.ParseCIDR)",
-		"!cidr <cidr>",
-		nil}
+		"",
+		nil,
+		[]Arg{
+			{Name: "cidr", Required: true},
+		}}
 	COMMANDS["clear"] = &Command{cmdClear,
 		"clear the screen / backlog",
 		"builtin",
 		"!clear [num]",
+		nil,
 		nil}
 	COMMANDS["cowsay"] = &Command{cmdCowsay,
 		"moo!",
 		"cowsay(1)",
-		"!cowsay <msg>",
-		nil}
+		"",
+		nil,
+		[]Arg{
+			{Name: "msg", Type: ARG_TEXT, Required: true},
+		}}
 	COMMANDS["curses"] = &Command{cmdCurses,
 		"check your curse count",
 		"builtin",
 		"!curses [<user>]",
+		nil,
 		nil}
 	COMMANDS["fml"] = &Command{cmdFml,
 		"display a quote from www.fmylife.com",
 		"http://www.fmylife.com/random",
-		"!fml",
-		nil}
+		"",
+		nil,
+		[]Arg{}}
 	COMMANDS["fortune"] = &Command{cmdFortune,
 		"print a random, hopefully interesting, adage",
 		"fortune(1)",
-		"!fortune",
-		[]string{"motd"}}
+		"",
+		[]string{"motd"},
+		[]Arg{}}
 	COMMANDS["giphy"] = &Command{cmdGiphy,
 		"get a gif from giphy",
 		"https://api.giphy.com/v1/gifs/search",
 		"!giphy",
-		[]string{"gif"}}
+		[]string{"gif"},
+		nil}
 	COMMANDS["help"] = &Command{cmdHelp,
 		"display this help",
 		"builtin",
 		"!help [all|<command>]",
-		[]string{"?", "commands", "hlp"}}
+		[]string{"?", "commands", "hlp"},
+		nil}
 	COMMANDS["host"] = &Command{cmdHost,
 		"host lookup",
 		"host(1)",
-		"!host <host>",
-		nil}
+		"",
+		nil,
+		[]Arg{
+			{Name: "host", Required: true},
+		}}
 	COMMANDS["how"] = &Command{cmdHow,
 		"show how a command is implemented",
 		"builtin",
-		"!how <command>",
-		nil}
+		"",
+		nil,
+		[]Arg{
+			{Name: "command", Required: true},
+		}}
 	COMMANDS["img"] = &Command{cmdImage,
 		"post a link to an image",
 		"https://images.search.yahoo.com/search/images?p=",
-		"!img <search term>",
-		[]string{"image", "pic"}}
+		"",
+		[]string{"image", "pic"},
+		[]Arg{
+			{Name: "search term", Type: ARG_TEXT, Required: true},
+		}}
 	COMMANDS["info"] = &Command{cmdInfo,
 		"display info about a channel",
 		"builtin",
 		"!info <channel>",
+		nil,
 		nil}
 	COMMANDS["insult"] = &Command{cmdInsult,
 		"insult somebody",
 		"http://www.pangloss.com/seidel/Shaker/index.html",
 		"!insult <somebody>",
+		nil,
 		nil}
 	COMMANDS["latlong"] = &Command{cmdLatLong,
 		"look up latitude and longitude for a given location",
 		"https://www.latlong.net/",
-		"!latlong location",
-		[]string{"coords"}}
+		"",
+		[]string{"coords"},
+		[]Arg{
+			{Name: "location", Type: ARG_TEXT, Required: true},
+		}}
 	COMMANDS["leave"] = &Command{nil,
 		"cause me to leave the current channel",
 		"builtin",
 		"!leave",
+		nil,
 		nil}
 	COMMANDS["log"] = &Command{cmdLog,
 		"show the URL of a room's logs",
 		"HipChat API",
-		"!log [room]",
-		nil}
+		"",
+		nil,
+		[]Arg{
+			{Name: "room"},
+		}}
 	COMMANDS["man"] = &Command{cmdMan,
 		"summarize manual page",
 		"http://man7.org/linux/man-pages/",
-		"!man [<section>] <command>",
-		nil}
+		"",
+		nil,
+		[]Arg{
+			{Name: "section"},
+			{Name: "command", Required: true},
+		}}
 	COMMANDS["monkeystab"] = &Command{cmdMonkeyStab,
 		"unleash a troop of pen-wielding stabbing monkeys",
 		"builtin",
 		"!monkeystab <something>",
+		nil,
 		nil}
 	COMMANDS["oid"] = &Command{cmdOid,
 		"display OID information",
 		"http://oid-info.com/cgi-bin/display?action=display&oid=",
-		"!oid <oid>",
-		nil}
+		"",
+		nil,
+		[]Arg{
+			{Name: "oid", Required: true},
+		}}
 	COMMANDS["oncall"] = &Command{cmdOncall,
 		"show who's oncall",
 		"Service Now & OpsGenie",
 		"!oncall [<group>]\nIf <group> is not specified, this uses the channel name.\nUse '!set oncall=<rotation-name>' to change the default.\nIf your <rotation name> contains spaces, you have to quote the argument ('!set oncall=\"<rotation name>\"').\n\nIf you invoke the command and follow it with multiple arguments ('!oncall please look at ticket 12345'), then I will @-mention the current oncall for the rotation set in the channel and point them to your message.\n\nIf your channel does not have an oncall rotation and you want to have me reply to users with some other message, use '!set noncall=\"your message here\", and I will give people \"your message here\" when they run '!oncall'.\n\n",
-		[]string{"on_call", "on-call"}}
+		[]string{"on_call", "on-call"},
+		[]Arg{
+			{Name: "group"},
+			{Name: "message", Type: ARG_TEXT},
+		}}
 	COMMANDS["onion"] = &Command{cmdOnion,
 		"get your finest news headlines",
 		"https://www.theonion.com/",
-		"!onion [<term>]",
-		nil}
+		"",
+		nil,
+		[]Arg{
+			{Name: "term", Type: ARG_TEXT},
+		}}
 	COMMANDS["ping"] = &Command{cmdPing,
 		"try to ping hostname",
 		"ping(1)",
-		"!ping <hostname>",
-		nil}
+		"",
+		nil,
+		[]Arg{
+			{Name: "hostname"},
+		}}
 	COMMANDS["praise"] = &Command{cmdPraise,
 		"praise somebody",
 		URLS["praise"],
-		"!praise <somebody>",
-		[]string{"compliment"}}
+		"",
+		[]string{"compliment"},
+		[]Arg{
+			{Name: "somebody", Type: ARG_TEXT, Required: true},
+		}}
 	COMMANDS["pwgen"] = &Command{cmdPwgen,
 		"generate a password for you",
 		URLS["pwgen"],
-		"!pwgen [length] [count] [complex]",
-		nil}
+		"",
+		nil,
+		[]Arg{
+			{Name: "length", Type: ARG_INT, Help: "between 0 and 50"},
+			{Name: "count", Type: ARG_INT, Help: "between 0 and 50"},
+			{Name: "complex", Type: ARG_INT, Help: "any number asks for complex passwords"},
+		}}
 	COMMANDS["quote"] = &Command{cmdQuote,
 		"show stock price information",
 		"https://finance.yahoo.com/quote/",
-		"!quote <symbol>",
-		[]string{"stock"}}
+		"",
+		[]string{"stock"},
+		[]Arg{
+			{Name: "symbol", Type: ARG_TEXT, Required: true},
+		}}
 	COMMANDS["reset"] = &Command{cmdResetCounter,
 		"reset a global counter (requires bot admin privs)",
 		"builtin",
 		"!reset <counter>",
+		nil,
 		nil}
 	COMMANDS["rfc"] = &Command{cmdRfc,
 		"display title and URL of given RFC",
 		"https://tools.ietf.org/html/",
-		"!rfc <rfc>",
-		nil}
+		"",
+		nil,
+		[]Arg{
+			{Name: "rfc", Required: true},
+		}}
 	COMMANDS["room"] = &Command{cmdRoom,
 		"show information about the given chat room",
 		"HipChat / Slack API",
-		"!room <name>",
-		[]string{"channel"}}
+		"",
+		[]string{"channel"},
+		[]Arg{
+			{Name: "name", Required: true},
+		}}
 	COMMANDS["seen"] = &Command{cmdSeen,
 		"show last time <user> was seen in <channel>",
 		"builtin",
-		"!seen <user> [<channel>]",
-		nil}
+		"",
+		nil,
+		[]Arg{
+			{Name: "user", Required: true},
+			{Name: "channel"},
+		}}
 	COMMANDS["set"] = &Command{cmdSet,
 		"set a channel setting",
 		"builtin",
 		"!set -- show all current settings\n" +
-			"!set name=value -- set 'name' to 'value'\n",
-		[]string{"setting"}}
+			"!set name=value -- set 'name' to 'value'\n" +
+			"!set help [<name>] -- show the known settings, or explain 'name'\n",
+		[]string{"setting"},
+		[]Arg{
+			{Name: "name=value", Type: ARG_TEXT},
+		}}
 	COMMANDS["sms"] = &Command{cmdSms,
 		"show short code information",
 		"https://usshortcodedirectory.com/directory/",
-		"!sms <numbers>",
-		nil}
+		"",
+		nil,
+		[]Arg{
+			/* Yahoo! Shortcode */
+			{Name: "numbers", Default: "773786", Help: "the short code to look up"},
+		}}
 	COMMANDS["speb"] = &Command{cmdSpeb,
 		"show a security problem excuse bingo result",
 		/* http://crypto.com/bingo/pr */
 		URLS["speb"],
-		"!speb",
-		[]string{"secbingo"}}
+		"",
+		[]string{"secbingo"},
+		[]Arg{}}
 	COMMANDS["stfu"] = &Command{cmdStfu,
 		"show channel chatterers",
 		"builtin",
 		"!stfu [<user>]",
+		nil,
 		nil}
 	COMMANDS["tfln"] = &Command{cmdTfln,
 		"display a text from last night",
 		"http://www.textsfromlastnight.com/Random-Texts-From-Last-Night.html",
-		"!tfln",
-		nil}
+		"",
+		nil,
+		[]Arg{}}
 	COMMANDS["throttle"] = &Command{cmdThrottle,
 		"show current throttles",
 		"builtin",
@@ -3627,140 +3676,145 @@ func createCommands() {
 			fmt.Sprintf("!throttle <something>  -- set throttle for <something> to %d seconds\n", DEFAULT_THROTTLE) +
 			"!throttle <something> <seconds> -- set throttle for <something> to <seconds>\n" +
 			"Note: I will happily let you set throttles I don't know or care about.",
-		nil}
+		nil,
+		[]Arg{
+			{Name: "something"},
+			{Name: "seconds", Type: ARG_INT, Default: strconv.Itoa(DEFAULT_THROTTLE)},
+		}}
 	/*COMMANDS["time"] = &Command{cmdTime,
 	"show the current time",
 	"builtin",
 	"!time [TZ]",
+	nil,
 	nil}*/
 	COMMANDS["tld"] = &Command{cmdTld,
 		"show what TLD is",
 		"whois -h whois.iana.org",
-		"!tld <tld>",
-		nil}
+		"",
+		nil,
+		[]Arg{
+			{Name: "tld", Required: true},
+		}}
 	COMMANDS["toggle"] = &Command{cmdToggle,
 		"toggle a feature",
 		"builtin",
-		"!toggle [<feature>]",
-		nil}
+		"",
+		nil,
+		[]Arg{
+			{Name: "feature", Help: "omit to show all toggles"},
+		}}
 	COMMANDS["top"] = &Command{cmdTop,
 		"display top 10 stats of <counter>",
 		"builtin",
 		"!top <counter>",
+		nil,
 		nil}
 	COMMANDS["trivia"] = &Command{cmdTrivia,
 		"show a random piece of trivia",
 		URLS["trivia"],
-		"!trivia",
-		nil}
+		"",
+		nil,
+		[]Arg{}}
 	COMMANDS["troutslap"] = &Command{cmdTroutSlap,
 		"troutslap a sucker",
 		"builtin",
 		"!troutslap <something>",
+		nil,
 		nil}
 	COMMANDS["ud"] = &Command{cmdUd,
 		"look up a term using the Urban Dictionary (NSFW)",
 		"https://www.urbandictionary.com/",
-		"!ud [<term>]",
-		nil}
+		"",
+		nil,
+		[]Arg{
+			{Name: "term", Type: ARG_TEXT},
+		}}
 	COMMANDS["unset"] = &Command{cmdUnset,
 		"unset a channel setting",
 		"builtin",
-		"!unset name",
-		nil}
+		"",
+		nil,
+		[]Arg{
+			{Name: "name", Required: true},
+		}}
 	COMMANDS["unthrottle"] = &Command{cmdUnthrottle,
 		"unset a throttle",
 		"builtin",
 		"!unthrottle <throttle> -- remove given throttle for this channel\n" +
 			"Note: I will happily pretend to unthrottle throttles I don't know or care about.",
-		nil}
+		nil,
+		[]Arg{
+			{Name: "throttle", Required: true},
+		}}
 	COMMANDS["user"] = &Command{cmdUser,
-		"show information about the given HipChat user",
-		"HipChat API",
-		"!user <name>",
-		nil}
+		"show information about the given HipChat or XMPP user",
+		"HipChat API / XMPP roster",
+		"",
+		nil,
+		[]Arg{
+			{Name: "name", Required: true},
+		}}
 	COMMANDS["vu"] = &Command{cmdVu,
 		"display summary of a CERT vulnerability",
 		"https://www.kb.cert.org/vuls/id/",
-		"!vu <num>",
-		nil}
+		"",
+		nil,
+		[]Arg{
+			{Name: "num", Required: true},
+		}}
 	/*COMMANDS["weather"] = &Command{cmdWeather,
 	"show weather information",
 	"https://api.openweathermap.org/data/2.5/",
 	"!weather <location>",
+	nil,
 	nil}*/
 	COMMANDS["whois"] = &Command{cmdWhois,
 		"show whois information",
 		"whois(1)",
-		"!whois <domain>",
-		nil}
+		"",
+		nil,
+		[]Arg{
+			{Name: "domain", Required: true},
+		}}
 	COMMANDS["whocyberedme"] = &Command{cmdWhocyberedme,
 		"show who cybered you",
 		"https://whocybered.me",
-		"!whocyberedme",
-		[]string{"attribution"}}
+		"",
+		[]string{"attribution"},
+		[]Arg{}}
 	COMMANDS["wiki"] = &Command{cmdWiki,
 		"look up a term on Wikipedia",
 		"https://en.wikipedia.org/w/api.php?action=opensearch&redirects=resolve&search=",
-		"!wiki <something>",
-		nil}
+		"",
+		nil,
+		[]Arg{
+			{Name: "something", Type: ARG_TEXT, Required: true},
+		}}
 	/*COMMANDS["wtf"] = &Command{cmdWtf,
 	"decrypt acronyms",
 	"ywtf(1)",
-	"!wtf <term>",
-	[]string{"ywtf"}}*/
+	"",
+	[]string{"ywtf"},
+	[]Arg{
+		{Name: "is", Choices: []string{"is"}},
+		{Name: "term", Required: true},
+	}}*/
 	COMMANDS["xkcd"] = &Command{cmdXkcd,
 		"find an xkcd for you",
 		"https://relevantxkcd.appspot.com/",
-		"!xkcd <words>",
-		nil}
+		"",
+		nil,
+		[]Arg{
+			{Name: "words", Type: ARG_TEXT},
+		}}
 	COMMANDS["yubifail"] = &Command{cmdYubifail,
 		"check your yubifail count",
 		"builtin",
 		"!yubifail [<user>]",
+		nil,
 		nil}
 }
 
-func jbotDebug(in interface{}) {
-	if CONFIG["debug"] == "yes" {
-		fmt.Fprintf(os.Stderr, "%v\n", in)
-	}
-}
-
-func joinKnownChannels() {
-	verbose(1, "Joining channels slack thinks I'm in...")
-
-	var params slack.GetConversationsForUserParameters
-	params.UserID = CONFIG["slackID"]
-	params.Limit = 999
-	params.Cursor = ""
-	params.Types = []string{"public_channel", "private_channel"}
-
-	channels, cursor, err := SLACK_CLIENT.GetConversationsForUser(&params)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to GetConversationsForUser: %s\n", err)
-		return
-	}
-
-	for cursor != "" {
-		params.Cursor = cursor
-		nextChannels, nextCursor, err := SLACK_CLIENT.GetConversationsForUser(&params)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Unable to GetConversationsForUser: %s\n", err)
-			break
-		}
-		channels = append(channels, nextChannels...)
-		cursor = nextCursor
-	}
-
-	for _, c := range channels {
-		if _, found := CHANNELS[c.Name]; !found {
-			ch := newSlackChannel(c.Name, c.ID, "Slack")
-			CHANNELS[ch.Name] = &ch
-		}
-	}
-}
-
 func dehtmlify(in string) (out string) {
 	out = in
 	strip_html_re := regexp.MustCompile(`<.+?>`)
@@ -3775,131 +3829,8 @@ func dehtmlify(in string) (out string) {
 	return
 }
 
-func doTheHipChat() {
-	user := strings.Split(CONFIG["hcJabberID"], "@")[0]
-
-	authType := "plain"
-	pass := CONFIG["hcPassword"]
-	if len(pass) < 1 {
-		authType = "oauth"
-		pass = CONFIG["hcOauthToken"]
-	}
-
-	var err error
-	HIPCHAT_CLIENT, err = hipchat.NewClient(user, pass, "bot", authType)
-	if err != nil {
-		fail("Client error: %s\n", err)
-	}
-
-	HIPCHAT_CLIENT.Status("chat")
-	HIPCHAT_CLIENT.RequestUsers()
-	HIPCHAT_CLIENT.RequestRooms()
-
-	for _, ch := range CHANNELS {
-		verbose(1, "Joining HipChat channel #%s...", ch.Name)
-		HIPCHAT_CLIENT.Join(ch.Id, CONFIG["fullName"])
-
-		/* Our state file might not contain
-		 * the changed structures, so explicitly
-		 * fix things here. */
-		if len(ch.HipChatUsers) < 1 {
-			ch.HipChatUsers = make(map[hipchat.User]UserInfo, 0)
-		}
-
-		for t, v := range TOGGLES {
-			if len(ch.Toggles) == 0 {
-				ch.Toggles = map[string]bool{}
-			}
-			if _, found := ch.Toggles[t]; !found {
-				ch.Toggles[t] = v
-			}
-		}
-	}
-
-	go hcPeriodics()
-	go HIPCHAT_CLIENT.KeepAlive()
-
-	go func() {
-		defer catchPanic()
-
-		for {
-			select {
-			case message := <-HIPCHAT_CLIENT.Messages():
-				processHipChatMessage(message)
-			case users := <-HIPCHAT_CLIENT.Users():
-				updateRoster(users)
-			case rooms := <-HIPCHAT_CLIENT.Rooms():
-				updateHipChatRooms(rooms)
-			}
-		}
-	}()
-}
-
-func doTheSlackChat() {
-	SLACK_CLIENT = slack.New(CONFIG["slackToken"])
-
-	SLACK_RTM = SLACK_CLIENT.NewRTM()
-	go SLACK_RTM.ManageConnection()
-
-	/* If we introduced a new channel property,
-	 * but the serialized data does not contain it, it
-	 * would be undefined (e.g. 'off' / nonexistent
-	 * for a toggle).  So here we
-	 * quickly initialize all (unknown) data.
-	 */
-	updateChannels()
-
-	joinKnownChannels()
-	go updateSlackChannels()
-	go slackPeriodics()
-Loop:
-	for {
-		select {
-		case msg := <-SLACK_RTM.IncomingEvents:
-			switch ev := msg.Data.(type) {
-
-			case *slack.ChannelJoinedEvent:
-				processSlackChannelJoin(ev)
-
-			case *slack.ChannelRenameEvent:
-				processSlackChannelRename(ev)
-
-			case *slack.InvalidAuthEvent:
-				fmt.Fprintf(os.Stderr, "Unable to authenticate.")
-				break Loop
-
-			case *slack.MessageEvent:
-				processSlackMessage(ev)
-
-			case *slack.RateLimitEvent:
-				processSlackRateLimit(ev)
-
-			case *slack.RTMError:
-				fmt.Fprintf(os.Stderr, "Slack error: %s\n", ev.Error())
-
-			case *slack.UserChangeEvent:
-				processSlackUserChangeEvent(ev)
-			default:
-				jbotDebug(msg)
-
-			}
-		}
-	}
-}
-
-func expandSlackUser(in string) (u *slack.User) {
-	// Slack expands '@user' to e.g. '<@CBEAWGAPJ>'
-	slack_user_re := regexp.MustCompile(`(?i)<@([A-Z0-9]+)>`)
-	m := slack_user_re.FindStringSubmatch(in)
-	if len(m) > 0 {
-		u, _ = SLACK_CLIENT.GetUserInfo(m[1])
-	}
-
-	return
-}
-
 func fail(format string, v ...interface{}) {
-	fmt.Fprintf(os.Stderr, format+"\n", v...)
+	LOG.Error(strings.TrimSpace(fmt.Sprintf(format, v...)))
 	os.Exit(EXIT_FAILURE)
 }
 
@@ -3914,7 +3845,7 @@ func findCommandAlias(cmd string) (alias string) {
 	return
 }
 
-func fqdn(host string) (fqdn string) {
+func fqdn(ctx context.Context, host string) (fqdn string) {
 	/* Kinda like 'search' domains in /etc/resolv.conf. */
 	tries := []string{
 		host,
@@ -3923,7 +3854,7 @@ func fqdn(host string) (fqdn string) {
 	}
 
 	for _, h := range tries {
-		if _, err := net.LookupHost(h); err == nil {
+		if _, err := net.DefaultResolver.LookupHost(ctx, h); err == nil {
 			return h
 		}
 	}
@@ -3940,7 +3871,7 @@ func getopts() {
 		}
 		switch arg {
 		case "-D":
-			CONFIG["debug"] = "yes"
+			CONFIG_FLAGS["debug"] = "yes"
 			VERBOSITY = 10
 		case "-V":
 			printVersion()
@@ -3948,10 +3879,32 @@ func getopts() {
 		case "-c":
 			eatit = true
 			argcheck("-f", args, i)
-			CONFIG["configFile"] = args[i+1]
+			CONFIG_FLAGS["configFile"] = args[i+1]
+		case "-channels":
+			eatit = true
+			argcheck("-channels", args, i)
+			for _, ch := range strings.Split(args[i+1], ",") {
+				if ch = strings.TrimSpace(ch); len(ch) > 0 {
+					EXPORT_CHANNELS = append(EXPORT_CHANNELS, ch)
+				}
+			}
+		case "-e":
+			eatit = true
+			argcheck("-e", args, i)
+			CONSOLE_EVAL = args[i+1]
+		case "-export":
+			eatit = true
+			argcheck("-export", args, i)
+			EXPORT_FILE = args[i+1]
 		case "-h":
 			usage(os.Stdout)
 			os.Exit(EXIT_SUCCESS)
+		case "-i":
+			CONSOLE_INTERACTIVE = true
+		case "-import":
+			eatit = true
+			argcheck("-import", args, i)
+			IMPORT_FILE = args[i+1]
 		case "-v":
 			VERBOSITY++
 		default:
@@ -3960,76 +3913,38 @@ func getopts() {
 			os.Exit(EXIT_FAILURE)
 		}
 	}
-}
-
-func getAllMembersInChannel(id string) (allMembers []string) {
-	params := slack.GetUsersInConversationParameters{
-		ChannelID: id,
-		Limit:     1000,
-	}
 
-	for {
-		members, cursor, err := SLACK_CLIENT.GetUsersInConversation(&params)
-		if err != nil {
-			fmt.Printf("Unable to get conversation: %s\n", err)
-			break
-		}
-		allMembers = append(allMembers, members...)
-		if len(cursor) > 0 {
-			params.Cursor = cursor
-		} else {
-			break
-		}
+	if len(EXPORT_FILE) > 0 && len(IMPORT_FILE) > 0 {
+		fail("Please specify either '-export' or '-import', not both.")
 	}
-
-	return
 }
 
 func getChannel(chatType, id string) (ch *Channel, ok bool) {
 	ok = false
 
-	if chatType == "slack" {
-		uId := strings.ToUpper(id)
-		slackChannel, err := SLACK_CLIENT.GetConversationInfo(uId, false)
-		if err == nil {
-			id = slackChannel.Name
-		}
+	if b, found := BACKENDS[chatType]; found {
+		id = b.ResolveChannel(id)
 	}
 
-	ch, ok = CHANNELS[id]
+	ch, ok = getChannelByName(id)
 
 	return
 }
 
-func getChannelInfo(id string) (info string) {
-	var ch slack.Channel
-	found := false
-	if strings.HasPrefix(id, "#") {
-		id = id[1:]
-		ch, found = SLACK_CHANNELS[id]
-	}
-
-	if !found {
-		c, err := SLACK_CLIENT.GetConversationInfo(id, false)
-		if err != nil {
-			return
-		}
-		ch = *c
-		ch.Members = []string{}
+func getChannelRecipient(ch *Channel) (r Recipient) {
+	r.ChatType = ch.Type
+	if b, found := BACKENDS[ch.Type]; found {
+		r = b.ChannelRecipient(ch)
 	}
 
-	topic := ""
-	if len(ch.Topic.Value) > 0 {
-		topic = fmt.Sprintf(" -- \"%s\"", ch.Topic.Value)
-	}
-	members := getAllMembersInChannel(id)
-	info = fmt.Sprintf("%s (%d members)%s\n%s\n",
-		ch.Name, len(members),
-		topic, ch.Purpose.Value)
 	return
 }
 
+/* Returns a copy of the counter. */
 func getCounter(c string) (counter map[string]int, err string) {
+	STATE_LOCK.RLock()
+	defer STATE_LOCK.RUnlock()
+
 	cnt, ok := COUNTERS[c]
 	if !ok {
 		if len(c) > 0 {
@@ -4043,18 +3958,25 @@ func getCounter(c string) (counter map[string]int, err string) {
 		sort.Strings(counters)
 		err += strings.Join(counters, ", ")
 	} else {
-		counter = cnt
+		counter = make(map[string]int, len(cnt))
+		for k, v := range cnt {
+			counter[k] = v
+		}
 	}
 	return
 }
 
-func getManResults(section, cmd string) (result string) {
+func getManResults(ctx context.Context, section, cmd string) (result string) {
 	nsection := section
 	if strings.HasSuffix(section, "p") {
 		nsection = string(section[0])
 	}
 	theUrl := fmt.Sprintf("%sman%s/%s.%s.html", COMMANDS["man"].How, nsection, cmd, section)
-	data := getURLContents(theUrl, nil)
+	data, err := getURLContents(ctx, theUrl, nil)
+	if err != nil && !isFetchNotFound(err) {
+		LOG.WarnContext(ctx, "unable to fetch man page", "cmd", cmd, "section", section, "err", err)
+		return
+	}
 
 	section_re := regexp.MustCompile(`(?i)^<h2><a id="(NAME|SYNOPSIS|DESCRIPTION)" href="#`)
 	p := false
@@ -4099,48 +4021,8 @@ func getManResults(section, cmd string) (result string) {
 
 func getRecipientFromMessage(mfrom string, chatType string) (r Recipient) {
 	r.ChatType = chatType
-	if chatType == "hipchat" {
-		from := strings.Split(mfrom, "/")
-		r.Id = from[0]
-		r.ReplyTo = strings.SplitN(strings.Split(r.Id, "@")[0], "_", 2)[1]
-		r.Name = ""
-		r.MentionName = ""
-
-		if len(from) > 1 {
-			r.Name = from[1]
-		}
-
-		if len(r.Name) > 1 {
-			for _, u := range HIPCHAT_ROSTER {
-				if u.Name == r.Name {
-					r.MentionName = u.MentionName
-					break
-				}
-			}
-		}
-	} else if chatType == "slack" {
-		/* Format is "user@channel"; if no
-		 * "user" component, then we have a
-		 * privmsg, which is a private
-		 * channel. */
-		index := 0
-		if strings.HasPrefix(mfrom, "@") {
-			index = 1
-		}
-		from := strings.Split(mfrom, "@")
-		r.Id = strings.Trim(from[index], "@")
-		r.ReplyTo = from[1]
-		user, err := SLACK_CLIENT.GetUserInfo(r.Id)
-		if err != nil {
-			if bot, e := SLACK_CLIENT.GetBotInfo(r.Id); e == nil {
-				r.Name = bot.Name
-				r.MentionName = bot.Name
-			}
-			/* else: privmsg; let's just ignore it */
-		} else {
-			r.Name = user.Profile.RealName
-			r.MentionName = user.Name
-		}
+	if b, found := BACKENDS[chatType]; found {
+		r = b.ResolveUser(mfrom)
 	}
 
 	return
@@ -4175,116 +4057,6 @@ func getSortedKeys(hash map[string]int, rev bool) (sorted []string) {
 	return
 }
 
-/* Additional arguments can influence how the request is made:
- * - if args["auth"] is "x509", then the URL requires x509 client a cert / key
- *   from CONFIG["x509Cert"] and CONFIG["x509Key"]
- * - if args["by"] is "true", then the URL requires access credentials
- * - if args["corp"] is "true", then the URL requires a second type of credentials
- * - if args["ua"] is "true", then we fake the User-Agent
- * - if args["basic-auth-user"] is set, use that username for basic HTTP auth
- * - if args["basic-auth-password"] is set, use that password for basic HTTP auth
- * - if any args["header"] is set, use that value to set the given header
- *   set the given 'key=value' headers
- */
-func getURLContents(givenURL string, args map[string]string) (data []byte) {
-	/*verbose(3, "Fetching %s...", givenURL)
-
-	u, err := url.Parse(givenURL)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to parse url '%s': %s\n", givenURL, err)
-		return
-	}
-
-	client := &http.Client{}
-
-	if x509, ok := args["auth"]; ok && x509 == "x509" {
-		if len(CONFIG["x509Cert"]) < 1 || len(CONFIG["x509Key"]) < 1 {
-			fmt.Fprintf(os.Stderr, "URL '%s' requires an x509 cert/key, but none found in config.\n", givenURL)
-			return
-		}
-
-		client = mtls.NewClient(mtls.Config{
-			Cert: CONFIG["x509Cert"],
-			Key:  CONFIG["x509Key"],
-		})
-	}
-
-	if by, ok := args["by"]; ok && by == "true" {
-
-		jar, err := cookiejar.New(nil)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Unable to initialize cookie jar: %s\n", err)
-			return
-		}
-
-		_, err = bouncer.CheckLogin(givenURL, COOKIES)
-		if err != nil {
-			if !strings.Contains(err.Error(), "URL mismatch") {
-				fmt.Fprintf(os.Stderr, "+++ bouncer.CheckLogin failed: %s\n", err.Error())
-				return
-			}
-
-			verbose(4, "BY Cookies expired - reloading.")
-			loginOpt := bouncer.UseBouncer
-			if corp, ok := args["corp"]; ok && corp == "true" {
-				loginOpt = bouncer.UseGuesthouse
-			}
-			c, err := bouncer.Login(CONFIG["byUser"], CONFIG["byPassword"], loginOpt)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Unable to refresh BY cookie: %s\n", err)
-				return
-			}
-			COOKIES = c
-		}
-		jar.SetCookies(u, COOKIES)
-
-		client = &http.Client{
-			Jar: jar,
-		}
-	}
-
-	request, err := http.NewRequest("GET", givenURL, nil)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to create new request for '%s': %s\n", givenURL, err)
-		return
-	}
-
-	var ba_user string
-	var ba_pass string
-
-	for key, val := range args {
-		if key == "ua" {
-			request.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_13_2) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/63.0.3239.132 Safari/537.36")
-		} else if key == "basic-auth-user" {
-			ba_user = val
-		} else if key == "basic-auth-password" {
-			ba_pass = val
-		} else {
-			request.Header.Set(key, val)
-		}
-	}
-
-	if len(ba_user) > 0 {
-		request.SetBasicAuth(ba_user, ba_pass)
-	}
-
-	response, err := client.Do(request)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to GET '%s': %s\n", givenURL, err)
-		return
-	}
-
-	defer response.Body.Close()
-
-	data, err = ioutil.ReadAll(response.Body)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to read body of '%s': %s\n", givenURL, err)
-		return
-	}
-	*/
-	return
-}
-
 /*
  * !countable -> your total 'countable' account
  * !countable @user -> that user's total countable count
@@ -4301,7 +4073,7 @@ func getCountable(which, chName string, r Recipient, args []string) (result stri
 	} else if len(args) == 1 {
 		wanted = args[0]
 	}
-	verbose(3, "Getting %s count for %s in %s, looking for %s...", which, r.MentionName, chName, wanted)
+	LOG.Debug("getting count", "countable", which, "user", r.MentionName, "channel", chName, "wanted", wanted)
 
 	channelLookup := false
 	// Slack expands '#channel' to e.g. '<#CBEAWGAPJ|channel>'
@@ -4339,12 +4111,12 @@ func getCountable(which, chName string, r Recipient, args []string) (result stri
 }
 
 func getUserCountableByChannel(countable, channel string, r Recipient) (result string) {
-	verbose(3, "Getting %s count by channel for %s in %s...", countable, r.MentionName, channel)
+	LOG.Debug("getting count by channel", "countable", countable, "user", r.MentionName, "channel", channel)
 
 	count := 0
 	if channel == "*" {
 		userCurses := map[string]int{}
-		for _, ch := range CHANNELS {
+		for _, ch := range channelList() {
 			users := getUsersFromChannel(ch.Name, r.ChatType)
 			if uinfo, found := users[r.MentionName]; found {
 				if countable == "yubifail" {
@@ -4371,7 +4143,7 @@ func getUserCountableByChannel(countable, channel string, r Recipient) (result s
 			return
 		}
 	} else {
-		_, found := CHANNELS[channel]
+		_, found := getChannelByName(channel)
 		if !found {
 			result = fmt.Sprintf("I don't know anything about #%s.", channel)
 			return
@@ -4415,24 +4187,32 @@ func getUserCountableByChannel(countable, channel string, r Recipient) (result s
 	return
 }
 
+/* Returns a copy of the channel's seen users. */
 func getUsersFromChannel(channel, chatType string) (users map[string]UserInfo) {
+	STATE_LOCK.RLock()
+	defer STATE_LOCK.RUnlock()
+
 	ch, found := CHANNELS[channel]
 	if !found {
 		return
 	}
 
-	if chatType == "slack" {
-		users = ch.SlackUsers
-	} else {
-		for hc, u := range ch.HipChatUsers {
-			users[hc.MentionName] = u
+	if b, found := BACKENDS[chatType]; found {
+		users = map[string]UserInfo{}
+		for u, info := range b.SeenUsers(ch) {
+			users[u] = info
 		}
 	}
 
 	return
 }
 
+/* Counters change with nearly every message, so we
+ * leave writing them to the periodic serializeData(). */
 func incrementCounter(category, counter string) {
+	STATE_LOCK.Lock()
+	defer STATE_LOCK.Unlock()
+
 	if categoryCounters, ok := COUNTERS[category]; ok {
 		if ccount, ok := categoryCounters[counter]; ok {
 			categoryCounters[counter] = ccount + 1
@@ -4446,6 +4226,10 @@ func incrementCounter(category, counter string) {
 }
 
 func isThrottled(throttle string, ch *Channel) (is_throttled bool) {
+	defer storeChannel(ch)
+	STATE_LOCK.Lock()
+	defer STATE_LOCK.Unlock()
+
 	is_throttled = false
 	if ch.Throttles == nil {
 		ch.Throttles = map[string]time.Time{}
@@ -4465,28 +4249,16 @@ func isThrottled(throttle string, ch *Channel) (is_throttled bool) {
 }
 
 func leave(r Recipient, channelFound bool, msg string, command bool) {
-	verbose(2, "%s asked us to leave %s on %s.", r.Name, r.ReplyTo, r.ChatType)
+	LOG.Info("asked to leave", "user", r.Name, "channel", r.ReplyTo, "chat", r.ChatType)
 	if !command && !strings.Contains(msg, "please") {
 		reply(r, "Please ask politely.")
 		return
 	}
 
 	if channelFound {
-		if r.ChatType == "hipchat" {
-			HIPCHAT_CLIENT.Part(r.Id, CONFIG["fullName"])
-			delete(CHANNELS, r.ReplyTo)
-		} else if r.ChatType == "slack" {
-			msg := "Bots can't leave Slack channels - you'd have to find a Slack admin to kick me out.\n"
-			msg += "But I'm going to ignore everything in this channel going forward.\n"
-			msg += "If you do miss me terribly much, @-mention me and I'll start paying attention in here again, ok?\n\n"
-			rand.Seed(time.Now().UnixNano())
-			msg += cursiveText(GOODBYE[rand.Intn(len(GOODBYE))])
-			ch, found := getChannel(r.ChatType, r.ReplyTo)
-			if found {
-				ch.Settings["ignored"] = "true"
-				msg += fmt.Sprintf("\n_pretends to have left #%s._", ch.Name)
-			}
-			reply(r, msg)
+		if b, found := BACKENDS[r.ChatType]; found {
+			ch, _ := getChannel(r.ChatType, r.ReplyTo)
+			b.Leave(r, ch)
 		}
 	} else {
 		reply(r, "Try again from a channel I'm in.")
@@ -4503,10 +4275,10 @@ func listContains(list []string, item string) bool {
 	return false
 }
 
-func locationToTZ(l string) (result string, success bool) {
+func locationToTZ(ctx context.Context, l string) (result string, success bool) {
 	success = false
 
-	apikey := CONFIG["timezonedbApiKey"]
+	apikey := getConfig("timezonedbApiKey")
 	if len(apikey) < 1 {
 		result = "Missing 'timezonedbApiKey'."
 		return
@@ -4515,7 +4287,7 @@ func locationToTZ(l string) (result string, success bool) {
 	lat := "0.0"
 	lng := "0.0"
 
-	latlon := cmdLatLong(Recipient{}, "", []string{l})
+	latlon := cmdLatLong(ctx, Recipient{}, "", []string{l})
 	if !strings.Contains(latlon, ",") {
 		result = "Unknown location."
 		return
@@ -4527,7 +4299,11 @@ func locationToTZ(l string) (result string, success bool) {
 
 	theURL := fmt.Sprintf("http://api.timezonedb.com/v2.1/get-time-zone?key=%s&format=json&by=position&lat=%s&lng=%s",
 		apikey, lat, lng)
-	data := getURLContents(theURL, nil)
+	data, err := getURLContents(ctx, theURL, nil)
+	if err != nil {
+		result = fmt.Sprintf("Unable to fetch tz data: %s\n", err)
+		return
+	}
 
 	type TZData struct {
 		Abbreviation string
@@ -4542,7 +4318,7 @@ func locationToTZ(l string) (result string, success bool) {
 
 	var t TZData
 
-	err := json.Unmarshal(data, &t)
+	err = json.Unmarshal(data, &t)
 	if err != nil {
 		result = fmt.Sprintf("Unable to unmarshal tz data: %s\n", err)
 		return
@@ -4554,165 +4330,41 @@ func locationToTZ(l string) (result string, success bool) {
 	return
 }
 
-func newSlackChannel(name, id, inviter string) (ch Channel) {
-	verbose(2, "Creating new channel '#%s'...", name)
-
-	ch.Toggles = map[string]bool{}
-	ch.Throttles = map[string]time.Time{}
-	ch.Settings = map[string]string{}
-	ch.Type = "slack"
-	ch.Id = id
-	ch.SlackUsers = make(map[string]UserInfo, 0)
-	ch.Inviter = "Nobody"
-	ch.Name = name
-	ch.Phishy = &PhishCount{0, 0, time.Now(), time.Unix(0, 0)}
-
-	if len(inviter) > 0 {
-		user, err := SLACK_CLIENT.GetUserInfo(inviter)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Unable to find user information for '%s'.\n", inviter)
-		} else {
-			ch.Inviter = user.Name
-		}
-	}
+func periodics() {
+	n := 0
+	for _ = range time.Tick(PERIODICS * time.Second) {
+		LOG.Info("running periodics")
+
+		go serializeData()
+		go channelPeriodics()
 
-	for t, v := range TOGGLES {
-		ch.Toggles[t] = v
+		if (n % CVE_FEED_UPDATE_INTERVAL) == 0 {
+			updateCVEData()
+		}
+		n++
 	}
+}
 
-	return
+func printVersion() {
+	fmt.Printf("%v version %v\n", PROGNAME, VERSION)
 }
 
-func parseConfig() {
-	fname := CONFIG["configFile"]
-	verbose(1, "Parsing config file '%s'...", fname)
-	fd, err := os.Open(fname)
-	if err != nil {
-		fail("Unable to open '%s': %v\n", fname, err)
-	}
-	defer fd.Close()
-
-	n := 0
-	input := bufio.NewReader(fd)
-	for {
-		data, err := input.ReadBytes('\n')
-		if err != nil {
-			if err != io.EOF {
-				fmt.Fprintf(os.Stderr, "Unable to read input: %v\n", err)
-			}
-			break
-		}
-
-		/* Ignore everything after '#' */
-		line := strings.Split(string(data), "#")[0]
-		line = strings.TrimSpace(line)
-
-		n++
-
-		if len(line) == 0 {
-			continue
-		}
-
-		keyval := strings.Split(line, "=")
-		if len(keyval) != 2 {
-			fail("Invalid line in configuration file '%s', line %d.",
-				fname, n)
-		} else {
-			key := strings.TrimSpace(keyval[0])
-			val := strings.TrimSpace(keyval[1])
-			printval := val
-			for _, s := range SECRETS {
-				if key == s {
-					printval = val[:4] + "..."
-					break
-				}
-			}
-			jbotDebug(fmt.Sprintf("Setting '%s' to '%s'...", key, printval))
-			CONFIG[key] = val
-		}
-	}
-
-	if len(CONFIG["hcService"]) > 0 {
-		if len(CONFIG["hcPassword"]) > 0 && len(CONFIG["hcOauthToken"]) > 0 {
-			fail("Please set *either* 'password' *or* 'oauth_token', not both.\n")
-		} else if len(CONFIG["hcPassword"]) < 1 && len(CONFIG["hcOauthToken"]) < 1 {
-			fail("You need to set either 'password' or 'oauth_token' in your config.\n")
-		}
-
-		if len(CONFIG["hcControlChannel"]) > 0 {
-			var ch Channel
-
-			verbose(2, "Setting up control channel '%s'...", CONFIG["hcControlChannel"])
-			r := getRecipientFromMessage(CONFIG["hcControlChannel"], "hipchat")
-
-			ch.Toggles = map[string]bool{}
-			ch.Throttles = map[string]time.Time{}
-			ch.Settings = map[string]string{}
-			ch.Type = "hipchat"
-			ch.Name = r.ReplyTo
-			ch.Id = r.Id
-			ch.HipChatUsers = make(map[hipchat.User]UserInfo, 0)
-			for t, v := range TOGGLES {
-				ch.Toggles[t] = v
-			}
-			jbotDebug(fmt.Sprintf("%v", ch))
-			CHANNELS[ch.Name] = &ch
-		}
-	}
-
-	if len(CONFIG["slackService"]) > 0 {
-		if len(CONFIG["mentionName"]) < 1 || len(CONFIG["slackToken"]) < 0 {
-			fail("Please set 'mentionName' and 'slackToken'.")
-		}
-	}
-
-	fileOptions := []string{"x509Cert", "x509Key"}
-	for _, f := range fileOptions {
-		if len(CONFIG[f]) > 0 {
-			fh, err := os.Open(CONFIG[f])
-			if err != nil {
-				fail("Unable to open %s file '%s': %q\n", f, CONFIG[f], err)
-			}
-			fh.Close()
-		}
-	}
-}
-
-func hcPeriodics() {
-	for _ = range time.Tick(PERIODICS * time.Second) {
-		HIPCHAT_CLIENT.Status("chat")
-		HIPCHAT_CLIENT.RequestUsers()
-		HIPCHAT_CLIENT.RequestRooms()
-
-		if len(CONFIG["hcControlChannel"]) > 0 {
-			r := getRecipientFromMessage(CONFIG["hcControlChannel"], "hipchat")
-			HIPCHAT_CLIENT.Say(r.Id, CONFIG["fullName"], "ping")
-		}
-	}
-}
-
-func printVersion() {
-	fmt.Printf("%v version %v\n", PROGNAME, VERSION)
-}
-
-func processCommands(r Recipient, invocation, line string) {
-	defer catchPanic()
+func processCommands(ctx context.Context, r Recipient, invocation, line string) {
+	defer catchPanic()
 
 	who := r.ReplyTo
 	ch, channelFound := getChannel(r.ChatType, r.ReplyTo)
 	if channelFound {
 		who = ch.Name
-	} else if r.ChatType == "slack" {
-		if user, err := SLACK_CLIENT.GetUserInfo(r.Id); err == nil {
-			who = user.Name
-		}
+	} else if len(r.MentionName) > 0 {
+		who = r.MentionName
 	}
 
 	line = replaceFancyQuotes(line)
 
 	args, err := shlex.Split(line)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to shlex.Split(%s): %s\n", line, err)
+		LOG.WarnContext(ctx, "unable to split command line", "line", line, "err", err)
 		args = strings.Fields(line)
 	}
 	if len(args) < 1 {
@@ -4738,10 +4390,10 @@ func processCommands(r Recipient, invocation, line string) {
 		return
 	}
 
-	verbose(2, "%s #%s: '%s'", r.ChatType, who, line)
+	LOG.DebugContext(ctx, "processing command line", "who", who, "line", line)
 
 	var cmd string
-	if strings.EqualFold(args[0], CONFIG["mentionName"]) {
+	if strings.EqualFold(args[0], getConfig("mentionName")) {
 		args = args[1:]
 	}
 
@@ -4750,7 +4402,7 @@ func processCommands(r Recipient, invocation, line string) {
 		args = args[1:]
 	}
 
-	jbotDebug(fmt.Sprintf("|%s| |%s|", cmd, args))
+	LOG.DebugContext(ctx, "parsed command line", "cmd", cmd, "args", args)
 
 	/* '!leave' does not have a callback, so needs
 	 * to be processed first. */
@@ -4789,23 +4441,24 @@ func processCommands(r Recipient, invocation, line string) {
 			if rex.MatchString(cmd) {
 				return
 			}
-			response = cmdHelp(r, r.ReplyTo, []string{cmd})
+			response = cmdHelp(context.Background(), r, r.ReplyTo, []string{cmd})
 		} else if channelFound {
-			processChatter(r, line, true)
+			processChatter(ctx, r, line, true)
 			return
 		}
 	}
 
 	if commandFound {
+		ctx = withLogFields(ctx, "command", cmd)
 		incrementCounter("commands", cmd)
 		if COMMANDS[cmd].Call != nil {
 			chName := r.ReplyTo
 			if ch, found := getChannel(r.ChatType, r.ReplyTo); found {
 				chName = ch.Name
 			}
-			response = COMMANDS[cmd].Call(r, chName, args)
+			response = callCommand(ctx, cmd, r, chName, args)
 		} else {
-			fmt.Fprintf(os.Stderr, "'nil' function for %s?\n", cmd)
+			LOG.ErrorContext(ctx, "command has no function")
 			return
 		}
 	}
@@ -4814,315 +4467,38 @@ func processCommands(r Recipient, invocation, line string) {
 	return
 }
 
-func processHipChatInvite(r Recipient, invite string) {
-	from := strings.Split(invite, "'")[1]
-	fr := getRecipientFromMessage(from, "hipchat")
-	inviter := strings.Split(fr.Id, "@")[0]
-	channelName := r.ReplyTo
-
-	var ch Channel
-	ch.Toggles = map[string]bool{}
-	ch.Throttles = map[string]time.Time{}
-	ch.Settings = map[string]string{}
-	ch.Name = r.ReplyTo
-	ch.Type = "hipchat"
-	ch.Id = r.Id
-	if _, found := HIPCHAT_ROSTER[inviter]; found {
-		ch.Inviter = HIPCHAT_ROSTER[inviter].MentionName
-	} else {
-		ch.Inviter = "Nobody"
-	}
-	ch.HipChatUsers = make(map[hipchat.User]UserInfo, 0)
-
-	for t, v := range TOGGLES {
-		ch.Toggles[t] = v
-	}
-
-	verbose(2, "I was invited into '%s' (%s) by '%s'.", channelName, r.Id, from)
-	CHANNELS[channelName] = &ch
-	verbose(1, "Joining HipChat #%s...", ch.Name)
-	HIPCHAT_CLIENT.Join(r.Id, CONFIG["fullName"])
-}
-
-func processHipChatMessage(message *hipchat.Message) {
-	if len(message.Body) < 1 {
-		/* If a user initiates a 1:1 dialog
-		 * with the bot, the hipchat client will send a ''
-		 * ping even if they try to close the
-		 * dialog.  If there is no data, we
-		 * have no business replying or doing
-		 * much of anything, so let's just
-		 * return. */
-		return
-	}
-
-	r := getRecipientFromMessage(message.From, "hipchat")
-	if r.Name == CONFIG["fullName"] {
-		//verbose("Ignoring message from myself.", 5)
-		return
-	}
-
-	updateSeen(r, message.Body)
-
-	if strings.HasPrefix(message.Body, "<invite from") {
-		processHipChatInvite(r, message.Body)
-		return
-	}
-
-	if len(r.Name) < 1 && len(r.MentionName) < 1 {
-		verbose(3, "Ignoring channel topic message ('%s') in #%s.", message.Body, r.ReplyTo)
-		return
-	}
-
-	processMessage(r, message.Body)
-}
+func processMessage(parent context.Context, r Recipient, msg string) {
+	ctx := messageContext(parent, r)
 
-func processMessage(r Recipient, msg string) {
-	p := fmt.Sprintf("^(?i)(!|[@/]%s [/!]?", CONFIG["mentionName"])
+	p := fmt.Sprintf("^(?i)(!|[@/]%s [/!]?", getConfig("mentionName"))
 
 	if r.ChatType == "slack" {
-		p += "|<@" + CONFIG["slackID"] + "> [/!]?"
+		p += "|<@" + getConfig("slackID") + "> [/!]?"
 	}
 	p += ")"
 
 	command_re := regexp.MustCompile(p)
 	if command_re.MatchString(msg) {
 		matchEnd := command_re.FindStringIndex(msg)[1]
-		processCommands(r, msg[0:matchEnd], msg[matchEnd:])
+		processCommands(ctx, r, msg[0:matchEnd], msg[matchEnd:])
 	} else {
-		processChatter(r, msg, false)
-	}
-}
-
-func processSlackChannelJoin(ev *slack.ChannelJoinedEvent) {
-	jbotDebug(fmt.Sprintf("Join: %v\n", ev))
-}
-
-func processSlackChannelRename(ev *slack.ChannelRenameEvent) {
-	newName := ev.Channel.Name
-	id := ev.Channel.ID
-	verbose(1, "Renaming '<%s>' to '#%s'...", id, newName)
-	if _, found := CHANNELS[newName]; found {
-		fmt.Fprintf(os.Stderr, "Renamed channel '%s' already found?\n", newName)
-		return
-	}
-
-	for oldName, chInfo := range CHANNELS {
-		if chInfo.Id == id {
-			verbose(2, "Renaming '#%s' to '#%s'...", oldName, newName)
-			delete(CHANNELS, oldName)
-			chInfo.Name = newName
-			CHANNELS[newName] = chInfo
-			break
-		}
+		processChatter(ctx, r, msg, false)
 	}
 }
 
-func processSlackInvite(r Recipient, name string, msg *slack.MessageEvent) {
-	if strings.Contains(msg.Text, "<@"+CONFIG["slackID"]+">") {
-		slackChannel, err := SLACK_CLIENT.GetConversationInfo(msg.Channel, false)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Unable to SLACK_CLIENT.GetConversationInfo(%s): %s\n",
-				msg.Channel, err)
-			return
-		}
-		if slackChannel.IsExtShared {
-			fmt.Fprintf(os.Stderr, "Refusing to join externally shared channel '%s' (%s).\n",
-				slackChannel.Name, msg.Channel)
-			return
-		}
-		ch := newSlackChannel(name, msg.Channel, msg.User)
-		verbose(2, "I was invited into Slack '%s' (%s) by '%s'.", ch.Name, ch.Id, ch.Inviter)
-		CHANNELS[ch.Name] = &ch
-		rand.Seed(time.Now().UnixNano())
-		reply(r, HELLO[rand.Intn(len(HELLO))])
-	}
-}
-
-func processSlackMessage(msg *slack.MessageEvent) {
-	jbotDebug(fmt.Sprintf("\nMessage: |%v|", msg))
-
-	LAST_SLACK_MESSAGE_TIME = time.Now()
-
-	info := SLACK_RTM.GetInfo()
-
-	var channelName string
-
-	channel, err := SLACK_CLIENT.GetConversationInfo(msg.Channel, false)
-	if err == nil {
-		channelName = channel.Name
-	}
-
-	r := getRecipientFromMessage(fmt.Sprintf("%s@%s", msg.User, msg.Channel), "slack")
-
-	ch, found := CHANNELS[channelName]
-	if !found {
-		/* Hey, let's just pretend that any
-		 * message we get in a channel that
-		 * we don't know about is effectively
-		 * an invite. */
-		processSlackInvite(r, channelName, msg)
-		return
-	} else {
-		ignored := ch.Settings["ignored"]
-		atMention := fmt.Sprintf("<@" + CONFIG["slackID"] + ">")
-		if strings.EqualFold(ignored, "true") {
-			if strings.Contains(msg.Text, atMention) {
-				ch.Settings["ignored"] = "false"
-			} else {
-				return
-			}
-		}
-	}
-
-	if msg.User == info.User.ID {
-		/* Ignore our own messages. */
-		return
-	}
-
-	txt := msg.Text
-	if msg.SubType == "message_changed" {
-		/* When unfirling a link, Slack effectively updates
-		 * the original message, so it shows up here again
-		 * with an attachment.  Let's simply ignore any
-		 * edited messages with attachments to avoid processing
-		 * it twice. */
-		if len(msg.SubMessage.Attachments) > 0 {
-			return
-		}
-
-		txt = msg.SubMessage.Text
-		/* Edited messages come from the channel only,
-		 * so we need to reconstruct the recipient from
-		 * the submessage.  That will yield a no-channel
-		 * recipient, however, so we reuse the original
-		 * channel to avoid sending a privmsg. */
-		r = getRecipientFromMessage(fmt.Sprintf("%s@%s", msg.SubMessage.User, msg.Channel), "slack")
-	}
-
-	/* E.g. threads and replies get a dupe event with
-	 * an empty text.  Let's ignore those right
-	 * away. */
-	if len(txt) < 1 {
-		return
-	}
-
-	updateSeen(r, txt)
-
-	/* Slack "helpfully" hyperlinks text that
-	 * looks like a URL:
-	 * "foo www.yahoo.com" becomes "foo <http://www.yahoo.com|www.yahoo.com>"
-	 * Undo that nonsense.
-	 *
-	 * Note: Slack will also do all sorts of other
-	 * encoding and linking, but to undo all of
-	 * that would quickly become way too complex,
-	 * so here we only undo the simplest cases to
-	 * allow users to pass hostnames. */
-	txt = SLACK_UNLINK_RE1.ReplaceAllString(txt, "${3}")
-	txt = SLACK_UNLINK_RE2.ReplaceAllString(txt, "${1}")
-	processMessage(r, txt)
-}
-
-func processSlackRateLimit(ev *slack.RateLimitEvent) {
-	fmt.Fprintf(os.Stderr, "%v\n", ev)
-}
-
-func processSlackUserChangeEvent(ev *slack.UserChangeEvent) {
-	if !ev.User.IsBot {
-		return
-	}
-
-	newName := ev.User.Name
-	oldReal := ev.User.Profile.RealName
-
-	if oldReal == CONFIG["fullName"] {
-		if newName != oldReal {
-			verbose(1, "Bot was renamed from '%s' to '%s'!", oldReal, newName)
-		}
-
-		from := CONFIG["fullName"] + "@" + CONFIG["emailDomain"]
-		to := []string{CONFIG["botOwner"] + "@" + CONFIG["emailDomain"]}
-		subject := CONFIG["fullName"] + " bot change"
-		body := fmt.Sprintf("New User Info:\n\n"+
-			"ID: %s\n"+
-			"TeamID: %s\n"+
-			"Name: %s\n"+
-			"Deleted: %v\n"+
-			"RealName: %s\n"+
-			"Profile:\n"+
-			"  FirstName: %s\n"+
-			"  LastName: %s\n"+
-			"  RealName: %s\n"+
-			"  Email: %s\n",
-			ev.User.ID,
-			ev.User.TeamID,
-			ev.User.Name,
-			ev.User.Deleted,
-			ev.User.RealName,
-			ev.User.Profile.FirstName,
-			ev.User.Profile.LastName,
-			ev.User.Profile.RealName,
-			ev.User.Profile.Email)
-
-		err := sendMailSMTP(from, to, []string{""}, subject, body)
-		if len(err) > 0 {
-			fmt.Fprintf(os.Stderr, "Unable to send bot change mail: %s\n", err)
-			fmt.Fprintf(os.Stderr, "%v\n", ev)
-		}
-	}
-}
-
-func randomLineFromUrl(theUrl string, useBy bool) (line string) {
+/* Returns an empty line if the URL can't be
+ * fetched. */
+func randomLineFromUrl(ctx context.Context, theUrl string) (line string) {
 	rand.Seed(time.Now().UnixNano())
-	urlArgs := map[string]string{"by": "false"}
-	if useBy {
-		urlArgs["by"] = "true"
+	data, err := getURLContents(ctx, theUrl, nil)
+	if err != nil {
+		return
 	}
-	data := getURLContents(theUrl, urlArgs)
 	lines := strings.Split(string(data), "\n")
 	line = lines[rand.Intn(len(lines))]
 	return
 }
 
-func readSavedData() {
-	verbose(2, "Reading saved data from: %s", CONFIG["channelsFile"])
-	if _, err := os.Stat(CONFIG["channelsFile"]); err != nil {
-		return
-	}
-
-	b, err := ioutil.ReadFile(CONFIG["channelsFile"])
-	if err != nil {
-		fail("Error %s: %q\n", CONFIG["channelsFile"], err)
-	}
-
-	buf := bytes.Buffer{}
-	buf.Write(b)
-
-	d := gob.NewDecoder(&buf)
-	if err := d.Decode(&CHANNELS); err != nil {
-		fail("Unable to decode data: %s\n", err)
-	}
-
-	verbose(2, "Reading saved data from: %s", CONFIG["countersFile"])
-	if _, err := os.Stat(CONFIG["countersFile"]); err != nil {
-		return
-	}
-
-	b, err = ioutil.ReadFile(CONFIG["countersFile"])
-	if err != nil {
-		fail("Error %s: %q\n", CONFIG["countersFile"], err)
-	}
-
-	buf = bytes.Buffer{}
-	buf.Write(b)
-
-	d = gob.NewDecoder(&buf)
-	if err := d.Decode(&COUNTERS); err != nil {
-		fail("Unable to decode data: %s\n", err)
-	}
-}
-
 func replaceFancyQuotes(in string) (out string) {
 	out = in
 
@@ -5144,56 +4520,31 @@ func replaceFancyQuotes(in string) (out string) {
 
 func reply(r Recipient, msg string) {
 	incrementCounter("replies", msg)
-	if r.ChatType == "hipchat" {
-		if _, found := CHANNELS[r.ReplyTo]; found {
-			HIPCHAT_CLIENT.Say(r.Id, CONFIG["fullName"], msg)
-		} else {
-			HIPCHAT_CLIENT.PrivSay(r.Id, CONFIG["fullName"], msg)
-		}
-	} else if r.ChatType == "slack" {
-		recipient := r.ReplyTo
-		channelName := "#"
-		slackChannel, err := SLACK_CLIENT.GetConversationInfo(r.ReplyTo, false)
-		if err == nil {
-			channelName = slackChannel.Name
-		} else {
-			_, _, id, err := SLACK_RTM.OpenIMChannel(r.Id)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Unable to open private channel: %s\n%v\n", err, r)
-				return
-			}
-			recipient = id
-		}
-
-		for len(msg) > SLACK_MAX_LENGTH {
-			verbose(3, "Message length %d > limit %d, chunking...\n", len(msg), SLACK_MAX_LENGTH)
-			m1 := msg[:SLACK_MAX_LENGTH-1]
-
-			last_index := strings.LastIndex(m1, "\n")
-			if last_index == 0 {
-				last_index = strings.LastIndex(m1, " ")
-			}
-			if last_index == 0 {
-				last_index = strings.LastIndex(m1, ",")
-			}
-			if last_index > 0 {
-				m1 = msg[:last_index-1]
-				msg = msg[last_index+1:]
+	if b, found := BACKENDS[r.ChatType]; found {
+		b.Send(r, msg)
+	}
+}
 
-				m1 = fontFormat(channelName, m1)
-				SLACK_RTM.SendMessage(SLACK_RTM.NewOutgoingMessage(m1, recipient))
-			} else {
-				SLACK_RTM.SendMessage(SLACK_RTM.NewOutgoingMessage("Message too long, truncating...\n", recipient))
-				SLACK_RTM.SendMessage(SLACK_RTM.NewOutgoingMessage(msg[:SLACK_MAX_LENGTH-1], recipient))
-				msg = msg[SLACK_MAX_LENGTH:]
-			}
-		}
-		msg = fontFormat(channelName, msg)
-		SLACK_RTM.SendMessage(SLACK_RTM.NewOutgoingMessage(msg, recipient))
+/* Like reply(), but the backend may drop the message
+ * and summarize what it dropped as "N more <kind>
+ * suppressed." */
+func replyBulk(r Recipient, kind, msg string) {
+	if b, ok := BACKENDS[r.ChatType].(BulkSender); ok {
+		incrementCounter("replies", msg)
+		b.SendBulk(r, kind, msg)
+		return
 	}
+	reply(r, msg)
+}
+
+func resetCounter(c string) {
+	defer storeCounter(c)
+	STATE_LOCK.Lock()
+	defer STATE_LOCK.Unlock()
+	COUNTERS[c] = map[string]int{}
 }
 
-func runCommand(cmd ...string) (out []byte, rval int) {
+func runCommand(ctx context.Context, cmd ...string) (out []byte, rval int) {
 	var argv []string
 
 	if len(cmd) == 0 {
@@ -5207,72 +4558,39 @@ func runCommand(cmd ...string) (out []byte, rval int) {
 			argv = append(argv, dehtmlify(word))
 		}
 	}
-	command := exec.Command(argv[0], argv[1:]...)
+	command := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	/* Don't wait for grandchildren holding on to
+	 * our output once the command was killed. */
+	command.WaitDelay = time.Second
 
 	rval = 0
-	verbose(3, "Exec'ing '%s'...", argv)
-
-	go func() {
-		time.Sleep(30 * time.Second)
-		if command != nil && command.ProcessState != nil &&
-			command.ProcessState.Exited() != true {
-			response := fmt.Sprintf("Sorry, I had to kill your '%s' command.\n", cmd)
-			fmt.Fprintf(os.Stderr, ":: |%v|\n", command)
-			if err := command.Process.Kill(); err != nil {
-				response += fmt.Sprintf("Unable to kill your process: %s", err)
-			}
-			out = []byte(response)
-		}
-	}()
-
-	tmp, err := command.CombinedOutput()
-	if err != nil {
+	LOG.DebugContext(ctx, "exec'ing command", "argv", argv)
+
+	start := time.Now()
+	out, err := command.CombinedOutput()
+	observeMetric("jbot_external_call_duration_seconds", time.Since(start), "exec", argv[0])
+	if ctx.Err() == context.DeadlineExceeded {
+		LOG.WarnContext(ctx, "killed command after timeout", "argv", argv)
+		out = []byte(fmt.Sprintf("Sorry, I had to kill your '%s' command.\n", argv[0]))
+		rval = 1
+	} else if err != nil {
 		rval = 1
-		if len(out) < 1 && len(tmp) < 1 {
+		if len(out) < 1 {
 			out = []byte(fmt.Sprintf("%s", err))
 		}
 	}
-
-	if len(out) < 1 {
-		out = tmp
-	}
 	return
 }
 
 func serializeData() {
-	verbose(1, "Serializing data...")
-
-	gob.Register(Channel{})
-	b := bytes.Buffer{}
-	e := gob.NewEncoder(&b)
-	if err := e.Encode(CHANNELS); err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to encode channels: %s\n", err)
-		return
-	}
-
-	err := ioutil.WriteFile(CONFIG["channelsFile"], b.Bytes(), 0600)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to write data to '%s': %s\n",
-			CONFIG["channelsFile"], err)
-		return
-	}
-
-	gob.Register(map[string]int{})
-	b = bytes.Buffer{}
-	e = gob.NewEncoder(&b)
-	if err := e.Encode(COUNTERS); err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to encode counters: %s\n", err)
-		return
-	}
+	STORE_LOG.Info("serializing data")
 
-	err = ioutil.WriteFile(CONFIG["countersFile"], b.Bytes(), 0600)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to write data to '%s': %s\n",
-			CONFIG["countersFile"], err)
+	if err := storeSave(); err != nil {
+		STORE_LOG.Error("unable to write data", "file", getConfig("stateDB"), "err", err)
 		return
 	}
 
-	memfile := CONFIG["memfile"]
+	memfile := getConfig("memfile")
 	if len(memfile) > 0 {
 		f, err := os.Create(memfile)
 		if err != nil {
@@ -5280,7 +4598,7 @@ func serializeData() {
 		}
 		defer f.Close()
 		runtime.GC()
-		verbose(2, "Writing memory profile...")
+		LOG.Debug("writing memory profile", "file", memfile)
 		if err := pprof.WriteHeapProfile(f); err != nil {
 			fail("Unable to write memory profile: %s\n", err)
 		}
@@ -5288,7 +4606,7 @@ func serializeData() {
 }
 
 func sendMailSMTP(from string, to, cc []string, subject, body string) (errstr string) {
-	verbose(3, "Sending email from '%s' to '%s' with subject '%s'...", from, strings.Join(to, ", "), subject)
+	LOG.Debug("sending email", "from", from, "to", strings.Join(to, ", "), "subject", subject)
 
 	msg := []byte(fmt.Sprintf("From: %s\r\n", from) +
 		fmt.Sprintf("To: %s\r\n", strings.Join(to, ", ")) +
@@ -5298,7 +4616,7 @@ func sendMailSMTP(from string, to, cc []string, subject, body string) (errstr st
 		"\r\n" +
 		body + "\r\n")
 
-	err := smtp.SendMail(CONFIG["SMTP"], nil, from, to, msg)
+	err := smtp.SendMail(getConfig("SMTP"), nil, from, to, msg)
 	if err != nil {
 		return fmt.Sprintf("%s", err)
 	}
@@ -5306,94 +4624,6 @@ func sendMailSMTP(from string, to, cc []string, subject, body string) (errstr st
 	return
 }
 
-func slackChannelPeriodics() {
-	verbose(2, "Running slack channel periodics...")
-	for _, chInfo := range CHANNELS {
-		cveAlert(*chInfo)
-		snowAlerts(*chInfo)
-		jiraAlert(*chInfo, false)
-	}
-}
-
-func slackLiveCheck() {
-	verbose(2, "Checking if Slack is still sending me messages...")
-
-	threshold := SLACK_LIVE_CHECK * PERIODICS * time.Second
-
-	diff := time.Now().Sub(LAST_SLACK_MESSAGE_TIME)
-	if diff.Seconds() > threshold.Seconds() {
-		verbose(2, "Uhoh, I haven't seen any messages in %s seconds. Restarting...", threshold)
-		serializeData()
-		err := syscall.Exec(os.Args[0], os.Args, os.Environ())
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Unable to restart: %s\n", err)
-		}
-	}
-}
-
-func slackPeriodics() {
-	ticks := PERIODICS * time.Second
-
-	n := 0
-	for _ = range time.Tick(ticks) {
-		verbose(1, "Running slack periodics...")
-
-		go serializeData()
-		go slackChannelPeriodics()
-
-		if (n % SLACK_CHANNEL_UPDATE_INTERVAL) == 0 {
-			go updateSlackChannels()
-		}
-		if (n % CVE_FEED_UPDATE_INTERVAL) == 0 {
-			updateCVEData()
-		}
-
-		if (n % SLACK_LIVE_CHECK) == 0 {
-			slackLiveCheck()
-		}
-		n++
-	}
-}
-
-func updateHipChatRooms(rooms []*hipchat.Room) {
-	for _, room := range rooms {
-		HIPCHAT_ROOMS[room.Id] = room
-	}
-}
-
-func updateSlackChannels() {
-	params := slack.GetConversationsParameters{
-		Limit: 1000,
-	}
-
-	for {
-		channels, cursor, err := SLACK_CLIENT.GetConversations(&params)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Unable to get conversations: %s\n", err)
-			break
-		}
-		for _, c := range channels {
-			/* Let's not try to keep in
-			 * memory a map of all users
-			 * in all channels... */
-			c.Members = []string{}
-			SLACK_CHANNELS[c.Name] = c
-		}
-		if len(cursor) > 0 {
-			params.Cursor = cursor
-		} else {
-			break
-		}
-	}
-}
-
-func updateRoster(users []*hipchat.User) {
-	for _, user := range users {
-		uid := strings.Split(user.Id, "@")[0]
-		HIPCHAT_ROSTER[uid] = user
-	}
-}
-
 func updateSeen(r Recipient, msg string) {
 	if len(r.Name) == 0 {
 		/* Not a chat message. */
@@ -5436,98 +4666,69 @@ func updateSeen(r Recipient, msg string) {
 			count -= 1
 		}
 
-		if r.ChatType == "hipchat" {
-			var u *hipchat.User
-			for _, u = range HIPCHAT_ROSTER {
-				if u.Name == r.Name {
-					break
-				}
-			}
-			if u == nil {
-				return
-			}
+		b, found := BACKENDS[r.ChatType]
+		if !found {
+			return
+		}
 
-			if t, found := ch.HipChatUsers[*u]; found {
-				uInfo.Yubifail = t.Yubifail + len(yubifail_match)
-				uInfo.Curses = t.Curses + len(curses_match)
-				uInfo.Count = t.Count + count
+		STATE_LOCK.Lock()
+		defer STATE_LOCK.Unlock()
 
-				/* Need to remember other counters here,
-				 * lest they be reset. */
-				for c, n := range t.CurseWords {
-					uInfo.CurseWords[c] += n
-				}
-			}
-			ch.HipChatUsers[*u] = uInfo
-		} else if r.ChatType == "slack" {
-			if len(ch.SlackUsers) < 1 {
-				ch.SlackUsers = make(map[string]UserInfo, 0)
-			}
-			if t, found := ch.SlackUsers[r.MentionName]; found {
-				uInfo.Yubifail = t.Yubifail + len(yubifail_match)
-				uInfo.Curses = t.Curses + len(curses_match)
-				uInfo.Count = t.Count + count
-
-				/* Need to remember other counters here,
-				 * lest they be reset. */
-				for c, n := range t.CurseWords {
-					uInfo.CurseWords[c] += n
-				}
+		if t, found := b.SeenUsers(ch)[r.MentionName]; found {
+			uInfo.Yubifail = t.Yubifail + len(yubifail_match)
+			uInfo.Curses = t.Curses + len(curses_match)
+			uInfo.Count = t.Count + count
+
+			/* Need to remember other counters here,
+			 * lest they be reset. */
+			for c, n := range t.CurseWords {
+				uInfo.CurseWords[c] += n
 			}
-			ch.SlackUsers[r.MentionName] = uInfo
 		}
-		CHANNELS[ch.Name] = ch
+		b.UpdateSeenUser(ch, r, uInfo)
 	}
 }
 
 func usage(out io.Writer) {
-	usage := `Usage: %v [-DVhv] [-c configFile]
+	usage := `Usage: %v [-DVhiv] [-c configFile] [-e command]
+       %v [-Dv] [-c configFile] -export|-import file [-channels list]
 	-D             enable debugging output
 	-V             print version information and exit
 	-c configFile  read configuration from configFile
+	-channels list only export / import these (comma-separated) channels
+	-e command     run the given command on the console and exit
+	-export file   export the state as JSON to file ('-' for stdout) and exit
 	-h             print this help and exit
+	-i             run interactively on the console
+	-import file   import the state from JSON file ('-' for stdin) and exit
 	-v             be verbose
 `
-	fmt.Fprintf(out, usage, PROGNAME)
+	fmt.Fprintf(out, usage, PROGNAME, PROGNAME)
 }
 
 func updateChannels() {
+	STATE_LOCK.Lock()
 	for n, ch := range CHANNELS {
-		verbose(2, "Updating channel info for channel %s (#%s)...", n, ch.Name)
 		if n != ch.Name {
-			fmt.Fprintf(os.Stderr, "+++ dupe: %s (#%s)\n", n, ch.Name)
+			LOG.Warn("removing duplicate channel", "key", n, "channel", ch.Name)
 			delete(CHANNELS, n)
-			continue
 		}
+	}
+	STATE_LOCK.Unlock()
 
-		if !ch.Verified {
-		RATE_LIMIT_LOOP:
-			verbose(3, "Trying to get info on %s (%s)...\n", n, ch.Id)
-			slackChannel, err := SLACK_CLIENT.GetConversationInfo(ch.Id, false)
-			if err != nil {
-				if rateLimitedError, ok := err.(*slack.RateLimitedError); ok {
-					verbose(3, "Sleeping for rate limit %d seconds...", rateLimitedError.RetryAfter)
-					time.Sleep(rateLimitedError.RetryAfter * time.Second)
-					goto RATE_LIMIT_LOOP
-				}
-				fmt.Fprintf(os.Stderr, "Unable to SLACK_CLIENT.GetConversationInfo(%s): %s\n",
-					ch.Id, err)
-				if fmt.Sprintf("%s", err) == "channel_not_found" {
-					fmt.Fprintf(os.Stderr, "Removing myself from no-longer found channel '%s' (%s).\n",
-						n, ch.Id)
-					delete(CHANNELS, n)
-				}
-				continue
-			}
-			if slackChannel.IsExtShared {
-				fmt.Fprintf(os.Stderr, "Removing myself from externally shared channel '%s' (%s).\n",
-					slackChannel.Name, ch.Id)
-				delete(CHANNELS, n)
+	/* Verifying talks to Slack, so we can't hold
+	 * the lock here. */
+	for _, ch := range channelList() {
+		n := ch.Name
+		LOG.Debug("updating channel info", "channel", n)
+
+		if ch.Type == "slack" && !ch.Verified {
+			if !verifySlackChannel(n, ch) {
 				continue
 			}
-			ch.Verified = true
 		}
 
+		STATE_LOCK.Lock()
 		for t, v := range TOGGLES {
 			if len(ch.Toggles) == 0 {
 				ch.Toggles = map[string]bool{}
@@ -5544,16 +4745,7 @@ func updateChannels() {
 		if ch.CVEs == nil {
 			ch.CVEs = map[string]CVEItem{}
 		}
-	}
-}
-
-func verbose(level int, format string, v ...interface{}) {
-	if level <= VERBOSITY {
-		fmt.Fprintf(os.Stderr, "%s ", time.Now().Format("2006-01-02 15:04:05"))
-		for i := 0; i < level; i++ {
-			fmt.Fprintf(os.Stderr, "=")
-		}
-		fmt.Fprintf(os.Stderr, "> "+format+"\n", v...)
+		STATE_LOCK.Unlock()
 	}
 }
 
@@ -5568,8 +4760,20 @@ func main() {
 	}
 
 	getopts()
+	setupLogging()
 	parseConfig()
+	setupLogging()
 	createCommands()
+	loadPlugins()
+
+	if BACKENDS["console"].Enabled() {
+		runConsole()
+	}
+
+	if len(EXPORT_FILE) > 0 || len(IMPORT_FILE) > 0 {
+		runExportImport()
+	}
+
 	readSavedData()
 
 	defer serializeData()
@@ -5583,11 +4787,33 @@ func main() {
 		os.Exit(EXIT_FAILURE)
 	}()
 
-	if len(CONFIG["hcService"]) > 0 {
-		doTheHipChat()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for _ = range hup {
+			reloadConfig()
+		}
+	}()
+
+	for name, b := range BACKENDS {
+		if !b.Enabled() {
+			continue
+		}
+		LOG.Info("connecting", "backend", name)
+		if err := b.Connect(); err != nil {
+			fail("Unable to connect to %s: %s\n", name, err)
+		}
+		go b.Receive()
 	}
-	if len(CONFIG["slackService"]) > 0 {
-		doTheSlackChat()
+
+	if len(getConfig("metricsListen")) > 0 {
+		go serveMetrics()
+	}
+
+	if len(getConfig("apiListen")) > 0 {
+		go serveApi()
 	}
+
+	go periodics()
 	select {}
 }
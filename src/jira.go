@@ -6,15 +6,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/url"
-	"os"
+	"regexp"
 	"strconv"
 	"strings"
 )
 
 var JIRA_REST = "/rest/api/latest"
+var JIRA_LOG = newLogger("jira")
 
 type JiraFilterResult struct {
 	ErrorMessages []string
@@ -46,26 +48,33 @@ func init() {
 	COMMANDS["jira"] = &Command{cmdJira,
 		"display info about a jira ticket",
 		URLS["jira"] + JIRA_REST,
-		"!jira <ticket>",
-		nil}
+		"",
+		nil,
+		[]Arg{
+			{Name: "ticket", Required: true},
+		}}
+	SETTINGS["jira-alert"] = &Setting{"periodically run the given jira filters; see '!alerts jira-alert'",
+		"<minutes>,<filterId>[;<minutes>,<filterId>...]",
+		"",
+		validateJiraAlert}
+	SETTINGS_INTERNAL = append(SETTINGS_INTERNAL, regexp.MustCompile(`^jira-alert-counter[0-9]+$`))
 }
 
-func cmdJira(r Recipient, chName string, args []string) (result string) {
-	if len(args) != 1 {
-		result = "Usage: " + COMMANDS["jira"].Usage
-		return
-	}
-
+func cmdJira(ctx context.Context, r Recipient, chName string, args []string) (result string) {
 	urlArgs := map[string]string{
-		"basic-auth-user":     CONFIG["jiraUser"],
-		"basic-auth-password": CONFIG["jiraPassword"],
+		"basic-auth-user":     getConfig("jiraUser"),
+		"basic-auth-password": getConfig("jiraPassword"),
 	}
 	ticket := strings.TrimPrefix(args[0], URLS["jira"]+"/browse/")
 	jiraUrl := fmt.Sprintf("%s/issue/%s", COMMANDS["jira"].How, ticket)
-	data := getURLContents(jiraUrl, urlArgs)
+	data, err := getURLContents(ctx, jiraUrl, urlArgs)
+	if err != nil && !isFetchStatusError(err) {
+		result = fmt.Sprintf("Unable to fetch jira data: %s\n", err)
+		return
+	}
 
 	var jiraJson map[string]interface{}
-	err := json.Unmarshal(data, &jiraJson)
+	err = json.Unmarshal(data, &jiraJson)
 	if err != nil {
 		result = fmt.Sprintf("Unable to unmarshal jira data: %s\n", err)
 		return
@@ -77,7 +86,7 @@ func cmdJira(r Recipient, chName string, args []string) (result string) {
 				ticket, errmsg.([]interface{})[0].(string))
 			return
 		}
-		fmt.Fprintf(os.Stderr, "+++ jira fail for %s: %v\n", ticket, jiraJson)
+		JIRA_LOG.WarnContext(ctx, "no fields in jira data", "ticket", ticket, "data", jiraJson)
 		result = fmt.Sprintf("No data found for ticket %s", ticket)
 		return
 	}
@@ -109,23 +118,25 @@ func cmdJira(r Recipient, chName string, args []string) (result string) {
 }
 
 
-func jiraAlert(chInfo Channel, printFilter bool) {
-	alertSettings, found := chInfo.Settings["jira-alert"]
+func jiraAlert(ctx context.Context, chInfo *Channel, printFilter bool) {
+	alertSettings, found := getSetting(chInfo, "jira-alert")
 	if !found {
 		return
 	}
+	incrementMetric("jbot_alert_runs_total", "jira-alert")
 
-	r := getRecipientFromMessage(fmt.Sprintf("%s@%s", CONFIG["mentionName"], chInfo.Id), "slack")
+	r := getChannelRecipient(chInfo)
 
 	for i, alert := range strings.Split(alertSettings, ";") {
 		setval := strings.SplitN(alert, ",", 2)
 		counter_num := 0
 		alertCounter := fmt.Sprintf("jira-alert-counter%d", i)
-		counter, found := chInfo.Settings[alertCounter]
+		counter, found := getSetting(chInfo, alertCounter)
 		if found {
 			c, err := strconv.Atoi(counter)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Invalid '%s' for %s: %d", alertCounter, chInfo.Name, counter_num)
+				JIRA_LOG.WarnContext(ctx, "invalid jira-alert counter", "channel", chInfo.Name,
+					"setting", alertCounter, "value", counter)
 				counter_num = 1
 			} else {
 				counter_num = c
@@ -158,29 +169,33 @@ func jiraAlert(chInfo Channel, printFilter bool) {
 		}
 
 		if printFilter {
-			jiraFilter(chInfo, filterId, true)
+			jiraFilter(ctx, chInfo, filterId, true)
 		} else if counter_num == 0 || counter_num >= alert_num {
-			jiraFilter(chInfo, filterId, false)
+			jiraFilter(ctx, chInfo, filterId, false)
 			counter_num = 0
 		}
 		counter_num += 1
-		chInfo.Settings[alertCounter] = fmt.Sprintf("%d", counter_num)
+		setSetting(chInfo, alertCounter, fmt.Sprintf("%d", counter_num), "")
 	}
 }
 
-func jiraFilter(chInfo Channel, filterId int, printFilter bool) {
-	verbose(4, "Running jira-alert in '%s'...", chInfo.Name)
+func jiraFilter(ctx context.Context, chInfo *Channel, filterId int, printFilter bool) {
+	JIRA_LOG.DebugContext(ctx, "running jira-alert", "channel", chInfo.Name, "filter", filterId)
 
-	r := getRecipientFromMessage(fmt.Sprintf("%s@%s", CONFIG["mentionName"], chInfo.Id), "slack")
+	r := getChannelRecipient(chInfo)
 	theURL := fmt.Sprintf("%s%s/filter/%d", URLS["jira"], JIRA_REST, filterId)
 	urlArgs := map[string]string{
-		"basic-auth-user":     CONFIG["jiraUser"],
-		"basic-auth-password": CONFIG["jiraPassword"],
+		"basic-auth-user":     getConfig("jiraUser"),
+		"basic-auth-password": getConfig("jiraPassword"),
+	}
+	data, err := getURLContents(ctx, theURL, urlArgs)
+	if err != nil && !isFetchStatusError(err) {
+		reply(r, fmt.Sprintf("Unable to fetch jira filter %d: %s\n", filterId, err))
+		return
 	}
-	data := getURLContents(theURL, urlArgs)
 
 	var filter JiraFilterResult
-	err := json.Unmarshal(data, &filter)
+	err = json.Unmarshal(data, &filter)
 	if err != nil {
 		reply(r, fmt.Sprintf("Unable to unmarshal jira data: %s\n", err))
 		return
@@ -197,7 +212,7 @@ func jiraFilter(chInfo Channel, filterId int, printFilter bool) {
 	if printFilter {
 		result = fmt.Sprintf("Filter %d is called '%s': %s\n", filterId, filter.Name, filter.ViewUrl)
 	} else {
-		result = jiraSearch(filter.Jql)
+		result = jiraSearch(ctx, filter.Jql)
 		if len(result) > 0 {
 			result = fmt.Sprintf("Results for filter '<%s|%s>':\n", filter.ViewUrl, filter.Name) + result
 		}
@@ -206,18 +221,22 @@ func jiraFilter(chInfo Channel, filterId int, printFilter bool) {
 	return
 }
 
-func jiraSearch(jql string) (result string) {
-	verbose(4, "Running jira search '%s'...", jql)
+func jiraSearch(ctx context.Context, jql string) (result string) {
+	JIRA_LOG.DebugContext(ctx, "running jira search", "jql", jql)
 
 	theURL := fmt.Sprintf("%s%s/search?jql=%s", URLS["jira"], JIRA_REST, url.QueryEscape(jql))
 	urlArgs := map[string]string{
-		"basic-auth-user":     CONFIG["jiraUser"],
-		"basic-auth-password": CONFIG["jiraPassword"],
+		"basic-auth-user":     getConfig("jiraUser"),
+		"basic-auth-password": getConfig("jiraPassword"),
+	}
+	data, err := getURLContents(ctx, theURL, urlArgs)
+	if err != nil && !isFetchStatusError(err) {
+		result = fmt.Sprintf("Unable to fetch jira data: %s\n", err)
+		return
 	}
-	data := getURLContents(theURL, urlArgs)
 
 	var jiraJson JiraSearchResult
-	err := json.Unmarshal(data, &jiraJson)
+	err = json.Unmarshal(data, &jiraJson)
 	if err != nil {
 		result = fmt.Sprintf("Unable to unmarshal jira data: %s\n", err)
 		return
@@ -240,3 +259,19 @@ func jiraSearch(jql string) (result string) {
 
 	return
 }
+
+func validateJiraAlert(value string) error {
+	for _, alert := range strings.Split(value, ";") {
+		setval := strings.SplitN(alert, ",", 2)
+		if len(setval) != 2 {
+			return fmt.Errorf("'%s' is not '<minutes>,<filterId>'", alert)
+		}
+		if _, err := strconv.Atoi(setval[0]); err != nil {
+			return fmt.Errorf("interval '%s' is not a number", setval[0])
+		}
+		if _, err := strconv.Atoi(setval[1]); err != nil {
+			return fmt.Errorf("filter '%s' is not a number", setval[1])
+		}
+	}
+	return nil
+}
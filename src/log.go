@@ -0,0 +1,256 @@
+/* This file contains functionality around
+ * logging: every subsystem (slack, cve, jira,
+ * opsgenie, chatter, ...) has its own *slog.Logger,
+ * all of which write through the same output.
+ *
+ * 'logFormat' selects "text" or "json" output,
+ * 'logLevel' the default level and 'logLevels'
+ * per-subsystem levels, e.g. "slack=debug,cve=error".
+ * '-v' lowers the default level to info, '-v -v' (or
+ * '-D' or 'debug = yes') to debug.
+ *
+ * Every line carries the subsystem; log calls given
+ * a context from messageContext() also carry the
+ * request ID, chat type, channel, user and (once
+ * known) command.
+ *
+ * The values of all secrets in CONFIG are replaced
+ * with "[REDACTED]" wherever they show up.  To make
+ * that possible, non-string values are logged as
+ * strings.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const LOG_REDACTED = "[REDACTED]"
+
+/* Secrets shorter than this are not redacted, as
+ * they would match all over the place. */
+const LOG_MIN_SECRET = 4
+
+var LOG = newLogger("jbot")
+
+var LOG_LOCK sync.RWMutex
+var LOG_SETTINGS LogSettings
+
+var LOG_LEVEL_NAMES = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+type logFieldsKey struct{}
+
+/* Until setupLogging() has run, we log warnings
+ * and errors as text. */
+func init() {
+	LOG_SETTINGS = LogSettings{
+		Output: newLogOutput(os.Stderr, "text"),
+		Level:  slog.LevelWarn,
+		Levels: map[string]slog.Level{},
+	}
+}
+
+/* All loggers share a LogHandler per subsystem,
+ * which looks up the current settings on every
+ * call, so that they can be created at init time and
+ * changed on reload. */
+type LogHandler struct {
+	Subsystem string
+	Wrap      []func(slog.Handler) slog.Handler
+}
+
+type LogSettings struct {
+	Output  slog.Handler
+	Level   slog.Level
+	Levels  map[string]slog.Level
+	Secrets []string
+}
+
+func (h *LogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= logLevel(h.Subsystem)
+}
+
+func (h *LogHandler) Handle(ctx context.Context, rec slog.Record) error {
+	LOG_LOCK.RLock()
+	out := LOG_SETTINGS.Output
+	LOG_LOCK.RUnlock()
+
+	out = out.WithAttrs([]slog.Attr{slog.String("subsystem", h.Subsystem)})
+	for _, w := range h.Wrap {
+		out = w(out)
+	}
+
+	if fields, ok := ctx.Value(logFieldsKey{}).([]slog.Attr); ok {
+		rec.AddAttrs(fields...)
+	}
+	return out.Handle(ctx, rec)
+}
+
+func (h *LogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(out slog.Handler) slog.Handler {
+		return out.WithAttrs(attrs)
+	})
+}
+
+func (h *LogHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(out slog.Handler) slog.Handler {
+		return out.WithGroup(name)
+	})
+}
+
+func (h *LogHandler) with(w func(slog.Handler) slog.Handler) *LogHandler {
+	wrap := append([]func(slog.Handler) slog.Handler{}, h.Wrap...)
+	return &LogHandler{h.Subsystem, append(wrap, w)}
+}
+
+/* Returns a context carrying the fields identifying
+ * the message we're processing. */
+func messageContext(parent context.Context, r Recipient) context.Context {
+	return withLogFields(parent,
+		"request", newRequestID(),
+		"chat", r.ChatType,
+		"channel", r.ReplyTo,
+		"user", r.Id)
+}
+
+func logLevel(subsystem string) slog.Level {
+	LOG_LOCK.RLock()
+	defer LOG_LOCK.RUnlock()
+	if l, found := LOG_SETTINGS.Levels[subsystem]; found {
+		return l
+	}
+	return LOG_SETTINGS.Level
+}
+
+func logSecrets() []string {
+	LOG_LOCK.RLock()
+	defer LOG_LOCK.RUnlock()
+	return LOG_SETTINGS.Secrets
+}
+
+func newLogger(subsystem string) *slog.Logger {
+	return slog.New(&LogHandler{Subsystem: subsystem})
+}
+
+func newLogOutput(w io.Writer, format string) slog.Handler {
+	opts := &slog.HandlerOptions{
+		Level:       slog.LevelDebug,
+		ReplaceAttr: redactLogAttr,
+	}
+	if format == "json" {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+func newRequestID() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+/* Parses a 'subsystem=level,...' list, e.g.
+ * "slack=debug,cve=error"; invalid entries are
+ * skipped. */
+func parseLogLevels(val string) (levels map[string]slog.Level, problems []string) {
+	levels = map[string]slog.Level{}
+	for _, f := range strings.Split(val, ",") {
+		f = strings.TrimSpace(f)
+		if len(f) < 1 {
+			continue
+		}
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			problems = append(problems, fmt.Sprintf("'%s' is not of the form subsystem=level", f))
+			continue
+		}
+		l, found := LOG_LEVEL_NAMES[strings.ToLower(strings.TrimSpace(kv[1]))]
+		if !found {
+			problems = append(problems, fmt.Sprintf("'%s' is not a log level (debug|info|warn|error)", kv[1]))
+			continue
+		}
+		levels[strings.TrimSpace(kv[0])] = l
+	}
+	return
+}
+
+func redactLogAttr(groups []string, a slog.Attr) slog.Attr {
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+	case slog.KindAny:
+		v = slog.StringValue(fmt.Sprintf("%v", v.Any()))
+	default:
+		return a
+	}
+
+	s := v.String()
+	for _, secret := range logSecrets() {
+		s = strings.Replace(s, secret, LOG_REDACTED, -1)
+	}
+	return slog.String(a.Key, s)
+}
+
+/* Applies the logging configuration; called after
+ * (re-)reading the config. */
+func setupLogging() {
+	level := LOG_LEVEL_NAMES[strings.ToLower(getConfig("logLevel"))]
+	if configBool("debug") || VERBOSITY > 1 {
+		level = slog.LevelDebug
+	} else if VERBOSITY > 0 && level > slog.LevelInfo {
+		level = slog.LevelInfo
+	}
+
+	levels, _ := parseLogLevels(getConfig("logLevels"))
+
+	/* Longest first, so that a secret containing
+	 * another is redacted as a whole. */
+	var secrets []string
+	for _, key := range configKeys() {
+		if isSecret(key) && len(getConfig(key)) >= LOG_MIN_SECRET {
+			secrets = append(secrets, getConfig(key))
+		}
+	}
+	sort.Slice(secrets, func(i, j int) bool {
+		return len(secrets[i]) > len(secrets[j])
+	})
+
+	LOG_LOCK.Lock()
+	defer LOG_LOCK.Unlock()
+	LOG_SETTINGS = LogSettings{
+		Output:  newLogOutput(os.Stderr, getConfig("logFormat")),
+		Level:   level,
+		Levels:  levels,
+		Secrets: secrets,
+	}
+}
+
+/* Returns ctx with the given key-value pairs added
+ * to every line logged with it. */
+func withLogFields(ctx context.Context, args ...interface{}) context.Context {
+	fields, _ := ctx.Value(logFieldsKey{}).([]slog.Attr)
+	fields = append([]slog.Attr{}, fields...)
+
+	var r slog.Record
+	r.Add(args...)
+	r.Attrs(func(a slog.Attr) bool {
+		fields = append(fields, a)
+		return true
+	})
+	return context.WithValue(ctx, logFieldsKey{}, fields)
+}
@@ -0,0 +1,492 @@
+/* This file contains functionality around the
+ * Matrix chat backend, using the client-server API
+ * of a (self-hosted) Matrix homeserver: we log in
+ * with an access token, long-poll '/sync', join any
+ * room we're invited into, and reply via m.notice
+ * messages.
+ *
+ * Matrix rooms are mapped to channels named after
+ * their canonical alias (e.g. "ops:example.org" for
+ * "#ops:example.org") or, lacking that, their room
+ * ID.
+ *
+ * Configuration:
+ *   matrixHomeserver  = the homeserver's base URL, e.g. https://matrix.example.org
+ *   matrixAccessToken = the bot user's access token
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const MATRIX_API = "/_matrix/client/v3"
+
+/* How long (in milliseconds) the server may hold
+ * a '/sync' request before returning. */
+const MATRIX_SYNC_TIMEOUT = 30000
+
+const MATRIX_RETRY_DELAY = 10
+
+/* On startup, we only want the room state, not
+ * the history. */
+const MATRIX_INITIAL_FILTER = `{"room":{"timeline":{"limit":1}}}`
+
+var MATRIX_CLIENT = &http.Client{
+	Timeout:   (MATRIX_SYNC_TIMEOUT/1000 + PERIODICS) * time.Second,
+	Transport: METRICS_TRANSPORT,
+}
+var MATRIX_LOCK sync.Mutex
+var MATRIX_LOG = newLogger("matrix")
+var MATRIX_NEXT_BATCH string
+
+/* The error of the last '/sync', if it failed. */
+var MATRIX_SYNC_ERR error
+var MATRIX_TXN int
+var MATRIX_USER_ID string
+
+/* Matrix user ID -> display name; written by the
+ * sync loop and read by commands and periodics, so
+ * guarded by MATRIX_USERS_LOCK. */
+var MATRIX_DISPLAYNAMES = map[string]string{}
+var MATRIX_USERS_LOCK sync.RWMutex
+
+type MatrixEvent struct {
+	Content  map[string]interface{} `json:"content"`
+	EventId  string                 `json:"event_id"`
+	Sender   string                 `json:"sender"`
+	StateKey *string                `json:"state_key"`
+	Type     string                 `json:"type"`
+}
+
+type MatrixEvents struct {
+	Events []MatrixEvent `json:"events"`
+}
+
+type MatrixSync struct {
+	NextBatch string `json:"next_batch"`
+	Rooms     struct {
+		Invite map[string]struct {
+			InviteState MatrixEvents `json:"invite_state"`
+		} `json:"invite"`
+		Join map[string]struct {
+			State    MatrixEvents `json:"state"`
+			Timeline MatrixEvents `json:"timeline"`
+		} `json:"join"`
+		Leave map[string]interface{} `json:"leave"`
+	} `json:"rooms"`
+}
+
+type MatrixBackend struct{}
+
+func init() {
+	BACKENDS["matrix"] = &MatrixBackend{}
+}
+
+func (b *MatrixBackend) Enabled() bool {
+	return backendEnabled("matrix")
+}
+
+func (b *MatrixBackend) Connect() (err error) {
+	var whoami struct {
+		UserId string `json:"user_id"`
+	}
+	if err = matrixRequest("GET", "/account/whoami", nil, &whoami); err != nil {
+		return
+	}
+	MATRIX_USER_ID = whoami.UserId
+	MATRIX_LOG.Debug("logged in", "user", MATRIX_USER_ID)
+
+	MATRIX_LOG.Info("performing initial sync")
+	var s MatrixSync
+	if err = matrixSync(MATRIX_INITIAL_FILTER, &s); err != nil {
+		return
+	}
+	processMatrixSync(s, true)
+
+	return
+}
+
+func (b *MatrixBackend) Receive() {
+	for {
+		var s MatrixSync
+		err := matrixSync("", &s)
+
+		MATRIX_LOCK.Lock()
+		MATRIX_SYNC_ERR = err
+		MATRIX_LOCK.Unlock()
+
+		if err != nil {
+			MATRIX_LOG.Error("unable to sync", "err", err)
+			time.Sleep(MATRIX_RETRY_DELAY * time.Second)
+			continue
+		}
+		handleEvent("matrix", func() error {
+			processMatrixSync(s, false)
+			return nil
+		})
+	}
+}
+
+func (b *MatrixBackend) Healthy() error {
+	MATRIX_LOCK.Lock()
+	defer MATRIX_LOCK.Unlock()
+	return MATRIX_SYNC_ERR
+}
+
+func (b *MatrixBackend) Send(r Recipient, msg string) {
+	MATRIX_LOCK.Lock()
+	MATRIX_TXN++
+	txn := fmt.Sprintf("%s.%d.%d", PROGNAME, time.Now().Unix(), MATRIX_TXN)
+	MATRIX_LOCK.Unlock()
+
+	content := map[string]string{
+		"msgtype": "m.notice",
+		"body":    msg,
+	}
+	path := fmt.Sprintf("/rooms/%s/send/m.room.message/%s", url.PathEscape(r.ReplyTo), txn)
+	if err := matrixRequest("PUT", path, content, nil); err != nil {
+		MATRIX_LOG.Warn("unable to send message", "room", r.ReplyTo, "err", err)
+	}
+}
+
+/* Format is "<user ID> <room ID>"; neither may
+ * contain a space. */
+func (b *MatrixBackend) ResolveUser(from string) (r Recipient) {
+	r.ChatType = "matrix"
+	f := strings.SplitN(from, " ", 2)
+	r.Id = f[0]
+	if len(f) > 1 {
+		r.ReplyTo = f[1]
+	}
+
+	r.MentionName = strings.SplitN(strings.TrimPrefix(r.Id, "@"), ":", 2)[0]
+	r.Name = r.MentionName
+	if name := matrixDisplayName(r.Id); len(name) > 0 {
+		r.Name = name
+	}
+
+	return
+}
+
+func (b *MatrixBackend) ResolveChannel(id string) string {
+	if ch := findMatrixChannel(id); ch != nil {
+		return ch.Name
+	}
+	return id
+}
+
+func (b *MatrixBackend) Leave(r Recipient, ch *Channel) {
+	if ch == nil {
+		return
+	}
+	path := fmt.Sprintf("/rooms/%s/leave", url.PathEscape(ch.Id))
+	if err := matrixRequest("POST", path, map[string]string{}, nil); err != nil {
+		MATRIX_LOG.Warn("unable to leave room", "room", ch.Id, "err", err)
+		return
+	}
+	deleteChannel(ch.Name)
+}
+
+func (b *MatrixBackend) ChannelRecipient(ch *Channel) Recipient {
+	return b.ResolveUser(fmt.Sprintf("%s %s", MATRIX_USER_ID, ch.Id))
+}
+
+func (b *MatrixBackend) SeenUsers(ch *Channel) map[string]UserInfo {
+	return ch.MatrixUsers
+}
+
+func (b *MatrixBackend) UpdateSeenUser(ch *Channel, r Recipient, uInfo UserInfo) {
+	if len(ch.MatrixUsers) < 1 {
+		ch.MatrixUsers = make(map[string]UserInfo, 0)
+	}
+	ch.MatrixUsers[r.MentionName] = uInfo
+}
+
+/* Room IDs are case-sensitive, but commands such as
+ * '!info' lower-case their input, so we compare
+ * case-insensitively. */
+func findMatrixChannel(id string) *Channel {
+	for _, ch := range channelList() {
+		if ch.Type == "matrix" && strings.EqualFold(ch.Id, id) {
+			return ch
+		}
+	}
+	return nil
+}
+
+func joinMatrixRoom(roomId, inviter string) {
+	MATRIX_LOG.Info("joining room", "room", roomId)
+	path := fmt.Sprintf("/join/%s", url.PathEscape(roomId))
+	if err := matrixRequest("POST", path, map[string]string{}, nil); err != nil {
+		MATRIX_LOG.Warn("unable to join room", "room", roomId, "err", err)
+		return
+	}
+
+	if findMatrixChannel(roomId) == nil {
+		ch := newMatrixChannel(roomId, roomId, inviter)
+		addChannel(&ch)
+		MATRIX_LOG.Info("invited into room", "channel", ch.Name, "room", roomId, "inviter", ch.Inviter)
+	}
+}
+
+func matrixDisplayName(id string) string {
+	MATRIX_USERS_LOCK.RLock()
+	defer MATRIX_USERS_LOCK.RUnlock()
+	return MATRIX_DISPLAYNAMES[id]
+}
+
+/* Perform a Matrix client-server API request,
+ * retrying if we are rate-limited. */
+func matrixRequest(method, path string, body interface{}, result interface{}) (err error) {
+	var data []byte
+	if body != nil {
+		if data, err = json.Marshal(body); err != nil {
+			return
+		}
+	}
+
+	theURL := strings.TrimRight(getConfig("matrixHomeserver"), "/") + MATRIX_API + path
+	for {
+		var req *http.Request
+		req, err = http.NewRequest(method, theURL, bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		req.Header.Set("Authorization", "Bearer "+getConfig("matrixAccessToken"))
+		req.Header.Set("Content-Type", "application/json")
+
+		var resp *http.Response
+		if resp, err = MATRIX_CLIENT.Do(req); err != nil {
+			return
+		}
+
+		var respBody []byte
+		respBody, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return
+		}
+
+		if resp.StatusCode == http.StatusTooManyRequests {
+			var limit struct {
+				RetryAfterMs int `json:"retry_after_ms"`
+			}
+			json.Unmarshal(respBody, &limit)
+			if limit.RetryAfterMs < 1 {
+				limit.RetryAfterMs = MATRIX_RETRY_DELAY * 1000
+			}
+			MATRIX_LOG.Debug("rate limited, sleeping", "retryAfterMs", limit.RetryAfterMs)
+			time.Sleep(time.Duration(limit.RetryAfterMs) * time.Millisecond)
+			continue
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			var mErr struct {
+				Errcode string `json:"errcode"`
+				Error   string `json:"error"`
+			}
+			json.Unmarshal(respBody, &mErr)
+			return fmt.Errorf("%s: %s %s", resp.Status, mErr.Errcode, mErr.Error)
+		}
+
+		if result != nil {
+			err = json.Unmarshal(respBody, result)
+		}
+		return
+	}
+}
+
+func matrixSync(filter string, s *MatrixSync) (err error) {
+	args := url.Values{}
+	if len(MATRIX_NEXT_BATCH) > 0 {
+		args.Set("since", MATRIX_NEXT_BATCH)
+		args.Set("timeout", fmt.Sprintf("%d", MATRIX_SYNC_TIMEOUT))
+	}
+	if len(filter) > 0 {
+		args.Set("filter", filter)
+	}
+
+	if err = matrixRequest("GET", "/sync?"+args.Encode(), nil, s); err != nil {
+		return
+	}
+	MATRIX_NEXT_BATCH = s.NextBatch
+	return
+}
+
+/* 'inviter' is the inviter's Matrix user ID, which
+ * makes them a channel admin; see src/roles.go. */
+func newMatrixChannel(name, id, inviter string) (ch Channel) {
+	MATRIX_LOG.Debug("creating new channel", "channel", name)
+
+	ch.Toggles = map[string]bool{}
+	ch.Throttles = map[string]time.Time{}
+	ch.Settings = map[string]string{}
+	ch.Type = "matrix"
+	ch.Id = id
+	ch.MatrixUsers = make(map[string]UserInfo, 0)
+	ch.Inviter = "Nobody"
+	ch.Name = strings.ToLower(name)
+	ch.Phishy = &PhishCount{0, 0, time.Now(), time.Unix(0, 0)}
+	ch.CVEs = map[string]CVEItem{}
+
+	if len(inviter) > 0 {
+		ch.Inviter = strings.SplitN(strings.TrimPrefix(inviter, "@"), ":", 2)[0]
+		ch.InviterId = inviter
+	}
+
+	for t, v := range TOGGLES {
+		ch.Toggles[t] = v
+	}
+
+	return
+}
+
+func processMatrixMessage(roomId string, ev MatrixEvent) {
+	if ev.Sender == MATRIX_USER_ID {
+		/* Ignore our own messages. */
+		return
+	}
+
+	/* Don't reply to other bots' notices, lest
+	 * we end up in a loop. */
+	msgtype, _ := ev.Content["msgtype"].(string)
+	if msgtype != "m.text" && msgtype != "m.emote" {
+		return
+	}
+
+	txt, _ := ev.Content["body"].(string)
+	if len(txt) < 1 {
+		return
+	}
+
+	/* Edits are sent as new messages with
+	 * the original as a relation; ignore them to
+	 * avoid processing the same message twice. */
+	if _, found := ev.Content["m.new_content"]; found {
+		return
+	}
+
+	ch := findMatrixChannel(roomId)
+	if ch == nil {
+		/* A room we didn't know we were in. */
+		c := newMatrixChannel(roomId, roomId, "")
+		ch = &c
+		addChannel(ch)
+	}
+
+	r := getRecipientFromMessage(fmt.Sprintf("%s %s", ev.Sender, roomId), "matrix")
+
+	/* Matrix clients address others as
+	 * "displayname: ", so turn that into the
+	 * "@nick" form processMessage understands. */
+	names := []string{regexp.QuoteMeta(getConfig("mentionName"))}
+	if name := matrixDisplayName(MATRIX_USER_ID); len(name) > 0 {
+		names = append(names, regexp.QuoteMeta(name))
+	}
+	addressed_re := regexp.MustCompile(`(?i)^(` + strings.Join(names, "|") + `)[:,] *`)
+	mentioned := addressed_re.MatchString(txt)
+	if mentioned {
+		txt = addressed_re.ReplaceAllString(txt, "@"+getConfig("mentionName")+" ")
+	}
+
+	if ignored, _ := getSetting(ch, "ignored"); strings.EqualFold(ignored, "true") {
+		if mentioned || strings.Contains(txt, MATRIX_USER_ID) {
+			setSetting(ch, "ignored", "false", r.MentionName)
+		} else {
+			return
+		}
+	}
+
+	updateSeen(r, txt)
+	processMessage(context.Background(), r, txt)
+}
+
+func processMatrixStateEvent(roomId string, ev MatrixEvent) {
+	switch ev.Type {
+	case "m.room.canonical_alias":
+		alias, _ := ev.Content["alias"].(string)
+		if len(alias) > 0 {
+			renameMatrixChannel(roomId, strings.TrimPrefix(alias, "#"))
+		}
+
+	case "m.room.member":
+		if ev.StateKey == nil {
+			return
+		}
+		if name, ok := ev.Content["displayname"].(string); ok {
+			MATRIX_USERS_LOCK.Lock()
+			MATRIX_DISPLAYNAMES[*ev.StateKey] = name
+			MATRIX_USERS_LOCK.Unlock()
+		}
+
+		membership, _ := ev.Content["membership"].(string)
+		if *ev.StateKey == MATRIX_USER_ID && (membership == "leave" || membership == "ban") {
+			if ch := findMatrixChannel(roomId); ch != nil {
+				MATRIX_LOG.Info("removed from room", "channel", ch.Name, "by", ev.Sender)
+				deleteChannel(ch.Name)
+			}
+		}
+	}
+}
+
+func processMatrixSync(s MatrixSync, initial bool) {
+	for roomId, room := range s.Rooms.Join {
+		if findMatrixChannel(roomId) == nil {
+			ch := newMatrixChannel(roomId, roomId, "")
+			addChannel(&ch)
+		}
+
+		for _, ev := range room.State.Events {
+			processMatrixStateEvent(roomId, ev)
+		}
+
+		for _, ev := range room.Timeline.Events {
+			if ev.StateKey != nil {
+				processMatrixStateEvent(roomId, ev)
+			} else if ev.Type == "m.room.message" && !initial {
+				processMatrixMessage(roomId, ev)
+			}
+		}
+	}
+
+	for roomId, room := range s.Rooms.Invite {
+		inviter := ""
+		for _, ev := range room.InviteState.Events {
+			if ev.Type == "m.room.member" && ev.StateKey != nil && *ev.StateKey == MATRIX_USER_ID {
+				inviter = ev.Sender
+			}
+		}
+		joinMatrixRoom(roomId, inviter)
+	}
+
+	for roomId := range s.Rooms.Leave {
+		if ch := findMatrixChannel(roomId); ch != nil {
+			MATRIX_LOG.Info("no longer in room", "channel", ch.Name)
+			deleteChannel(ch.Name)
+		}
+	}
+}
+
+func renameMatrixChannel(roomId, newName string) {
+	newName = strings.ToLower(newName)
+	ch := findMatrixChannel(roomId)
+	if ch == nil || ch.Name == newName {
+		return
+	}
+	MATRIX_LOG.Debug("renaming channel", "old", ch.Name, "new", newName)
+	if !renameChannel(ch.Name, newName) {
+		MATRIX_LOG.Warn("renamed channel already known", "channel", newName)
+	}
+}
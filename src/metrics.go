@@ -0,0 +1,234 @@
+/* This file contains functionality around
+ * exposing metrics in the Prometheus text format on
+ * 'metricsListen' (e.g. ":9090"), path /metrics.
+ * Nothing is served unless 'metricsListen' is set.
+ *
+ * Metrics are registered in init() below and updated
+ * via incrementMetric() and observeMetric(); gauges
+ * that are computed when scraped have a Func.  The
+ * label values passed must match the labels the
+ * metric was registered with.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var METRICS_BUCKETS = []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+var METRICS_LOCK sync.Mutex
+var METRICS = map[string]*Metric{}
+
+/* Used by all HTTP clients whose calls we want to
+ * time; see MetricsTransport. */
+var METRICS_TRANSPORT = &MetricsTransport{http.DefaultTransport}
+
+type Metric struct {
+	Name   string
+	Type   string
+	Help   string
+	Labels []string
+	Values map[string]*MetricValue
+	Func   func() (float64, bool)
+}
+
+/* Counters only use Value; histograms use Buckets
+ * (one per METRICS_BUCKETS entry, not cumulative),
+ * Sum and Count. */
+type MetricValue struct {
+	LabelValues []string
+	Value       float64
+	Buckets     []uint64
+	Sum         float64
+	Count       uint64
+}
+
+/* Times every HTTP request by target host. */
+type MetricsTransport struct {
+	Base http.RoundTripper
+}
+
+func init() {
+	registerMetric("jbot_alert_runs_total", "counter",
+		"Alert runs by alert type.", "alert")
+	registerMetric("jbot_command_duration_seconds", "histogram",
+		"Command latency by command and outcome.", "command", "outcome")
+	registerMetric("jbot_commands_total", "counter",
+		"Command invocations by command and outcome.", "command", "outcome")
+	registerMetric("jbot_external_call_duration_seconds", "histogram",
+		"Latency of external HTTP and exec calls by target.", "type", "target")
+	registerMetric("jbot_http_cache_requests_total", "counter",
+		"HTTP cache lookups by source and result.", "source", "result")
+	registerMetric("jbot_slack_events_total", "counter",
+		"Slack events received by type.", "type")
+	registerMetric("jbot_slack_messages_sent_total", "counter",
+		"Messages posted to Slack.")
+	registerMetric("jbot_slack_rate_limits_total", "counter",
+		"Slack rate limit hits by API method.", "method")
+
+	m := registerMetric("jbot_slack_last_message_age_seconds", "gauge",
+		"Seconds since the last Slack message was received.")
+	m.Func = func() (float64, bool) {
+		last := lastSlackMessageTime()
+		if last.IsZero() {
+			return 0, false
+		}
+		return time.Since(last).Seconds(), true
+	}
+}
+
+func (t *MetricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.Base.RoundTrip(req)
+	observeMetric("jbot_external_call_duration_seconds", time.Since(start), "http", req.URL.Host)
+	return resp, err
+}
+
+func escapeMetricLabel(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	return strings.Replace(s, "\n", `\n`, -1)
+}
+
+func formatMetricLabels(names, values []string, extra ...string) string {
+	var labels []string
+	for i, n := range names {
+		labels = append(labels, fmt.Sprintf("%s=\"%s\"", n, escapeMetricLabel(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		labels = append(labels, fmt.Sprintf("%s=\"%s\"", extra[i], extra[i+1]))
+	}
+	if len(labels) < 1 {
+		return ""
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+/* Returns the value for the given label values,
+ * creating it if needed; nil if the number of label
+ * values is wrong.  Must be called with METRICS_LOCK
+ * held. */
+func getMetricValue(name string, labelValues []string) *MetricValue {
+	m, found := METRICS[name]
+	if !found || len(labelValues) != len(m.Labels) {
+		LOG.Warn("invalid metric", "metric", name, "labels", labelValues)
+		return nil
+	}
+
+	key := strings.Join(labelValues, "\xff")
+	v, found := m.Values[key]
+	if !found {
+		v = &MetricValue{LabelValues: labelValues}
+		if m.Type == "histogram" {
+			v.Buckets = make([]uint64, len(METRICS_BUCKETS))
+		}
+		m.Values[key] = v
+	}
+	return v
+}
+
+func incrementMetric(name string, labelValues ...string) {
+	METRICS_LOCK.Lock()
+	defer METRICS_LOCK.Unlock()
+	if v := getMetricValue(name, labelValues); v != nil {
+		v.Value++
+	}
+}
+
+func metricsHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprint(w, renderMetrics())
+}
+
+func observeMetric(name string, d time.Duration, labelValues ...string) {
+	METRICS_LOCK.Lock()
+	defer METRICS_LOCK.Unlock()
+
+	v := getMetricValue(name, labelValues)
+	if v == nil {
+		return
+	}
+
+	s := d.Seconds()
+	for i, b := range METRICS_BUCKETS {
+		if s <= b {
+			v.Buckets[i]++
+			break
+		}
+	}
+	v.Sum += s
+	v.Count++
+}
+
+func registerMetric(name, mtype, help string, labels ...string) *Metric {
+	m := &Metric{name, mtype, help, labels, map[string]*MetricValue{}, nil}
+	METRICS[name] = m
+	return m
+}
+
+func renderMetrics() string {
+	METRICS_LOCK.Lock()
+	defer METRICS_LOCK.Unlock()
+
+	var names []string
+	for n := range METRICS {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	var out strings.Builder
+	for _, n := range names {
+		m := METRICS[n]
+		fmt.Fprintf(&out, "# HELP %s %s\n", n, m.Help)
+		fmt.Fprintf(&out, "# TYPE %s %s\n", n, m.Type)
+
+		if m.Func != nil {
+			if val, ok := m.Func(); ok {
+				fmt.Fprintf(&out, "%s %g\n", n, val)
+			}
+			continue
+		}
+
+		var keys []string
+		for k := range m.Values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			v := m.Values[k]
+			if m.Type != "histogram" {
+				fmt.Fprintf(&out, "%s%s %g\n", n, formatMetricLabels(m.Labels, v.LabelValues), v.Value)
+				continue
+			}
+
+			var cumulative uint64
+			for i, b := range METRICS_BUCKETS {
+				cumulative += v.Buckets[i]
+				fmt.Fprintf(&out, "%s_bucket%s %d\n", n,
+					formatMetricLabels(m.Labels, v.LabelValues, "le", fmt.Sprintf("%g", b)), cumulative)
+			}
+			fmt.Fprintf(&out, "%s_bucket%s %d\n", n,
+				formatMetricLabels(m.Labels, v.LabelValues, "le", "+Inf"), v.Count)
+			fmt.Fprintf(&out, "%s_sum%s %g\n", n, formatMetricLabels(m.Labels, v.LabelValues), v.Sum)
+			fmt.Fprintf(&out, "%s_count%s %d\n", n, formatMetricLabels(m.Labels, v.LabelValues), v.Count)
+		}
+	}
+	return out.String()
+}
+
+func serveMetrics() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+
+	LOG.Info("serving metrics", "listen", getConfig("metricsListen"))
+	err := http.ListenAndServe(getConfig("metricsListen"), mux)
+	LOG.Error("unable to serve metrics", "err", err)
+}
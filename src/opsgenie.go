@@ -5,15 +5,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"os"
 	"strings"
 	"time"
 )
 
 const SLEEP_TIME = 5
 
+var OPSGENIE_LOG = newLogger("opsgenie")
+
 func init() {
 	URLS["opsgenie"] = "https://api.opsgenie.com/v2/"
 }
@@ -31,20 +33,20 @@ type OpsGenieApiData struct {
 	Data    interface{}
 }
 
-func cmdOncallOpsGenie(r Recipient, chName, args string, allowRecursion bool) (result string) {
+func cmdOncallOpsGenie(ctx context.Context, r Recipient, chName, args string, allowRecursion bool) (result string) {
 	var candidates []string
 	scheduleFound := false
 	wantedName := args
 	originalWantedName := wantedName
 	scheduleURL := "https://app.opsgenie.com/schedule#/"
 
-	if len(CONFIG["opsgenieApiKey"]) < 1 {
+	if len(getConfig("opsgenieApiKey")) < 1 {
 		result = "Unable to query OpsGenie -- no API key in config file."
 		return
 	}
 
 	theUrl := URLS["opsgenie"] + "schedules"
-	schedules := getOpsgenieAPIData(theUrl)
+	schedules := getOpsgenieAPIData(ctx, theUrl, "opsgenie-schedules")
 	if len(schedules.Message) > 0 {
 		result = schedules.Message
 		return
@@ -65,13 +67,16 @@ LabelLookup:
 		}
 
 		theUrl = URLS["opsgenie"] + "schedules/" + sid + "/on-calls"
-		ogOncalls := getOpsgenieAPIData(theUrl)
+		ogOncalls := getOpsgenieAPIData(ctx, theUrl, "")
 		if len(ogOncalls.Message) > 0 {
-			result = schedules.Message
+			result = ogOncalls.Message
 			return
 		}
 
-		participants := ogOncalls.Data.(map[string]interface{})["onCallParticipants"].([]interface{})
+		var participants []interface{}
+		if oncalls, ok := ogOncalls.Data.(map[string]interface{}); ok {
+			participants, _ = oncalls["onCallParticipants"].([]interface{})
+		}
 		if len(participants) > 0 {
 			scheduleFound = true
 			if (tname != sname) {
@@ -82,11 +87,11 @@ LabelLookup:
 
 		for _, participant := range participants {
 			if participant != nil {
-				result += fmt.Sprintf("%s\n", opsgenieUserDetails(participant.(map[string]interface{})["name"].(string)))
+				result += fmt.Sprintf("%s\n", opsgenieUserDetails(ctx, participant.(map[string]interface{})["name"].(string)))
 			}
 		}
 
-		rotationTeams := getOpsgenieRotations(sid)
+		rotationTeams := getOpsgenieRotations(ctx, sid)
 		for _, t := range rotationTeams {
 			wantedName = t
 			goto LabelLookup
@@ -98,16 +103,16 @@ LabelLookup:
 			result += fmt.Sprintf("%s%s\n", scheduleURL, sid)
 
 			theUrl = URLS["opsgenie"] + "teams/" + tid
-			ogt := getOpsgenieAPIData(theUrl)
+			ogt := getOpsgenieAPIData(ctx, theUrl, "opsgenie-teams")
 			if len(ogt.Message) > 0 {
-				result = schedules.Message
+				result = ogt.Message
 				return
 			}
 
 			var members []string
-			jsonMembers := ogOncalls.Data.(map[string]interface{})["members"]
-			if jsonMembers != nil {
-				for _, m := range jsonMembers.([]interface{}) {
+			if team, ok := ogt.Data.(map[string]interface{}); ok {
+				jsonMembers, _ := team["members"].([]interface{})
+				for _, m := range jsonMembers {
 					u := m.(map[string]interface{})["user"].(map[string]interface{})["username"].(string)
 					members = append(members, u)
 				}
@@ -124,7 +129,7 @@ LabelLookup:
 	if !scheduleFound && len(candidates) > 0 {
 		if len(candidates) == 1 && strings.EqualFold(wantedName, candidates[0]) &&
 			allowRecursion {
-			return cmdOncallOpsGenie(r, chName, candidates[0], false)
+			return cmdOncallOpsGenie(ctx, r, chName, candidates[0], false)
 		}
 		result += fmt.Sprintf("No OpsGenie schedule found for rotation '%s'.\n", wantedName)
 		result += "\nPossible candidates:\n"
@@ -133,14 +138,23 @@ LabelLookup:
 	return
 }
 
-func getOpsgenieAPIData(url string) (ogData OpsGenieApiData) {
-	key := CONFIG["opsgenieApiKey"]
+/* 'cache' is the cache source to use, if any; see
+ * src/cache.go. */
+func getOpsgenieAPIData(ctx context.Context, url, cache string) (ogData OpsGenieApiData) {
+	key := getConfig("opsgenieApiKey")
 	urlArgs := map[string]string{"Authorization": "GenieKey " + key}
+	if len(cache) > 0 {
+		urlArgs["cache"] = cache
+	}
 LabelOncalls:
-	data := getURLContents(url, urlArgs)
+	data, err := getURLContents(ctx, url, urlArgs)
 	sleepCount := 1;
+	if err != nil && !isFetchStatusError(err) {
+		ogData.Message = fmt.Sprintf("Unable to fetch opsgenie data: %s\n", err)
+		return
+	}
 
-	err := json.Unmarshal(data, &ogData)
+	err = json.Unmarshal(data, &ogData)
 	if err != nil {
 		ogData.Message = fmt.Sprintf("Unable to unmarshal opsgenie data: %s\n", err)
 		return
@@ -151,7 +165,12 @@ LabelOncalls:
 			ogData.Message = "I'm rate limited by OpsGenie. Please try again later."
 			return
 		}
-		time.Sleep(time.Duration(sleepCount*SLEEP_TIME) * time.Second)
+		select {
+		case <-time.After(time.Duration(sleepCount*SLEEP_TIME) * time.Second):
+		case <-ctx.Done():
+			ogData.Message = "Timed out waiting for OpsGenie to stop rate limiting me."
+			return
+		}
 		sleepCount++
 		goto LabelOncalls
 	}
@@ -159,11 +178,14 @@ LabelOncalls:
 	return
 }
 
-func getOpsgenieRotations(id string) (rnames []string) {
+func getOpsgenieRotations(ctx context.Context, id string) (rnames []string) {
 	theUrl := URLS["opsgenie"] + "schedules/" + id + "/rotations"
-	rotations := getOpsgenieAPIData(theUrl)
+	rotations := getOpsgenieAPIData(ctx, theUrl, "opsgenie-rotations")
 
-	data := rotations.Data.([]interface{})
+	data, ok := rotations.Data.([]interface{})
+	if !ok {
+		return
+	}
 	for _, r := range data {
 		participants := r.(map[string]interface{})["participants"].([]interface{})
 		for _, p := range participants {
@@ -177,7 +199,10 @@ func getOpsgenieRotations(id string) (rnames []string) {
 }
 
 func opsGenieIds(schedules OpsGenieApiData, wantedName string) (info []OpsGenieScheduleInfo) {
-	data := schedules.Data.([]interface{})
+	data, ok := schedules.Data.([]interface{})
+	if !ok {
+		return
+	}
 	for _, s := range data {
 		var i OpsGenieScheduleInfo
 
@@ -208,16 +233,21 @@ func opsGenieIds(schedules OpsGenieApiData, wantedName string) (info []OpsGenieS
 	return
 }
 
-func opsgenieUserDetails(u string) (details string) {
+func opsgenieUserDetails(ctx context.Context, u string) (details string) {
 	theURL := fmt.Sprintf("%susers/%s?expand=contact", URLS["opsgenie"], u)
-	urlArgs := map[string]string{"Authorization": "GenieKey " + CONFIG["opsgenieApiKey"]}
-	data := getURLContents(theURL, urlArgs)
+	urlArgs := map[string]string{
+		"Authorization": "GenieKey " + getConfig("opsgenieApiKey"),
+		"cache":         "opsgenie-users",
+	}
+	data, err := getURLContents(ctx, theURL, urlArgs)
+	if err != nil {
+		return
+	}
 
 	var ogu OpsGenieApiData
-	err := json.Unmarshal(data, &ogu)
+	err = json.Unmarshal(data, &ogu)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to unmarshal json from '%s': %s\n",
-			theURL, err)
+		OPSGENIE_LOG.WarnContext(ctx, "unable to unmarshal json", "url", theURL, "err", err)
 		return
 	}
 
@@ -0,0 +1,221 @@
+/* This file contains functionality around the
+ * outbound message queue for Slack.
+ *
+ * Messages are queued per channel, and each
+ * channel's queue is sent in order by its own
+ * goroutine, paced by two token buckets: one per
+ * channel (Slack allows about one message per second
+ * per channel) and one for the whole workspace
+ * (Slack allows "several hundred" per minute).  If
+ * Slack tells us to slow down anyway, we pause the
+ * channel and the workspace for as long as its
+ * 'Retry-After' says and then try again.
+ *
+ * While a message waits for its turn, any messages
+ * queued behind it are coalesced into it, up to
+ * SLACK_MAX_LENGTH.
+ *
+ * Bulk messages (e.g. CVE alerts) are dropped once a
+ * channel has OUTBOUND_MAX_BACKLOG messages queued;
+ * once the queue has drained, we post a summary like
+ * "12 more CVEs suppressed."  Regular replies are
+ * never dropped.
+ */
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const OUTBOUND_CHANNEL_BURST = 3
+const OUTBOUND_CHANNEL_RATE = 1.0
+const OUTBOUND_MAX_BACKLOG = 20
+const OUTBOUND_WORKSPACE_BURST = 20
+const OUTBOUND_WORKSPACE_RATE = 3.0
+
+var OUTBOUND_LOCK sync.Mutex
+
+/* Queues by Slack channel ID; kept around once
+ * created, so that the channel's bucket is, too. */
+var OUTBOUND_QUEUES = map[string]*OutboundQueue{}
+
+var OUTBOUND_WORKSPACE = TokenBucket{Rate: OUTBOUND_WORKSPACE_RATE, Burst: OUTBOUND_WORKSPACE_BURST}
+
+type OutboundMessage struct {
+	Kind string
+	Text string
+}
+
+type OutboundQueue struct {
+	Bucket     TokenBucket
+	Messages   []OutboundMessage
+	Sending    bool
+	Suppressed map[string]int
+}
+
+/* Rate is in tokens per second; the bucket starts
+ * out full. */
+type TokenBucket struct {
+	Rate   float64
+	Burst  float64
+	Tokens float64
+	Last   time.Time
+	Paused time.Time
+}
+
+/* Takes a token and returns how long the caller has
+ * to wait before using it.  Tokens may go negative,
+ * so that concurrent callers queue up behind each
+ * other. */
+func (b *TokenBucket) Take(now time.Time) (wait time.Duration) {
+	if b.Last.IsZero() {
+		b.Tokens = b.Burst
+	} else {
+		b.Tokens += now.Sub(b.Last).Seconds() * b.Rate
+		if b.Tokens > b.Burst {
+			b.Tokens = b.Burst
+		}
+	}
+	b.Last = now
+
+	b.Tokens--
+	if b.Tokens < 0 {
+		wait = time.Duration(-b.Tokens / b.Rate * float64(time.Second))
+	}
+	if b.Paused.After(now.Add(wait)) {
+		wait = b.Paused.Sub(now)
+	}
+	return
+}
+
+func (b *TokenBucket) Pause(until time.Time) {
+	if until.After(b.Paused) {
+		b.Paused = until
+	}
+}
+
+/* Pops the next message off the queue, coalescing as
+ * many of the following ones into it as fit.  Once
+ * the queue is empty, queues the summary of what we
+ * suppressed, if anything.  Must be called with
+ * OUTBOUND_LOCK held. */
+func nextOutboundMessage(q *OutboundQueue) (text string) {
+	for len(q.Messages) > 0 {
+		m := q.Messages[0]
+		if len(text) > 0 && len(text)+1+len(m.Text) > SLACK_MAX_LENGTH {
+			break
+		}
+		if len(text) > 0 {
+			text += "\n"
+		}
+		text += m.Text
+		q.Messages = q.Messages[1:]
+	}
+
+	if len(q.Messages) < 1 && len(q.Suppressed) > 0 {
+		q.Messages = append(q.Messages, OutboundMessage{"", outboundSummary(q.Suppressed)})
+		q.Suppressed = map[string]int{}
+	}
+	return
+}
+
+func outboundSummary(suppressed map[string]int) string {
+	var kinds []string
+	for k := range suppressed {
+		kinds = append(kinds, k)
+	}
+	sort.Strings(kinds)
+
+	var lines []string
+	for _, k := range kinds {
+		lines = append(lines, fmt.Sprintf("%d more %s suppressed.", suppressed[k], k))
+	}
+	return strings.Join(lines, "\n")
+}
+
+/* Slack told us to slow down, so we hold off on the
+ * channel and the whole workspace. */
+func pauseOutbound(channel string, d time.Duration) {
+	OUTBOUND_LOCK.Lock()
+	defer OUTBOUND_LOCK.Unlock()
+
+	until := time.Now().Add(d)
+	OUTBOUND_WORKSPACE.Pause(until)
+	if q, found := OUTBOUND_QUEUES[channel]; found {
+		q.Bucket.Pause(until)
+	}
+}
+
+/* Queues the given chunks of a message to be sent to
+ * the channel.  If 'kind' is given (e.g. "CVEs"), the
+ * message is dropped (and counted) if the channel's
+ * backlog is full. */
+func queueSlackMessage(channel, kind string, chunks []string) {
+	OUTBOUND_LOCK.Lock()
+	defer OUTBOUND_LOCK.Unlock()
+
+	q, found := OUTBOUND_QUEUES[channel]
+	if !found {
+		q = &OutboundQueue{
+			Bucket:     TokenBucket{Rate: OUTBOUND_CHANNEL_RATE, Burst: OUTBOUND_CHANNEL_BURST},
+			Suppressed: map[string]int{},
+		}
+		OUTBOUND_QUEUES[channel] = q
+	}
+
+	if len(kind) > 0 && len(q.Messages) >= OUTBOUND_MAX_BACKLOG {
+		SLACK_LOG.Debug("backlog full, suppressing message", "channel", channel, "kind", kind)
+		q.Suppressed[kind]++
+		return
+	}
+
+	for _, c := range chunks {
+		q.Messages = append(q.Messages, OutboundMessage{kind, c})
+	}
+
+	if !q.Sending {
+		q.Sending = true
+		go runOutboundQueue(channel, q)
+	}
+}
+
+func runOutboundQueue(channel string, q *OutboundQueue) {
+	defer catchPanic()
+
+	for {
+		OUTBOUND_LOCK.Lock()
+		if len(q.Messages) < 1 {
+			q.Sending = false
+			OUTBOUND_LOCK.Unlock()
+			return
+		}
+		now := time.Now()
+		wait := q.Bucket.Take(now)
+		if w := OUTBOUND_WORKSPACE.Take(now); w > wait {
+			wait = w
+		}
+		OUTBOUND_LOCK.Unlock()
+
+		if wait > 0 {
+			SLACK_LOG.Debug("waiting before posting", "channel", channel, "wait", wait)
+			time.Sleep(wait)
+		}
+
+		OUTBOUND_LOCK.Lock()
+		msg := nextOutboundMessage(q)
+		OUTBOUND_LOCK.Unlock()
+
+		if !postSlackMessage(channel, msg) {
+			/* Rate limited: put it back in front and
+			 * try again once the pause is over. */
+			OUTBOUND_LOCK.Lock()
+			q.Messages = append([]OutboundMessage{{"", msg}}, q.Messages...)
+			OUTBOUND_LOCK.Unlock()
+		}
+	}
+}
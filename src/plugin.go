@@ -0,0 +1,249 @@
+/* This file contains functionality around
+ * external command plugins.  Every executable in
+ * 'pluginDir' is registered as a command at startup,
+ * which lets us keep e.g. company-internal commands
+ * out of this tree.
+ *
+ * A plugin is invoked with '--describe' once at
+ * startup and must print a JSON object:
+ *
+ *   {"name": "foo", "help": "do foo", "usage": "!foo <bar>",
+ *    "how": "foo.internal", "aliases": ["fu"]}
+ *
+ * ("how" and "aliases" are optional.)  Plugins that
+ * read channel settings can register them, by name
+ * and description, via an optional
+ * "settings": {"foo-alert": "alert about foo"}; any
+ * value goes for those.
+ *
+ * When the command is run, the plugin is invoked
+ * without arguments and is handed a JSON request on
+ * stdin:
+ *
+ *   {"command": "foo", "args": ["bar"],
+ *    "recipient": {"chatType": "slack", "id": "U123", ...},
+ *    "channel": {"name": "foo", "settings": {...}, ...}}
+ *
+ * ("channel" is omitted for private messages.)
+ *
+ * It must print a JSON reply on stdout within
+ * 'pluginTimeout' (default: 30s):
+ *
+ *   {"reply": "text"}  or  {"error": "text"}
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+const PLUGIN_DESCRIBE_TIMEOUT = 10
+
+var PLUGIN_NAME_RE = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+var PLUGIN_LOG = newLogger("plugin")
+
+type PluginDescription struct {
+	Name     string            `json:"name"`
+	Help     string            `json:"help"`
+	How      string            `json:"how"`
+	Usage    string            `json:"usage"`
+	Aliases  []string          `json:"aliases"`
+	Settings map[string]string `json:"settings"`
+}
+
+type PluginRecipient struct {
+	ChatType    string `json:"chatType"`
+	Id          string `json:"id"`
+	MentionName string `json:"mentionName"`
+	Name        string `json:"name"`
+	ReplyTo     string `json:"replyTo"`
+}
+
+type PluginChannel struct {
+	Id       string            `json:"id"`
+	Name     string            `json:"name"`
+	Type     string            `json:"type"`
+	Settings map[string]string `json:"settings"`
+	Toggles  map[string]bool   `json:"toggles"`
+}
+
+type PluginRequest struct {
+	Command   string          `json:"command"`
+	Args      []string        `json:"args"`
+	Recipient PluginRecipient `json:"recipient"`
+	Channel   *PluginChannel  `json:"channel,omitempty"`
+}
+
+type PluginReply struct {
+	Reply string `json:"reply"`
+	Error string `json:"error"`
+}
+
+func describePlugin(path string) (desc PluginDescription, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), PLUGIN_DESCRIBE_TIMEOUT*time.Second)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, path, "--describe").Output()
+	if err != nil {
+		return
+	}
+
+	if err = json.Unmarshal(out, &desc); err != nil {
+		return
+	}
+
+	if !PLUGIN_NAME_RE.MatchString(desc.Name) {
+		err = fmt.Errorf("invalid command name '%s'", desc.Name)
+		return
+	}
+
+	if len(desc.Help) < 1 || len(desc.Usage) < 1 {
+		err = fmt.Errorf("missing 'help' or 'usage'")
+	}
+	return
+}
+
+func loadPlugins() {
+	dir := getConfig("pluginDir")
+	if len(dir) < 1 {
+		return
+	}
+
+	PLUGIN_LOG.Info("loading plugins", "dir", dir)
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		PLUGIN_LOG.Error("unable to read plugin directory", "dir", dir, "err", err)
+		return
+	}
+
+	for _, f := range files {
+		if !f.Mode().IsRegular() || (f.Mode().Perm()&0111) == 0 {
+			continue
+		}
+
+		path := filepath.Join(dir, f.Name())
+		if (f.Mode().Perm() & 0002) != 0 {
+			PLUGIN_LOG.Warn("ignoring world-writable plugin", "plugin", path)
+			continue
+		}
+
+		desc, err := describePlugin(path)
+		if err != nil {
+			PLUGIN_LOG.Warn("unable to load plugin", "plugin", path, "err", err)
+			continue
+		}
+
+		if _, found := COMMANDS[desc.Name]; found {
+			PLUGIN_LOG.Warn("plugin would override existing command, ignoring",
+				"plugin", path, "command", desc.Name)
+			continue
+		}
+
+		var aliases []string
+		for _, a := range desc.Aliases {
+			if _, found := COMMANDS[a]; found || len(findCommandAlias(a)) > 0 {
+				PLUGIN_LOG.Warn("ignoring alias for plugin", "plugin", path, "alias", a)
+				continue
+			}
+			aliases = append(aliases, a)
+		}
+
+		how := desc.How
+		if len(how) < 1 {
+			how = "plugin " + f.Name()
+		}
+
+		PLUGIN_LOG.Debug("registering plugin", "plugin", path, "command", desc.Name)
+		COMMANDS[desc.Name] = &Command{pluginCommand(path, desc.Name),
+			desc.Help,
+			how,
+			desc.Usage,
+			aliases,
+			nil}
+
+		for s, help := range desc.Settings {
+			if _, found := SETTINGS[s]; found || isInternalSetting(s) {
+				PLUGIN_LOG.Warn("ignoring setting for plugin", "plugin", path, "setting", s)
+				continue
+			}
+			SETTINGS[s] = &Setting{help, "<value>", "", nil}
+		}
+	}
+}
+
+func pluginCommand(path, name string) CommandFunc {
+	return func(ctx context.Context, r Recipient, chName string, args []string) string {
+		return runPlugin(ctx, path, name, r, args)
+	}
+}
+
+func runPlugin(ctx context.Context, path, name string, r Recipient, args []string) (result string) {
+	req := PluginRequest{
+		Command: name,
+		Args:    args,
+		Recipient: PluginRecipient{
+			ChatType:    r.ChatType,
+			Id:          r.Id,
+			MentionName: r.MentionName,
+			Name:        r.Name,
+			ReplyTo:     r.ReplyTo,
+		},
+	}
+
+	if req.Args == nil {
+		req.Args = []string{}
+	}
+
+	if ch, found := getChannel(r.ChatType, r.ReplyTo); found {
+		req.Channel = &PluginChannel{ch.Id, ch.Name, ch.Type, getSettings(ch), getToggles(ch)}
+	}
+
+	input, err := json.Marshal(req)
+	if err != nil {
+		PLUGIN_LOG.ErrorContext(ctx, "unable to encode plugin request", "plugin", path, "err", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, configDuration("pluginTimeout"))
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, path)
+	cmd.WaitDelay = time.Second
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	PLUGIN_LOG.DebugContext(ctx, "exec'ing plugin", "plugin", path)
+	start := time.Now()
+	err = cmd.Run()
+	observeMetric("jbot_external_call_duration_seconds", time.Since(start), "exec", name)
+	if err != nil {
+		PLUGIN_LOG.WarnContext(ctx, "plugin failed", "plugin", path, "err", err, "stderr", stderr.String())
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Sprintf("Sorry, I had to kill your '%s' command.", name)
+		}
+		return fmt.Sprintf("Sorry, '!%s' failed.", name)
+	}
+
+	var rep PluginReply
+	if err := json.Unmarshal(stdout.Bytes(), &rep); err != nil {
+		PLUGIN_LOG.WarnContext(ctx, "unable to parse reply from plugin", "plugin", path, "err", err)
+		return fmt.Sprintf("Sorry, '!%s' returned garbage.", name)
+	}
+
+	if len(rep.Error) > 0 {
+		return rep.Error
+	}
+	return rep.Reply
+}
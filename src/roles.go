@@ -0,0 +1,490 @@
+/* This file contains functionality around roles:
+ * who may run privileged commands, and the '!grant'
+ * and '!revoke' commands to manage that.
+ *
+ * There are three roles:
+ * - "admin": bot admins; those listed in 'botAdmins'
+ *   plus those granted the role
+ * - "channel-admin": a channel's admins; the user who
+ *   invited the bot plus those granted the role in
+ *   that channel
+ * - "anyone"
+ *
+ * Users are identified by chat type and user ID (see
+ * roleKey()), e.g. "slack:U01ABCDEF", so that a user
+ * on one chat service can't pass for one on another.
+ * 'botAdmins' entries without a chat type are Slack
+ * user IDs.
+ *
+ * On chat services whose user IDs are just names
+ * anybody can take (ROLES_NAME_BASED, i.e. IRC
+ * nicks), nobody has a role other than "anyone", and
+ * roles can't be granted.  The same goes for
+ * occupants of XMPP rooms, whose room nick can be
+ * taken by anybody once they leave, unless the room
+ * tells us their real JID; see roleUserId().
+ *
+ * Bot admins are channel admins everywhere.  Requests
+ * made via the HTTP API are made as a bot admin, as
+ * the caller has the API token.  As long as
+ * 'botAdmins' is not set, 'botOwner' is a bot admin;
+ * it is a Slack user name, which we only match
+ * against the Slack user looked up by ID.
+ *
+ * COMMAND_ROLES lists the role a command requires;
+ * 'commandRoles' can override that, e.g.
+ * "oncall=channel-admin,toggle=anyone".  Invocations
+ * that only show things (e.g. '!set' without a
+ * value) require no role.
+ *
+ * Usage:
+ * !grant [admin|channel-admin <user>]
+ * !revoke admin|channel-admin <user>
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const ROLE_ADMIN = "admin"
+const ROLE_ANYONE = "anyone"
+const ROLE_CHANNEL_ADMIN = "channel-admin"
+
+var ROLES = map[string]bool{
+	ROLE_ADMIN:         true,
+	ROLE_ANYONE:        true,
+	ROLE_CHANNEL_ADMIN: true,
+}
+
+var ROLES_NAME_BASED = map[string]bool{
+	"irc": true,
+}
+
+/* Granted bot admins, by roleKey(); see 'botAdmins'
+ * for the others. */
+var ADMINS = map[string]RoleGrant{}
+
+var COMMAND_ROLES = map[string]string{
+	"delete":     ROLE_ADMIN,
+	"grant":      ROLE_CHANNEL_ADMIN,
+	"reset":      ROLE_ADMIN,
+	"revert":     ROLE_CHANNEL_ADMIN,
+	"revoke":     ROLE_CHANNEL_ADMIN,
+	"set":        ROLE_CHANNEL_ADMIN,
+	"throttle":   ROLE_CHANNEL_ADMIN,
+	"toggle":     ROLE_CHANNEL_ADMIN,
+	"unset":      ROLE_CHANNEL_ADMIN,
+	"unthrottle": ROLE_CHANNEL_ADMIN,
+}
+
+/* Returns true if the given invocation of the
+ * command only shows things. */
+var COMMAND_READ_ONLY = map[string]func(args []string) bool{
+	"grant": func(args []string) bool {
+		return len(args) < 1
+	},
+	"set": func(args []string) bool {
+		return !strings.Contains(strings.Join(args, " "), "=")
+	},
+	"throttle": func(args []string) bool {
+		return len(args) < 1
+	},
+	"toggle": func(args []string) bool {
+		return len(args) < 1 || args[0] == "all"
+	},
+}
+
+type RoleGrant struct {
+	Name      string
+	GrantedBy string
+	Granted   time.Time
+}
+
+func init() {
+	COMMANDS["grant"] = &Command{cmdGrant,
+		"grant a role to a user, or show who has which role",
+		"builtin",
+		"",
+		nil,
+		[]Arg{
+			{Name: "role", Choices: []string{ROLE_ADMIN, ROLE_CHANNEL_ADMIN}, Help: "omit to show who has which role"},
+			{Name: "user"},
+		}}
+	COMMANDS["revoke"] = &Command{cmdRevoke,
+		"revoke a role from a user",
+		"builtin",
+		"",
+		nil,
+		[]Arg{
+			{Name: "role", Required: true, Choices: []string{ROLE_ADMIN, ROLE_CHANNEL_ADMIN}},
+			{Name: "user", Required: true},
+		}}
+}
+
+/* Returns a denial message if 'r' may not run the
+ * given command, an empty string otherwise. */
+func checkCommandRole(ctx context.Context, cmd string, r Recipient, chName string, args []string) (denial string) {
+	role := commandRole(cmd)
+	if role == ROLE_ANYONE {
+		return
+	}
+	if readOnly, found := COMMAND_READ_ONLY[cmd]; found && readOnly(args) {
+		return
+	}
+	if hasRole(r, chName, role) {
+		return
+	}
+
+	LOG.InfoContext(ctx, "permission denied", "role", role)
+	return roleDenial(cmd, role, chName)
+}
+
+func cmdGrant(ctx context.Context, r Recipient, chName string, args []string) (result string) {
+	role := args[0]
+	if len(role) < 1 {
+		result = listRoles(chName)
+		return
+	}
+	if len(args[1]) < 1 {
+		result = fmt.Sprintf("Whom should I grant %s to?", role)
+		return
+	}
+
+	if role == ROLE_ADMIN && !hasRole(r, chName, ROLE_ADMIN) {
+		result = roleDenial("grant admin", ROLE_ADMIN, chName)
+		return
+	}
+
+	ch, found := getChannelByName(chName)
+	if role == ROLE_CHANNEL_ADMIN && !found {
+		result = "I can only grant channel-admin in a channel."
+		return
+	}
+
+	id, name, err := resolveRoleUser(r, chName, args[1])
+	if len(err) > 0 {
+		result = err
+		return
+	}
+
+	g := RoleGrant{name, r.MentionName, time.Now()}
+	if role == ROLE_ADMIN {
+		found = grantAdmin(roleKey(r.ChatType, id), g)
+	} else {
+		found = grantChannelAdmin(ch, roleKey(r.ChatType, id), g)
+	}
+	if found {
+		result = fmt.Sprintf("%s already has the %s role.", name, role)
+		return
+	}
+
+	LOG.InfoContext(ctx, "granted role", "role", role, "grantee", id, "name", name)
+	result = fmt.Sprintf("Granted %s to %s.", role, name)
+	return
+}
+
+func cmdRevoke(ctx context.Context, r Recipient, chName string, args []string) (result string) {
+	role := args[0]
+
+	if role == ROLE_ADMIN && !hasRole(r, chName, ROLE_ADMIN) {
+		result = roleDenial("revoke admin", ROLE_ADMIN, chName)
+		return
+	}
+
+	ch, found := getChannelByName(chName)
+	if role == ROLE_CHANNEL_ADMIN && !found {
+		result = "I can only revoke channel-admin in a channel."
+		return
+	}
+
+	id, name, err := resolveRoleUser(r, chName, args[1])
+	if len(err) > 0 {
+		result = err
+		return
+	}
+
+	key := roleKey(r.ChatType, id)
+	if role == ROLE_ADMIN {
+		if configAdmins()[key] {
+			result = fmt.Sprintf("%s is a bot admin via 'botAdmins' in the config file; I can't revoke that.", name)
+			return
+		}
+		found = revokeAdmin(key)
+	} else {
+		if isChannelInviter(r.ChatType, ch, id) {
+			result = fmt.Sprintf("%s invited me into #%s and thus is a channel admin; I can't revoke that.", name, ch.Name)
+			return
+		}
+		found = revokeChannelAdmin(ch, key)
+	}
+	if !found {
+		result = fmt.Sprintf("%s doesn't have the %s role.", name, role)
+		return
+	}
+
+	LOG.InfoContext(ctx, "revoked role", "role", role, "grantee", id, "name", name)
+	result = fmt.Sprintf("Revoked %s from %s.", role, name)
+	return
+}
+
+/* The role required to run the command, taking
+ * 'commandRoles' into account. */
+func commandRole(cmd string) string {
+	roles, _ := parseCommandRoles(getConfig("commandRoles"))
+	if role, found := roles[cmd]; found {
+		return role
+	}
+	if role, found := COMMAND_ROLES[cmd]; found {
+		return role
+	}
+	return ROLE_ANYONE
+}
+
+/* The bot admins from 'botAdmins', by roleKey(). */
+func configAdmins() (admins map[string]bool) {
+	admins, _ = parseBotAdmins(getConfig("botAdmins"))
+	return
+}
+
+func hasRole(r Recipient, chName, role string) bool {
+	switch role {
+	case ROLE_ANYONE:
+		return true
+	case ROLE_CHANNEL_ADMIN:
+		if ch, found := getChannelByName(chName); found && isChannelAdmin(r, ch) {
+			return true
+		}
+	}
+	return isBotAdmin(r)
+}
+
+func isBotAdmin(r Recipient) bool {
+	if r.ChatType == "api" {
+		return true
+	}
+	id := roleUserId(r.ChatType, r.Id)
+	if len(id) < 1 {
+		return false
+	}
+
+	admins := configAdmins()
+	if len(admins) < 1 && isBotOwner(r) {
+		return true
+	}
+
+	key := roleKey(r.ChatType, id)
+	if admins[key] {
+		return true
+	}
+
+	_, found := getAdmins()[key]
+	return found
+}
+
+/* 'botOwner' is a Slack user name. */
+func isBotOwner(r Recipient) bool {
+	owner := getConfig("botOwner")
+	if r.ChatType != "slack" || len(owner) < 1 {
+		return false
+	}
+	return slackUserName(r.Id) == owner
+}
+
+func isChannelAdmin(r Recipient, ch *Channel) bool {
+	id := roleUserId(r.ChatType, r.Id)
+	if len(id) < 1 {
+		return false
+	}
+	if isChannelInviter(r.ChatType, ch, id) {
+		return true
+	}
+	_, found := getChannelAdmins(ch)[roleKey(r.ChatType, id)]
+	return found
+}
+
+/* 'id' is a roleUserId().  Channels we joined before
+ * we kept track of the inviter's ID only have their
+ * name; on Slack, we can check that against the
+ * user's ID. */
+func isChannelInviter(chatType string, ch *Channel, id string) bool {
+	if chatType != ch.Type || ROLES_NAME_BASED[chatType] || len(id) < 1 {
+		return false
+	}
+	if len(ch.InviterId) > 0 {
+		return ch.InviterId == id
+	}
+	if chatType != "slack" || ch.Inviter == "Nobody" || len(ch.Inviter) < 1 {
+		return false
+	}
+	return slackUserName(id) == ch.Inviter
+}
+
+func listRoles(chName string) (result string) {
+	var admins []string
+	for id := range configAdmins() {
+		admins = append(admins, id)
+	}
+	for id, g := range getAdmins() {
+		admins = append(admins, fmt.Sprintf("%s (%s)", g.Name, id))
+	}
+	if len(admins) < 1 && len(getConfig("botOwner")) > 0 {
+		admins = append(admins, getConfig("botOwner"))
+	}
+	sort.Strings(admins)
+
+	if len(admins) > 0 {
+		result = "Bot admins: " + strings.Join(admins, ", ") + "\n"
+	} else {
+		result = "There are no bot admins.\n"
+	}
+
+	ch, found := getChannelByName(chName)
+	if !found {
+		return
+	}
+
+	chAdmins := []string{}
+	if ch.Inviter != "Nobody" && len(ch.Inviter) > 0 {
+		chAdmins = append(chAdmins, ch.Inviter+" (inviter)")
+	}
+	var granted []string
+	for id, g := range getChannelAdmins(ch) {
+		granted = append(granted, fmt.Sprintf("%s (%s)", g.Name, id))
+	}
+	sort.Strings(granted)
+	chAdmins = append(chAdmins, granted...)
+
+	if len(chAdmins) > 0 {
+		result += fmt.Sprintf("Channel admins of #%s: %s\n", ch.Name, strings.Join(chAdmins, ", "))
+	} else {
+		result += fmt.Sprintf("#%s has no channel admins.\n", ch.Name)
+	}
+	return
+}
+
+/* Parses a '[<chat type>:]<user ID>,...' list into
+ * roleKey()s; invalid entries are skipped, but
+ * reported as problems. */
+func parseBotAdmins(val string) (admins map[string]bool, problems []string) {
+	admins = map[string]bool{}
+	for _, entry := range strings.Split(val, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) < 1 {
+			continue
+		}
+
+		chatType, id := "slack", entry
+		if kv := strings.SplitN(entry, ":", 2); len(kv) == 2 {
+			if _, found := BACKENDS[kv[0]]; found {
+				chatType, id = kv[0], kv[1]
+			}
+		}
+
+		if ROLES_NAME_BASED[chatType] {
+			problems = append(problems, fmt.Sprintf("'%s': anybody can use any name on %s, so there can't be bot admins there", entry, chatType))
+			continue
+		}
+		if len(id) < 1 {
+			problems = append(problems, fmt.Sprintf("'%s' has no user ID", entry))
+			continue
+		}
+		if chatType == "xmpp" {
+			if strings.Contains(id, "/") {
+				problems = append(problems, fmt.Sprintf("'%s': XMPP bot admins are given by their bare JID", entry))
+				continue
+			}
+			id = strings.ToLower(id)
+		}
+		admins[roleKey(chatType, id)] = true
+	}
+	return
+}
+
+/* Parses a 'command=role,...' list; invalid entries
+ * are skipped, but reported as problems. */
+func parseCommandRoles(val string) (roles map[string]string, problems []string) {
+	roles = map[string]string{}
+	for _, entry := range strings.Split(val, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) < 1 {
+			continue
+		}
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 || len(strings.TrimSpace(kv[0])) < 1 {
+			problems = append(problems, fmt.Sprintf("'%s' is not 'command=role'", entry))
+			continue
+		}
+		role := strings.TrimSpace(kv[1])
+		if !ROLES[role] {
+			problems = append(problems, fmt.Sprintf("'%s' is not a role (admin|channel-admin|anyone)", role))
+			continue
+		}
+		roles[strings.TrimPrefix(strings.TrimSpace(kv[0]), "!")] = role
+	}
+	return
+}
+
+/* Returns the user's ID and name; on Slack, names
+ * aren't IDs, so we need to have seen the user or
+ * have them @-mentioned. */
+func resolveRoleUser(r Recipient, chName, who string) (id, name, err string) {
+	if ROLES_NAME_BASED[r.ChatType] {
+		err = fmt.Sprintf("Sorry, anybody can use any name on %s, so I don't grant roles there.", r.ChatType)
+		return
+	}
+
+	if r.ChatType == "slack" {
+		if u := expandSlackUser(who); u != nil {
+			return u.ID, u.Name, ""
+		}
+	}
+
+	who = strings.TrimPrefix(who, "@")
+	id = who
+	if u, found := getUsersFromChannel(chName, r.ChatType)[who]; found && len(u.Id) > 0 {
+		id = u.Id
+	} else if r.ChatType == "slack" {
+		err = fmt.Sprintf("I don't know who '%s' is; please @-mention them.", who)
+		return
+	} else if r.ChatType == "xmpp" && !strings.Contains(who, "@") {
+		/* A room nick. */
+		id = chName + "/" + who
+	}
+
+	if id = roleUserId(r.ChatType, id); len(id) < 1 {
+		err = fmt.Sprintf("I don't know who '%s' really is: this room doesn't tell me, and anybody can take their nick once they leave.", who)
+		return
+	}
+	return id, who, ""
+}
+
+/* How we key users with roles. */
+func roleKey(chatType, id string) string {
+	return chatType + ":" + id
+}
+
+func roleDenial(cmd, role, chName string) string {
+	who := "bot admins"
+	if role == ROLE_CHANNEL_ADMIN {
+		who = fmt.Sprintf("channel admins of #%s and bot admins", chName)
+	}
+	return fmt.Sprintf("Sorry, only %s may run '!%s'. Try '!grant' to see who that is.", who, cmd)
+}
+
+/* The ID we key the user's roles by, or "" if they
+ * can't have any; see the top of this file. */
+func roleUserId(chatType, id string) string {
+	switch {
+	case ROLES_NAME_BASED[chatType]:
+		return ""
+	case chatType == "xmpp":
+		return xmppRealJID(id)
+	}
+	return id
+}
@@ -10,6 +10,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -135,16 +136,14 @@ func init() {
 	COMMANDS["secheaders"] = &Command{cmdSecheaders,
 		"show securityheaders grade",
 		"built-in",
-		"!secheaders <url>",
-		[]string{"sec-headers"}}
+		"",
+		[]string{"sec-headers"},
+		[]Arg{
+			{Name: "url", Required: true},
+		}}
 }
 
-func cmdSecheaders(r Recipient, chName string, args []string) (result string) {
-	if len(args) < 1 {
-		result = "Usage: " + COMMANDS["secheaders"].Usage
-		return
-	}
-
+func cmdSecheaders(ctx context.Context, r Recipient, chName string, args []string) (result string) {
 	u := args[0]
 	if !strings.HasPrefix(u, "http") {
 		u = "https://" + u
@@ -156,7 +155,7 @@ func cmdSecheaders(r Recipient, chName string, args []string) (result string) {
 		return
 	}
 
-	req, err := http.NewRequest("GET", u, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
 	if err != nil {
 		result = fmt.Sprintf("Unable to create new request for '%s': %s\n", u, err)
 		return
@@ -166,7 +165,7 @@ func cmdSecheaders(r Recipient, chName string, args []string) (result string) {
 	 * return the full set of headers */
 	req.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_13_2) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/63.0.3239.132 Safari/537.36")
 
-	client := http.Client{}
+	client := http.Client{Transport: METRICS_TRANSPORT}
 	res, err := client.Do(req)
 	if err != nil {
 		result = fmt.Sprintf("Unable to make a request for '%s': %s\n", u, err)
@@ -0,0 +1,174 @@
+/* This file contains functionality around the
+ * registry of channel settings.
+ *
+ * Each module registers the settings it uses in
+ * SETTINGS (from its init()), with a description,
+ * the format of the value, a default and a
+ * validator; plugins can register settings via
+ * '--describe'.  '!set' (and the HTTP API) reject
+ * unknown settings and invalid values, and
+ * '!set help <name>' explains a setting.  An empty
+ * value is always allowed and generally disables
+ * whatever the setting controls.
+ *
+ * Settings we keep for ourselves, e.g. alert
+ * counters, match SETTINGS_INTERNAL; they are not
+ * shown by '!set' and can't be set by users, only
+ * unset.
+ */
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/* Unknown settings within this edit distance of a
+ * known one are suggested. */
+const SETTINGS_SUGGEST_DISTANCE = 2
+
+var SETTINGS = map[string]*Setting{}
+
+var SETTINGS_INTERNAL = []*regexp.Regexp{
+	regexp.MustCompile(`^ignored$`),
+}
+
+/* Validate may be nil if any value goes. */
+type Setting struct {
+	Help     string
+	Format   string
+	Default  string
+	Validate func(value string) error
+}
+
+func init() {
+	SETTINGS["noncall"] = &Setting{"what to reply to '!oncall' if the channel has no oncall rotation",
+		"<message>",
+		"",
+		nil}
+	SETTINGS["oncall"] = &Setting{"the oncall rotation '!oncall' looks up",
+		"<rotation-name>",
+		"the channel name",
+		nil}
+}
+
+func isInternalSetting(name string) bool {
+	for _, re := range SETTINGS_INTERNAL {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+/* The number of single-character edits needed to
+ * turn a into b. */
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		cur := make([]int, len(rb)+1)
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(minInt(prev[j]+1, cur[j-1]+1), prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(rb)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func settingHelp(name string) (result string) {
+	s, found := SETTINGS[name]
+	if !found {
+		result = fmt.Sprintf("Unknown setting '%s'.", name)
+		if suggestions := suggestSettings(name); len(suggestions) > 0 {
+			result += fmt.Sprintf(" Did you mean: %s?", strings.Join(suggestions, ", "))
+		}
+		return
+	}
+
+	result = fmt.Sprintf("%s: %s\n", name, s.Help)
+	result += fmt.Sprintf("Format: !set %s=%s\n", name, s.Format)
+	if len(s.Default) > 0 {
+		result += fmt.Sprintf("Default: %s\n", s.Default)
+	}
+	return
+}
+
+func settingsHelp() (result string) {
+	var names []string
+	for n := range SETTINGS {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	result = "I know the following settings:\n"
+	for _, n := range names {
+		result += fmt.Sprintf("%s -- %s\n", n, SETTINGS[n].Help)
+	}
+	result += "Use '!set help <name>' for details."
+	return
+}
+
+/* Known settings the given name may be a typo of. */
+func suggestSettings(name string) (suggestions []string) {
+	lname := strings.ToLower(name)
+	for n := range SETTINGS {
+		if levenshtein(lname, n) <= SETTINGS_SUGGEST_DISTANCE ||
+			(len(lname) > 2 && (strings.HasPrefix(n, lname) || strings.HasPrefix(lname, n))) {
+			suggestions = append(suggestions, n)
+		}
+	}
+	sort.Strings(suggestions)
+	return
+}
+
+func validateSetting(name, value string) error {
+	if isInternalSetting(name) {
+		return fmt.Errorf("'%s' is managed by me; you can only '!unset' it.", name)
+	}
+
+	s, found := SETTINGS[name]
+	if !found {
+		msg := fmt.Sprintf("Unknown setting '%s'.", name)
+		if suggestions := suggestSettings(name); len(suggestions) > 0 {
+			msg += fmt.Sprintf(" Did you mean: %s?", strings.Join(suggestions, ", "))
+		}
+		return fmt.Errorf("%s See '!set help' for all settings.", msg)
+	}
+
+	if len(value) < 1 || s.Validate == nil {
+		return nil
+	}
+
+	if err := s.Validate(value); err != nil {
+		return fmt.Errorf("Invalid value for '%s': %s\nFormat: !set %s=%s", name, err, name, s.Format)
+	}
+	return nil
+}
+
+func validateSettingBool(value string) error {
+	if _, err := strconv.ParseBool(value); err != nil {
+		return fmt.Errorf("'%s' is not a boolean", value)
+	}
+	return nil
+}
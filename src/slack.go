@@ -0,0 +1,940 @@
+/* This file contains functionality around the
+ * Slack chat backend: receiving events via Socket
+ * Mode or the HTTP Events API, processing them, and
+ * sending messages back to Slack channels and users
+ * via chat.postMessage.
+ *
+ * If 'slackAppToken' is set, we open a Socket Mode
+ * websocket; otherwise we listen for Events API
+ * requests on 'slackEventsListen' and verify them
+ * using 'slackSigningSecret'.
+ *
+ * A quiet channel says nothing about the connection,
+ * so liveness is based on the websocket: Slack pings
+ * us every few seconds, and if the pings stop, the
+ * socketmode client reconnects (with backoff).  If it
+ * gives up (e.g. because our token was revoked), or
+ * the events listener dies, we keep retrying with
+ * our own exponential backoff.  In addition, we call
+ * auth.test every SLACK_HEARTBEAT_INTERVAL periodics.
+ * After a reconnect, we re-register our channels;
+ * all other state stays as is. */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/slack-go/slack"
+	"github.com/slack-go/slack/slackevents"
+	"github.com/slack-go/slack/socketmode"
+)
+
+/* Slack wants an answer within 3 seconds, so we
+ * queue events and process them in order; messages
+ * are then handed to the worker pool. */
+const SLACK_EVENT_QUEUE = 100
+const SLACK_MAX_EVENT_SIZE = 1024 * 1024
+
+/* In seconds */
+const SLACK_PING_INTERVAL = 30
+const SLACK_RECONNECT_MIN = 1
+const SLACK_RECONNECT_MAX = 300
+
+var LAST_SLACK_MESSAGE_LOCK sync.Mutex
+var LAST_SLACK_MESSAGE_TIME time.Time
+var SLACK_UNLINK_RE1 = regexp.MustCompile("(<https?://([^|]+)\\|([^>]+)>)")
+var SLACK_UNLINK_RE2 = regexp.MustCompile("<(https?://[^>]+)>")
+
+var SLACK_BOT_ID string
+var SLACK_CLIENT *slack.Client
+var SLACK_SOCKET *socketmode.Client
+var SLACK_CHANNELS = map[string]slack.Channel{}
+var SLACK_LOG = newLogger("slack")
+
+var SLACK_STATUS_LOCK sync.Mutex
+var SLACK_STATUS SlackStatus
+
+type SlackBackend struct{}
+
+/* Connected: whether the websocket is up (or the
+ *            events listener is running)
+ * Since:     when Connected last changed
+ * Err:       why we're not connected
+ * Heartbeat: why the last auth.test failed, if it did
+ * Ever:      whether we've been connected before, i.e.
+ *            need to re-register channels once we
+ *            are again */
+type SlackStatus struct {
+	Connected bool
+	Since     time.Time
+	Err       error
+	Heartbeat error
+	Ever      bool
+}
+
+func init() {
+	BACKENDS["slack"] = &SlackBackend{}
+}
+
+func (b *SlackBackend) Enabled() bool {
+	return backendEnabled("slack")
+}
+
+func (b *SlackBackend) Connect() error {
+	SLACK_CLIENT = slack.New(getConfig("slackToken"),
+		slack.OptionAppLevelToken(getConfig("slackAppToken")),
+		slack.OptionHTTPClient(&http.Client{Transport: METRICS_TRANSPORT}))
+
+	auth, err := SLACK_CLIENT.AuthTest()
+	if err != nil {
+		return fmt.Errorf("Unable to authenticate to Slack: %s", err)
+	}
+	SLACK_BOT_ID = auth.UserID
+
+	/* If we introduced a new channel property,
+	 * but the serialized data does not contain it, it
+	 * would be undefined (e.g. 'off' / nonexistent
+	 * for a toggle).  So here we
+	 * quickly initialize all (unknown) data.
+	 */
+	updateChannels()
+
+	joinKnownChannels()
+	go updateSlackChannels()
+	go slackPeriodics()
+
+	return nil
+}
+
+func (b *SlackBackend) Receive() {
+	events := make(chan slackevents.EventsAPIEvent, SLACK_EVENT_QUEUE)
+
+	if len(getConfig("slackAppToken")) > 0 {
+		go receiveSlackSocketMode(events)
+	} else {
+		go receiveSlackEventsAPI(events)
+	}
+
+	for ev := range events {
+		handleEvent("slack", func() error {
+			processSlackEvent(ev)
+			return nil
+		})
+	}
+}
+
+func (b *SlackBackend) Healthy() error {
+	SLACK_STATUS_LOCK.Lock()
+	defer SLACK_STATUS_LOCK.Unlock()
+
+	s := SLACK_STATUS
+	if !s.Connected {
+		msg := "not connected"
+		if !s.Since.IsZero() {
+			msg += fmt.Sprintf(" for %s", time.Since(s.Since).Round(time.Second))
+		}
+		if s.Err != nil {
+			msg += fmt.Sprintf(": %s", s.Err)
+		}
+		return fmt.Errorf("%s", msg)
+	}
+	if s.Heartbeat != nil {
+		return fmt.Errorf("heartbeat failed: %s", s.Heartbeat)
+	}
+	return nil
+}
+
+func (b *SlackBackend) Send(r Recipient, msg string) {
+	sendSlackMessage(r, "", msg)
+}
+
+func (b *SlackBackend) SendBulk(r Recipient, kind, msg string) {
+	sendSlackMessage(r, kind, msg)
+}
+
+/* Chunks the message and queues it for the
+ * recipient; see outbound.go. */
+func sendSlackMessage(r Recipient, kind, msg string) {
+	recipient := r.ReplyTo
+	channelName := "#"
+	slackChannel, err := SLACK_CLIENT.GetConversationInfo(&slack.GetConversationInfoInput{ChannelID: r.ReplyTo})
+	if err == nil {
+		channelName = slackChannel.Name
+	} else {
+		params := slack.OpenConversationParameters{Users: []string{r.Id}}
+		im, _, _, err := SLACK_CLIENT.OpenConversation(&params)
+		if err != nil {
+			SLACK_LOG.Warn("unable to open private channel", "user", r.Id, "err", err)
+			return
+		}
+		recipient = im.ID
+	}
+
+	var chunks []string
+	for len(msg) > SLACK_MAX_LENGTH {
+		SLACK_LOG.Debug("message too long, chunking", "length", len(msg), "limit", SLACK_MAX_LENGTH)
+		m1 := msg[:SLACK_MAX_LENGTH-1]
+
+		last_index := strings.LastIndex(m1, "\n")
+		if last_index == 0 {
+			last_index = strings.LastIndex(m1, " ")
+		}
+		if last_index == 0 {
+			last_index = strings.LastIndex(m1, ",")
+		}
+		if last_index > 0 {
+			m1 = msg[:last_index-1]
+			msg = msg[last_index+1:]
+
+			m1 = fontFormat(channelName, m1)
+			chunks = append(chunks, m1)
+		} else {
+			chunks = append(chunks, "Message too long, truncating...\n")
+			chunks = append(chunks, msg[:SLACK_MAX_LENGTH-1])
+			msg = msg[SLACK_MAX_LENGTH:]
+		}
+	}
+	msg = fontFormat(channelName, msg)
+	chunks = append(chunks, msg)
+
+	queueSlackMessage(recipient, kind, chunks)
+}
+
+/* Format is "user@channel"; if no "user" component,
+ * then we have a privmsg, which is a private
+ * channel. */
+func (b *SlackBackend) ResolveUser(from string) (r Recipient) {
+	r.ChatType = "slack"
+	index := 0
+	if strings.HasPrefix(from, "@") {
+		index = 1
+	}
+	f := strings.Split(from, "@")
+	r.Id = strings.Trim(f[index], "@")
+	r.ReplyTo = f[1]
+	user, err := SLACK_CLIENT.GetUserInfo(r.Id)
+	if err != nil {
+		if bot, e := SLACK_CLIENT.GetBotInfo(slack.GetBotInfoParameters{Bot: r.Id}); e == nil {
+			r.Name = bot.Name
+			r.MentionName = bot.Name
+		}
+		/* else: privmsg; let's just ignore it */
+	} else {
+		r.Name = user.Profile.RealName
+		r.MentionName = user.Name
+	}
+
+	return
+}
+
+func (b *SlackBackend) ResolveChannel(id string) string {
+	slackChannel, err := SLACK_CLIENT.GetConversationInfo(&slack.GetConversationInfoInput{ChannelID: strings.ToUpper(id)})
+	if err == nil {
+		return slackChannel.Name
+	}
+	return id
+}
+
+func (b *SlackBackend) Leave(r Recipient, ch *Channel) {
+	msg := "Bots can't leave Slack channels - you'd have to find a Slack admin to kick me out.\n"
+	msg += "But I'm going to ignore everything in this channel going forward.\n"
+	msg += "If you do miss me terribly much, @-mention me and I'll start paying attention in here again, ok?\n\n"
+	rand.Seed(time.Now().UnixNano())
+	msg += cursiveText(GOODBYE[rand.Intn(len(GOODBYE))])
+	if ch != nil {
+		setSetting(ch, "ignored", "true", r.MentionName)
+		msg += fmt.Sprintf("\n_pretends to have left #%s._", ch.Name)
+	}
+	reply(r, msg)
+}
+
+func (b *SlackBackend) ChannelRecipient(ch *Channel) Recipient {
+	return b.ResolveUser(fmt.Sprintf("%s@%s", getConfig("mentionName"), ch.Id))
+}
+
+func (b *SlackBackend) SeenUsers(ch *Channel) map[string]UserInfo {
+	return ch.SlackUsers
+}
+
+func (b *SlackBackend) UpdateSeenUser(ch *Channel, r Recipient, uInfo UserInfo) {
+	if len(ch.SlackUsers) < 1 {
+		ch.SlackUsers = make(map[string]UserInfo, 0)
+	}
+	ch.SlackUsers[r.MentionName] = uInfo
+}
+
+func expandSlackUser(in string) (u *slack.User) {
+	// Slack expands '@user' to e.g. '<@CBEAWGAPJ>'
+	slack_user_re := regexp.MustCompile(`(?i)<@([A-Z0-9]+)>`)
+	m := slack_user_re.FindStringSubmatch(in)
+	if len(m) > 0 {
+		u, _ = SLACK_CLIENT.GetUserInfo(m[1])
+	}
+
+	return
+}
+
+func getAllMembersInChannel(id string) (allMembers []string) {
+	params := slack.GetUsersInConversationParameters{
+		ChannelID: id,
+		Limit:     1000,
+	}
+
+	for {
+		members, cursor, err := SLACK_CLIENT.GetUsersInConversation(&params)
+		if err != nil {
+			SLACK_LOG.Warn("unable to get conversation members", "channel", id, "err", err)
+			break
+		}
+		allMembers = append(allMembers, members...)
+		if len(cursor) > 0 {
+			params.Cursor = cursor
+		} else {
+			break
+		}
+	}
+
+	return
+}
+
+func getChannelInfo(id string) (info string) {
+	var ch slack.Channel
+	found := false
+	if strings.HasPrefix(id, "#") {
+		id = id[1:]
+		STATE_LOCK.RLock()
+		ch, found = SLACK_CHANNELS[id]
+		STATE_LOCK.RUnlock()
+	}
+
+	if !found {
+		c, err := SLACK_CLIENT.GetConversationInfo(&slack.GetConversationInfoInput{ChannelID: id})
+		if err != nil {
+			return
+		}
+		ch = *c
+		ch.Members = []string{}
+	}
+
+	topic := ""
+	if len(ch.Topic.Value) > 0 {
+		topic = fmt.Sprintf(" -- \"%s\"", ch.Topic.Value)
+	}
+	members := getAllMembersInChannel(id)
+	info = fmt.Sprintf("%s (%d members)%s\n%s\n",
+		ch.Name, len(members),
+		topic, ch.Purpose.Value)
+	return
+}
+
+/* Returns a snapshot of SLACK_CHANNELS. */
+func getSlackChannels() (channels []slack.Channel) {
+	STATE_LOCK.RLock()
+	defer STATE_LOCK.RUnlock()
+	for _, c := range SLACK_CHANNELS {
+		channels = append(channels, c)
+	}
+	return
+}
+
+func joinKnownChannels() {
+	SLACK_LOG.Info("joining channels slack thinks I'm in")
+
+	var params slack.GetConversationsForUserParameters
+	params.UserID = getConfig("slackID")
+	params.Limit = 999
+	params.Cursor = ""
+	params.Types = []string{"public_channel", "private_channel"}
+
+	channels, cursor, err := SLACK_CLIENT.GetConversationsForUser(&params)
+	if err != nil {
+		SLACK_LOG.Error("unable to get conversations for user", "err", err)
+		return
+	}
+
+	for cursor != "" {
+		params.Cursor = cursor
+		nextChannels, nextCursor, err := SLACK_CLIENT.GetConversationsForUser(&params)
+		if err != nil {
+			SLACK_LOG.Error("unable to get conversations for user", "err", err)
+			break
+		}
+		channels = append(channels, nextChannels...)
+		cursor = nextCursor
+	}
+
+	for _, c := range channels {
+		if _, found := getChannelByName(c.Name); !found {
+			ch := newSlackChannel(c.Name, c.ID, "Slack")
+			addChannel(&ch)
+		}
+	}
+}
+
+func lastSlackMessageTime() time.Time {
+	LAST_SLACK_MESSAGE_LOCK.Lock()
+	defer LAST_SLACK_MESSAGE_LOCK.Unlock()
+	return LAST_SLACK_MESSAGE_TIME
+}
+
+func newSlackChannel(name, id, inviter string) (ch Channel) {
+	SLACK_LOG.Debug("creating new channel", "channel", name, "id", id)
+
+	ch.Toggles = map[string]bool{}
+	ch.Throttles = map[string]time.Time{}
+	ch.Settings = map[string]string{}
+	ch.Type = "slack"
+	ch.Id = id
+	ch.SlackUsers = make(map[string]UserInfo, 0)
+	ch.Inviter = "Nobody"
+	ch.Name = name
+	ch.Phishy = &PhishCount{0, 0, time.Now(), time.Unix(0, 0)}
+
+	if len(inviter) > 0 {
+		user, err := SLACK_CLIENT.GetUserInfo(inviter)
+		if err != nil {
+			SLACK_LOG.Warn("unable to find user information", "user", inviter, "err", err)
+		} else {
+			ch.Inviter = user.Name
+			ch.InviterId = inviter
+		}
+	}
+
+	for t, v := range TOGGLES {
+		ch.Toggles[t] = v
+	}
+
+	return
+}
+
+/* Returns false if we were rate limited and should
+ * try again. */
+func postSlackMessage(channel, msg string) bool {
+	_, _, err := SLACK_CLIENT.PostMessage(channel, slack.MsgOptionText(msg, false))
+	if err != nil {
+		if rateLimitedError, ok := err.(*slack.RateLimitedError); ok {
+			processSlackRateLimit(channel, rateLimitedError)
+			return false
+		}
+		SLACK_LOG.Warn("unable to post message", "channel", channel, "err", err)
+		return true
+	}
+	incrementMetric("jbot_slack_messages_sent_total")
+	return true
+}
+
+func processSlackChannelJoin(ev *slackevents.MemberJoinedChannelEvent) {
+	SLACK_LOG.Debug("member joined channel", "event", ev)
+}
+
+func processSlackChannelRename(ev *slackevents.ChannelRenameEvent) {
+	newName := ev.Channel.Name
+	id := ev.Channel.ID
+	SLACK_LOG.Info("channel renamed", "id", id, "channel", newName)
+	if _, found := getChannelByName(newName); found {
+		SLACK_LOG.Warn("renamed channel already known", "channel", newName)
+		return
+	}
+
+	for _, chInfo := range channelList() {
+		if chInfo.Id == id {
+			SLACK_LOG.Debug("renaming channel", "old", chInfo.Name, "new", newName)
+			renameChannel(chInfo.Name, newName)
+			break
+		}
+	}
+}
+
+func processSlackEvent(ev slackevents.EventsAPIEvent) {
+	incrementMetric("jbot_slack_events_total", ev.InnerEvent.Type)
+
+	switch e := ev.InnerEvent.Data.(type) {
+
+	case *slackevents.ChannelRenameEvent:
+		processSlackChannelRename(e)
+
+	case *slackevents.MemberJoinedChannelEvent:
+		processSlackChannelJoin(e)
+
+	case *slackevents.MessageEvent:
+		LAST_SLACK_MESSAGE_LOCK.Lock()
+		LAST_SLACK_MESSAGE_TIME = time.Now()
+		LAST_SLACK_MESSAGE_LOCK.Unlock()
+		dispatchWork(e.Channel, func(ctx context.Context) { processSlackMessage(ctx, e) })
+
+	case *slackevents.UserChangeEvent:
+		processSlackUserChangeEvent(e)
+	default:
+		SLACK_LOG.Debug("ignoring event", "type", ev.InnerEvent.Type)
+
+	}
+}
+
+func processSlackInvite(r Recipient, name string, msg *slackevents.MessageEvent) {
+	if strings.Contains(msg.Text, "<@"+getConfig("slackID")+">") {
+		slackChannel, err := SLACK_CLIENT.GetConversationInfo(&slack.GetConversationInfoInput{ChannelID: msg.Channel})
+		if err != nil {
+			SLACK_LOG.Warn("unable to get conversation info", "channel", msg.Channel, "err", err)
+			return
+		}
+		if slackChannel.IsExtShared {
+			SLACK_LOG.Warn("refusing to join externally shared channel",
+				"channel", slackChannel.Name, "id", msg.Channel)
+			return
+		}
+		ch := newSlackChannel(name, msg.Channel, msg.User)
+		SLACK_LOG.Info("invited into channel", "channel", ch.Name, "id", ch.Id, "inviter", ch.Inviter)
+		addChannel(&ch)
+		rand.Seed(time.Now().UnixNano())
+		reply(r, HELLO[rand.Intn(len(HELLO))])
+	}
+}
+
+func processSlackMessage(ctx context.Context, msg *slackevents.MessageEvent) {
+	SLACK_LOG.Debug("message", "channel", msg.Channel, "user", msg.User, "text", msg.Text)
+
+	var channelName string
+
+	channel, err := SLACK_CLIENT.GetConversationInfo(&slack.GetConversationInfoInput{ChannelID: msg.Channel})
+	if err == nil {
+		channelName = channel.Name
+	}
+
+	r := getRecipientFromMessage(fmt.Sprintf("%s@%s", msg.User, msg.Channel), "slack")
+
+	ch, found := getChannelByName(channelName)
+	if !found {
+		/* Hey, let's just pretend that any
+		 * message we get in a channel that
+		 * we don't know about is effectively
+		 * an invite. */
+		processSlackInvite(r, channelName, msg)
+		return
+	} else {
+		ignored, _ := getSetting(ch, "ignored")
+		atMention := fmt.Sprintf("<@" + getConfig("slackID") + ">")
+		if strings.EqualFold(ignored, "true") {
+			if strings.Contains(msg.Text, atMention) {
+				setSetting(ch, "ignored", "false", r.MentionName)
+			} else {
+				return
+			}
+		}
+	}
+
+	if msg.User == SLACK_BOT_ID {
+		/* Ignore our own messages. */
+		return
+	}
+
+	txt := msg.Text
+	if msg.SubType == "message_changed" {
+		if msg.Message == nil {
+			return
+		}
+
+		/* When unfirling a link, Slack effectively updates
+		 * the original message, so it shows up here again
+		 * with an attachment.  Let's simply ignore any
+		 * edited messages with attachments to avoid processing
+		 * it twice. */
+		if len(msg.Message.Attachments) > 0 {
+			return
+		}
+
+		txt = msg.Message.Text
+		/* Edited messages come from the channel only,
+		 * so we need to reconstruct the recipient from
+		 * the submessage.  That will yield a no-channel
+		 * recipient, however, so we reuse the original
+		 * channel to avoid sending a privmsg. */
+		r = getRecipientFromMessage(fmt.Sprintf("%s@%s", msg.Message.User, msg.Channel), "slack")
+	}
+
+	/* E.g. threads and replies get a dupe event with
+	 * an empty text.  Let's ignore those right
+	 * away. */
+	if len(txt) < 1 {
+		return
+	}
+
+	updateSeen(r, txt)
+
+	/* Slack "helpfully" hyperlinks text that
+	 * looks like a URL:
+	 * "foo www.yahoo.com" becomes "foo <http://www.yahoo.com|www.yahoo.com>"
+	 * Undo that nonsense.
+	 *
+	 * Note: Slack will also do all sorts of other
+	 * encoding and linking, but to undo all of
+	 * that would quickly become way too complex,
+	 * so here we only undo the simplest cases to
+	 * allow users to pass hostnames. */
+	txt = SLACK_UNLINK_RE1.ReplaceAllString(txt, "${3}")
+	txt = SLACK_UNLINK_RE2.ReplaceAllString(txt, "${1}")
+	processMessage(ctx, r, txt)
+}
+
+func processSlackRateLimit(channel string, err *slack.RateLimitedError) {
+	SLACK_LOG.Warn("rate limited, pausing", "channel", channel, "retryAfter", err.RetryAfter)
+	incrementMetric("jbot_slack_rate_limits_total", "chat.postMessage")
+	pauseOutbound(channel, err.RetryAfter)
+}
+
+func processSlackUserChangeEvent(ev *slackevents.UserChangeEvent) {
+	if !ev.User.IsBot {
+		return
+	}
+
+	newName := ev.User.Name
+	oldReal := ev.User.Profile.RealName
+
+	if oldReal == getConfig("fullName") {
+		if newName != oldReal {
+			SLACK_LOG.Info("bot was renamed", "old", oldReal, "new", newName)
+		}
+
+		/* The event's profile does not include the email. */
+		email := ""
+		if u, err := SLACK_CLIENT.GetUserInfo(ev.User.ID); err == nil {
+			email = u.Profile.Email
+		}
+
+		from := getConfig("fullName") + "@" + getConfig("emailDomain")
+		to := []string{getConfig("botOwner") + "@" + getConfig("emailDomain")}
+		subject := getConfig("fullName") + " bot change"
+		body := fmt.Sprintf("New User Info:\n\n"+
+			"ID: %s\n"+
+			"TeamID: %s\n"+
+			"Name: %s\n"+
+			"Deleted: %v\n"+
+			"RealName: %s\n"+
+			"Profile:\n"+
+			"  FirstName: %s\n"+
+			"  LastName: %s\n"+
+			"  RealName: %s\n"+
+			"  Email: %s\n",
+			ev.User.ID,
+			ev.User.TeamID,
+			ev.User.Name,
+			ev.User.Deleted,
+			ev.User.RealName,
+			ev.User.Profile.FirstName,
+			ev.User.Profile.LastName,
+			ev.User.Profile.RealName,
+			email)
+
+		err := sendMailSMTP(from, to, []string{""}, subject, body)
+		if len(err) > 0 {
+			SLACK_LOG.Error("unable to send bot change mail", "err", err, "event", ev)
+		}
+	}
+}
+
+/* Socket Mode and the Events API deliver the same
+ * events; all we need to do is acknowledge them and
+ * hand them to the queue. */
+func receiveSlackEventsAPI(events chan slackevents.EventsAPIEvent) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(getConfig("slackEventsPath"), func(w http.ResponseWriter, req *http.Request) {
+		slackEventsHandler(w, req, events)
+	})
+
+	for attempt := 0; ; attempt++ {
+		SLACK_LOG.Info("listening for events", "listen", getConfig("slackEventsListen"), "path", getConfig("slackEventsPath"))
+		start := time.Now()
+		if setSlackStatus(true, nil) {
+			go reregisterSlackChannels()
+		}
+		err := http.ListenAndServe(getConfig("slackEventsListen"), mux)
+		setSlackStatus(false, err)
+
+		if time.Since(start) > SLACK_RECONNECT_MAX*time.Second {
+			attempt = 0
+		}
+		delay := slackBackoff(attempt)
+		SLACK_LOG.Error("unable to listen for events, retrying", "err", err, "delay", delay)
+		time.Sleep(delay)
+	}
+}
+
+func receiveSlackSocketMode(events chan slackevents.EventsAPIEvent) {
+	SLACK_SOCKET = socketmode.New(SLACK_CLIENT,
+		socketmode.OptionPingInterval(SLACK_PING_INTERVAL*time.Second))
+	go runSlackSocketMode()
+
+	for evt := range SLACK_SOCKET.Events {
+		switch evt.Type {
+
+		case socketmode.EventTypeConnecting:
+			SLACK_LOG.Info("connecting in socket mode")
+			setSlackStatus(false, nil)
+
+		case socketmode.EventTypeConnected:
+			SLACK_LOG.Info("connected")
+			if setSlackStatus(true, nil) {
+				go reregisterSlackChannels()
+			}
+
+		case socketmode.EventTypeConnectionError:
+			err := fmt.Errorf("%v", evt.Data)
+			if e, ok := evt.Data.(*slack.ConnectionErrorEvent); ok {
+				err = e.ErrorObj
+			}
+			SLACK_LOG.Warn("connection error", "err", err)
+			setSlackStatus(false, err)
+
+		case socketmode.EventTypeDisconnect:
+			SLACK_LOG.Info("slack asked us to reconnect")
+			setSlackStatus(false, fmt.Errorf("disconnected by slack"))
+
+		case socketmode.EventTypeInvalidAuth:
+			SLACK_LOG.Error("unable to authenticate")
+			setSlackStatus(false, fmt.Errorf("invalid auth"))
+
+		case socketmode.EventTypeEventsAPI:
+			if evt.Request != nil {
+				SLACK_SOCKET.Ack(*evt.Request)
+			}
+			if ev, ok := evt.Data.(slackevents.EventsAPIEvent); ok {
+				events <- ev
+			}
+		default:
+			SLACK_LOG.Debug("ignoring socket mode event", "type", evt.Type)
+
+		}
+	}
+}
+
+/* Picks up the channels we were invited to, and
+ * renames, while we weren't connected. */
+func reregisterSlackChannels() {
+	SLACK_LOG.Info("re-registering channels")
+	joinKnownChannels()
+	updateSlackChannels()
+}
+
+/* Run() only returns if the socketmode client gave
+ * up reconnecting. */
+func runSlackSocketMode() {
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		err := SLACK_SOCKET.Run()
+		setSlackStatus(false, err)
+
+		if time.Since(start) > SLACK_RECONNECT_MAX*time.Second {
+			attempt = 0
+		}
+		delay := slackBackoff(attempt)
+		SLACK_LOG.Error("socket mode connection failed, retrying", "err", err, "delay", delay)
+		time.Sleep(delay)
+	}
+}
+
+/* Records whether we're connected; err (if given)
+ * is why we aren't.  Returns true if we just got
+ * reconnected. */
+func setSlackStatus(connected bool, err error) (reconnected bool) {
+	SLACK_STATUS_LOCK.Lock()
+	defer SLACK_STATUS_LOCK.Unlock()
+
+	s := &SLACK_STATUS
+	if connected != s.Connected || s.Since.IsZero() {
+		s.Since = time.Now()
+	}
+	if connected {
+		reconnected = s.Ever && !s.Connected
+		s.Ever = true
+	}
+	if connected || err != nil {
+		s.Err = err
+	}
+	s.Connected = connected
+	return
+}
+
+/* Returns how long to wait before the given
+ * (0-based) retry: SLACK_RECONNECT_MIN seconds,
+ * doubling up to SLACK_RECONNECT_MAX, plus up to 20%
+ * jitter so we don't all come back at once. */
+func slackBackoff(attempt int) time.Duration {
+	delay := SLACK_RECONNECT_MAX * time.Second
+	if attempt < 16 {
+		if d := (SLACK_RECONNECT_MIN * time.Second) << uint(attempt); d < delay {
+			delay = d
+		}
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay)/5+1))
+}
+
+/* Every request must carry a valid signature; see
+ * https://api.slack.com/authentication/verifying-requests-from-slack
+ * Slack retries events it believes were not
+ * delivered, so we answer right away and drop
+ * retries to avoid processing a message twice. */
+func slackEventsHandler(w http.ResponseWriter, req *http.Request, events chan slackevents.EventsAPIEvent) {
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, SLACK_MAX_EVENT_SIZE))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	sv, err := slack.NewSecretsVerifier(req.Header, getConfig("slackSigningSecret"))
+	if err != nil {
+		SLACK_LOG.Debug("rejecting event", "remote", req.RemoteAddr, "err", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	sv.Write(body)
+	if err := sv.Ensure(); err != nil {
+		SLACK_LOG.Debug("rejecting event", "remote", req.RemoteAddr, "err", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	ev, err := slackevents.ParseEvent(body, slackevents.OptionNoVerifyToken())
+	if err != nil {
+		SLACK_LOG.Warn("unable to parse event", "err", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	switch ev.Type {
+	case slackevents.URLVerification:
+		if v, ok := ev.Data.(*slackevents.EventsAPIURLVerificationEvent); ok {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte(v.Challenge))
+		}
+	case slackevents.CallbackEvent:
+		w.WriteHeader(http.StatusOK)
+		if len(req.Header.Get("X-Slack-Retry-Num")) > 0 {
+			SLACK_LOG.Debug("ignoring retry", "reason", req.Header.Get("X-Slack-Retry-Reason"))
+			return
+		}
+		events <- ev
+	default:
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+/* Checks that the Web API is reachable and our token
+ * is still good; once it is again after a failure,
+ * we re-register our channels. */
+func slackHeartbeat() {
+	_, err := SLACK_CLIENT.AuthTest()
+
+	SLACK_STATUS_LOCK.Lock()
+	recovered := err == nil && SLACK_STATUS.Heartbeat != nil
+	SLACK_STATUS.Heartbeat = err
+	SLACK_STATUS_LOCK.Unlock()
+
+	if err != nil {
+		SLACK_LOG.Warn("heartbeat failed", "err", err)
+	} else if recovered {
+		SLACK_LOG.Info("heartbeat recovered")
+		reregisterSlackChannels()
+	}
+}
+
+func slackPeriodics() {
+	ticks := PERIODICS * time.Second
+
+	n := 0
+	for _ = range time.Tick(ticks) {
+		SLACK_LOG.Info("running slack periodics")
+
+		if (n % SLACK_CHANNEL_UPDATE_INTERVAL) == 0 {
+			go updateSlackChannels()
+		}
+
+		if n > 0 && (n%SLACK_HEARTBEAT_INTERVAL) == 0 {
+			slackHeartbeat()
+		}
+		n++
+	}
+}
+
+/* The name of the (human) user with the given ID,
+ * or an empty string; bots may carry any name. */
+func slackUserName(id string) string {
+	if SLACK_CLIENT == nil {
+		return ""
+	}
+	u, err := SLACK_CLIENT.GetUserInfo(id)
+	if err != nil || u.IsBot || u.Deleted {
+		return ""
+	}
+	return u.Name
+}
+
+func updateSlackChannels() {
+	params := slack.GetConversationsParameters{
+		Limit: 1000,
+	}
+
+	for {
+		channels, cursor, err := SLACK_CLIENT.GetConversations(&params)
+		if err != nil {
+			SLACK_LOG.Warn("unable to get conversations", "err", err)
+			break
+		}
+		for _, c := range channels {
+			/* Let's not try to keep in
+			 * memory a map of all users
+			 * in all channels... */
+			c.Members = []string{}
+			STATE_LOCK.Lock()
+			SLACK_CHANNELS[c.Name] = c
+			STATE_LOCK.Unlock()
+		}
+		if len(cursor) > 0 {
+			params.Cursor = cursor
+		} else {
+			break
+		}
+	}
+}
+
+/* Verify that we're still in the given channel and
+ * that it's not externally shared.  Returns false if
+ * the channel was removed from CHANNELS. */
+func verifySlackChannel(n string, ch *Channel) bool {
+RATE_LIMIT_LOOP:
+	SLACK_LOG.Debug("verifying channel", "channel", n, "id", ch.Id)
+	slackChannel, err := SLACK_CLIENT.GetConversationInfo(&slack.GetConversationInfoInput{ChannelID: ch.Id})
+	if err != nil {
+		if rateLimitedError, ok := err.(*slack.RateLimitedError); ok {
+			SLACK_LOG.Debug("rate limited, sleeping", "retryAfter", rateLimitedError.RetryAfter)
+			incrementMetric("jbot_slack_rate_limits_total", "conversations.info")
+			time.Sleep(rateLimitedError.RetryAfter)
+			goto RATE_LIMIT_LOOP
+		}
+		SLACK_LOG.Warn("unable to get conversation info", "channel", n, "id", ch.Id, "err", err)
+		if fmt.Sprintf("%s", err) == "channel_not_found" {
+			SLACK_LOG.Warn("removing myself from no-longer found channel", "channel", n, "id", ch.Id)
+			deleteChannel(n)
+			return false
+		}
+		return true
+	}
+	if slackChannel.IsExtShared {
+		SLACK_LOG.Warn("removing myself from externally shared channel",
+			"channel", slackChannel.Name, "id", ch.Id)
+		deleteChannel(n)
+		return false
+	}
+	STATE_LOCK.Lock()
+	ch.Verified = true
+	STATE_LOCK.Unlock()
+	return true
+}
@@ -6,14 +6,15 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"os"
 	"regexp"
 	"strconv"
 	"strings"
 )
 
 var SNOW_ALERTS = []string{ "cmr-alert", "snow-alert" }
+var SNOW_LOG = newLogger("snow")
 
 func init() {
 	ALERTS["cmr-alert"] =  "-c"
@@ -22,29 +23,38 @@ func init() {
 	COMMANDS["cmrs"] = &Command{cmdCmrs,
 		"display upcoming CMRs",
 		"service-now",
-		"!cmrs [time[dh]|all|ongoing] [property]",
-		[]string{"chgs"}}
+		"",
+		[]string{"chgs"},
+		[]Arg{
+			{Name: "time", Help: "<num>[h|d] (default: hours), 'all' or 'ongoing'"},
+			{Name: "property"},
+		}}
 	COMMANDS["sn"] = &Command{cmdSnow,
 		"show Service Now data for the given ticket",
 		"cli via Yahoo::ServiceNow::Simple",
 		"!sn [-S search]|[<ticket>]",
-		[]string{"chg", "cm", "cmr", "inc", "snow"}}
+		[]string{"chg", "cm", "cmr", "inc", "snow"},
+		nil}
+
+	SETTINGS["cmr-alert"] = &Setting{"periodically look for upcoming or ongoing CMRs; see '!alerts cmr-alert'",
+		"<num>[h|d][,<property>|all[,all|ongoing]]",
+		"",
+		validateSnowAlert}
+	SETTINGS["snow-alert"] = &Setting{"periodically look for new incident tickets; see '!alerts snow-alert'",
+		"<num>[h|d][,<property>|all[,all|ongoing]]",
+		"",
+		validateSnowAlert}
+	SETTINGS_INTERNAL = append(SETTINGS_INTERNAL, regexp.MustCompile(`^(cmr|snow)-alert-counter$`))
 }
 
-func cmdCmrs(r Recipient, chName string, args []string) (result string) {
-	if len(args) > 2 {
-		result = "Usage: " + COMMANDS["cmrs"].Usage
-		return
-	}
-
+func cmdCmrs(ctx context.Context, r Recipient, chName string, args []string) (result string) {
 	cmd := []string{"-c"}
 
-	if len(args) > 0 {
+	if len(args[0]) > 0 {
 		counterRe := regexp.MustCompile(`(([0-9]+)([hd])?|all|ongoing)`)
 		m := counterRe.FindStringSubmatch(args[0])
 		if len(m) < 1 {
-			result = fmt.Sprintf("Invalid argument '%s' forr time.\n", args[0])
-			result += "Usage: " + COMMANDS["cmrs"].Usage
+			result = fmt.Sprintf("Invalid <time> '%s'; try e.g. '12', '4h', '2d', 'all' or 'ongoing'.", args[0])
 			return
 		}
 		if m[1] != "all" {
@@ -63,20 +73,20 @@ func cmdCmrs(r Recipient, chName string, args []string) (result string) {
 		}
 	}
 
-	if len(args) > 1 {
+	if len(args[1]) > 0 {
 		cmd = append(cmd, "-p", args[1])
 	}
 
-	result = cmdSnow(r, chName, cmd)
+	result = cmdSnow(ctx, r, chName, cmd)
 	if len(result) < 1 {
 		result = "No upcoming CMRs found."
 	}
 	return
 }
 
-func cmdSnow(r Recipient, chName string, args []string) (result string) {
+func cmdSnow(ctx context.Context, r Recipient, chName string, args []string) (result string) {
 	input := strings.Join(args, " ")
-	verbose(2, "Running 'snow' with '%s'...", input)
+	SNOW_LOG.DebugContext(ctx, "running snow", "input", input)
 	// unmatch <#something|channel>
 	if strings.HasPrefix(input, "#") {
 		input = input[1:]
@@ -106,8 +116,8 @@ func cmdSnow(r Recipient, chName string, args []string) (result string) {
 
 	var lines string
 	for {
-		cmd := strings.TrimSpace(fmt.Sprintf("snow -u %s %s", CONFIG["mentionName"], input))
-		out, _ := runCommand(cmd)
+		cmd := strings.TrimSpace(fmt.Sprintf("snow -u %s %s", getConfig("mentionName"), input))
+		out, _ := runCommand(ctx, cmd)
 		lines = string(out)
 
 		if !strings.HasPrefix(lines, "Usage:") {
@@ -145,25 +155,26 @@ func cmdSnow(r Recipient, chName string, args []string) (result string) {
 	return
 }
 
-func snowAlerts(chInfo Channel) {
+func snowAlerts(ctx context.Context, chInfo *Channel) {
 	for _, alert := range SNOW_ALERTS {
-		snowAlert(chInfo, alert)
+		snowAlert(ctx, chInfo, alert)
 	}
 }
 
-func snowAlert(chInfo Channel, alert string) {
-	alertSettings, found := chInfo.Settings[alert]
+func snowAlert(ctx context.Context, chInfo *Channel, alert string) {
+	alertSettings, found := getSetting(chInfo, alert)
 	if !found {
 		return
 	}
 
-	verbose(4, "Running %s in '%s'...", alert, chInfo.Name)
-	r := getRecipientFromMessage(fmt.Sprintf("%s@%s", CONFIG["mentionName"], chInfo.Id), "slack")
+	SNOW_LOG.DebugContext(ctx, "running alert", "alert", alert, "channel", chInfo.Name)
+	r := getChannelRecipient(chInfo)
 	setval := strings.SplitN(alertSettings, ",", 3)
 	// alert=''; i.e. unset
 	if len(setval[0]) < 1 {
 		return
 	}
+	incrementMetric("jbot_alert_runs_total", alert)
 
 	counterRe := regexp.MustCompile(`([0-9]+)([hd])?`)
 	unit := ""
@@ -189,11 +200,12 @@ func snowAlert(chInfo Channel, alert string) {
 	}
 
 	counter_num := 0
-	counter, found := chInfo.Settings[alert+"-counter"]
+	counter, found := getSetting(chInfo, alert+"-counter")
 	if found {
 		counter_num, err = strconv.Atoi(counter)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Invalid '%s-counter' for %s: %d", alert, chInfo.Name, counter_num)
+			SNOW_LOG.WarnContext(ctx, "invalid alert counter", "channel", chInfo.Name,
+				"setting", alert+"-counter", "value", counter)
 			counter_num = 1
 		}
 	}
@@ -220,17 +232,28 @@ func snowAlert(chInfo Channel, alert string) {
 			args = append(args, "-p", setval[1])
 		}
 
-		reply(r, cmdSnow(r, chInfo.Name, args))
+		reply(r, cmdSnow(ctx, r, chInfo.Name, args))
 		counter_num = 0
 	}
 
 	counter_num += 1
-	chInfo.Settings[alert+"-counter"] = fmt.Sprintf("%d", counter_num)
+	setSetting(chInfo, alert+"-counter", fmt.Sprintf("%d", counter_num), "")
 }
 
-func cmdOncallSnow(r Recipient, chName string, args []string) (result string) {
-	cmd := []string{"oncall", "-u", CONFIG["mentionName"], strings.Join(args, " ")}
-	out, _ := runCommand(cmd...)
+func cmdOncallSnow(ctx context.Context, r Recipient, chName string, args []string) (result string) {
+	cmd := []string{"oncall", "-u", getConfig("mentionName"), strings.Join(args, " ")}
+	out, _ := runCommand(ctx, cmd...)
 	result = string(out)
 	return
 }
+
+func validateSnowAlert(value string) error {
+	setval := strings.SplitN(value, ",", 3)
+	if !regexp.MustCompile(`^[0-9]+[hd]?$`).MatchString(setval[0]) {
+		return fmt.Errorf("interval '%s' is not '<num>[h|d]'", setval[0])
+	}
+	if len(setval) > 2 && setval[2] != "all" && setval[2] != "ongoing" {
+		return fmt.Errorf("'%s' is neither 'all' nor 'ongoing'", setval[2])
+	}
+	return nil
+}
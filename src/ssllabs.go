@@ -9,11 +9,11 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net"
 	"net/url"
-	"os"
 	"strings"
 	"time"
 )
@@ -44,28 +44,27 @@ func init() {
 	COMMANDS["ssllabs"] = &Command{cmdSsllabs,
 		"show SSLLabs rating for a given site",
 		"https://api.ssllabs.com/api/v3/analyze?host=",
-		"!ssllabs <hostname>",
-		[]string{"ssllab"}}
+		"",
+		[]string{"ssllab"},
+		[]Arg{
+			{Name: "hostname", Required: true},
+		}}
 }
 
-func cmdSsllabs(r Recipient, chName string, args []string) (result string) {
-	if len(args) < 1 {
-		result = "Usage: " + COMMANDS["ssllabs"].Usage
-		return
-	}
-	input := strings.Join(args, " ")
+func cmdSsllabs(ctx context.Context, r Recipient, chName string, args []string) (result string) {
+	input := args[0]
 
 	input = strings.TrimPrefix(input, "https://")
 	input = strings.TrimSuffix(input, "/")
 
-	input = fqdn(input)
-	if _, err := net.LookupHost(input); err != nil {
+	input = fqdn(ctx, input)
+	if _, err := net.DefaultResolver.LookupHost(ctx, input); err != nil {
 		result = "Sorry, that does not seem to resolve right now."
 		return
 	}
 
 	theURL := COMMANDS["ssllabs"].How + url.QueryEscape(input)
-	ssllabs := getSsllabsResults(theURL)
+	ssllabs := getSsllabsResults(ctx, theURL)
 
 	if ssllabs.Status != "READY" {
 		if ssllabs.Status == "ERROR" {
@@ -80,21 +79,26 @@ func cmdSsllabs(r Recipient, chName string, args []string) (result string) {
 		result += fmt.Sprintf(".\nI'll check in on this in a minute or so and get you results when they're ready.")
 	}
 
-	go showSsllabsResults(r, theURL, ssllabs)
+	/* The command's context is cancelled once we
+	 * return, but we want to keep its log fields. */
+	go showSsllabsResults(context.WithoutCancel(ctx), r, theURL, ssllabs)
 	return
 }
 
-func getSsllabsResults(theURL string) (result SsllabsResult) {
-	data := getURLContents(theURL, nil)
+func getSsllabsResults(ctx context.Context, theURL string) (result SsllabsResult) {
+	data, err := getURLContents(ctx, theURL, nil)
+	if err != nil && !isFetchStatusError(err) {
+		return
+	}
 
-	err := json.Unmarshal(data, &result)
+	err = json.Unmarshal(data, &result)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to unmarshal SSLLabs data from '%s': %s\n", theURL, err)
+		LOG.WarnContext(ctx, "unable to unmarshal SSLLabs data", "url", theURL, "err", err)
 	}
 	return
 }
 
-func showSsllabsResults(r Recipient, theURL string, ssllabs SsllabsResult) {
+func showSsllabsResults(parent context.Context, r Recipient, theURL string, ssllabs SsllabsResult) {
 	n := 0
 	for {
 		if ssllabs.Status == "READY" {
@@ -111,7 +115,9 @@ func showSsllabsResults(r Recipient, theURL string, ssllabs SsllabsResult) {
 		}
 
 		time.Sleep(SSLLABS_SLEEP * time.Second)
-		ssllabs = getSsllabsResults(theURL)
+		ctx, cancel := commandContext(parent, "ssllabs")
+		ssllabs = getSsllabsResults(ctx, theURL)
+		cancel()
 		n++
 	}
 
@@ -0,0 +1,407 @@
+/* This file contains functionality around
+ * accessing the bot's shared state: CHANNELS,
+ * COUNTERS, ALL_CVES, ADMINS and each channel's
+ * Settings, Toggles, Throttles, CVEs, Admins, History
+ * and seen users.
+ *
+ * Messages from the chat services, the periodics and
+ * serialization all run in their own goroutines, so
+ * all access to that state must go through the
+ * functions here (or hold STATE_LOCK).
+ *
+ * STATE_LOCK is only ever held for short, in-memory
+ * operations -- never while talking to the network
+ * or running commands -- so that a slow command
+ * can't stall the rest of the bot.  Functions
+ * returning maps return copies.
+ *
+ * A Channel that has not yet been added via
+ * addChannel() is not visible to anybody else and
+ * can be set up without locking.
+ *
+ * Functions changing a channel's Settings, Toggles
+ * or Throttles take the name of 'who' made the
+ * change and record it in the channel's History (see
+ * src/history.go); bookkeeping changes, e.g. alert
+ * counters, pass an empty 'who' and aren't recorded.
+ *
+ * Functions changing a stored record write it to the
+ * state database once they've released STATE_LOCK,
+ * by deferring the matching store*() function (see
+ * src/store.go) before taking the lock.
+ */
+
+package main
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var STATE_LOCK sync.RWMutex
+
+func addChannel(ch *Channel) {
+	defer storeChannel(ch)
+	STATE_LOCK.Lock()
+	defer STATE_LOCK.Unlock()
+	CHANNELS[ch.Name] = ch
+}
+
+/* Returns false if we already have a channel by
+ * that name. */
+func addChannelIfMissing(ch *Channel) bool {
+	defer storeChannel(ch)
+	STATE_LOCK.Lock()
+	defer STATE_LOCK.Unlock()
+	if _, found := CHANNELS[ch.Name]; found {
+		return false
+	}
+	CHANNELS[ch.Name] = ch
+	return true
+}
+
+/* Returns false if we already knew about this CVE. */
+func addCVE(id string, cve CVEItem) bool {
+	STATE_LOCK.Lock()
+	defer STATE_LOCK.Unlock()
+	if _, found := ALL_CVES[id]; found {
+		return false
+	}
+	ALL_CVES[id] = cve
+	return true
+}
+
+/* Returns a snapshot of all channels, sorted by
+ * name. */
+func channelList() (channels []*Channel) {
+	STATE_LOCK.RLock()
+	defer STATE_LOCK.RUnlock()
+	for _, ch := range CHANNELS {
+		channels = append(channels, ch)
+	}
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].Name < channels[j].Name
+	})
+	return
+}
+
+func counterNames() (names []string) {
+	STATE_LOCK.RLock()
+	defer STATE_LOCK.RUnlock()
+	for c := range COUNTERS {
+		names = append(names, c)
+	}
+	sort.Strings(names)
+	return
+}
+
+func deleteChannel(name string) {
+	defer storeChannelByName(name)
+	STATE_LOCK.Lock()
+	defer STATE_LOCK.Unlock()
+	delete(CHANNELS, name)
+}
+
+/* Returns true if the toggle is now enabled; found
+ * is false if there is no such toggle. */
+func flipToggle(ch *Channel, name, who string) (enabled, found bool) {
+	defer storeChannel(ch)
+	STATE_LOCK.Lock()
+	defer STATE_LOCK.Unlock()
+
+	if ch.Toggles == nil {
+		ch.Toggles = map[string]bool{}
+	}
+
+	existed := false
+	if enabled, existed = ch.Toggles[name]; existed {
+		found = true
+		enabled = !enabled
+	} else if _, found = TOGGLES[name]; found {
+		enabled = true
+	}
+
+	if found {
+		ch.Toggles[name] = enabled
+		recordChange(ch, who, CHANGE_TOGGLE, name, strconv.FormatBool(!enabled), existed,
+			strconv.FormatBool(enabled), false)
+	}
+	return
+}
+
+/* Returns a copy of the granted bot admins. */
+func getAdmins() (admins map[string]RoleGrant) {
+	STATE_LOCK.RLock()
+	defer STATE_LOCK.RUnlock()
+	admins = make(map[string]RoleGrant, len(ADMINS))
+	for k, v := range ADMINS {
+		admins[k] = v
+	}
+	return
+}
+
+/* Returns a copy of the channel's granted admins. */
+func getChannelAdmins(ch *Channel) (admins map[string]RoleGrant) {
+	STATE_LOCK.RLock()
+	defer STATE_LOCK.RUnlock()
+	admins = make(map[string]RoleGrant, len(ch.Admins))
+	for k, v := range ch.Admins {
+		admins[k] = v
+	}
+	return
+}
+
+func getChannelByName(name string) (ch *Channel, found bool) {
+	STATE_LOCK.RLock()
+	defer STATE_LOCK.RUnlock()
+	ch, found = CHANNELS[name]
+	return
+}
+
+func getCVE(id string) (cve CVEItem, found bool) {
+	STATE_LOCK.RLock()
+	defer STATE_LOCK.RUnlock()
+	cve, found = ALL_CVES[id]
+	return
+}
+
+func getSetting(ch *Channel, name string) (value string, found bool) {
+	STATE_LOCK.RLock()
+	defer STATE_LOCK.RUnlock()
+	value, found = ch.Settings[name]
+	return
+}
+
+func getSettings(ch *Channel) (settings map[string]string) {
+	STATE_LOCK.RLock()
+	defer STATE_LOCK.RUnlock()
+	settings = make(map[string]string, len(ch.Settings))
+	for k, v := range ch.Settings {
+		settings[k] = v
+	}
+	return
+}
+
+/* Returns a copy of the channel's History, oldest
+ * first. */
+func getHistory(ch *Channel) (history []ChannelChange) {
+	STATE_LOCK.RLock()
+	defer STATE_LOCK.RUnlock()
+	history = make([]ChannelChange, len(ch.History))
+	copy(history, ch.History)
+	return
+}
+
+func getThrottles(ch *Channel) (throttles map[string]time.Time) {
+	STATE_LOCK.RLock()
+	defer STATE_LOCK.RUnlock()
+	throttles = make(map[string]time.Time, len(ch.Throttles))
+	for k, v := range ch.Throttles {
+		throttles[k] = v
+	}
+	return
+}
+
+func getToggle(ch *Channel, name string) bool {
+	STATE_LOCK.RLock()
+	defer STATE_LOCK.RUnlock()
+	return ch.Toggles[name]
+}
+
+func getToggles(ch *Channel) (toggles map[string]bool) {
+	STATE_LOCK.RLock()
+	defer STATE_LOCK.RUnlock()
+	toggles = make(map[string]bool, len(ch.Toggles))
+	for k, v := range ch.Toggles {
+		toggles[k] = v
+	}
+	return
+}
+
+/* Returns true if the user already was a bot
+ * admin. */
+func grantAdmin(id string, g RoleGrant) (found bool) {
+	defer storeAdmins()
+	STATE_LOCK.Lock()
+	defer STATE_LOCK.Unlock()
+	if _, found = ADMINS[id]; !found {
+		ADMINS[id] = g
+	}
+	return
+}
+
+/* Returns true if the user already was an admin of
+ * the channel. */
+func grantChannelAdmin(ch *Channel, id string, g RoleGrant) (found bool) {
+	defer storeChannel(ch)
+	STATE_LOCK.Lock()
+	defer STATE_LOCK.Unlock()
+
+	if ch.Admins == nil {
+		ch.Admins = map[string]RoleGrant{}
+	}
+	if _, found = ch.Admins[id]; !found {
+		ch.Admins[id] = g
+	}
+	return
+}
+
+/* Returns all CVEs the channel has not yet seen
+ * and marks them as seen. */
+func newCVEs(ch *Channel) (cves []CVEItem) {
+	defer storeChannel(ch)
+	STATE_LOCK.Lock()
+	defer STATE_LOCK.Unlock()
+
+	if ch.CVEs == nil {
+		ch.CVEs = map[string]CVEItem{}
+	}
+
+	for id, cve := range ALL_CVES {
+		if _, found := ch.CVEs[id]; found {
+			continue
+		}
+		ch.CVEs[id] = cve
+		cves = append(cves, cve)
+	}
+	return
+}
+
+/* Appends the change to the channel's History,
+ * dropping the oldest entries beyond
+ * CHANNEL_HISTORY_MAX.  Must be called with
+ * STATE_LOCK held. */
+func recordChange(ch *Channel, who, kind, name, old string, existed bool, value string, deleted bool) {
+	if len(who) < 1 {
+		return
+	}
+	if existed && !deleted && old == value {
+		return
+	}
+
+	ch.History = append(ch.History, ChannelChange{time.Now(), who, kind, name,
+		old, existed, value, deleted})
+	if len(ch.History) > CHANNEL_HISTORY_MAX {
+		ch.History = ch.History[len(ch.History)-CHANNEL_HISTORY_MAX:]
+	}
+}
+
+/* Returns false if there is no channel 'oldName'
+ * or we already have a channel 'newName'. */
+func renameChannel(oldName, newName string) bool {
+	defer storeChannelByName(oldName)
+	defer storeChannelByName(newName)
+	STATE_LOCK.Lock()
+	defer STATE_LOCK.Unlock()
+
+	ch, found := CHANNELS[oldName]
+	if !found {
+		return false
+	}
+	if _, found := CHANNELS[newName]; found {
+		return false
+	}
+
+	delete(CHANNELS, oldName)
+	ch.Name = newName
+	CHANNELS[newName] = ch
+	return true
+}
+
+func revokeAdmin(id string) (found bool) {
+	defer storeAdmins()
+	STATE_LOCK.Lock()
+	defer STATE_LOCK.Unlock()
+	if _, found = ADMINS[id]; found {
+		delete(ADMINS, id)
+	}
+	return
+}
+
+func revokeChannelAdmin(ch *Channel, id string) (found bool) {
+	defer storeChannel(ch)
+	STATE_LOCK.Lock()
+	defer STATE_LOCK.Unlock()
+	if _, found = ch.Admins[id]; found {
+		delete(ch.Admins, id)
+	}
+	return
+}
+
+func setSetting(ch *Channel, name, value, who string) (old string, found bool) {
+	defer storeChannel(ch)
+	STATE_LOCK.Lock()
+	defer STATE_LOCK.Unlock()
+
+	if ch.Settings == nil {
+		ch.Settings = map[string]string{}
+	}
+	old, found = ch.Settings[name]
+	ch.Settings[name] = value
+	recordChange(ch, who, CHANGE_SETTING, name, old, found, value, false)
+	return
+}
+
+func setThrottle(ch *Channel, name string, t time.Time, who string) {
+	defer storeChannel(ch)
+	STATE_LOCK.Lock()
+	defer STATE_LOCK.Unlock()
+
+	if ch.Throttles == nil {
+		ch.Throttles = map[string]time.Time{}
+	}
+	old, found := ch.Throttles[name]
+	ch.Throttles[name] = t
+	recordChange(ch, who, CHANGE_THROTTLE, name, formatThrottle(old), found, formatThrottle(t), false)
+}
+
+/* Only known toggles (see flipToggle) can be set. */
+func setToggle(ch *Channel, name string, enabled bool, who string) (found bool) {
+	defer storeChannel(ch)
+	STATE_LOCK.Lock()
+	defer STATE_LOCK.Unlock()
+
+	old, existed := ch.Toggles[name]
+	if found = existed; !found {
+		_, found = TOGGLES[name]
+	}
+	if !found {
+		return
+	}
+
+	if ch.Toggles == nil {
+		ch.Toggles = map[string]bool{}
+	}
+	ch.Toggles[name] = enabled
+	recordChange(ch, who, CHANGE_TOGGLE, name, strconv.FormatBool(old), existed,
+		strconv.FormatBool(enabled), false)
+	return
+}
+
+func unsetSetting(ch *Channel, name, who string) (old string, found bool) {
+	defer storeChannel(ch)
+	STATE_LOCK.Lock()
+	defer STATE_LOCK.Unlock()
+
+	if old, found = ch.Settings[name]; found {
+		delete(ch.Settings, name)
+		recordChange(ch, who, CHANGE_SETTING, name, old, true, "", true)
+	}
+	return
+}
+
+/* "*" removes all throttles. */
+func unsetThrottle(ch *Channel, name, who string) {
+	defer storeChannel(ch)
+	STATE_LOCK.Lock()
+	defer STATE_LOCK.Unlock()
+
+	for n, t := range ch.Throttles {
+		if name == "*" || n == name {
+			delete(ch.Throttles, n)
+			recordChange(ch, who, CHANGE_THROTTLE, n, formatThrottle(t), true, "", true)
+		}
+	}
+}
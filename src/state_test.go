@@ -0,0 +1,206 @@
+/* This file contains a test of the locking around
+ * the bot's shared state: it runs simulated chat
+ * traffic through the worker pool and the Matrix
+ * sync loop while the periodics, serialization,
+ * config reloads and the IRC receive loop run
+ * alongside.  It only finds
+ * something when run with the race detector:
+ *
+ *   go test -race -run TestConcurrentTraffic .
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+const TEST_MATRIX_ROOM = "!test:example.org"
+const TEST_ROUNDS = 50
+
+var TEST_MESSAGES = []string{
+	"!set cve-alert=true",
+	"!set noncall=nobody home",
+	"!unset noncall",
+	"!toggle chatter",
+	"!throttle",
+	"!unthrottle *",
+	"!history",
+	"!rot13 hello",
+	"quoth the raven",
+	"!unset cve-alert",
+}
+
+func TestConcurrentTraffic(t *testing.T) {
+	dir := t.TempDir()
+	cfgFile := filepath.Join(dir, "jbot.conf")
+	/* Nothing listens on the Matrix homeserver;
+	 * we only want the backend enabled, so that the
+	 * periodics run for its channels. */
+	cfg := fmt.Sprintf("stateDB = %s\nircNick = jbot\nmatrixHomeserver = http://127.0.0.1:1\n",
+		filepath.Join(dir, "jbot.db"))
+	if err := ioutil.WriteFile(cfgFile, []byte(cfg), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	CONSOLE_INTERACTIVE = true
+	CONFIG_FLAGS["configFile"] = cfgFile
+	config, problems := loadConfig()
+	problems = append(problems, validateConfig(config)...)
+	if len(problems) > 0 {
+		t.Fatalf("invalid configuration: %v", problems)
+	}
+	setConfig(config)
+
+	/* Replies go to stdout. */
+	devnull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = devnull
+	defer func() { os.Stdout = stdout }()
+
+	createCommands()
+	if err := openStore(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		STORE_DB.Close()
+		STORE_DB = nil
+	}()
+
+	BACKENDS["console"].Connect()
+	channels := []string{CONSOLE_CHANNEL}
+	for i := 0; i < 3; i++ {
+		ch := newConsoleTestChannel(fmt.Sprintf("test%d", i))
+		addChannel(ch)
+		channels = append(channels, ch.Name)
+	}
+
+	MATRIX_USER_ID = "@jbot:example.org"
+	processMatrixSync(newMatrixTestSync(t, 0), true)
+
+	var traffic sync.WaitGroup
+	for _, name := range channels {
+		for u := 0; u < 2; u++ {
+			r := getRecipientFromMessage(fmt.Sprintf("user%d@%s", u, name), "console")
+			for n := 0; n < TEST_ROUNDS; n++ {
+				msg := TEST_MESSAGES[n%len(TEST_MESSAGES)]
+				traffic.Add(1)
+				go dispatchWork(name, func(ctx context.Context) {
+					defer traffic.Done()
+					processConsoleInput(r, msg)
+				})
+			}
+		}
+	}
+
+	/* The Matrix sync loop processes its events
+	 * itself. */
+	traffic.Add(1)
+	go func() {
+		defer traffic.Done()
+		for n := 0; n < TEST_ROUNDS; n++ {
+			processMatrixSync(newMatrixTestSync(t, n), false)
+		}
+	}()
+
+	background := []func(int){
+		func(n int) {
+			addCVE(fmt.Sprintf("CVE-2026-%04d", n), CVEItem{})
+			channelPeriodics()
+		},
+		func(int) { serializeData() },
+		func(int) { reloadConfig() },
+		func(n int) {
+			processIRCEvent(parseIRCMessage(":irc.example.org 001 jbot :Welcome"))
+			processIRCEvent(parseIRCMessage(fmt.Sprintf(":jbot!jbot@example.org NICK jbot%d", n)))
+		},
+		func(int) { ircMaxPayload("#test") },
+		func(n int) {
+			getRecipientFromMessage(fmt.Sprintf("@user%d:example.org %s", n%2, TEST_MATRIX_ROOM), "matrix")
+		},
+	}
+	/* These keep going for as long as there is
+	 * traffic. */
+	var wg sync.WaitGroup
+	stop := make(chan bool)
+	for _, f := range background {
+		wg.Add(1)
+		go func(f func(int)) {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+					f(n)
+				}
+			}
+		}(f)
+	}
+
+	traffic.Wait()
+	close(stop)
+	wg.Wait()
+
+	for _, name := range channels {
+		if _, found := getChannelByName(name); !found {
+			t.Errorf("channel '%s' is gone", name)
+		}
+	}
+	if findMatrixChannel(TEST_MATRIX_ROOM) == nil {
+		t.Errorf("matrix room '%s' is gone", TEST_MATRIX_ROOM)
+	}
+}
+
+/* A sync in which one of two users changes their
+ * display name and then says something. */
+func newMatrixTestSync(t *testing.T, n int) (s MatrixSync) {
+	user := fmt.Sprintf("@user%d:example.org", n%2)
+	events := []map[string]interface{}{
+		{
+			"type":      "m.room.member",
+			"sender":    user,
+			"state_key": user,
+			"content":   map[string]string{"membership": "join", "displayname": fmt.Sprintf("User %d", n)},
+		},
+		{
+			"type":    "m.room.message",
+			"sender":  user,
+			"content": map[string]string{"msgtype": "m.text", "body": TEST_MESSAGES[n%len(TEST_MESSAGES)]},
+		},
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"next_batch": fmt.Sprintf("s%d", n),
+		"rooms": map[string]interface{}{
+			"join": map[string]interface{}{
+				TEST_MATRIX_ROOM: map[string]interface{}{
+					"timeline": map[string]interface{}{"events": events},
+				},
+			},
+		},
+	})
+	if err == nil {
+		err = json.Unmarshal(data, &s)
+	}
+	if err != nil {
+		t.Error(err)
+	}
+	return
+}
+
+func newConsoleTestChannel(name string) *Channel {
+	ch := &Channel{Name: name, Id: name, Type: "console"}
+	ch.Settings = map[string]string{}
+	ch.CVEs = map[string]CVEItem{}
+	return ch
+}
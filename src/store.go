@@ -0,0 +1,588 @@
+/* This file contains functionality around the
+ * state store: channels and counters are kept in a
+ * bbolt database ('stateDB'), one record per channel
+ * and per counter; granted bot admins are kept in a
+ * single record.  Granted roles are keyed by
+ * roleKey().
+ *
+ * Records are JSON-encoded, so that added or removed
+ * fields don't break decoding; a record that can't be
+ * decoded is skipped rather than taking down the bot.
+ * A record is written in its own transaction as soon
+ * as it is changed via src/state.go; serializeData()
+ * periodically writes whatever else changed since,
+ * e.g. seen users and incremented counters, and
+ * serves as a safety net.  Only records
+ * that changed since the last write are written.
+ * Records are encoded under STATE_LOCK, but written
+ * without holding it.
+ *
+ * The schema is versioned: STORE_MIGRATIONS[n]
+ * migrates the database from version n to n+1.  The
+ * first migration imports the old 'channelsFile' and
+ * 'countersFile' gob files, if any.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/daneharrigan/hipchat"
+	bolt "go.etcd.io/bbolt"
+)
+
+var STORE_BUCKET_CHANNELS = []byte("channels")
+var STORE_BUCKET_COUNTERS = []byte("counters")
+var STORE_BUCKET_META = []byte("meta")
+var STORE_BUCKET_ROLES = []byte("roles")
+
+var STORE_DB *bolt.DB
+var STORE_LOG = newLogger("store")
+
+/* Serializes storeSave() calls. */
+var STORE_LOCK sync.Mutex
+
+var STORE_MIGRATIONS = []func(tx *bolt.Tx) error{
+	storeMigrateLegacy,
+	storeMigrateRoles,
+	storeMigrateRoleKeys,
+	storeMigrateXMPPChannels,
+}
+
+/* How we tell the chat type of user IDs from before
+ * we keyed roles by it. */
+var STORE_MATRIX_ID_RE = regexp.MustCompile(`^@[^:]+:.+$`)
+var STORE_SLACK_ID_RE = regexp.MustCompile(`^[UW][A-Z0-9]+$`)
+
+/* Checksums of the records as last written, so that
+ * we only write what changed; keyed by bucket/name. */
+var STORE_WRITTEN = map[string][sha256.Size]byte{}
+
+type HipChatUserInfo struct {
+	User hipchat.User
+	Info UserInfo
+}
+
+/* JSON can't have struct keys, so HipChatUsers is
+ * encoded as a list. */
+func (ch Channel) MarshalJSON() ([]byte, error) {
+	type channel Channel
+	c := struct {
+		channel
+		HipChatUsers []HipChatUserInfo
+	}{channel: channel(ch)}
+
+	for u, info := range ch.HipChatUsers {
+		c.HipChatUsers = append(c.HipChatUsers, HipChatUserInfo{u, info})
+	}
+	sort.Slice(c.HipChatUsers, func(i, j int) bool {
+		return c.HipChatUsers[i].User.Id < c.HipChatUsers[j].User.Id
+	})
+
+	return json.Marshal(c)
+}
+
+func (ch *Channel) UnmarshalJSON(data []byte) error {
+	type channel Channel
+	c := struct {
+		*channel
+		HipChatUsers []HipChatUserInfo
+	}{channel: (*channel)(ch)}
+
+	if err := json.Unmarshal(data, &c); err != nil {
+		return err
+	}
+
+	if len(c.HipChatUsers) > 0 {
+		ch.HipChatUsers = map[hipchat.User]UserInfo{}
+		for _, u := range c.HipChatUsers {
+			ch.HipChatUsers[u.User] = u.Info
+		}
+	}
+	return nil
+}
+
+func migrateStore() error {
+	return STORE_DB.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(STORE_BUCKET_META)
+		if err != nil {
+			return err
+		}
+
+		version := 0
+		if v := meta.Get([]byte("version")); v != nil {
+			if version, err = strconv.Atoi(string(v)); err != nil {
+				return fmt.Errorf("invalid schema version '%s'", v)
+			}
+		}
+
+		if version > len(STORE_MIGRATIONS) {
+			return fmt.Errorf("schema version %d is newer than this jbot (%d)",
+				version, len(STORE_MIGRATIONS))
+		}
+
+		for ; version < len(STORE_MIGRATIONS); version++ {
+			STORE_LOG.Info("migrating state", "from", version, "to", version+1)
+			if err := STORE_MIGRATIONS[version](tx); err != nil {
+				return fmt.Errorf("migration to version %d failed: %s", version+1, err)
+			}
+		}
+
+		return meta.Put([]byte("version"), []byte(strconv.Itoa(version)))
+	})
+}
+
+func openStore() (err error) {
+	STORE_LOG.Debug("opening state database", "file", getConfig("stateDB"))
+	STORE_DB, err = bolt.Open(getConfig("stateDB"), 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err == bolt.ErrTimeout {
+		return fmt.Errorf("database is locked; is another jbot running?")
+	} else if err != nil {
+		return
+	}
+	return migrateStore()
+}
+
+func readSavedData() {
+	if err := openStore(); err != nil {
+		fail("Unable to open state database '%s': %s\n", getConfig("stateDB"), err)
+	}
+
+	err := STORE_DB.View(func(tx *bolt.Tx) error {
+		tx.Bucket(STORE_BUCKET_CHANNELS).ForEach(func(k, v []byte) error {
+			var ch Channel
+			if err := storeDecode(v, &ch); err != nil {
+				STORE_LOG.Warn("unable to decode channel, skipping", "channel", string(k), "err", err)
+				return nil
+			}
+			CHANNELS[string(k)] = &ch
+			STORE_WRITTEN[storeKey(STORE_BUCKET_CHANNELS, string(k))] = sha256.Sum256(v)
+			return nil
+		})
+
+		tx.Bucket(STORE_BUCKET_COUNTERS).ForEach(func(k, v []byte) error {
+			var c map[string]int
+			if err := storeDecode(v, &c); err != nil {
+				STORE_LOG.Warn("unable to decode counter, skipping", "counter", string(k), "err", err)
+				return nil
+			}
+			COUNTERS[string(k)] = c
+			STORE_WRITTEN[storeKey(STORE_BUCKET_COUNTERS, string(k))] = sha256.Sum256(v)
+			return nil
+		})
+
+		if v := tx.Bucket(STORE_BUCKET_ROLES).Get([]byte("admins")); v != nil {
+			if err := storeDecode(v, &ADMINS); err != nil {
+				STORE_LOG.Warn("unable to decode admins, skipping", "err", err)
+			} else {
+				STORE_WRITTEN[storeKey(STORE_BUCKET_ROLES, "admins")] = sha256.Sum256(v)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		fail("Unable to read state database '%s': %s\n", getConfig("stateDB"), err)
+	}
+
+	STORE_LOG.Debug("read state database", "channels", len(CHANNELS),
+		"counters", len(COUNTERS), "admins", len(ADMINS), "file", getConfig("stateDB"))
+}
+
+/* The store*() functions below write a single record
+ * right away, in its own transaction; they are
+ * deferred by the functions changing that record
+ * (see src/state.go) so that they run once
+ * STATE_LOCK has been released. */
+func storeAdmins() {
+	storeRecord(STORE_BUCKET_ROLES, func() (string, interface{}, bool) {
+		return "admins", ADMINS, true
+	})
+}
+
+/* Channels that haven't been added (or have since
+ * been replaced) are not written. */
+func storeChannel(ch *Channel) {
+	storeRecord(STORE_BUCKET_CHANNELS, func() (string, interface{}, bool) {
+		return ch.Name, ch, CHANNELS[ch.Name] == ch
+	})
+}
+
+/* Deletes the record if there is no such channel
+ * (anymore). */
+func storeChannelByName(name string) {
+	storeRecord(STORE_BUCKET_CHANNELS, func() (string, interface{}, bool) {
+		ch, found := CHANNELS[name]
+		return name, ch, found
+	})
+}
+
+func storeCounter(name string) {
+	storeRecord(STORE_BUCKET_COUNTERS, func() (string, interface{}, bool) {
+		c, found := COUNTERS[name]
+		return name, c, found
+	})
+}
+
+func storeDecode(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+/* encoding/json sorts map keys, so unchanged records
+ * encode to the same bytes. */
+func storeEncode(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func storeEncodeAll(records map[string]map[string][]byte) error {
+	STATE_LOCK.RLock()
+	defer STATE_LOCK.RUnlock()
+
+	for name, ch := range CHANNELS {
+		data, err := storeEncode(ch)
+		if err != nil {
+			return fmt.Errorf("unable to encode channel '%s': %s", name, err)
+		}
+		records[string(STORE_BUCKET_CHANNELS)][name] = data
+	}
+
+	for name, c := range COUNTERS {
+		data, err := storeEncode(c)
+		if err != nil {
+			return fmt.Errorf("unable to encode counter '%s': %s", name, err)
+		}
+		records[string(STORE_BUCKET_COUNTERS)][name] = data
+	}
+
+	data, err := storeEncode(ADMINS)
+	if err != nil {
+		return fmt.Errorf("unable to encode admins: %s", err)
+	}
+	records[string(STORE_BUCKET_ROLES)]["admins"] = data
+	return nil
+}
+
+func storeKey(bucket []byte, name string) string {
+	return string(bucket) + "/" + name
+}
+
+/* Version 0 => 1: create the buckets and import the
+ * gob files we used to dump all state into. */
+func storeMigrateLegacy(tx *bolt.Tx) error {
+	channels, err := tx.CreateBucketIfNotExists(STORE_BUCKET_CHANNELS)
+	if err != nil {
+		return err
+	}
+	counters, err := tx.CreateBucketIfNotExists(STORE_BUCKET_COUNTERS)
+	if err != nil {
+		return err
+	}
+
+	var oldChannels map[string]*Channel
+	if storeReadLegacy(getConfig("channelsFile"), &oldChannels) {
+		for name, ch := range oldChannels {
+			data, err := storeEncode(ch)
+			if err != nil {
+				STORE_LOG.Warn("unable to encode channel, skipping", "channel", name, "err", err)
+				continue
+			}
+			if err := channels.Put([]byte(name), data); err != nil {
+				return err
+			}
+		}
+		STORE_LOG.Info("imported channels", "channels", len(oldChannels), "file", getConfig("channelsFile"))
+	}
+
+	var oldCounters map[string]map[string]int
+	if storeReadLegacy(getConfig("countersFile"), &oldCounters) {
+		for name, c := range oldCounters {
+			data, err := storeEncode(c)
+			if err != nil {
+				STORE_LOG.Warn("unable to encode counter, skipping", "counter", name, "err", err)
+				continue
+			}
+			if err := counters.Put([]byte(name), data); err != nil {
+				return err
+			}
+		}
+		STORE_LOG.Info("imported counters", "counters", len(oldCounters), "file", getConfig("countersFile"))
+	}
+
+	return nil
+}
+
+/* Version 2 => 3: key granted roles by chat type and
+ * user ID (see roleKey()).  A channel's admins are of
+ * the channel's chat type; for bot admins, we can
+ * only tell Slack and Matrix IDs by their format, so
+ * others have to be granted again.  Roles on
+ * ROLES_NAME_BASED chat services are dropped. */
+func storeMigrateRoleKeys(tx *bolt.Tx) error {
+	roles := tx.Bucket(STORE_BUCKET_ROLES)
+	if v := roles.Get([]byte("admins")); v != nil {
+		var admins map[string]RoleGrant
+		if err := storeDecode(v, &admins); err != nil {
+			STORE_LOG.Warn("unable to decode admins, skipping", "err", err)
+		} else {
+			keyed := map[string]RoleGrant{}
+			for id, g := range admins {
+				switch {
+				case STORE_SLACK_ID_RE.MatchString(id):
+					keyed[roleKey("slack", id)] = g
+				case STORE_MATRIX_ID_RE.MatchString(id):
+					keyed[roleKey("matrix", id)] = g
+				default:
+					STORE_LOG.Warn("dropping bot admin of unknown chat type; please grant again",
+						"id", id, "name", g.Name)
+				}
+			}
+			data, err := storeEncode(keyed)
+			if err != nil {
+				return err
+			}
+			if err := roles.Put([]byte("admins"), data); err != nil {
+				return err
+			}
+		}
+	}
+
+	channels := tx.Bucket(STORE_BUCKET_CHANNELS)
+	updated := map[string][]byte{}
+	err := channels.ForEach(func(k, v []byte) error {
+		var ch Channel
+		if err := storeDecode(v, &ch); err != nil || len(ch.Admins) < 1 {
+			return nil
+		}
+
+		keyed := map[string]RoleGrant{}
+		for id, g := range ch.Admins {
+			if ROLES_NAME_BASED[ch.Type] {
+				STORE_LOG.Warn("dropping channel admin", "channel", ch.Name, "chat", ch.Type, "id", id)
+				continue
+			}
+			keyed[roleKey(ch.Type, id)] = g
+		}
+		ch.Admins = keyed
+
+		data, err := storeEncode(&ch)
+		if err != nil {
+			return err
+		}
+		updated[string(k)] = data
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	/* Can't modify the bucket while iterating
+	 * over it. */
+	for k, data := range updated {
+		if err := channels.Put([]byte(k), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* Version 1 => 2: create the bucket for granted
+ * bot admins. */
+func storeMigrateRoles(tx *bolt.Tx) error {
+	_, err := tx.CreateBucketIfNotExists(STORE_BUCKET_ROLES)
+	return err
+}
+
+/* Version 3 => 4: XMPP rooms are known by their
+ * full JID rather than their local part. */
+func storeMigrateXMPPChannels(tx *bolt.Tx) error {
+	channels := tx.Bucket(STORE_BUCKET_CHANNELS)
+	renamed := map[string]*Channel{}
+	err := channels.ForEach(func(k, v []byte) error {
+		var ch Channel
+		if err := storeDecode(v, &ch); err != nil || ch.Type != "xmpp" {
+			return nil
+		}
+		if room := strings.ToLower(ch.Id); string(k) != room {
+			ch.Name = room
+			renamed[string(k)] = &ch
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for k, ch := range renamed {
+		data, err := storeEncode(ch)
+		if err != nil {
+			return err
+		}
+		if err := channels.Delete([]byte(k)); err != nil {
+			return err
+		}
+		if err := channels.Put([]byte(ch.Name), data); err != nil {
+			return err
+		}
+		STORE_LOG.Info("renamed XMPP channel", "from", k, "to", ch.Name)
+	}
+	return nil
+}
+
+func storeReadLegacy(fname string, v interface{}) bool {
+	if len(fname) < 1 {
+		return false
+	}
+
+	b, err := ioutil.ReadFile(fname)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			STORE_LOG.Warn("unable to read legacy file, not importing", "file", fname, "err", err)
+		}
+		return false
+	}
+
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(v); err != nil {
+		STORE_LOG.Warn("unable to decode legacy file, not importing", "file", fname, "err", err)
+		return false
+	}
+	return true
+}
+
+/* Encodes the record returned by 'record' (called
+ * with STATE_LOCK held) and writes it if it changed,
+ * or deletes it if it's gone.  Errors are only
+ * logged: storeSave() will try again. */
+func storeRecord(bucket []byte, record func() (name string, v interface{}, found bool)) {
+	if STORE_DB == nil {
+		return
+	}
+
+	STORE_LOCK.Lock()
+	defer STORE_LOCK.Unlock()
+
+	var data []byte
+	var err error
+	STATE_LOCK.RLock()
+	name, v, found := record()
+	if found {
+		data, err = storeEncode(v)
+	}
+	STATE_LOCK.RUnlock()
+
+	key := storeKey(bucket, name)
+	if err != nil {
+		STORE_LOG.Error("unable to encode record", "record", key, "err", err)
+		return
+	}
+
+	sum := sha256.Sum256(data)
+	last, known := STORE_WRITTEN[key]
+	if (found && known && last == sum) || (!found && !known) {
+		return
+	}
+
+	err = STORE_DB.Update(func(tx *bolt.Tx) error {
+		if found {
+			return tx.Bucket(bucket).Put([]byte(name), data)
+		}
+		return tx.Bucket(bucket).Delete([]byte(name))
+	})
+	if err != nil {
+		STORE_LOG.Error("unable to write record", "record", key, "err", err)
+		return
+	}
+
+	if found {
+		STORE_WRITTEN[key] = sum
+	} else {
+		delete(STORE_WRITTEN, key)
+	}
+	STORE_LOG.Debug("saved record", "record", key, "deleted", !found)
+}
+
+/* Writes all changed records and deletes those that
+ * are gone in a single transaction.  Records are
+ * written as they change (see storeRecord()), so this
+ * only catches what's changed in passing, e.g. seen
+ * users, or what failed to be written. */
+func storeSave() error {
+	if STORE_DB == nil {
+		return nil
+	}
+
+	STORE_LOCK.Lock()
+	defer STORE_LOCK.Unlock()
+
+	records := map[string]map[string][]byte{
+		string(STORE_BUCKET_CHANNELS): map[string][]byte{},
+		string(STORE_BUCKET_COUNTERS): map[string][]byte{},
+		string(STORE_BUCKET_ROLES):    map[string][]byte{},
+	}
+
+	if err := storeEncodeAll(records); err != nil {
+		return err
+	}
+
+	written := map[string][sha256.Size]byte{}
+	deleted := []string{}
+	err := STORE_DB.Update(func(tx *bolt.Tx) error {
+		for bucket, recs := range records {
+			b := tx.Bucket([]byte(bucket))
+
+			for name, data := range recs {
+				key := storeKey([]byte(bucket), name)
+				sum := sha256.Sum256(data)
+				if last, found := STORE_WRITTEN[key]; found && last == sum {
+					continue
+				}
+				if err := b.Put([]byte(name), data); err != nil {
+					return err
+				}
+				written[key] = sum
+			}
+
+			/* Records we couldn't decode are left alone. */
+			var gone [][]byte
+			b.ForEach(func(k, v []byte) error {
+				_, found := recs[string(k)]
+				_, known := STORE_WRITTEN[storeKey([]byte(bucket), string(k))]
+				if !found && known {
+					gone = append(gone, append([]byte{}, k...))
+				}
+				return nil
+			})
+			for _, k := range gone {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+				deleted = append(deleted, storeKey([]byte(bucket), string(k)))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for key, sum := range written {
+		STORE_WRITTEN[key] = sum
+	}
+	for _, key := range deleted {
+		delete(STORE_WRITTEN, key)
+	}
+
+	STORE_LOG.Debug("saved state", "written", len(written), "deleted", len(deleted))
+	return nil
+}
@@ -0,0 +1,117 @@
+/* This file contains functionality around the
+ * worker pool that incoming Slack messages -- and
+ * thus commands -- are run in.
+ *
+ * Work is queued per channel, and each channel's
+ * queue is worked off in order, so that replies
+ * within a channel arrive in the order they were
+ * asked for, while a slow command in one channel
+ * doesn't hold up any other channel.
+ *
+ * At most WORKERS jobs run at the same time, and at
+ * most WORK_QUEUE_SIZE may be pending; beyond that,
+ * dispatchWork() blocks, which slows down reading
+ * events instead of piling up goroutines.
+ *
+ * Jobs are handed a context marking them as run by
+ * the pool; commands run from such a context that
+ * take longer than WORKING_DELAY seconds get a
+ * "working on it" reply.  Commands run via the API
+ * or on the console don't.
+ */
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const WORKERS = 8
+const WORK_QUEUE_SIZE = 256
+const WORKING_DELAY = 5
+
+var WORK_LOCK sync.Mutex
+
+/* Pending jobs by channel; the first one is the one
+ * currently running (or waiting for a worker). */
+var WORK_QUEUES = map[string][]func(ctx context.Context){}
+
+var WORK_PENDING = make(chan bool, WORK_QUEUE_SIZE)
+var WORK_RUNNING = make(chan bool, WORKERS)
+
+type workerKey struct{}
+
+/* Queues the job to be run after all other jobs
+ * with the same key. */
+func dispatchWork(key string, job func(ctx context.Context)) {
+	WORK_PENDING <- true
+
+	WORK_LOCK.Lock()
+	defer WORK_LOCK.Unlock()
+
+	WORK_QUEUES[key] = append(WORK_QUEUES[key], job)
+	if len(WORK_QUEUES[key]) == 1 {
+		go runWorkQueue(key)
+	}
+}
+
+/* Whether ctx is that of a job run by the worker
+ * pool. */
+func inWorkerPool(ctx context.Context) bool {
+	inPool, _ := ctx.Value(workerKey{}).(bool)
+	return inPool
+}
+
+func runJob(job func(ctx context.Context)) {
+	defer catchPanic()
+
+	WORK_RUNNING <- true
+	defer func() { <-WORK_RUNNING }()
+
+	job(context.WithValue(context.Background(), workerKey{}, true))
+}
+
+func runWorkQueue(key string) {
+	for {
+		WORK_LOCK.Lock()
+		job := WORK_QUEUES[key][0]
+		WORK_LOCK.Unlock()
+
+		runJob(job)
+		<-WORK_PENDING
+
+		WORK_LOCK.Lock()
+		WORK_QUEUES[key] = WORK_QUEUES[key][1:]
+		if len(WORK_QUEUES[key]) < 1 {
+			delete(WORK_QUEUES, key)
+			WORK_LOCK.Unlock()
+			return
+		}
+		WORK_LOCK.Unlock()
+	}
+}
+
+/* Tells the user we're on it if we haven't been
+ * stopped within WORKING_DELAY seconds.  Once stop()
+ * returns, the indicator has either been sent or
+ * won't be, so it can't show up after the result. */
+func workingIndicator(r Recipient) (stop func()) {
+	done := make(chan bool)
+	finished := make(chan bool)
+
+	go func() {
+		defer close(finished)
+		select {
+		case <-time.After(WORKING_DELAY * time.Second):
+			reply(r, "_is working on it..._")
+		case <-done:
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-finished
+	}
+}
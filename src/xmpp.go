@@ -0,0 +1,802 @@
+/* This file contains functionality around the
+ * XMPP chat backend, allowing the bot to join
+ * multi-user chat rooms (XEP-0045) on standards-based
+ * Jabber servers such as Prosody or ejabberd.  This
+ * is what the HipChat backend did underneath, minus
+ * the HipChat specific bits.
+ *
+ * Configuration:
+ *   xmppJID       = the bot's JID, e.g. jbot@example.org
+ *   xmppPassword  = the bot's password
+ *   xmppServer    = host[:port] to connect to (default: JID domain)
+ *   xmppMUCDomain = the MUC service (default: conference.<JID domain>)
+ *   xmppChannels  = comma-separated list of rooms to join
+ *   xmppTLS       = yes|no; require STARTTLS (default: yes)
+ *   xmppCAFile    = CA certificate(s) to verify the server with
+ *
+ * Rooms are known by their full JID, e.g.
+ * "ops@conference.example.org", so that they don't
+ * clash with channels on other chat services.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const XMPP_KICK_REJOIN_DELAY = 10
+const XMPP_RECONNECT_DELAY = 60
+
+var XMPP_CONN net.Conn
+var XMPP_LOG = newLogger("xmpp")
+var XMPP_DECODER *xml.Decoder
+var XMPP_LOCK sync.Mutex
+
+/* Occupant JID ("room@muc/nick") -> real bare JID,
+ * for occupants of non-anonymous rooms who are
+ * currently present.  Both maps are written by the
+ * receive loop and read by commands, so are guarded
+ * by XMPP_USERS_LOCK. */
+var XMPP_OCCUPANTS = map[string]string{}
+var XMPP_ROSTER = map[string]XMPPRosterItem{}
+var XMPP_USERS_LOCK sync.RWMutex
+
+type XMPPFeatures struct {
+	StartTLS   *struct{} `xml:"urn:ietf:params:xml:ns:xmpp-tls starttls"`
+	Mechanisms *struct {
+		Mechanism []string `xml:"mechanism"`
+	} `xml:"urn:ietf:params:xml:ns:xmpp-sasl mechanisms"`
+	Session *struct{} `xml:"urn:ietf:params:xml:ns:xmpp-session session"`
+}
+
+type XMPPMUCUser struct {
+	Invite *struct {
+		From string `xml:"from,attr"`
+	} `xml:"invite"`
+	Item *struct {
+		JID string `xml:"jid,attr"`
+	} `xml:"item"`
+	Status []struct {
+		Code string `xml:"code,attr"`
+	} `xml:"status"`
+}
+
+type XMPPMessage struct {
+	From       string    `xml:"from,attr"`
+	Type       string    `xml:"type,attr"`
+	Body       string    `xml:"body"`
+	Delay      *struct{} `xml:"urn:xmpp:delay delay"`
+	Conference *struct {
+		JID string `xml:"jid,attr"`
+	} `xml:"jabber:x:conference x"`
+	MUCUser *XMPPMUCUser `xml:"http://jabber.org/protocol/muc#user x"`
+}
+
+type XMPPPresence struct {
+	From    string       `xml:"from,attr"`
+	Type    string       `xml:"type,attr"`
+	MUCUser *XMPPMUCUser `xml:"http://jabber.org/protocol/muc#user x"`
+}
+
+type XMPPRosterItem struct {
+	JID          string `xml:"jid,attr"`
+	Name         string `xml:"name,attr"`
+	Subscription string `xml:"subscription,attr"`
+}
+
+type XMPPIQ struct {
+	From string `xml:"from,attr"`
+	Id   string `xml:"id,attr"`
+	Type string `xml:"type,attr"`
+	Bind *struct {
+		JID string `xml:"jid"`
+	} `xml:"urn:ietf:params:xml:ns:xmpp-bind bind"`
+	Ping   *struct{} `xml:"urn:xmpp:ping ping"`
+	Roster *struct {
+		Items []XMPPRosterItem `xml:"item"`
+	} `xml:"jabber:iq:roster query"`
+}
+
+type XMPPBackend struct{}
+
+func init() {
+	BACKENDS["xmpp"] = &XMPPBackend{}
+}
+
+func (b *XMPPBackend) Enabled() bool {
+	return backendEnabled("xmpp")
+}
+
+func (b *XMPPBackend) Connect() (err error) {
+	if err = xmppConnect(); err != nil {
+		return
+	}
+
+	go xmppPeriodics()
+	return
+}
+
+func (b *XMPPBackend) Receive() {
+	for {
+		XMPP_LOCK.Lock()
+		conn := XMPP_CONN
+		dec := XMPP_DECODER
+		XMPP_LOCK.Unlock()
+
+		for {
+			/* We ping the server every PERIODICS
+			 * seconds, so if we don't hear anything
+			 * for a while, the connection is dead. */
+			conn.SetReadDeadline(time.Now().Add(3 * PERIODICS * time.Second))
+			se, err := xmppNextElement(dec)
+			if err == nil {
+				err = handleEvent("xmpp", func() error {
+					return processXMPPStanza(dec, se)
+				})
+			}
+			if err != nil {
+				XMPP_LOG.Error("unable to read from server", "err", err)
+				break
+			}
+		}
+		conn.Close()
+
+		XMPP_LOCK.Lock()
+		XMPP_CONN = nil
+		XMPP_LOCK.Unlock()
+
+		for {
+			XMPP_LOG.Info("reconnecting", "delay", XMPP_RECONNECT_DELAY)
+			time.Sleep(XMPP_RECONNECT_DELAY * time.Second)
+			if err := xmppConnect(); err != nil {
+				XMPP_LOG.Error("unable to reconnect", "err", err)
+				continue
+			}
+			break
+		}
+	}
+}
+
+func (b *XMPPBackend) Healthy() error {
+	XMPP_LOCK.Lock()
+	defer XMPP_LOCK.Unlock()
+	if XMPP_CONN == nil {
+		return fmt.Errorf("not connected")
+	}
+	return nil
+}
+
+func (b *XMPPBackend) Send(r Recipient, msg string) {
+	if ch, found := getChannelByName(r.ReplyTo); found && ch.Type == "xmpp" {
+		xmppSend("<message to='%s' type='groupchat'><body>%s</body></message>",
+			xmppEscape(ch.Id), xmppEscape(msg))
+	} else {
+		xmppSend("<message to='%s' type='chat'><body>%s</body></message>",
+			xmppEscape(r.Id), xmppEscape(msg))
+	}
+}
+
+/* Format is "room@muc.example.org/nick" for room
+ * occupants or "user@example.org/resource" for
+ * everybody else. */
+func (b *XMPPBackend) ResolveUser(from string) (r Recipient) {
+	r.ChatType = "xmpp"
+	r.Id = from
+
+	f := strings.SplitN(from, "/", 2)
+	bare := strings.ToLower(f[0])
+	local := strings.SplitN(bare, "@", 2)[0]
+
+	if isXMPPRoom(bare) {
+		r.ReplyTo = bare
+		if len(f) > 1 {
+			r.Name = f[1]
+			r.MentionName = f[1]
+		}
+	} else {
+		r.ReplyTo = bare
+		r.Name = local
+		r.MentionName = local
+		XMPP_USERS_LOCK.RLock()
+		item, found := XMPP_ROSTER[bare]
+		XMPP_USERS_LOCK.RUnlock()
+		if found && len(item.Name) > 0 {
+			r.Name = item.Name
+		}
+	}
+
+	return
+}
+
+/* Only rooms are channels; a user's JID is not. */
+func (b *XMPPBackend) ResolveChannel(id string) string {
+	bare := strings.ToLower(strings.SplitN(id, "/", 2)[0])
+	if isXMPPRoom(bare) {
+		return bare
+	}
+	return ""
+}
+
+func (b *XMPPBackend) Leave(r Recipient, ch *Channel) {
+	if ch == nil {
+		return
+	}
+	xmppSend("<presence to='%s/%s' type='unavailable'/>",
+		xmppEscape(ch.Id), xmppEscape(getConfig("mentionName")))
+	deleteChannel(ch.Name)
+}
+
+func (b *XMPPBackend) ChannelRecipient(ch *Channel) (r Recipient) {
+	r.ChatType = "xmpp"
+	r.Id = ch.Id
+	r.ReplyTo = ch.Name
+	r.Name = getConfig("mentionName")
+	r.MentionName = getConfig("mentionName")
+	return
+}
+
+func (b *XMPPBackend) SeenUsers(ch *Channel) map[string]UserInfo {
+	return ch.XMPPUsers
+}
+
+func (b *XMPPBackend) UpdateSeenUser(ch *Channel, r Recipient, uInfo UserInfo) {
+	if len(ch.XMPPUsers) < 1 {
+		ch.XMPPUsers = make(map[string]UserInfo, 0)
+	}
+	ch.XMPPUsers[r.MentionName] = uInfo
+}
+
+func isXMPPRoom(bare string) bool {
+	domain := ""
+	if f := strings.SplitN(bare, "@", 2); len(f) > 1 {
+		domain = f[1]
+	}
+	if strings.EqualFold(domain, getConfig("xmppMUCDomain")) {
+		return true
+	}
+
+	for _, ch := range channelList() {
+		if ch.Type == "xmpp" && strings.EqualFold(ch.Id, bare) {
+			return true
+		}
+	}
+	return false
+}
+
+func joinXMPPChannels() {
+	for _, room := range strings.Split(getConfig("xmppChannels"), ",") {
+		room = strings.ToLower(strings.TrimSpace(room))
+		if len(room) < 1 {
+			continue
+		}
+		if !strings.Contains(room, "@") {
+			room += "@" + getConfig("xmppMUCDomain")
+		}
+		ch := newXMPPChannel(room, "", "")
+		addChannelIfMissing(&ch)
+	}
+
+	for _, ch := range channelList() {
+		if ch.Type == "xmpp" {
+			joinXMPPRoom(ch.Id)
+		}
+	}
+}
+
+func joinXMPPRoom(room string) {
+	XMPP_LOG.Info("joining room", "room", room)
+	xmppSend("<presence to='%s/%s'><x xmlns='http://jabber.org/protocol/muc'><history maxstanzas='0'/></x></presence>",
+		xmppEscape(room), xmppEscape(getConfig("mentionName")))
+}
+
+/* 'inviterId' is the inviter's bare JID, so that
+ * they are a channel admin; see src/roles.go. */
+func newXMPPChannel(room, inviter, inviterId string) (ch Channel) {
+	room = strings.ToLower(room)
+	XMPP_LOG.Debug("creating new channel", "room", room)
+
+	ch.Toggles = map[string]bool{}
+	ch.Throttles = map[string]time.Time{}
+	ch.Settings = map[string]string{}
+	ch.Type = "xmpp"
+	ch.Id = room
+	ch.XMPPUsers = make(map[string]UserInfo, 0)
+	ch.Inviter = "Nobody"
+	ch.Name = room
+	ch.Phishy = &PhishCount{0, 0, time.Now(), time.Unix(0, 0)}
+	ch.CVEs = map[string]CVEItem{}
+
+	if len(inviter) > 0 {
+		ch.Inviter = inviter
+		ch.InviterId = inviterId
+	}
+
+	for t, v := range TOGGLES {
+		ch.Toggles[t] = v
+	}
+
+	return
+}
+
+func processXMPPInvite(room, from string) {
+	r := getRecipientFromMessage(from, "xmpp")
+	ch := newXMPPChannel(room, r.MentionName, xmppRealJID(from))
+	addChannelIfMissing(&ch)
+
+	XMPP_LOG.Info("invited into room", "channel", ch.Name, "room", ch.Id, "inviter", from)
+	joinXMPPRoom(ch.Id)
+}
+
+func processXMPPIQ(iq XMPPIQ) {
+	switch {
+	case iq.Roster != nil && (iq.Type == "result" || iq.Type == "set"):
+		XMPP_USERS_LOCK.Lock()
+		for _, item := range iq.Roster.Items {
+			jid := strings.ToLower(item.JID)
+			if item.Subscription == "remove" {
+				delete(XMPP_ROSTER, jid)
+			} else {
+				XMPP_ROSTER[jid] = item
+			}
+		}
+		XMPP_USERS_LOCK.Unlock()
+		if iq.Type == "set" {
+			xmppSend("<iq to='%s' id='%s' type='result'/>", xmppEscape(iq.From), xmppEscape(iq.Id))
+		}
+
+	case iq.Ping != nil && iq.Type == "get":
+		xmppSend("<iq to='%s' id='%s' type='result'/>", xmppEscape(iq.From), xmppEscape(iq.Id))
+
+	case iq.Type == "get" || iq.Type == "set":
+		xmppSend("<iq to='%s' id='%s' type='error'><error type='cancel'>"+
+			"<service-unavailable xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></iq>",
+			xmppEscape(iq.From), xmppEscape(iq.Id))
+
+	case iq.Type == "error":
+		XMPP_LOG.Debug("iq error", "iq", iq)
+	}
+}
+
+func processXMPPMessage(m XMPPMessage) {
+	if m.Type == "error" {
+		XMPP_LOG.Warn("message error", "from", m.From)
+		return
+	}
+
+	/* Direct invitations per XEP-0249... */
+	if m.Conference != nil && len(m.Conference.JID) > 0 {
+		processXMPPInvite(m.Conference.JID, m.From)
+		return
+	}
+
+	/* ...and mediated invitations per XEP-0045. */
+	if m.MUCUser != nil && m.MUCUser.Invite != nil {
+		processXMPPInvite(strings.SplitN(m.From, "/", 2)[0], m.MUCUser.Invite.From)
+		return
+	}
+
+	/* Ignore room history replayed upon joining. */
+	if len(m.Body) < 1 || m.Delay != nil {
+		return
+	}
+
+	r := getRecipientFromMessage(m.From, "xmpp")
+
+	if m.Type != "groupchat" {
+		/* A privmsg, possibly from a room
+		 * occupant; either way, reply
+		 * directly, and only to commands. */
+		r.ReplyTo = m.From
+		if strings.HasPrefix(m.Body, "!") {
+			processMessage(context.Background(), r, m.Body)
+		} else {
+			processCommands(messageContext(context.Background(), r), r, "!", m.Body)
+		}
+		return
+	}
+
+	if len(r.Name) < 1 || r.Name == getConfig("mentionName") {
+		/* Room topic or our own message. */
+		return
+	}
+
+	ch, found := getChannelByName(r.ReplyTo)
+	if !found {
+		return
+	}
+
+	if ignored, _ := getSetting(ch, "ignored"); strings.EqualFold(ignored, "true") {
+		if strings.Contains(strings.ToLower(m.Body), strings.ToLower(getConfig("mentionName"))) {
+			setSetting(ch, "ignored", "false", r.MentionName)
+		} else {
+			return
+		}
+	}
+
+	updateSeen(r, m.Body)
+	processMessage(context.Background(), r, m.Body)
+}
+
+func processXMPPPresence(p XMPPPresence) {
+	f := strings.SplitN(p.From, "/", 2)
+	bare := strings.ToLower(f[0])
+
+	if p.Type == "subscribe" {
+		/* Let folks from our own domain add
+		 * us to their roster. */
+		_, domain, ok := xmppSplitJID(getConfig("xmppJID"))
+		if ok && strings.HasSuffix(bare, "@"+strings.ToLower(domain)) {
+			xmppSend("<presence to='%s' type='subscribed'/>", xmppEscape(bare))
+		}
+		return
+	}
+
+	if p.Type == "error" {
+		XMPP_LOG.Warn("presence error", "from", p.From)
+		return
+	}
+
+	if p.MUCUser == nil || len(f) < 2 {
+		return
+	}
+
+	/* Once an occupant leaves, anybody may take
+	 * their nick, so we only keep the real JID of
+	 * whoever has it now. */
+	nick := f[1]
+	occupant := bare + "/" + nick
+	XMPP_USERS_LOCK.Lock()
+	if p.Type != "unavailable" && p.MUCUser.Item != nil && len(p.MUCUser.Item.JID) > 0 {
+		XMPP_OCCUPANTS[occupant] = strings.ToLower(strings.SplitN(p.MUCUser.Item.JID, "/", 2)[0])
+	} else {
+		delete(XMPP_OCCUPANTS, occupant)
+	}
+	XMPP_USERS_LOCK.Unlock()
+
+	if p.Type != "unavailable" || nick != getConfig("mentionName") {
+		return
+	}
+
+	for _, s := range p.MUCUser.Status {
+		switch s.Code {
+		/* banned */
+		case "301":
+			XMPP_LOG.Info("banned from room", "room", bare)
+			deleteChannel(bare)
+		/* kicked */
+		case "307":
+			XMPP_LOG.Info("kicked out of room, rejoining", "room", bare,
+				"delay", XMPP_KICK_REJOIN_DELAY)
+			go func() {
+				time.Sleep(XMPP_KICK_REJOIN_DELAY * time.Second)
+				joinXMPPRoom(bare)
+			}()
+		}
+	}
+}
+
+func processXMPPStanza(dec *xml.Decoder, se xml.StartElement) (err error) {
+	switch se.Name.Local {
+	case "message":
+		var m XMPPMessage
+		if err = dec.DecodeElement(&m, &se); err == nil {
+			processXMPPMessage(m)
+		}
+	case "presence":
+		var p XMPPPresence
+		if err = dec.DecodeElement(&p, &se); err == nil {
+			processXMPPPresence(p)
+		}
+	case "iq":
+		var iq XMPPIQ
+		if err = dec.DecodeElement(&iq, &se); err == nil {
+			processXMPPIQ(iq)
+		}
+	case "error":
+		dec.Skip()
+		err = errors.New("stream error")
+	default:
+		err = dec.Skip()
+	}
+	return
+}
+
+/* Connect, STARTTLS, authenticate via SASL PLAIN,
+ * bind a resource, and then join our rooms. */
+func xmppConnect() (err error) {
+	user, domain, ok := xmppSplitJID(getConfig("xmppJID"))
+	if !ok {
+		return fmt.Errorf("xmppJID '%s' is not of the form user@domain", getConfig("xmppJID"))
+	}
+	requireTLS := configBool("xmppTLS")
+
+	server := getConfig("xmppServer")
+	if len(server) < 1 {
+		server = domain
+	}
+	if _, _, e := net.SplitHostPort(server); e != nil {
+		server += ":5222"
+	}
+
+	XMPP_LOG.Info("connecting", "server", server)
+	conn, err := net.DialTimeout("tcp", server, PERIODICS*time.Second)
+	if err != nil {
+		return
+	}
+
+	abort := func(e error) error {
+		conn.Close()
+		return e
+	}
+
+	dec, features, err := xmppStartStream(conn, domain)
+	if err != nil {
+		return abort(err)
+	}
+
+	if features.StartTLS != nil {
+		fmt.Fprintf(conn, "<starttls xmlns='urn:ietf:params:xml:ns:xmpp-tls'/>")
+		se, err := xmppNextElement(dec)
+		if err != nil {
+			return abort(err)
+		}
+		if se.Name.Local != "proceed" {
+			return abort(errors.New("STARTTLS failed"))
+		}
+
+		tlsConfig := &tls.Config{ServerName: domain}
+		if len(getConfig("xmppCAFile")) > 0 {
+			pem, err := ioutil.ReadFile(getConfig("xmppCAFile"))
+			if err != nil {
+				return abort(err)
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			tlsConfig.RootCAs.AppendCertsFromPEM(pem)
+		}
+
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			return abort(err)
+		}
+		conn = tlsConn
+
+		if dec, features, err = xmppStartStream(conn, domain); err != nil {
+			return abort(err)
+		}
+	} else if requireTLS {
+		return abort(errors.New("server does not offer STARTTLS"))
+	}
+
+	if features.Mechanisms == nil || !listContains(features.Mechanisms.Mechanism, "PLAIN") {
+		return abort(errors.New("server does not offer SASL PLAIN"))
+	}
+
+	auth := "\x00" + user + "\x00" + getConfig("xmppPassword")
+	fmt.Fprintf(conn, "<auth xmlns='urn:ietf:params:xml:ns:xmpp-sasl' mechanism='PLAIN'>%s</auth>",
+		base64.StdEncoding.EncodeToString([]byte(auth)))
+	se, err := xmppNextElement(dec)
+	if err != nil {
+		return abort(err)
+	}
+	if se.Name.Local != "success" {
+		return abort(errors.New("authentication failed"))
+	}
+
+	if dec, features, err = xmppStartStream(conn, domain); err != nil {
+		return abort(err)
+	}
+
+	fmt.Fprintf(conn, "<iq type='set' id='bind'><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'>"+
+		"<resource>%s</resource></bind></iq>", PROGNAME)
+	var iq XMPPIQ
+	if se, err = xmppNextElement(dec); err == nil {
+		err = dec.DecodeElement(&iq, &se)
+	}
+	if err != nil {
+		return abort(err)
+	}
+	if iq.Type != "result" || iq.Bind == nil {
+		return abort(errors.New("unable to bind resource"))
+	}
+	XMPP_LOG.Debug("bound to JID", "jid", iq.Bind.JID)
+
+	if features.Session != nil {
+		fmt.Fprintf(conn, "<iq type='set' id='session'><session xmlns='urn:ietf:params:xml:ns:xmpp-session'/></iq>")
+	}
+
+	XMPP_LOCK.Lock()
+	XMPP_CONN = conn
+	XMPP_DECODER = dec
+	XMPP_LOCK.Unlock()
+
+	/* We'll hear about everybody in our rooms
+	 * again when we join them. */
+	XMPP_USERS_LOCK.Lock()
+	XMPP_OCCUPANTS = map[string]string{}
+	XMPP_USERS_LOCK.Unlock()
+
+	xmppSend("<iq type='get' id='roster'><query xmlns='jabber:iq:roster'/></iq>")
+	xmppSend("<presence/>")
+	joinXMPPChannels()
+
+	return
+}
+
+func xmppEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+func xmppNextElement(dec *xml.Decoder) (se xml.StartElement, err error) {
+	for {
+		var t xml.Token
+		if t, err = dec.Token(); err != nil {
+			return
+		}
+		switch e := t.(type) {
+		case xml.StartElement:
+			se = e
+			return
+		case xml.EndElement:
+			if e.Name.Local == "stream" {
+				err = io.EOF
+				return
+			}
+		}
+	}
+}
+
+func xmppPeriodics() {
+	for _ = range time.Tick(PERIODICS * time.Second) {
+		XMPP_LOG.Info("running xmpp periodics")
+		/* Presence doubles as a keepalive; the
+		 * ping lets us notice a dead
+		 * connection. */
+		xmppSend("<presence/>")
+		xmppSend("<iq type='get' id='ping'><ping xmlns='urn:xmpp:ping'/></iq>")
+	}
+}
+
+/* Returns the bare JID of the user behind the given
+ * JID: for room occupants, their real JID, if the
+ * room tells us; "" otherwise. */
+func xmppRealJID(jid string) string {
+	f := strings.SplitN(jid, "/", 2)
+	bare := strings.ToLower(f[0])
+	if !isXMPPRoom(bare) {
+		return bare
+	}
+	if len(f) < 2 {
+		return ""
+	}
+
+	XMPP_USERS_LOCK.RLock()
+	defer XMPP_USERS_LOCK.RUnlock()
+	return XMPP_OCCUPANTS[bare+"/"+f[1]]
+}
+
+func xmppSend(format string, v ...interface{}) {
+	XMPP_LOCK.Lock()
+	defer XMPP_LOCK.Unlock()
+
+	if XMPP_CONN == nil {
+		return
+	}
+
+	if _, err := fmt.Fprintf(XMPP_CONN, format, v...); err != nil {
+		XMPP_LOG.Error("unable to write to server", "err", err)
+	}
+}
+
+/* Returns the local part and the domain of the given
+ * JID, and whether it has both. */
+func xmppSplitJID(jid string) (user, domain string, ok bool) {
+	f := strings.SplitN(jid, "@", 2)
+	if len(f) != 2 || len(f[0]) < 1 || len(f[1]) < 1 {
+		return
+	}
+	return f[0], f[1], true
+}
+
+/* Opens a new stream and returns the stream
+ * features the server offers. */
+func xmppStartStream(conn net.Conn, domain string) (dec *xml.Decoder, features XMPPFeatures, err error) {
+	fmt.Fprintf(conn, "<?xml version='1.0'?><stream:stream to='%s' xmlns='jabber:client' "+
+		"xmlns:stream='http://etherx.jabber.org/streams' version='1.0'>", xmppEscape(domain))
+
+	dec = xml.NewDecoder(conn)
+	se, err := xmppNextElement(dec)
+	if err != nil {
+		return
+	}
+	if se.Name.Local != "stream" {
+		err = fmt.Errorf("expected stream, got '%s'", se.Name.Local)
+		return
+	}
+
+	if se, err = xmppNextElement(dec); err != nil {
+		return
+	}
+	if se.Name.Local != "features" {
+		err = fmt.Errorf("expected stream features, got '%s'", se.Name.Local)
+		return
+	}
+	err = dec.DecodeElement(&features, &se)
+	return
+}
+
+/* Look up the given user in our roster and the
+ * occupants of non-anonymous rooms. */
+func xmppUserInfo(user string) (result string) {
+	var candidates []string
+	luser := strings.ToLower(user)
+
+	XMPP_USERS_LOCK.RLock()
+	defer XMPP_USERS_LOCK.RUnlock()
+
+	for occupant, jid := range XMPP_OCCUPANTS {
+		if strings.HasSuffix(occupant, "/"+user) {
+			user = jid
+			break
+		}
+	}
+
+	for jid, item := range XMPP_ROSTER {
+		local := strings.SplitN(jid, "@", 2)[0]
+		info := fmt.Sprintf("%s <%s>", item.Name, jid)
+		if len(item.Name) < 1 {
+			info = jid
+		}
+
+		if strings.EqualFold(jid, user) ||
+			strings.EqualFold(local, user) ||
+			strings.EqualFold(item.Name, user) {
+			result = info
+			return
+		} else if strings.Contains(jid, luser) ||
+			strings.Contains(strings.ToLower(item.Name), luser) {
+			candidates = append(candidates, info)
+		}
+	}
+
+	if len(candidates) > 0 {
+		result = "No user with that exact name found.\n"
+		if len(candidates) > 1 {
+			result += "Some possible candidates might be:\n"
+		} else {
+			result += "Did you mean:\n"
+		}
+		for i, c := range candidates {
+			if i > 6 {
+				result += "..."
+				break
+			}
+			result += c + "\n"
+		}
+		return
+	}
+
+	if strings.Contains(user, "@") {
+		result = user
+		return
+	}
+
+	xmppSend("<iq type='get' id='roster'><query xmlns='jabber:iq:roster'/></iq>")
+	result = "No such user: " + user
+	return
+}